@@ -0,0 +1,394 @@
+package veap
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Operation is a set of VEAP operations for access control.
+type Operation int
+
+// VEAP operations
+const (
+	OpReadPV Operation = 1 << iota
+	OpWritePV
+	OpReadHistory
+	OpWriteHistory
+	OpReadProperties
+	OpWriteProperties
+	OpDelete
+
+	// all read operations
+	OpRead = OpReadPV | OpReadHistory | OpReadProperties
+	// all write operations
+	OpWrite = OpWritePV | OpWriteHistory | OpWriteProperties | OpDelete
+	// all operations
+	OpAll = OpRead | OpWrite
+)
+
+var operationNames = []string{"ReadPV", "WritePV", "ReadHistory", "WriteHistory",
+	"ReadProperties", "WriteProperties", "Delete"}
+
+func (o Operation) String() string {
+	var names []string
+	for i, n := range operationNames {
+		if o&(1<<uint(i)) != 0 {
+			names = append(names, n)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// AnyPrincipal can be used as principal of an AccessRule, which applies to
+// all callers including anonymous ones.
+const AnyPrincipal = "*"
+
+// AccessRule grants operations on the VEAP objects matching a path pattern to
+// a principal.
+type AccessRule struct {
+	// Principal is the name of the caller (e.g. the user name of HTTP basic
+	// authentication). An empty principal denotes anonymous callers.
+	// AnyPrincipal matches all callers.
+	Principal string
+
+	// PathPattern is matched segment by segment with path.Match. The segment
+	// ** matches zero or more levels (e.g. /devices/**).
+	PathPattern string
+
+	// Operations are the granted operations.
+	Operations Operation
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context, which carries the principal of the caller.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal of the caller. If the context
+// carries no principal, an empty string (anonymous) is returned.
+func PrincipalFromContext(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// AccessControlService checks the access rights of the caller before
+// forwarding a service call to the provided Service. The principal of the
+// caller is taken from the context (q.v. WithPrincipal). An operation is
+// permitted, if at least one rule grants it. Otherwise an error with code
+// StatusForbidden is returned. Service calls without context are executed as
+// anonymous caller.
+//
+// AccessControlService also implements MetaService. ExgData requests are
+// checked entry by entry. Query results are restricted to objects with
+// OpReadProperties permission. If the provided service does not implement
+// MetaService, a BasicMetaService is used.
+type AccessControlService struct {
+	Service
+
+	// Rules are the access rules. They must not be modified while the service
+	// is in use.
+	Rules []AccessRule
+}
+
+// Make sure that AccessControlService implements all service interfaces.
+var _ Service = (*AccessControlService)(nil)
+var _ ContextService = (*AccessControlService)(nil)
+var _ MetaService = (*AccessControlService)(nil)
+var _ ContextMetaService = (*AccessControlService)(nil)
+var _ ExtendedExgDataService = (*AccessControlService)(nil)
+var _ ExtendedQueryService = (*AccessControlService)(nil)
+var _ StreamingQueryService = (*AccessControlService)(nil)
+
+// Permitted checks whether the principal may execute the operations on the
+// VEAP object.
+func (a *AccessControlService) Permitted(principal string, objPath string, op Operation) bool {
+	pathSegs := splitPath(objPath)
+	var granted Operation
+	for _, r := range a.Rules {
+		if r.Principal != principal && r.Principal != AnyPrincipal {
+			continue
+		}
+		if matchSegments(splitPath(r.PathPattern), pathSegs) {
+			granted |= r.Operations
+			if granted&op == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *AccessControlService) check(ctx context.Context, objPath string, op Operation) Error {
+	principal := PrincipalFromContext(ctx)
+	if a.Permitted(principal, objPath, op) {
+		return nil
+	}
+	if principal == "" {
+		return NewErrorf(StatusForbidden, "Access denied for anonymous caller, operation %v: %s", op, objPath)
+	}
+	return NewErrorf(StatusForbidden, "Access denied for %s, operation %v: %s", principal, op, objPath)
+}
+
+func (a *AccessControlService) meta() ContextMetaService {
+	if ms, ok := a.Service.(MetaService); ok {
+		return AsContextMetaService(ms)
+	}
+	return &BasicMetaService{Service: a.Service}
+}
+
+// ReadPV implements Service.
+func (a *AccessControlService) ReadPV(path string) (PV, Error) {
+	return a.ReadPVContext(context.Background(), path)
+}
+
+// ReadPVContext implements ContextService.
+func (a *AccessControlService) ReadPVContext(ctx context.Context, path string) (PV, Error) {
+	if err := a.check(ctx, path, OpReadPV); err != nil {
+		return PV{}, err
+	}
+	return AsContextService(a.Service).ReadPVContext(ctx, path)
+}
+
+// WritePV implements Service.
+func (a *AccessControlService) WritePV(path string, pv PV) Error {
+	return a.WritePVContext(context.Background(), path, pv)
+}
+
+// WritePVContext implements ContextService.
+func (a *AccessControlService) WritePVContext(ctx context.Context, path string, pv PV) Error {
+	if err := a.check(ctx, path, OpWritePV); err != nil {
+		return err
+	}
+	return AsContextService(a.Service).WritePVContext(ctx, path, pv)
+}
+
+// ReadHistory implements Service.
+func (a *AccessControlService) ReadHistory(path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	return a.ReadHistoryContext(context.Background(), path, begin, end, limit)
+}
+
+// ReadHistoryContext implements ContextService.
+func (a *AccessControlService) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	if err := a.check(ctx, path, OpReadHistory); err != nil {
+		return nil, err
+	}
+	return AsContextService(a.Service).ReadHistoryContext(ctx, path, begin, end, limit)
+}
+
+// WriteHistory implements Service.
+func (a *AccessControlService) WriteHistory(path string, timeSeries []PV) Error {
+	return a.WriteHistoryContext(context.Background(), path, timeSeries)
+}
+
+// WriteHistoryContext implements ContextService.
+func (a *AccessControlService) WriteHistoryContext(ctx context.Context, path string, timeSeries []PV) Error {
+	if err := a.check(ctx, path, OpWriteHistory); err != nil {
+		return err
+	}
+	return AsContextService(a.Service).WriteHistoryContext(ctx, path, timeSeries)
+}
+
+// ReadProperties implements Service.
+func (a *AccessControlService) ReadProperties(path string) (AttrValues, []Link, Error) {
+	return a.ReadPropertiesContext(context.Background(), path)
+}
+
+// ReadPropertiesContext implements ContextService.
+func (a *AccessControlService) ReadPropertiesContext(ctx context.Context, path string) (AttrValues, []Link, Error) {
+	if err := a.check(ctx, path, OpReadProperties); err != nil {
+		return nil, nil, err
+	}
+	return AsContextService(a.Service).ReadPropertiesContext(ctx, path)
+}
+
+// WriteProperties implements Service.
+func (a *AccessControlService) WriteProperties(path string, attributes AttrValues) (bool, Error) {
+	return a.WritePropertiesContext(context.Background(), path, attributes)
+}
+
+// WritePropertiesContext implements ContextService.
+func (a *AccessControlService) WritePropertiesContext(ctx context.Context, path string, attributes AttrValues) (bool, Error) {
+	if err := a.check(ctx, path, OpWriteProperties); err != nil {
+		return false, err
+	}
+	return AsContextService(a.Service).WritePropertiesContext(ctx, path, attributes)
+}
+
+// Delete implements Service.
+func (a *AccessControlService) Delete(path string) Error {
+	return a.DeleteContext(context.Background(), path)
+}
+
+// DeleteContext implements ContextService.
+func (a *AccessControlService) DeleteContext(ctx context.Context, path string) Error {
+	if err := a.check(ctx, path, OpDelete); err != nil {
+		return err
+	}
+	return AsContextService(a.Service).DeleteContext(ctx, path)
+}
+
+// ExgData implements MetaService.
+func (a *AccessControlService) ExgData(writePVs []WritePVParam, readPaths []string) ([]Error, []ReadPVResult, Error) {
+	return a.ExgDataContext(context.Background(), writePVs, readPaths)
+}
+
+// ExgDataContext implements ContextMetaService.
+func (a *AccessControlService) ExgDataContext(ctx context.Context, writePVs []WritePVParam, readPaths []string) ([]Error, []ReadPVResult, Error) {
+	results, err := a.ExtendedExgData(ctx, ExgDataParams{WritePVs: writePVs, ReadPaths: readPaths})
+	return results.WriteErrors, results.ReadResults, err
+}
+
+// ExtendedExgData implements ExtendedExgDataService. Entries without
+// permission get an error with code StatusForbidden, the permitted entries
+// are passed to the provided service. An atomic request is rejected, if a
+// write is not permitted.
+func (a *AccessControlService) ExtendedExgData(ctx context.Context, params ExgDataParams) (ExgDataResults, Error) {
+	// prepare results
+	results := ExgDataResults{
+		WriteErrors: make([]Error, len(params.WritePVs)),
+		ReadResults: make([]ReadPVResult, len(params.ReadPaths)),
+	}
+	if len(params.WriteProperties) > 0 {
+		results.WritePropertiesResults = make([]WritePropertiesResult, len(params.WriteProperties))
+	}
+	if len(params.ReadProperties) > 0 {
+		results.ReadPropertiesResults = make([]ReadPropertiesResult, len(params.ReadProperties))
+	}
+	if len(params.ReadHistory) > 0 {
+		results.ReadHistoryResults = make([]ReadHistoryResult, len(params.ReadHistory))
+	}
+
+	// check permissions, indices of the permitted entries are collected
+	permitted := ExgDataParams{Atomic: params.Atomic}
+	var writePVs, writeProps, readPaths, readProps, readHist []int
+	for i, w := range params.WritePVs {
+		if err := a.check(ctx, w.Path, OpWritePV); err != nil {
+			if params.Atomic {
+				return ExgDataResults{}, NewErrorf(err.Code(), "Atomic write rejected, %s: %v", w.Path, err)
+			}
+			results.WriteErrors[i] = err
+			continue
+		}
+		permitted.WritePVs = append(permitted.WritePVs, w)
+		writePVs = append(writePVs, i)
+	}
+	for i, w := range params.WriteProperties {
+		if err := a.check(ctx, w.Path, OpWriteProperties); err != nil {
+			results.WritePropertiesResults[i].Error = err
+			continue
+		}
+		permitted.WriteProperties = append(permitted.WriteProperties, w)
+		writeProps = append(writeProps, i)
+	}
+	for i, readPath := range params.ReadPaths {
+		if err := a.check(ctx, readPath, OpReadPV); err != nil {
+			results.ReadResults[i].Error = err
+			continue
+		}
+		permitted.ReadPaths = append(permitted.ReadPaths, readPath)
+		readPaths = append(readPaths, i)
+	}
+	for i, readPath := range params.ReadProperties {
+		if err := a.check(ctx, readPath, OpReadProperties); err != nil {
+			results.ReadPropertiesResults[i].Error = err
+			continue
+		}
+		permitted.ReadProperties = append(permitted.ReadProperties, readPath)
+		readProps = append(readProps, i)
+	}
+	for i, rh := range params.ReadHistory {
+		if err := a.check(ctx, rh.Path, OpReadHistory); err != nil {
+			results.ReadHistoryResults[i].Error = err
+			continue
+		}
+		permitted.ReadHistory = append(permitted.ReadHistory, rh)
+		readHist = append(readHist, i)
+	}
+
+	// execute permitted entries
+	r, err := AsExtendedExgDataService(a.meta(), AsContextService(a.Service)).ExtendedExgData(ctx, permitted)
+	if err != nil {
+		return ExgDataResults{}, err
+	}
+	if len(r.WriteErrors) != len(writePVs) || len(r.WritePropertiesResults) != len(writeProps) ||
+		len(r.ReadResults) != len(readPaths) || len(r.ReadPropertiesResults) != len(readProps) ||
+		len(r.ReadHistoryResults) != len(readHist) {
+		return ExgDataResults{}, NewErrorf(StatusInternalServerError, "ExgData results do not match request")
+	}
+	for i, idx := range writePVs {
+		results.WriteErrors[idx] = r.WriteErrors[i]
+	}
+	for i, idx := range writeProps {
+		results.WritePropertiesResults[idx] = r.WritePropertiesResults[i]
+	}
+	for i, idx := range readPaths {
+		results.ReadResults[idx] = r.ReadResults[i]
+	}
+	for i, idx := range readProps {
+		results.ReadPropertiesResults[idx] = r.ReadPropertiesResults[i]
+	}
+	for i, idx := range readHist {
+		results.ReadHistoryResults[idx] = r.ReadHistoryResults[i]
+	}
+	return results, nil
+}
+
+// Query implements MetaService.
+func (a *AccessControlService) Query(pathPatterns []string) ([]QueryResult, Error) {
+	return a.QueryContext(context.Background(), pathPatterns)
+}
+
+// QueryContext implements ContextMetaService.
+func (a *AccessControlService) QueryContext(ctx context.Context, pathPatterns []string) ([]QueryResult, Error) {
+	return a.ExtendedQuery(ctx, QueryParams{PathPatterns: pathPatterns})
+}
+
+// ExtendedQuery implements ExtendedQueryService.
+func (a *AccessControlService) ExtendedQuery(ctx context.Context, params QueryParams) ([]QueryResult, Error) {
+	results := make([]QueryResult, 0)
+	if err := a.QueryFunc(ctx, params, func(item QueryResult) Error {
+		results = append(results, item)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// signals that the query limit is reached, must differ from the signal of the
+// provided service (errors are compared by value)
+var errAccessLimitReached = NewErrorf(StatusOK, "Access controlled query limit reached")
+
+// QueryFunc implements StreamingQueryService. Objects without permission for
+// OpReadProperties are skipped. Offset and limit are applied after the
+// objects are skipped.
+func (a *AccessControlService) QueryFunc(ctx context.Context, params QueryParams, handle func(item QueryResult) Error) Error {
+	principal := PrincipalFromContext(ctx)
+	innerParams := QueryParams{PathPatterns: params.PathPatterns, Filters: params.Filters, MaxDepth: params.MaxDepth}
+	var matches, results int
+	err := AsStreamingQueryService(a.meta()).QueryFunc(ctx, innerParams, func(item QueryResult) Error {
+		if !a.Permitted(principal, item.Path, OpReadProperties) {
+			return nil
+		}
+		// paginate
+		matches++
+		if matches <= params.Offset {
+			return nil
+		}
+		if err := handle(item); err != nil {
+			return err
+		}
+		results++
+		if params.Limit > 0 && results >= params.Limit {
+			return errAccessLimitReached
+		}
+		return nil
+	})
+	if err == errAccessLimitReached {
+		return nil
+	}
+	return err
+}
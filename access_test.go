@@ -0,0 +1,94 @@
+package veap
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestAccessControlService(t *testing.T) {
+	tree := newTreeService(map[string][]string{
+		"/": {"a", "b"}, "/a": {"x"}, "/a/x": nil, "/b": nil,
+	})
+	tree.WritePVFunc = func(path string, pv PV) Error { return nil }
+	svc := &AccessControlService{
+		Service: tree,
+		Rules: []AccessRule{
+			{Principal: AnyPrincipal, PathPattern: "/**", Operations: OpReadProperties},
+			{Principal: AnyPrincipal, PathPattern: "/a/**", Operations: OpReadPV},
+			{Principal: "op", PathPattern: "/a/*", Operations: OpWritePV},
+			{Principal: "", PathPattern: "/b", Operations: OpReadPV},
+		},
+	}
+
+	// permissions
+	cases := []struct {
+		principal string
+		path      string
+		op        Operation
+		permitted bool
+	}{
+		{"", "/a", OpReadPV, true},
+		{"", "/a/x", OpReadPV | OpReadProperties, true},
+		{"", "/b", OpReadPV, true},
+		{"op", "/b", OpReadPV, false},
+		{"", "/a/x", OpWritePV, false},
+		{"op", "/a/x", OpWritePV, true},
+		{"op", "/a", OpWritePV, false},
+		{"op", "/a/x", OpDelete, false},
+	}
+	for _, c := range cases {
+		if svc.Permitted(c.principal, c.path, c.op) != c.permitted {
+			t.Errorf("Wrong permission for %s, %s, %v", c.principal, c.path, c.op)
+		}
+	}
+
+	// service calls
+	if _, err := svc.ReadPV("/a/x"); err != nil {
+		t.Error(err)
+	}
+	if err := svc.WritePV("/a/x", PV{}); err == nil || err.Code() != StatusForbidden {
+		t.Error(err)
+	}
+	ctx := WithPrincipal(context.Background(), "op")
+	if PrincipalFromContext(ctx) != "op" {
+		t.Error("principal not stored")
+	}
+	if err := svc.WritePVContext(ctx, "/a/x", PV{}); err != nil {
+		t.Error(err)
+	}
+
+	// exgdata
+	writeErrs, readResults, err := svc.ExgDataContext(ctx,
+		[]WritePVParam{{Path: "/b"}, {Path: "/a/x"}},
+		[]string{"/b", "/a"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writeErrs[0] == nil || writeErrs[0].Code() != StatusForbidden || writeErrs[1] != nil {
+		t.Error(writeErrs)
+	}
+	if readResults[0].Error == nil || readResults[0].Error.Code() != StatusForbidden ||
+		readResults[1].Error != nil || readResults[1].PV.Value != "/a" {
+		t.Error(readResults)
+	}
+	_, err = svc.ExtendedExgData(ctx, ExgDataParams{Atomic: true, WritePVs: []WritePVParam{{Path: "/b"}}})
+	if err == nil || err.Code() != StatusForbidden {
+		t.Error(err)
+	}
+
+	// query
+	svc.Rules[0].PathPattern = "/a/**"
+	res, err := svc.ExtendedQuery(context.Background(), QueryParams{PathPatterns: []string{"/**"}, Offset: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, r := range res {
+		paths = append(paths, r.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"/a/x"}) {
+		t.Error(paths)
+	}
+}
@@ -0,0 +1,305 @@
+package veap
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// default number of raw entries read at once by the aggregation fallback
+	defaultRawHistoryChunkSize = 10000
+)
+
+// AggregateFunc selects the aggregation of history entries within an
+// interval.
+type AggregateFunc string
+
+// Aggregation functions
+const (
+	AggregateMin   AggregateFunc = "min"
+	AggregateMax   AggregateFunc = "max"
+	AggregateAvg   AggregateFunc = "avg"
+	AggregateFirst AggregateFunc = "first"
+	AggregateLast  AggregateFunc = "last"
+	AggregateCount AggregateFunc = "count"
+	// time-weighted average, each value is valid until the next entry
+	AggregateTimeAvg AggregateFunc = "tavg"
+)
+
+// Valid checks whether f is a known aggregation function.
+func (f AggregateFunc) Valid() bool {
+	switch f {
+	case AggregateMin, AggregateMax, AggregateAvg, AggregateFirst, AggregateLast, AggregateCount, AggregateTimeAvg:
+		return true
+	}
+	return false
+}
+
+func (f AggregateFunc) numeric() bool {
+	return f != AggregateFirst && f != AggregateLast && f != AggregateCount
+}
+
+// Aggregation specifies the aggregation of a history. The time range is
+// divided into intervals starting at begin. For each interval with entries one
+// aggregated entry is returned. Its timestamp is the start of the interval. The
+// results of min, max, avg, count and tavg are float64 values and their state
+// is the highest state of the entries within the interval. first and last
+// return the corresponding entry with its value and state, but the timestamp
+// of the interval.
+type Aggregation struct {
+	Func     AggregateFunc
+	Interval time.Duration
+}
+
+// Validate checks the aggregation parameters.
+func (a Aggregation) Validate() Error {
+	if !a.Func.Valid() {
+		return NewErrorf(StatusBadRequest, "Invalid aggregation function: %s", a.Func)
+	}
+	if a.Interval <= 0 {
+		return NewErrorf(StatusBadRequest, "Invalid aggregation interval: %v", a.Interval)
+	}
+	return nil
+}
+
+// AggregatingHistoryReader can optionally be implemented by a Service to
+// aggregate histories natively (e.g. in a database). Otherwise the raw
+// history is read with ReadHistory and aggregated (q.v.
+// AsAggregatingHistoryReader).
+type AggregatingHistoryReader interface {
+	// ReadAggregatedHistory retrieves the aggregated history of a data point.
+	// At most limit aggregated entries are returned. VEAP-Protocol: HTTP-GET
+	// on history (.../~hist) with the parameters aggr and interval
+	ReadAggregatedHistory(ctx context.Context, path string, begin time.Time, end time.Time, aggr Aggregation, limit int64) ([]PV, Error)
+}
+
+// AsAggregatingHistoryReader returns the AggregatingHistoryReader of the
+// service, if implemented. Otherwise an adapter is returned, which aggregates
+// the raw history (q.v. AggregateRawHistory).
+func AsAggregatingHistoryReader(service Service) AggregatingHistoryReader {
+	if ahr, ok := service.(AggregatingHistoryReader); ok {
+		return ahr
+	}
+	return aggregatingAdapter{AsContextService(service)}
+}
+
+type aggregatingAdapter struct {
+	service ContextService
+}
+
+func (a aggregatingAdapter) ReadAggregatedHistory(ctx context.Context, path string, begin time.Time, end time.Time, aggr Aggregation, limit int64) ([]PV, Error) {
+	return AggregateRawHistory(ctx, a.service, path, begin, end, aggr, limit, 0)
+}
+
+// AggregateRawHistory reads the raw history of a data point in chunks with
+// ReadHistoryContext and aggregates it. Therefore the time range is not
+// limited by the history size limit of the service. chunkSize is the number
+// of entries read at once and must not exceed the history size limit of the
+// service. If chunkSize is not positive, 10000 entries are read at once. The
+// service may return less entries than requested, the reading stops with a
+// chunk without new entries. Entries with the same timestamp are read
+// completely, as long as they fit into one chunk. The reading stops as soon as
+// limit aggregated entries are complete.
+func AggregateRawHistory(ctx context.Context, service ContextService, path string, begin time.Time, end time.Time, aggr Aggregation, limit int64, chunkSize int64) ([]PV, Error) {
+	if err := aggr.Validate(); err != nil {
+		return nil, err
+	}
+	if chunkSize <= 0 {
+		chunkSize = defaultRawHistoryChunkSize
+	}
+	ag := newAggregator(begin, end, aggr)
+	cursor := begin
+	// number of entries with the timestamp of cursor, which are already
+	// aggregated
+	skip := 0
+	for cursor.Before(end) && !ag.complete(limit) {
+		chunk, err := service.ReadHistoryContext(ctx, path, cursor, end, chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		added, seen := 0, 0
+		for _, e := range chunk {
+			// already aggregated?
+			if e.Time.Before(cursor) {
+				continue
+			}
+			if e.Time.Equal(cursor) && seen < skip {
+				seen++
+				continue
+			}
+			if err := ag.add(e); err != nil {
+				return nil, err
+			}
+			added++
+		}
+		if added == 0 {
+			if !chunk[0].Time.Equal(cursor) || !chunk[len(chunk)-1].Time.Equal(cursor) {
+				// no new entries
+				break
+			}
+			// more entries with the same timestamp than fit into a chunk,
+			// continue with the next timestamp
+			cursor = cursor.Add(time.Nanosecond)
+			skip = 0
+			continue
+		}
+		// continue at the timestamp of the last entry, because more entries
+		// with this timestamp may follow
+		last := chunk[len(chunk)-1].Time
+		skip = 0
+		for i := len(chunk) - 1; i >= 0 && chunk[i].Time.Equal(last); i-- {
+			skip++
+		}
+		cursor = last
+	}
+	return ag.finish(limit), nil
+}
+
+// AggregateHistory aggregates a raw history. The entries must be in ascending
+// time order. Entries outside of begin..end (exclusive) are ignored.
+func AggregateHistory(hist []PV, begin time.Time, end time.Time, aggr Aggregation) ([]PV, Error) {
+	if err := aggr.Validate(); err != nil {
+		return nil, err
+	}
+	ag := newAggregator(begin, end, aggr)
+	for _, e := range hist {
+		if err := ag.add(e); err != nil {
+			return nil, err
+		}
+	}
+	return ag.finish(-1), nil
+}
+
+// aggregator aggregates history entries incrementally.
+type aggregator struct {
+	begin, end time.Time
+	aggr       Aggregation
+	results    []PV
+
+	// current interval
+	bucket     int64
+	count      int
+	first      PV
+	last       PV
+	min, max   float64
+	sum        float64
+	state      State
+	weightSum  float64
+	weightTime time.Duration
+
+	// previous entry for tavg
+	prev      PV
+	prevValue float64
+	hasPrev   bool
+}
+
+func newAggregator(begin, end time.Time, aggr Aggregation) *aggregator {
+	return &aggregator{begin: begin, end: end, aggr: aggr, results: make([]PV, 0)}
+}
+
+func (a *aggregator) add(e PV) Error {
+	if e.Time.Before(a.begin) || !e.Time.Before(a.end) {
+		return nil
+	}
+	var v float64
+	if a.aggr.Func.numeric() {
+		var ok bool
+		v, ok = NumericValue(e.Value)
+		if !ok {
+			return NewErrorf(StatusBadRequest, "Aggregation %s needs numeric values: %v", a.aggr.Func, e.Value)
+		}
+	}
+	bucket := int64(e.Time.Sub(a.begin) / a.aggr.Interval)
+	if a.count > 0 && bucket != a.bucket {
+		a.flush(a.bucketStart(a.bucket + 1))
+	}
+	if a.count == 0 {
+		a.bucket = bucket
+		a.first = e
+		a.min, a.max, a.sum = v, v, 0
+		a.state = e.State
+		a.weightSum, a.weightTime = 0, 0
+		// value of the previous entry is valid at the start of the interval
+		if a.hasPrev {
+			a.weight(a.prevValue, a.bucketStart(bucket), e.Time)
+		}
+	} else {
+		a.weight(a.prevValue, a.prev.Time, e.Time)
+	}
+	a.count++
+	a.last = e
+	if v < a.min {
+		a.min = v
+	}
+	if v > a.max {
+		a.max = v
+	}
+	a.sum += v
+	if e.State > a.state {
+		a.state = e.State
+	}
+	a.prev, a.prevValue, a.hasPrev = e, v, true
+	return nil
+}
+
+func (a *aggregator) weight(v float64, from, to time.Time) {
+	d := to.Sub(from)
+	a.weightSum += v * float64(d)
+	a.weightTime += d
+}
+
+func (a *aggregator) bucketStart(bucket int64) time.Time {
+	return a.begin.Add(time.Duration(bucket) * a.aggr.Interval)
+}
+
+// flush completes the current interval. The last value is valid until the
+// specified time.
+func (a *aggregator) flush(until time.Time) {
+	if until.After(a.end) {
+		until = a.end
+	}
+	ts := a.bucketStart(a.bucket)
+	r := PV{Time: ts, State: a.state}
+	switch a.aggr.Func {
+	case AggregateMin:
+		r.Value = a.min
+	case AggregateMax:
+		r.Value = a.max
+	case AggregateAvg:
+		r.Value = a.sum / float64(a.count)
+	case AggregateCount:
+		r.Value = float64(a.count)
+	case AggregateFirst:
+		r = PV{Time: ts, Value: a.first.Value, State: a.first.State}
+	case AggregateLast:
+		r = PV{Time: ts, Value: a.last.Value, State: a.last.State}
+	case AggregateTimeAvg:
+		a.weight(a.prevValue, a.prev.Time, until)
+		if a.weightTime > 0 {
+			r.Value = a.weightSum / float64(a.weightTime)
+		} else {
+			r.Value = a.prevValue
+		}
+	}
+	a.results = append(a.results, r)
+	a.count = 0
+}
+
+// complete checks whether at least limit intervals are completed. A negative
+// limit is never reached.
+func (a *aggregator) complete(limit int64) bool {
+	return limit >= 0 && int64(len(a.results)) >= limit
+}
+
+func (a *aggregator) finish(limit int64) []PV {
+	if a.count > 0 {
+		a.flush(a.bucketStart(a.bucket + 1))
+	}
+	if limit >= 0 && int64(len(a.results)) > limit {
+		return a.results[:limit]
+	}
+	return a.results
+}
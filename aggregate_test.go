@@ -0,0 +1,148 @@
+package veap
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAggregateHistory(t *testing.T) {
+	hist := []PV{
+		{Time: time.Unix(0, 0), Value: 1.0},
+		{Time: time.Unix(2, 0), Value: 3.0, State: StateUncertain},
+		{Time: time.Unix(9, 0), Value: 2.0},
+		{Time: time.Unix(25, 0), Value: true},
+	}
+	begin, end := time.Unix(0, 0), time.Unix(30, 0)
+	cases := []struct {
+		f      AggregateFunc
+		values []interface{}
+	}{
+		{AggregateMin, []interface{}{1.0, 1.0}},
+		{AggregateMax, []interface{}{3.0, 1.0}},
+		{AggregateAvg, []interface{}{2.0, 1.0}},
+		{AggregateCount, []interface{}{3.0, 1.0}},
+		{AggregateFirst, []interface{}{1.0, true}},
+		{AggregateLast, []interface{}{2.0, true}},
+		// 0..2: 1, 2..9: 3, 9..10: 2 => 25/10
+		// 20..25: 2 (previous interval), 25..30: 1 => 15/10
+		{AggregateTimeAvg, []interface{}{2.5, 1.5}},
+	}
+	for _, c := range cases {
+		res, err := AggregateHistory(hist, begin, end, Aggregation{Func: c.f, Interval: 10 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []interface{}
+		for _, r := range res {
+			values = append(values, r.Value)
+		}
+		if !reflect.DeepEqual(values, c.values) {
+			t.Errorf("%s: expected %v, got %v", c.f, c.values, values)
+		}
+		if !res[0].Time.Equal(begin) || !res[1].Time.Equal(time.Unix(20, 0)) {
+			t.Errorf("%s: wrong timestamps: %v", c.f, res)
+		}
+	}
+
+	// state
+	res, _ := AggregateHistory(hist, begin, end, Aggregation{Func: AggregateAvg, Interval: 10 * time.Second})
+	if res[0].State != StateUncertain || res[1].State != StateGood {
+		t.Error(res)
+	}
+
+	// invalid parameters
+	if _, err := AggregateHistory(hist, begin, end, Aggregation{Func: "median", Interval: time.Second}); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := AggregateHistory(hist, begin, end, Aggregation{Func: AggregateAvg}); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := AggregateHistory([]PV{{Time: time.Unix(1, 0), Value: "a"}}, begin, end, Aggregation{Func: AggregateAvg, Interval: time.Second}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestAggregateRawHistory(t *testing.T) {
+	var svc MemoryService
+	if _, err := svc.WriteProperties("/a", AttrValues{}); err != nil {
+		t.Fatal(err)
+	}
+	// more entries than read at once
+	n := 2*defaultRawHistoryChunkSize + 500
+	hist := make([]PV, n)
+	for i := range hist {
+		hist[i] = PV{Time: time.Unix(int64(i), 0), Value: 1.0}
+	}
+	if err := svc.WriteHistory("/a", hist); err != nil {
+		t.Fatal(err)
+	}
+	res, err := AsAggregatingHistoryReader(&svc).ReadAggregatedHistory(context.Background(), "/a",
+		time.Unix(0, 0), time.Unix(int64(n), 0), Aggregation{Func: AggregateCount, Interval: time.Duration(n) * time.Second}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Value != float64(n) {
+		t.Error(res)
+	}
+}
+
+func TestAggregateRawHistoryChunks(t *testing.T) {
+	// 3 entries per second, 10 seconds
+	var hist []PV
+	for i := 0; i < 30; i++ {
+		hist = append(hist, PV{Time: time.Unix(int64(i/3), 0), Value: float64(i)})
+	}
+	var requests int
+	svc := &FuncService{
+		ReadHistoryFunc: func(path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+			requests++
+			if limit > 5 {
+				return nil, NewErrorf(StatusBadRequest, "History size limit exceeded: %d", limit)
+			}
+			// backend returns less entries than requested
+			if limit > 4 {
+				limit = 4
+			}
+			var res []PV
+			for _, e := range hist {
+				if !e.Time.Before(begin) && e.Time.Before(end) && int64(len(res)) < limit {
+					res = append(res, e)
+				}
+			}
+			return res, nil
+		},
+	}
+	res, err := AggregateRawHistory(context.Background(), AsContextService(svc), "/a", time.Unix(0, 0), time.Unix(10, 0),
+		Aggregation{Func: AggregateCount, Interval: time.Second}, -1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 10 {
+		t.Fatal(res)
+	}
+	for _, r := range res {
+		if r.Value != 3.0 {
+			t.Error(res)
+			break
+		}
+	}
+	if requests < 10 {
+		t.Error(requests)
+	}
+
+	// reading stops, when the limit is reached
+	requests = 0
+	res, err = AggregateRawHistory(context.Background(), AsContextService(svc), "/a", time.Unix(0, 0), time.Unix(10, 0),
+		Aggregation{Func: AggregateCount, Interval: time.Second}, 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Value != 3.0 || res[1].Value != 3.0 {
+		t.Error(res)
+	}
+	if requests != 2 {
+		t.Error(requests)
+	}
+}
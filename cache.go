@@ -0,0 +1,465 @@
+package veap
+
+import (
+	"container/list"
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// default max. number of cache entries of CachingService
+	defaultCacheSize = 10000
+)
+
+// cached operations
+const (
+	cacheReadPV = iota
+	cacheReadProperties
+)
+
+type cacheKey struct {
+	op   int
+	path string
+	// results are cached per caller, because they may depend on the access
+	// rights
+	principal string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	value   interface{}
+	expires time.Time
+}
+
+// flight is a running service call, which is shared by concurrent identical
+// reads.
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	err   Error
+	// the result must not be cached, if the path was invalidated meanwhile
+	stale bool
+}
+
+// CachingService caches the results of ReadPV and ReadProperties of the
+// provided Service. Concurrent identical reads are coalesced into one service
+// call. Writes through the CachingService invalidate the cache entries of the
+// affected paths for all callers. Errors are not cached. Results are cached
+// and coalesced per principal (q.v. WithPrincipal), so that a CachingService
+// can wrap an AccessControlService. A coalesced service call is executed with
+// the values of the first caller's context, but it is not canceled with it.
+// Each caller waits only until its own context is done.
+//
+// The MetaService, Subscriber, WritePreparer and AggregatingHistoryReader of
+// the provided Service are forwarded without caching. If the provided Service
+// does not implement MetaService, ExgData and Query return an error. If it
+// does not implement Subscriber, the PVs are polled every second.
+type CachingService struct {
+	Service
+
+	// PVTTL is the time to live of cached PVs. If 0, PVs are not cached, but
+	// concurrent reads are still coalesced.
+	PVTTL time.Duration
+
+	// PropertiesTTL is the time to live of cached properties. If 0,
+	// properties are not cached, but concurrent reads are still coalesced.
+	PropertiesTTL time.Duration
+
+	// MaxEntries is the maximum number of cache entries. If exceeded, the
+	// least recently used entries are removed. If not set, the limit is 10000
+	// entries.
+	MaxEntries int
+
+	mutex    sync.Mutex
+	entries  map[cacheKey]*list.Element
+	lru      *list.List
+	inflight map[cacheKey]*flight
+	// for tests
+	now func() time.Time
+
+	poller     *PollingSubscriber
+	pollerOnce sync.Once
+}
+
+// Make sure that CachingService implements all service interfaces.
+var _ Service = (*CachingService)(nil)
+var _ ContextService = (*CachingService)(nil)
+var _ MetaService = (*CachingService)(nil)
+var _ ContextMetaService = (*CachingService)(nil)
+var _ ExtendedExgDataService = (*CachingService)(nil)
+var _ ExtendedQueryService = (*CachingService)(nil)
+var _ StreamingQueryService = (*CachingService)(nil)
+var _ Subscriber = (*CachingService)(nil)
+var _ WritePreparer = (*CachingService)(nil)
+var _ AggregatingHistoryReader = (*CachingService)(nil)
+
+// ReadPV implements Service.
+func (c *CachingService) ReadPV(path string) (PV, Error) {
+	return c.ReadPVContext(context.Background(), path)
+}
+
+// ReadPVContext implements ContextService.
+func (c *CachingService) ReadPVContext(ctx context.Context, path string) (PV, Error) {
+	v, err := c.read(ctx, cacheKey{op: cacheReadPV, path: path, principal: PrincipalFromContext(ctx)}, c.PVTTL, func(ctx context.Context) (interface{}, Error) {
+		return AsContextService(c.Service).ReadPVContext(ctx, path)
+	})
+	if err != nil {
+		return PV{}, err
+	}
+	return v.(PV), nil
+}
+
+type cachedProps struct {
+	attributes AttrValues
+	links      []Link
+}
+
+// ReadProperties implements Service.
+func (c *CachingService) ReadProperties(path string) (AttrValues, []Link, Error) {
+	return c.ReadPropertiesContext(context.Background(), path)
+}
+
+// ReadPropertiesContext implements ContextService. Copies of the cached
+// attributes and links are returned.
+func (c *CachingService) ReadPropertiesContext(ctx context.Context, path string) (AttrValues, []Link, Error) {
+	v, err := c.read(ctx, cacheKey{op: cacheReadProperties, path: path, principal: PrincipalFromContext(ctx)}, c.PropertiesTTL, func(ctx context.Context) (interface{}, Error) {
+		attr, links, err := AsContextService(c.Service).ReadPropertiesContext(ctx, path)
+		return cachedProps{attr, links}, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	p := v.(cachedProps)
+	var attr AttrValues
+	if p.attributes != nil {
+		attr = make(AttrValues, len(p.attributes))
+		for k, v := range p.attributes {
+			attr[k] = v
+		}
+	}
+	var links []Link
+	if p.links != nil {
+		links = append(make([]Link, 0, len(p.links)), p.links...)
+	}
+	return attr, links, nil
+}
+
+// WritePV implements Service.
+func (c *CachingService) WritePV(path string, pv PV) Error {
+	return c.WritePVContext(context.Background(), path, pv)
+}
+
+// WritePVContext implements ContextService. The cached PV of the path is
+// invalidated.
+func (c *CachingService) WritePVContext(ctx context.Context, path string, pv PV) Error {
+	defer c.invalidate(cacheKey{op: cacheReadPV, path: path})
+	return AsContextService(c.Service).WritePVContext(ctx, path, pv)
+}
+
+// ReadHistoryContext implements ContextService. Histories are not cached.
+func (c *CachingService) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	return AsContextService(c.Service).ReadHistoryContext(ctx, path, begin, end, limit)
+}
+
+// WriteHistoryContext implements ContextService.
+func (c *CachingService) WriteHistoryContext(ctx context.Context, path string, timeSeries []PV) Error {
+	return AsContextService(c.Service).WriteHistoryContext(ctx, path, timeSeries)
+}
+
+// WriteProperties implements Service.
+func (c *CachingService) WriteProperties(path string, attributes AttrValues) (bool, Error) {
+	return c.WritePropertiesContext(context.Background(), path, attributes)
+}
+
+// WritePropertiesContext implements ContextService. The cached properties of
+// the path and its parent (the links may change) are invalidated.
+func (c *CachingService) WritePropertiesContext(ctx context.Context, objPath string, attributes AttrValues) (bool, Error) {
+	defer c.invalidate(cacheKey{op: cacheReadProperties, path: objPath}, cacheKey{op: cacheReadProperties, path: path.Dir(objPath)})
+	return AsContextService(c.Service).WritePropertiesContext(ctx, objPath, attributes)
+}
+
+// Delete implements Service.
+func (c *CachingService) Delete(path string) Error {
+	return c.DeleteContext(context.Background(), path)
+}
+
+// DeleteContext implements ContextService. All cache entries of the path and
+// its descendants are invalidated, as well as the properties of the parent.
+func (c *CachingService) DeleteContext(ctx context.Context, objPath string) Error {
+	defer c.invalidateTree(objPath)
+	return AsContextService(c.Service).DeleteContext(ctx, objPath)
+}
+
+// ExgData implements MetaService.
+func (c *CachingService) ExgData(writePVs []WritePVParam, readPaths []string) ([]Error, []ReadPVResult, Error) {
+	return c.ExgDataContext(context.Background(), writePVs, readPaths)
+}
+
+// ExgDataContext implements ContextMetaService.
+func (c *CachingService) ExgDataContext(ctx context.Context, writePVs []WritePVParam, readPaths []string) ([]Error, []ReadPVResult, Error) {
+	results, err := c.ExtendedExgData(ctx, ExgDataParams{WritePVs: writePVs, ReadPaths: readPaths})
+	return results.WriteErrors, results.ReadResults, err
+}
+
+// ExtendedExgData implements ExtendedExgDataService. The ExgData service of
+// the provided Service is used. The cache entries of all written paths are
+// invalidated.
+func (c *CachingService) ExtendedExgData(ctx context.Context, params ExgDataParams) (ExgDataResults, Error) {
+	ms, ok := c.Service.(MetaService)
+	if !ok {
+		return ExgDataResults{}, NewErrorf(StatusBadRequest, "ExgData service not implemented")
+	}
+	defer func() {
+		var keys []cacheKey
+		for _, p := range params.WritePVs {
+			keys = append(keys, cacheKey{op: cacheReadPV, path: p.Path})
+		}
+		for _, p := range params.WriteProperties {
+			keys = append(keys, cacheKey{op: cacheReadProperties, path: p.Path}, cacheKey{op: cacheReadProperties, path: path.Dir(p.Path)})
+		}
+		c.invalidate(keys...)
+	}()
+	return AsExtendedExgDataService(AsContextMetaService(ms), AsContextService(c.Service)).ExtendedExgData(ctx, params)
+}
+
+// Query implements MetaService.
+func (c *CachingService) Query(pathPatterns []string) ([]QueryResult, Error) {
+	return c.QueryContext(context.Background(), pathPatterns)
+}
+
+// QueryContext implements ContextMetaService.
+func (c *CachingService) QueryContext(ctx context.Context, pathPatterns []string) ([]QueryResult, Error) {
+	return c.ExtendedQuery(ctx, QueryParams{PathPatterns: pathPatterns})
+}
+
+// ExtendedQuery implements ExtendedQueryService. The Query service of the
+// provided Service is used.
+func (c *CachingService) ExtendedQuery(ctx context.Context, params QueryParams) ([]QueryResult, Error) {
+	ms, ok := c.Service.(MetaService)
+	if !ok {
+		return nil, NewErrorf(StatusBadRequest, "Query service not implemented")
+	}
+	return AsExtendedQueryService(AsContextMetaService(ms)).ExtendedQuery(ctx, params)
+}
+
+// QueryFunc implements StreamingQueryService.
+func (c *CachingService) QueryFunc(ctx context.Context, params QueryParams, handle func(item QueryResult) Error) Error {
+	ms, ok := c.Service.(MetaService)
+	if !ok {
+		return NewErrorf(StatusBadRequest, "Query service not implemented")
+	}
+	return AsStreamingQueryService(AsContextMetaService(ms)).QueryFunc(ctx, params, handle)
+}
+
+func (c *CachingService) subscriber() Subscriber {
+	if sub, ok := c.Service.(Subscriber); ok {
+		return sub
+	}
+	c.pollerOnce.Do(func() {
+		c.poller = &PollingSubscriber{Service: c.Service}
+	})
+	return c.poller
+}
+
+// Subscribe implements Subscriber.
+func (c *CachingService) Subscribe(paths []string, callback PVChangeFunc) (SubscriptionID, Error) {
+	return c.subscriber().Subscribe(paths, callback)
+}
+
+// Unsubscribe implements Subscriber.
+func (c *CachingService) Unsubscribe(id SubscriptionID) Error {
+	return c.subscriber().Unsubscribe(id)
+}
+
+// PrepareWritePV implements WritePreparer. On commit the cached PV of the path
+// is invalidated.
+func (c *CachingService) PrepareWritePV(ctx context.Context, path string, pv PV) (PreparedWrite, Error) {
+	wp, ok := c.Service.(WritePreparer)
+	if !ok {
+		return nil, NewErrorf(StatusBadRequest, "Atomic writes not supported by service")
+	}
+	pw, err := wp.PrepareWritePV(ctx, path, pv)
+	if pw == nil {
+		return nil, err
+	}
+	return &FuncPreparedWrite{
+		CommitFunc: func(ctx context.Context) Error {
+			defer c.invalidate(cacheKey{op: cacheReadPV, path: path})
+			return pw.Commit(ctx)
+		},
+		RollbackFunc: pw.Rollback,
+	}, err
+}
+
+// ReadAggregatedHistory implements AggregatingHistoryReader. Histories are not
+// cached.
+func (c *CachingService) ReadAggregatedHistory(ctx context.Context, path string, begin time.Time, end time.Time, aggr Aggregation, limit int64) ([]PV, Error) {
+	return AsAggregatingHistoryReader(c.Service).ReadAggregatedHistory(ctx, path, begin, end, aggr, limit)
+}
+
+// Invalidate removes all cache entries of the path. This is needed, if the
+// PV or the properties are modified bypassing the CachingService.
+func (c *CachingService) Invalidate(path string) {
+	c.invalidate(cacheKey{op: cacheReadPV, path: path}, cacheKey{op: cacheReadProperties, path: path})
+}
+
+// Clear removes all cache entries.
+func (c *CachingService) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.init()
+	for k, f := range c.inflight {
+		f.stale = true
+		delete(c.inflight, k)
+	}
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+}
+
+func (c *CachingService) read(ctx context.Context, key cacheKey, ttl time.Duration, call func(ctx context.Context) (interface{}, Error)) (interface{}, Error) {
+	c.mutex.Lock()
+	c.init()
+
+	// cache hit?
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*cacheEntry)
+		if c.now().Before(e.expires) {
+			c.lru.MoveToFront(elem)
+			c.mutex.Unlock()
+			return e.value, nil
+		}
+		c.removeElement(elem)
+	}
+
+	// start service call, if no identical read is running
+	f, ok := c.inflight[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		c.inflight[key] = f
+		go c.fly(detachedContext{ctx}, key, ttl, f, call)
+	}
+	c.mutex.Unlock()
+
+	// wait for result
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		return nil, ContextError(ctx)
+	}
+}
+
+// fly executes a shared service call.
+func (c *CachingService) fly(ctx context.Context, key cacheKey, ttl time.Duration, f *flight, call func(ctx context.Context) (interface{}, Error)) {
+	completed := false
+	defer func() {
+		// store result, also on panic the waiting readers are released
+		if r := recover(); r != nil {
+			middlewareLog.Errorf("Panic in cached service call for %s: %v", key.path, r)
+		}
+		c.mutex.Lock()
+		if !f.stale {
+			delete(c.inflight, key)
+			if completed && f.err == nil && ttl > 0 {
+				c.store(key, f.value, ttl)
+			}
+		}
+		c.mutex.Unlock()
+		if !completed {
+			f.err = NewErrorf(StatusInternalServerError, "Service call failed")
+		}
+		close(f.done)
+	}()
+	f.value, f.err = call(ctx)
+	completed = true
+}
+
+// detachedContext keeps the values of a context, but is never canceled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// mutex must be locked.
+func (c *CachingService) init() {
+	if c.entries == nil {
+		c.entries = make(map[cacheKey]*list.Element)
+		c.lru = list.New()
+		c.inflight = make(map[cacheKey]*flight)
+		if c.now == nil {
+			c.now = time.Now
+		}
+	}
+}
+
+// mutex must be locked.
+func (c *CachingService) store(key cacheKey, value interface{}, ttl time.Duration) {
+	e := &cacheEntry{key: key, value: value, expires: c.now().Add(ttl)}
+	c.entries[key] = c.lru.PushFront(e)
+	maxEntries := c.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheSize
+	}
+	for c.lru.Len() > maxEntries {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// mutex must be locked.
+func (c *CachingService) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// invalidate removes the cache entries of the keys for all principals.
+func (c *CachingService) invalidate(keys ...cacheKey) {
+	affected := make(map[cacheKey]bool, len(keys))
+	for _, key := range keys {
+		key.principal = ""
+		affected[key] = true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.init()
+	for key, elem := range c.entries {
+		if affected[cacheKey{op: key.op, path: key.path}] {
+			c.removeElement(elem)
+		}
+	}
+	for key, f := range c.inflight {
+		if affected[cacheKey{op: key.op, path: key.path}] {
+			f.stale = true
+			delete(c.inflight, key)
+		}
+	}
+}
+
+func (c *CachingService) invalidateTree(objPath string) {
+	prefix := strings.TrimSuffix(objPath, "/") + "/"
+	affected := func(p string) bool {
+		return p == objPath || strings.HasPrefix(p, prefix)
+	}
+	c.mutex.Lock()
+	c.init()
+	var keys []cacheKey
+	for key := range c.entries {
+		if affected(key.path) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range c.inflight {
+		if affected(key.path) {
+			keys = append(keys, key)
+		}
+	}
+	c.mutex.Unlock()
+	keys = append(keys, cacheKey{op: cacheReadProperties, path: path.Dir(objPath)})
+	c.invalidate(keys...)
+}
@@ -0,0 +1,307 @@
+package veap
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachingService(t *testing.T) {
+	var reads int64
+	values := map[string]interface{}{"/a": 1.0, "/b": 2.0}
+	var valuesMutex sync.Mutex
+	svc := &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			atomic.AddInt64(&reads, 1)
+			valuesMutex.Lock()
+			defer valuesMutex.Unlock()
+			v, ok := values[path]
+			if !ok {
+				return PV{}, NewErrorf(StatusNotFound, "Not found: %s", path)
+			}
+			return PV{Value: v}, nil
+		},
+		WritePVFunc: func(path string, pv PV) Error {
+			valuesMutex.Lock()
+			defer valuesMutex.Unlock()
+			values[path] = pv.Value
+			return nil
+		},
+		ReadPropertiesFunc: func(path string) (AttrValues, []Link, Error) {
+			atomic.AddInt64(&reads, 1)
+			return AttrValues{"path": path}, nil, nil
+		},
+		DeleteFunc: func(path string) Error {
+			return nil
+		},
+	}
+	now := time.Unix(1000, 0)
+	c := &CachingService{Service: svc, PVTTL: time.Second, PropertiesTTL: time.Minute}
+	c.now = func() time.Time { return now }
+
+	// cache hit
+	for i := 0; i < 3; i++ {
+		pv, err := c.ReadPV("/a")
+		if err != nil || pv.Value != 1.0 {
+			t.Fatal(pv, err)
+		}
+	}
+	if reads != 1 {
+		t.Error(reads)
+	}
+
+	// errors are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := c.ReadPV("/x"); err == nil || err.Code() != StatusNotFound {
+			t.Error(err)
+		}
+	}
+	if reads != 3 {
+		t.Error(reads)
+	}
+
+	// expiration
+	now = now.Add(2 * time.Second)
+	c.ReadPV("/a")
+	c.ReadPV("/a")
+	if reads != 4 {
+		t.Error(reads)
+	}
+
+	// invalidation by write
+	if err := c.WritePV("/a", PV{Value: 3.0}); err != nil {
+		t.Fatal(err)
+	}
+	if pv, _ := c.ReadPV("/a"); pv.Value != 3.0 || reads != 5 {
+		t.Error(pv, reads)
+	}
+
+	// properties and invalidation by delete
+	c.ReadProperties("/a/b")
+	c.ReadProperties("/a")
+	c.ReadProperties("/a/b")
+	if reads != 7 {
+		t.Error(reads)
+	}
+	c.Delete("/a/b")
+	c.ReadProperties("/a/b")
+	c.ReadProperties("/a")
+	if reads != 9 {
+		t.Error(reads)
+	}
+}
+
+func TestCachingServiceSize(t *testing.T) {
+	var reads int
+	svc := &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			reads++
+			return PV{Value: path}, nil
+		},
+	}
+	c := &CachingService{Service: svc, PVTTL: time.Hour, MaxEntries: 2}
+	for _, p := range []string{"/1", "/2", "/1", "/3", "/1", "/2"} {
+		c.ReadPV(p)
+	}
+	// /2 was removed by /3, /1 is kept as most recently used
+	if reads != 4 {
+		t.Error(reads)
+	}
+	if len(c.entries) != 2 || c.lru.Len() != 2 {
+		t.Error(len(c.entries))
+	}
+}
+
+func TestCachingServiceCoalescing(t *testing.T) {
+	var reads int64
+	release := make(chan struct{})
+	svc := &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			atomic.AddInt64(&reads, 1)
+			<-release
+			return PV{Value: path}, nil
+		},
+	}
+	// no caching, only coalescing
+	c := &CachingService{Service: svc}
+
+	var wg sync.WaitGroup
+	results := make([]PV, 10)
+	for i := range results {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = c.ReadPV("/a")
+		}()
+	}
+	// wait for the first read
+	for atomic.LoadInt64(&reads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if reads != 1 {
+		t.Error(reads)
+	}
+	for i, r := range results {
+		if r.Value != "/a" {
+			t.Error(strconv.Itoa(i), r)
+		}
+	}
+
+	// not cached
+	c.ReadPV("/a")
+	if reads != 2 {
+		t.Error(reads)
+	}
+}
+
+func TestCachingServiceCanceledCaller(t *testing.T) {
+	var reads int64
+	release := make(chan struct{})
+	svc := &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			atomic.AddInt64(&reads, 1)
+			<-release
+			return PV{Value: path}, nil
+		},
+	}
+	c := &CachingService{Service: svc, PVTTL: time.Hour}
+
+	// first caller gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan Error)
+	go func() {
+		_, err := c.ReadPVContext(ctx, "/a")
+		done <- err
+	}()
+	for atomic.LoadInt64(&reads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err == nil {
+		t.Error("expected error")
+	}
+
+	// second caller gets the result of the shared read
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	pv, err := c.ReadPV("/a")
+	if err != nil || pv.Value != "/a" {
+		t.Error(pv, err)
+	}
+	if reads != 1 {
+		t.Error(reads)
+	}
+}
+
+func TestCachingServiceMeta(t *testing.T) {
+	svc := &MemoryService{}
+	c := &CachingService{Service: svc, PVTTL: time.Hour}
+	if _, err := c.WriteProperties("/a", AttrValues{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var notified int64
+	id, err := c.Subscribe([]string{"/a"}, func(path string, pv PV) {
+		atomic.AddInt64(&notified, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Unsubscribe(id)
+
+	if err := c.WritePV("/a", PV{Value: 1.0}); err != nil {
+		t.Fatal(err)
+	}
+	if pv, err := c.ReadPV("/a"); err != nil || pv.Value != 1.0 {
+		t.Fatal(pv, err)
+	}
+
+	// ExgData invalidates the cached PV
+	werrs, _, err := c.ExgData([]WritePVParam{{Path: "/a", PV: PV{Value: 2.0}}}, nil)
+	if err != nil || werrs[0] != nil {
+		t.Fatal(werrs, err)
+	}
+	if pv, err := c.ReadPV("/a"); err != nil || pv.Value != 2.0 {
+		t.Error(pv, err)
+	}
+	if atomic.LoadInt64(&notified) != 2 {
+		t.Error(notified)
+	}
+
+	// atomic write invalidates the cached PV
+	pw, err := c.PrepareWritePV(context.Background(), "/a", PV{Value: 3.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if pv, err := c.ReadPV("/a"); err != nil || pv.Value != 3.0 {
+		t.Error(pv, err)
+	}
+
+	res, err := c.Query([]string{"/*"})
+	if err != nil || len(res) != 1 || res[0].Path != "/a" {
+		t.Error(res, err)
+	}
+
+	// no MetaService
+	c = &CachingService{Service: &FuncService{}}
+	if _, err := c.Query([]string{"/*"}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestCachingServicePrincipal(t *testing.T) {
+	var mem MemoryService
+	for _, p := range []string{"/a", "/b"} {
+		if _, err := mem.WriteProperties(p, AttrValues{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acl := &AccessControlService{
+		Service: &mem,
+		Rules:   []AccessRule{{Principal: "admin", PathPattern: "/**", Operations: OpAll}},
+	}
+	c := &CachingService{Service: acl, PropertiesTTL: time.Hour}
+
+	// result of admin is not served to other callers
+	admin := WithPrincipal(context.Background(), "admin")
+	if _, _, err := c.ReadPropertiesContext(admin, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadPropertiesContext(context.Background(), "/a"); err == nil || err.Code() != StatusForbidden {
+		t.Error(err)
+	}
+
+	// returned properties are copies
+	attr, links, err := c.ReadPropertiesContext(admin, "/")
+	if err != nil || len(links) < 2 {
+		t.Fatal(links, err)
+	}
+	n := len(links)
+	attr["x"] = 1.0
+	links[0].Target = "x"
+	_ = append(links[:1], Link{Role: "x"})
+	attr, links, err = c.ReadPropertiesContext(admin, "/")
+	if err != nil || attr["x"] != nil || links[0].Target == "x" || links[1].Role == "x" {
+		t.Error(attr, links, err)
+	}
+
+	// writes invalidate the entries of all principals
+	if _, err := c.WritePropertiesContext(admin, "/c", AttrValues{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, links, err := c.ReadPropertiesContext(admin, "/"); err != nil || len(links) != n+1 {
+		t.Error(links, err)
+	}
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mdzio/go-veap"
+)
+
+const (
+	// default max. number of cached responses
+	defaultCacheSize = 1000
+)
+
+// cacheEntry is a cached response with its validators.
+type cacheEntry struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+type ifMatchKey struct{}
+
+// WithIfMatch returns a context, which makes the writing services of the
+// Client (WritePVContext, WritePropertiesContext) conditional. The write is
+// rejected by the server with veap.StatusPreconditionFailed, if the current
+// state does not match the entity tag (e.g. from ReadPVETag or
+// ReadPropertiesETag).
+func WithIfMatch(ctx context.Context, etag string) context.Context {
+	return context.WithValue(ctx, ifMatchKey{}, etag)
+}
+
+func setIfMatch(ctx context.Context, req *http.Request) {
+	if etag, _ := ctx.Value(ifMatchKey{}).(string); etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+}
+
+// getCached does an HTTP-GET request and returns the response body and its
+// entity tag. A cached response is revalidated with a conditional request and
+// reused, if the server answers with StatusNotModified.
+func (c *Client) getCached(ctx context.Context, url string) ([]byte, string, veap.Error) {
+	// do request
+	c.Log.Debugf("Sending HTTP-GET request to %s", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", veap.NewErrorf(veap.StatusClientError, "Creating HTTP-GET request failed: %v", err)
+	}
+	if c.User != "" || c.Password != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	cached := c.revalidate(req, url)
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, "", veap.NewErrorf(veap.StatusClientError, "HTTP-GET on %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	respBytes, err := c.readLimited(resp.Body)
+	if err != nil {
+		return nil, "", veap.NewError(veap.StatusClientError, err)
+	}
+	if resp.StatusCode == veap.StatusNotModified && cached != nil {
+		c.Log.Tracef("Cached response is still valid")
+		return cached.body, cached.etag, nil
+	}
+	if resp.StatusCode != veap.StatusOK {
+		return nil, "", veap.NewErrorf(resp.StatusCode, "Received HTTP status: %d (%s)",
+			resp.StatusCode, string(respBytes))
+	}
+
+	// log response
+	if c.Log.TraceEnabled() {
+		c.Log.Tracef("Response body: %s", string(respBytes))
+	}
+
+	c.store(url, resp, respBytes)
+	return respBytes, resp.Header.Get("ETag"), nil
+}
+
+// revalidate adds the validators of a cached response to the request.
+func (c *Client) revalidate(req *http.Request, url string) *cacheEntry {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	e, ok := c.cache[url]
+	if !ok {
+		return nil
+	}
+	if e.etag != "" {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+	if e.lastModified != "" {
+		req.Header.Set("If-Modified-Since", e.lastModified)
+	}
+	return e
+}
+
+// store caches a successful response, if it carries validators. Otherwise a
+// cached response is removed.
+func (c *Client) store(url string, resp *http.Response, body []byte) {
+	if c.CacheSize < 0 {
+		return
+	}
+	e := &cacheEntry{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		body:         body,
+	}
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	if e.etag == "" && e.lastModified == "" {
+		delete(c.cache, url)
+		return
+	}
+	if c.cache == nil {
+		c.cache = make(map[string]*cacheEntry)
+	}
+	if _, ok := c.cache[url]; !ok && len(c.cache) >= c.CacheSize {
+		// evict an arbitrary entry
+		for k := range c.cache {
+			delete(c.cache, k)
+			break
+		}
+	}
+	c.cache[url] = e
+}
@@ -2,12 +2,14 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/mdzio/go-lib/any"
@@ -22,7 +24,9 @@ const (
 	defaultResponseSizeLimit = 1 * 1024 * 1024
 )
 
-// Client forwards service calls to a remote VEAP server. It implements veap.Service.
+// Client forwards service calls to a remote VEAP server. It implements
+// veap.Service and veap.MetaService including the optional extensions (e.g.
+// veap.ContextService).
 type Client struct {
 	// URL of the VEAP server, without a trailing slash (e.g.
 	// http://localhost:2121). HTTPS (default port 2122) is supported if the
@@ -34,16 +38,51 @@ type Client struct {
 	Password string
 
 	// ResponseSizeLimit is the maximum size of a valid response. If not set, the
-	// limit is 1 MB.
+	// limit is 1 MB. The limit applies to the decompressed response.
 	ResponseSizeLimit int
 
+	// DisableCompression disables the negotiation of compressed responses
+	// (gzip, deflate).
+	DisableCompression bool
+
+	// RequestCompressionThreshold is the minimum size of a WriteHistory request
+	// body to be sent gzip compressed. The VEAP server must support compressed
+	// requests (e.g. server.Handler). If not set, requests are not compressed.
+	RequestCompressionThreshold int
+
+	// HistoryChunkSize is the number of raw history entries read at once, if
+	// the VEAP server does not support aggregation (q.v.
+	// ReadAggregatedHistory). It must not exceed the history size limit of the
+	// server. If not set, 10000 entries are read at once.
+	HistoryChunkSize int64
+
 	// Use a specific HTTP client. If not set, the default client is used.
 	Client *http.Client
 
 	// Use a specific Logger. If not set, logging.Get("veap-client") is used.
 	Log logging.Logger
+
+	// CacheSize is the maximum number of cached responses of ReadPV and
+	// ReadProperties. Cached responses are revalidated with conditional
+	// requests (ETag, Last-Modified), the server only needs to send the body
+	// if it changed. If not set, 1000 responses are cached. A negative value
+	// disables caching.
+	CacheSize int
+
+	cacheMutex sync.Mutex
+	cache      map[string]*cacheEntry
 }
 
+// Make sure that Client implements all service interfaces.
+var _ veap.Service = (*Client)(nil)
+var _ veap.ContextService = (*Client)(nil)
+var _ veap.MetaService = (*Client)(nil)
+var _ veap.ContextMetaService = (*Client)(nil)
+var _ veap.ExtendedExgDataService = (*Client)(nil)
+var _ veap.ExtendedQueryService = (*Client)(nil)
+var _ veap.StreamingQueryService = (*Client)(nil)
+var _ veap.AggregatingHistoryReader = (*Client)(nil)
+
 // Init initializes the Client. This function must be called before use.
 func (c *Client) Init() {
 	if c.ResponseSizeLimit == 0 {
@@ -55,22 +94,66 @@ func (c *Client) Init() {
 	if c.Log == nil {
 		c.Log = logging.Get("veap-client")
 	}
+	if c.CacheSize == 0 {
+		c.CacheSize = defaultCacheSize
+	}
 }
 
 // ReadPV reads the process value of a data point. The path must not end with /~pv.
 // VEAP-Protocol: HTTP-GET on PV (.../~pv)
 func (c *Client) ReadPV(path string) (veap.PV, veap.Error) {
+	return c.ReadPVContext(context.Background(), path)
+}
+
+// ReadPVContext implements veap.ContextService.
+func (c *Client) ReadPVContext(ctx context.Context, path string) (veap.PV, veap.Error) {
+	pv, _, err := c.ReadPVETag(ctx, path)
+	return pv, err
+}
+
+// ReadPVETag reads the process value of a data point and additionally returns
+// its entity tag. The entity tag can be used with WithIfMatch for a
+// conditional write.
+func (c *Client) ReadPVETag(ctx context.Context, path string) (veap.PV, string, veap.Error) {
+	respBytes, etag, err := c.getCached(ctx, c.URL+path+"/"+veap.PVMarker)
+	if err != nil {
+		return veap.PV{}, "", err
+	}
+	pv, err2 := encoding.BytesToPV(respBytes, false /* no fuzzy parsing */)
+	if err2 != nil {
+		return veap.PV{}, "", veap.NewErrorf(veap.StatusClientError, "Conversion of JSON to PV failed: %v", err2)
+	}
+	return pv, etag, nil
+}
+
+// WaitPV waits until the timestamp of the process value is newer than since
+// or the timeout expires. Then the current process value is returned. If the
+// timeout expired, its timestamp is not newer than since. Timestamps are
+// compared with millisecond precision. VEAP-Protocol extension: HTTP-GET on PV
+// (.../~pv?since=<ms>&timeout=<ms>)
+func (c *Client) WaitPV(path string, since time.Time, timeout time.Duration) (veap.PV, veap.Error) {
+	return c.WaitPVContext(context.Background(), path, since, timeout)
+}
+
+// WaitPVContext is like WaitPV with a context.
+func (c *Client) WaitPVContext(ctx context.Context, path string, since time.Time, timeout time.Duration) (veap.PV, veap.Error) {
+	qvs := url.Values{}
+	qvs.Set("since", strconv.FormatInt(since.UnixNano()/1000000, 10))
+	qvs.Set("timeout", strconv.FormatInt(int64(timeout/time.Millisecond), 10))
+	return c.getPV(ctx, c.URL+path+"/"+veap.PVMarker+"?"+qvs.Encode())
+}
+
+func (c *Client) getPV(ctx context.Context, url string) (veap.PV, veap.Error) {
 	// do request
-	url := c.URL + path + "/" + veap.PVMarker
 	c.Log.Debugf("Sending HTTP-GET request to %s", url)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return veap.PV{}, veap.NewErrorf(veap.StatusClientError, "Creating HTTP-GET request failed: %v", err)
 	}
 	if c.User != "" || c.Password != "" {
 		req.SetBasicAuth(c.User, c.Password)
 	}
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return veap.PV{}, veap.NewErrorf(veap.StatusClientError, "HTTP-GET on %s failed: %v", url, err)
 	}
@@ -100,6 +183,11 @@ func (c *Client) ReadPV(path string) (veap.PV, veap.Error) {
 // WritePV sets the process value of a data point. VEAP-Protocol: HTTP-PUT
 // on PV (.../~pv)
 func (c *Client) WritePV(path string, pv veap.PV) veap.Error {
+	return c.WritePVContext(context.Background(), path, pv)
+}
+
+// WritePVContext implements veap.ContextService.
+func (c *Client) WritePVContext(ctx context.Context, path string, pv veap.PV) veap.Error {
 	// convert PV to JSON
 	url := c.URL + path + "/" + veap.PVMarker
 	c.Log.Debugf("Sending HTTP-PUT request to %s", url)
@@ -115,14 +203,15 @@ func (c *Client) WritePV(path string, pv veap.PV) veap.Error {
 
 	// do request
 	buf := bytes.NewBuffer(reqBytes)
-	req, err := http.NewRequest(http.MethodPut, url, buf)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, buf)
 	if err != nil {
 		return veap.NewErrorf(veap.StatusClientError, "Creating HTTP-PUT request failed: %v", err)
 	}
 	if c.User != "" || c.Password != "" {
 		req.SetBasicAuth(c.User, c.Password)
 	}
-	resp, err := c.Client.Do(req)
+	setIfMatch(ctx, req)
+	resp, err := c.do(req)
 	if err != nil {
 		return veap.NewErrorf(veap.StatusClientError, "HTTP-PUT request failed: %v", err)
 	}
@@ -141,36 +230,75 @@ func (c *Client) WritePV(path string, pv veap.PV) veap.Error {
 // returned entries must be in ascending order. VEAP-Protocol: HTTP-GET on
 // history (.../~hist)
 func (c *Client) ReadHistory(path string, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	return c.ReadHistoryContext(context.Background(), path, begin, end, limit)
+}
+
+// ReadHistoryContext implements veap.ContextService.
+func (c *Client) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	w, err := c.readHistory(ctx, path, histParams(begin, end, limit))
+	if err != nil {
+		return nil, err
+	}
+	return wireToHist(w)
+}
+
+// ReadAggregatedHistory implements veap.AggregatingHistoryReader. If the
+// VEAP server does not support aggregation, the raw history is read and
+// aggregated by the client.
+func (c *Client) ReadAggregatedHistory(ctx context.Context, path string, begin time.Time, end time.Time, aggr veap.Aggregation, limit int64) ([]veap.PV, veap.Error) {
+	if err := aggr.Validate(); err != nil {
+		return nil, err
+	}
+	params := histParams(begin, end, limit)
+	params.Set("aggr", string(aggr.Func))
+	params.Set("interval", strconv.FormatInt(int64(aggr.Interval/time.Millisecond), 10))
+	w, err := c.readHistory(ctx, path, params)
+	if err != nil {
+		return nil, err
+	}
+	if w.Aggregate != string(aggr.Func) {
+		// server ignored the aggregation
+		c.Log.Debugf("Aggregation not supported by server, aggregating history of %s locally", path)
+		return veap.AggregateRawHistory(ctx, c, path, begin, end, aggr, limit, c.HistoryChunkSize)
+	}
+	return wireToHist(w)
+}
+
+func histParams(begin time.Time, end time.Time, limit int64) url.Values {
 	// move timestamps to next millisecond
 	begin = begin.Add(999999 * time.Nanosecond).Truncate(time.Millisecond)
 	end = end.Add(999999 * time.Nanosecond).Truncate(time.Millisecond)
+	params := url.Values{}
+	params.Set("begin", strconv.FormatInt(begin.UnixNano()/1000000, 10))
+	params.Set("end", strconv.FormatInt(end.UnixNano()/1000000, 10))
+	params.Set("limit", strconv.FormatInt(limit, 10))
+	return params
+}
 
+func (c *Client) readHistory(ctx context.Context, path string, params url.Values) (encoding.WireHist, veap.Error) {
 	// build URL
-	beginParam := strconv.FormatInt(begin.UnixNano()/1000000, 10)
-	endParam := strconv.FormatInt(end.UnixNano()/1000000, 10)
-	limitParam := strconv.FormatInt(limit, 10)
-	url := c.URL + path + "/" + veap.HistMarker + "?begin=" + beginParam + "&end=" + endParam + "&limit=" + limitParam
+	url := c.URL + path + "/" + veap.HistMarker + "?" + params.Encode()
 	c.Log.Debugf("Sending HTTP-GET request to %s", url)
 
 	// do request
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, veap.NewErrorf(veap.StatusClientError, "Creating HTTP-GET request failed: %v", err)
+		return encoding.WireHist{}, veap.NewErrorf(veap.StatusClientError, "Creating HTTP-GET request failed: %v", err)
 	}
 	if c.User != "" || c.Password != "" {
 		req.SetBasicAuth(c.User, c.Password)
 	}
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, veap.NewErrorf(veap.StatusClientError, "HTTP-GET on %s failed: %v", url, err)
+		return encoding.WireHist{}, veap.NewErrorf(veap.StatusClientError, "HTTP-GET on %s failed: %v", url, err)
 	}
 	defer resp.Body.Close()
 	respBytes, err := c.readLimited(resp.Body)
 	if err != nil {
-		return nil, veap.NewError(veap.StatusClientError, err)
+		return encoding.WireHist{}, veap.NewError(veap.StatusClientError, err)
 	}
 	if resp.StatusCode != veap.StatusOK {
-		return nil, veap.NewErrorf(resp.StatusCode, "Received HTTP status: %d (%s)",
+		return encoding.WireHist{}, veap.NewErrorf(resp.StatusCode, "Received HTTP status: %d (%s)",
 			resp.StatusCode, string(respBytes))
 	}
 
@@ -183,8 +311,12 @@ func (c *Client) ReadHistory(path string, begin time.Time, end time.Time, limit
 	var w encoding.WireHist
 	err = json.Unmarshal(respBytes, &w)
 	if err != nil {
-		return nil, veap.NewErrorf(veap.StatusClientError, "Conversion of JSON to history failed: %v", err)
+		return encoding.WireHist{}, veap.NewErrorf(veap.StatusClientError, "Conversion of JSON to history failed: %v", err)
 	}
+	return w, nil
+}
+
+func wireToHist(w encoding.WireHist) ([]veap.PV, veap.Error) {
 	hist, err := encoding.WireToHist(w)
 	if err != nil {
 		return nil, veap.NewErrorf(veap.StatusClientError, "%v", err)
@@ -196,6 +328,11 @@ func (c *Client) ReadHistory(path string, begin time.Time, end time.Time, limit
 // range goes from the minimum timestamp to the maximum timestamp.
 // VEAP-Protocol: HTTP-PUT on history (.../~hist)
 func (c *Client) WriteHistory(path string, timeSeries []veap.PV) veap.Error {
+	return c.WriteHistoryContext(context.Background(), path, timeSeries)
+}
+
+// WriteHistoryContext implements veap.ContextService.
+func (c *Client) WriteHistoryContext(ctx context.Context, path string, timeSeries []veap.PV) veap.Error {
 	// convert history to JSON
 	url := c.URL + path + "/" + veap.HistMarker
 	c.Log.Debugf("Sending HTTP-PUT request to %s", url)
@@ -210,15 +347,21 @@ func (c *Client) WriteHistory(path string, timeSeries []veap.PV) veap.Error {
 	}
 
 	// do request
-	buf := bytes.NewBuffer(reqBytes)
-	req, err := http.NewRequest(http.MethodPut, url, buf)
+	body, coding, err := c.requestBody(reqBytes)
+	if err != nil {
+		return veap.NewErrorf(veap.StatusClientError, "Compression of request failed: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, body)
 	if err != nil {
 		return veap.NewErrorf(veap.StatusClientError, "Creating HTTP-PUT request failed: %v", err)
 	}
+	if coding != "" {
+		req.Header.Set("Content-Encoding", coding)
+	}
 	if c.User != "" || c.Password != "" {
 		req.SetBasicAuth(c.User, c.Password)
 	}
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return veap.NewErrorf(veap.StatusClientError, "HTTP-PUT request failed: %v", err)
 	}
@@ -237,40 +380,29 @@ func (c *Client) WriteHistory(path string, timeSeries []veap.PV) veap.Error {
 // Attribute values must be supported by package json. VEAP-Protocol:
 // HTTP-GET on object
 func (c *Client) ReadProperties(path string) (veap.AttrValues, []veap.Link, veap.Error) {
-	// do request
-	url := c.URL + path
-	c.Log.Debugf("Sending HTTP-GET request to %s", url)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, nil, veap.NewErrorf(veap.StatusClientError, "Creating HTTP-GET request failed: %v", err)
-	}
-	if c.User != "" || c.Password != "" {
-		req.SetBasicAuth(c.User, c.Password)
-	}
-	resp, err := c.Client.Do(req)
-	if err != nil {
-		return nil, nil, veap.NewErrorf(veap.StatusClientError, "HTTP-GET on %s failed: %v", url, err)
-	}
-	defer resp.Body.Close()
-	respBytes, err := c.readLimited(resp.Body)
-	if err != nil {
-		return nil, nil, veap.NewError(veap.StatusClientError, err)
-	}
-	if resp.StatusCode != veap.StatusOK {
-		return nil, nil, veap.NewErrorf(resp.StatusCode, "Received HTTP status: %d (%s)",
-			resp.StatusCode, string(respBytes))
-	}
+	return c.ReadPropertiesContext(context.Background(), path)
+}
 
-	// log response
-	if c.Log.TraceEnabled() {
-		c.Log.Tracef("Response body: %s", string(respBytes))
+// ReadPropertiesContext implements veap.ContextService.
+func (c *Client) ReadPropertiesContext(ctx context.Context, path string) (veap.AttrValues, []veap.Link, veap.Error) {
+	attr, links, _, err := c.ReadPropertiesETag(ctx, path)
+	return attr, links, err
+}
+
+// ReadPropertiesETag returns the attributes and links of a VEAP object and
+// additionally the entity tag of the properties. The entity tag can be used
+// with WithIfMatch for a conditional write.
+func (c *Client) ReadPropertiesETag(ctx context.Context, path string) (veap.AttrValues, []veap.Link, string, veap.Error) {
+	respBytes, etag, svcErr := c.getCached(ctx, c.URL+path)
+	if svcErr != nil {
+		return nil, nil, "", svcErr
 	}
 
 	// unmarshal JSON
 	var attr map[string]interface{}
-	err = json.Unmarshal(respBytes, &attr)
+	err := json.Unmarshal(respBytes, &attr)
 	if err != nil {
-		return nil, nil, veap.NewErrorf(veap.StatusClientError, "Invalid JSON object: %v", err)
+		return nil, nil, "", veap.NewErrorf(veap.StatusClientError, "Invalid JSON object: %v", err)
 	}
 
 	// extract ~links
@@ -286,24 +418,31 @@ func (c *Client) ReadProperties(path string) (veap.AttrValues, []veap.Link, veap
 		})
 	}
 	if query.Err() != nil {
-		return nil, nil, veap.NewErrorf(veap.StatusClientError, "Invalid ~links property: %v", query.Err())
+		return nil, nil, "", veap.NewErrorf(veap.StatusClientError, "Invalid ~links property: %v", query.Err())
 	}
 
 	// remove ~links to get remaining attributes
 	delete(attr, veap.LinksMarker)
 
-	return attr, links, nil
+	return attr, links, etag, nil
 }
 
 // WriteProperties updates properties of an existing VEAP object. If no
-// object exists at the specified path, a new object is created. Links are
-// intentionally not handled. (A concept is still pending.) Attributes were
-// unmarshalled with package json. VEAP-Protocol: HTTP-PUT on object
+// object exists at the specified path, a new object is created. Attributes
+// must be supported by package json. Links are changed with a
+// veap.LinkUpdate in the attribute veap.LinksMarker. Absolute link targets
+// must include the URL prefix of the server (q.v. ReadProperties).
+// VEAP-Protocol: HTTP-PUT on object
 func (c *Client) WriteProperties(path string, attributes veap.AttrValues) (bool, veap.Error) {
+	return c.WritePropertiesContext(context.Background(), path, attributes)
+}
+
+// WritePropertiesContext implements veap.ContextService.
+func (c *Client) WritePropertiesContext(ctx context.Context, path string, attributes veap.AttrValues) (bool, veap.Error) {
 	// convert attributes to JSON
 	url := c.URL + path
 	c.Log.Debugf("Sending HTTP-PUT request to %s", url)
-	reqBytes, err := json.Marshal(attributes)
+	reqBytes, err := json.Marshal(encoding.AttributesToWire(attributes))
 	if err != nil {
 		return false, veap.NewErrorf(veap.StatusBadRequest, "Conversion of attributes to JSON failed: %v", err)
 	}
@@ -315,14 +454,15 @@ func (c *Client) WriteProperties(path string, attributes veap.AttrValues) (bool,
 
 	// do request
 	reqReader := bytes.NewBuffer(reqBytes)
-	req, err := http.NewRequest(http.MethodPut, url, reqReader)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, reqReader)
 	if err != nil {
 		return false, veap.NewErrorf(veap.StatusClientError, "Creating HTTP-PUT request failed: %v", err)
 	}
 	if c.User != "" || c.Password != "" {
 		req.SetBasicAuth(c.User, c.Password)
 	}
-	resp, err := c.Client.Do(req)
+	setIfMatch(ctx, req)
+	resp, err := c.do(req)
 	if err != nil {
 		return false, veap.NewErrorf(veap.StatusClientError, "HTTP-PUT request failed: %v", err)
 	}
@@ -339,18 +479,23 @@ func (c *Client) WriteProperties(path string, attributes veap.AttrValues) (bool,
 
 // Delete destroys a VEAP object. VEAP-Protocol: HTTP-DELETE on object
 func (c *Client) Delete(path string) veap.Error {
+	return c.DeleteContext(context.Background(), path)
+}
+
+// DeleteContext implements veap.ContextService.
+func (c *Client) DeleteContext(ctx context.Context, path string) veap.Error {
 	// do request
 	url := c.URL + path
 	c.Log.Debugf("Sending HTTP-DELETE request to %s", url)
 	reqReader := &bytes.Buffer{}
-	req, err := http.NewRequest(http.MethodDelete, url, reqReader)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, reqReader)
 	if err != nil {
 		return veap.NewErrorf(veap.StatusClientError, "Creating HTTP-DELETE request failed: %v", err)
 	}
 	if c.User != "" || c.Password != "" {
 		req.SetBasicAuth(c.User, c.Password)
 	}
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return veap.NewErrorf(veap.StatusClientError, "HTTP-DELETE request failed: %v", err)
 	}
@@ -370,15 +515,41 @@ func (c *Client) Delete(path string) veap.Error {
 // optimized requests to the target system. The services are executed in the
 // following order: WritePV, ReadPV.
 func (c *Client) ExgData(writePVs []veap.WritePVParam, readPaths []string) ([]veap.Error, []veap.ReadPVResult, veap.Error) {
+	return c.ExgDataContext(context.Background(), writePVs, readPaths)
+}
+
+// ExgDataContext implements veap.ContextMetaService.
+func (c *Client) ExgDataContext(ctx context.Context, writePVs []veap.WritePVParam, readPaths []string) ([]veap.Error, []veap.ReadPVResult, veap.Error) {
+	results, err := c.ExtendedExgData(ctx, veap.ExgDataParams{WritePVs: writePVs, ReadPaths: readPaths})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results.WriteErrors, results.ReadResults, nil
+}
+
+// ExtendedExgData implements veap.ExtendedExgDataService. The VEAP server must
+// support the sections for properties and histories, if they are used.
+func (c *Client) ExtendedExgData(ctx context.Context, params veap.ExgDataParams) (veap.ExgDataResults, veap.Error) {
+	// move history timestamps to next millisecond
+	if len(params.ReadHistory) > 0 {
+		hps := make([]veap.ReadHistoryParam, len(params.ReadHistory))
+		for i, p := range params.ReadHistory {
+			p.Begin = p.Begin.Add(999999 * time.Nanosecond).Truncate(time.Millisecond)
+			p.End = p.End.Add(999999 * time.Nanosecond).Truncate(time.Millisecond)
+			hps[i] = p
+		}
+		params.ReadHistory = hps
+	}
+
 	// build URL
 	url := c.URL + "/" + veap.ExgDataMarker
 	c.Log.Debugf("Sending HTTP-PUT request to %s", url)
 
 	// request body
-	wireParams := encoding.ExgDataParamsToWire(writePVs, readPaths)
+	wireParams := encoding.ExtendedExgDataParamsToWire(params)
 	reqBytes, err := json.Marshal(wireParams)
 	if err != nil {
-		return nil, nil, veap.NewErrorf(veap.StatusBadRequest, "Conversion of exgdata params to JSON failed: %v", err)
+		return veap.ExgDataResults{}, veap.NewErrorf(veap.StatusBadRequest, "Conversion of exgdata params to JSON failed: %v", err)
 	}
 	if c.Log.TraceEnabled() {
 		c.Log.Tracef("Request body: %s", string(reqBytes))
@@ -386,26 +557,26 @@ func (c *Client) ExgData(writePVs []veap.WritePVParam, readPaths []string) ([]ve
 
 	// do request
 	reqReader := bytes.NewBuffer(reqBytes)
-	req, err := http.NewRequest(http.MethodPut, url, reqReader)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, reqReader)
 	if err != nil {
-		return nil, nil, veap.NewErrorf(veap.StatusClientError, "Creating HTTP-PUT request failed: %v", err)
+		return veap.ExgDataResults{}, veap.NewErrorf(veap.StatusClientError, "Creating HTTP-PUT request failed: %v", err)
 	}
 	if c.User != "" || c.Password != "" {
 		req.SetBasicAuth(c.User, c.Password)
 	}
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, nil, veap.NewErrorf(veap.StatusClientError, "HTTP-PUT request failed: %v", err)
+		return veap.ExgDataResults{}, veap.NewErrorf(veap.StatusClientError, "HTTP-PUT request failed: %v", err)
 	}
 	defer resp.Body.Close()
 
 	// read response
 	respBytes, err := c.readLimited(resp.Body)
 	if err != nil {
-		return nil, nil, veap.NewError(veap.StatusClientError, err)
+		return veap.ExgDataResults{}, veap.NewError(veap.StatusClientError, err)
 	}
 	if resp.StatusCode != veap.StatusOK {
-		return nil, nil, veap.NewErrorf(resp.StatusCode, "Received HTTP status: %d (%s)",
+		return veap.ExgDataResults{}, veap.NewErrorf(resp.StatusCode, "Received HTTP status: %d (%s)",
 			resp.StatusCode, string(respBytes))
 	}
 	if c.Log.TraceEnabled() {
@@ -416,37 +587,47 @@ func (c *Client) ExgData(writePVs []veap.WritePVParam, readPaths []string) ([]ve
 	var wireResult encoding.WireExgDataResults
 	err = json.Unmarshal(respBytes, &wireResult)
 	if err != nil {
-		return nil, nil, veap.NewErrorf(veap.StatusClientError, "Invalid JSON object: %v", err)
+		return veap.ExgDataResults{}, veap.NewErrorf(veap.StatusClientError, "Invalid JSON object: %v", err)
 	}
 
 	// convert response
 	if len(wireResult.WriteErrors) != len(wireParams.WritePVs) ||
-		len(wireResult.ReadResults) != len(wireParams.ReadPaths) {
-		return nil, nil, veap.NewErrorf(veap.StatusClientError, "Exgdata response does not match request")
+		len(wireResult.ReadResults) != len(wireParams.ReadPaths) ||
+		len(wireResult.WritePropertiesResults) != len(wireParams.WriteProperties) ||
+		len(wireResult.ReadPropertiesResults) != len(wireParams.ReadProperties) ||
+		len(wireResult.ReadHistoryResults) != len(wireParams.ReadHistory) {
+		return veap.ExgDataResults{}, veap.NewErrorf(veap.StatusClientError, "Exgdata response does not match request")
 	}
-	writeErrors, readResults := encoding.WireToExgDataResults(&wireResult)
-	return writeErrors, readResults, nil
+	results, err := encoding.WireToExtendedExgDataResults(&wireResult)
+	if err != nil {
+		return veap.ExgDataResults{}, veap.NewErrorf(veap.StatusClientError, "Malformed ExgData response: %v", err)
+	}
+	return results, nil
 }
 
 // Query searches for VEAP objects that match any of the specified path masks.
 func (c *Client) Query(pathPatterns []string) ([]veap.QueryResult, veap.Error) {
-	// build url
-	values := url.Values{}
-	for _, value := range pathPatterns {
-		values.Add(veap.PathMarker, value)
-	}
-	url := c.URL + "/" + veap.QueryMarker + "?" + values.Encode()
+	return c.QueryContext(context.Background(), pathPatterns)
+}
+
+// QueryContext implements veap.ContextMetaService.
+func (c *Client) QueryContext(ctx context.Context, pathPatterns []string) ([]veap.QueryResult, veap.Error) {
+	return c.ExtendedQuery(ctx, veap.QueryParams{PathPatterns: pathPatterns})
+}
 
+// ExtendedQuery implements veap.ExtendedQueryService.
+func (c *Client) ExtendedQuery(ctx context.Context, params veap.QueryParams) ([]veap.QueryResult, veap.Error) {
 	// do request
+	url := c.queryURL(params)
 	c.Log.Debugf("Sending HTTP-GET request to %s", url)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, veap.NewErrorf(veap.StatusClientError, "Creating HTTP-GET request failed: %v", err)
 	}
 	if c.User != "" || c.Password != "" {
 		req.SetBasicAuth(c.User, c.Password)
 	}
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, veap.NewErrorf(veap.StatusClientError, "HTTP-GET on %s failed: %v", url, err)
 	}
@@ -466,39 +647,118 @@ func (c *Client) Query(pathPatterns []string) ([]veap.QueryResult, veap.Error) {
 	}
 
 	// unmarshal JSON
-	var rawResult interface{}
+	var rawResult []interface{}
 	err = json.Unmarshal(respBytes, &rawResult)
 	if err != nil {
 		return nil, veap.NewErrorf(veap.StatusClientError, "Invalid JSON object: %v", err)
 	}
 
 	// convert result
-	inquirer := any.Q(rawResult)
-	rawItems := inquirer.Slice()
-	result := make([]veap.QueryResult, len(rawItems))
-	for ridx, rawItem := range rawItems {
-		item := rawItem.Map()
-		// extract ~path
-		result[ridx].Path = item.Key(veap.PathMarker).String()
-		// extract ~links
-		rawLinks := item.TryKey(veap.LinksMarker).Slice()
-		result[ridx].Links = make([]veap.Link, len(rawLinks))
-		for lidx, rawLink := range rawLinks {
-			link := rawLink.Map()
-			result[ridx].Links[lidx].Target = link.Key("href").String()
-			result[ridx].Links[lidx].Role = link.TryKey("rel").String()
-			result[ridx].Links[lidx].Title = link.TryKey("title").String()
+	result := make([]veap.QueryResult, len(rawResult))
+	for ridx, rawItem := range rawResult {
+		result[ridx], err = wireToQueryResult(rawItem)
+		if err != nil {
+			return nil, veap.NewErrorf(veap.StatusClientError, "Malformed JSON object: %v", err)
 		}
-		// extract attributes
-		attrs := item.Unwrap()
-		// reuse existing map
-		delete(attrs, veap.PathMarker)
-		delete(attrs, veap.LinksMarker)
-		result[ridx].Attributes = attrs
 	}
-	if inquirer.Err() != nil {
-		return nil, veap.NewErrorf(veap.StatusClientError, "Malformed JSON object: %v", inquirer.Err())
+	return result, nil
+}
+
+// QueryFunc implements veap.StreamingQueryService. The results are decoded
+// one by one from the response. ResponseSizeLimit is not applied.
+func (c *Client) QueryFunc(ctx context.Context, params veap.QueryParams, handle func(item veap.QueryResult) veap.Error) veap.Error {
+	// do request
+	url := c.queryURL(params)
+	c.Log.Debugf("Sending HTTP-GET request to %s", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return veap.NewErrorf(veap.StatusClientError, "Creating HTTP-GET request failed: %v", err)
+	}
+	if c.User != "" || c.Password != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return veap.NewErrorf(veap.StatusClientError, "HTTP-GET on %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != veap.StatusOK {
+		respBytes, _ := c.readLimited(resp.Body)
+		return veap.NewErrorf(resp.StatusCode, "Received HTTP status: %d (%s)",
+			resp.StatusCode, string(respBytes))
+	}
+
+	// decode JSON array item by item
+	dec := json.NewDecoder(resp.Body)
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		return veap.NewErrorf(veap.StatusClientError, "Invalid JSON array: %v", err)
+	}
+	for dec.More() {
+		var rawItem interface{}
+		if err := dec.Decode(&rawItem); err != nil {
+			return veap.NewErrorf(veap.StatusClientError, "Invalid JSON object: %v", err)
+		}
+		if c.Log.TraceEnabled() {
+			c.Log.Tracef("Response item: %v", rawItem)
+		}
+		item, err := wireToQueryResult(rawItem)
+		if err != nil {
+			return veap.NewErrorf(veap.StatusClientError, "Malformed JSON object: %v", err)
+		}
+		if err := handle(item); err != nil {
+			return err
+		}
 	}
+	if _, err := dec.Token(); err != nil {
+		return veap.NewErrorf(veap.StatusClientError, "Invalid JSON array: %v", err)
+	}
+	return nil
+}
+
+func (c *Client) queryURL(params veap.QueryParams) string {
+	values := url.Values{}
+	for _, value := range params.PathPatterns {
+		values.Add(veap.PathMarker, value)
+	}
+	for _, filter := range params.Filters {
+		values.Add(veap.FilterMarker, filter.String())
+	}
+	if params.MaxDepth > 0 {
+		values.Set(veap.MaxDepthMarker, strconv.Itoa(params.MaxDepth))
+	}
+	if params.Offset > 0 {
+		values.Set(veap.OffsetMarker, strconv.Itoa(params.Offset))
+	}
+	if params.Limit > 0 {
+		values.Set(veap.LimitMarker, strconv.Itoa(params.Limit))
+	}
+	return c.URL + "/" + veap.QueryMarker + "?" + values.Encode()
+}
+
+func wireToQueryResult(rawItem interface{}) (veap.QueryResult, error) {
+	var result veap.QueryResult
+	inquirer := any.Q(rawItem)
+	item := inquirer.Map()
+	// extract ~path
+	result.Path = item.Key(veap.PathMarker).String()
+	// extract ~links
+	rawLinks := item.TryKey(veap.LinksMarker).Slice()
+	result.Links = make([]veap.Link, len(rawLinks))
+	for lidx, rawLink := range rawLinks {
+		link := rawLink.Map()
+		result.Links[lidx].Target = link.Key("href").String()
+		result.Links[lidx].Role = link.TryKey("rel").String()
+		result.Links[lidx].Title = link.TryKey("title").String()
+	}
+	if inquirer.Err() != nil {
+		return veap.QueryResult{}, inquirer.Err()
+	}
+	// extract attributes
+	attrs := item.Unwrap()
+	// reuse existing map
+	delete(attrs, veap.PathMarker)
+	delete(attrs, veap.LinksMarker)
+	result.Attributes = attrs
 	return result, nil
 }
 
@@ -1,9 +1,12 @@
 package client
 
 import (
+	"context"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -96,6 +99,110 @@ func TestExgData(t *testing.T) {
 	}
 }
 
+func TestExtendedExgData(t *testing.T) {
+	// create simple test server
+	props := map[string]veap.AttrValues{
+		"/a": {"title": "A"},
+	}
+	hist := []veap.PV{
+		{Time: time.Unix(1, 0), Value: 1.0},
+		{Time: time.Unix(2, 0), Value: 2.0},
+		{Time: time.Unix(3, 0), Value: 3.0},
+	}
+	svc := veap.FuncService{
+		ReadPVFunc: func(path string) (veap.PV, veap.Error) {
+			return veap.PV{Time: time.Unix(1, 0), Value: props[path]["title"]}, nil
+		},
+		ReadPropertiesFunc: func(path string) (veap.AttrValues, []veap.Link, veap.Error) {
+			attr, ok := props[path]
+			if !ok {
+				return nil, nil, veap.NewErrorf(veap.StatusNotFound, "Not found: %s", path)
+			}
+			return attr, []veap.Link{{Role: "collection", Target: ".."}}, nil
+		},
+		WritePropertiesFunc: func(path string, attributes veap.AttrValues) (bool, veap.Error) {
+			_, exists := props[path]
+			props[path] = attributes
+			return !exists, nil
+		},
+		ReadHistoryFunc: func(path string, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+			if path != "/a" {
+				return nil, veap.NewErrorf(veap.StatusNotFound, "Not found: %s", path)
+			}
+			var r []veap.PV
+			for _, pv := range hist {
+				if !pv.Time.Before(begin) && !pv.Time.After(end) && int64(len(r)) < limit {
+					r = append(r, pv)
+				}
+			}
+			return r, nil
+		},
+	}
+	msvc := &veap.BasicMetaService{Service: &svc}
+	h := &server.Handler{Service: msvc}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// create client
+	cln := &Client{URL: srv.URL}
+	cln.Init()
+
+	res, err := cln.ExtendedExgData(context.Background(), veap.ExgDataParams{
+		WriteProperties: []veap.WritePropertiesParam{
+			{Path: "/b", Attributes: veap.AttrValues{"title": "B"}},
+		},
+		ReadPaths:      []string{"/b"},
+		ReadProperties: []string{"/a", "/b", "/x"},
+		ReadHistory: []veap.ReadHistoryParam{
+			{Path: "/a", Begin: time.Unix(2, 0), End: time.Unix(10, 0)},
+			{Path: "/a", Begin: time.Unix(0, 0), End: time.Unix(10, 0), Limit: 1},
+			{Path: "/x", Begin: time.Unix(0, 0), End: time.Unix(10, 0)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.WriteErrors) != 0 || len(res.WritePropertiesResults) != 1 || len(res.ReadResults) != 1 ||
+		len(res.ReadPropertiesResults) != 3 || len(res.ReadHistoryResults) != 3 {
+		t.Fatal(res)
+	}
+
+	// properties
+	if r := res.WritePropertiesResults[0]; r.Error != nil || !r.Created {
+		t.Error(r)
+	}
+	if r := res.ReadResults[0]; r.Error != nil || r.PV.Value != "B" {
+		t.Error(r)
+	}
+	if r := res.ReadPropertiesResults[0]; r.Error != nil || r.Attributes["title"] != "A" ||
+		!reflect.DeepEqual(r.Links, []veap.Link{{Role: "collection", Target: ".."}}) {
+		t.Error(r)
+	}
+	if r := res.ReadPropertiesResults[1]; r.Error != nil || r.Attributes["title"] != "B" {
+		t.Error(r)
+	}
+	if r := res.ReadPropertiesResults[2]; r.Error == nil || r.Error.Code() != veap.StatusNotFound {
+		t.Error(r)
+	}
+
+	// histories
+	if r := res.ReadHistoryResults[0]; r.Error != nil || len(r.History) != 2 || !r.History[0].Equal(hist[1]) {
+		t.Error(r)
+	}
+	if r := res.ReadHistoryResults[1]; r.Error != nil || len(r.History) != 1 || !r.History[0].Equal(hist[0]) {
+		t.Error(r)
+	}
+	if r := res.ReadHistoryResults[2]; r.Error == nil || r.Error.Code() != veap.StatusNotFound {
+		t.Error(r)
+	}
+
+	// legacy payload
+	writeErrors, readResults, err := cln.ExgData(nil, []string{"/a"})
+	if err != nil || len(writeErrors) != 0 || len(readResults) != 1 || readResults[0].PV.Value != "A" {
+		t.Error(writeErrors, readResults, err)
+	}
+}
+
 func buildTree(parent model.ChangeableCollection, depth int) {
 	if depth == 0 {
 		return
@@ -179,3 +286,488 @@ func TestQuery(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestContext(t *testing.T) {
+	// create slow test server
+	svc := veap.FuncService{
+		ReadPVFunc: func(path string) (veap.PV, veap.Error) {
+			time.Sleep(200 * time.Millisecond)
+			return veap.PV{Time: time.Unix(1, 0), Value: 1.0}, nil
+		},
+	}
+	h := &server.Handler{Service: &svc}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// create client
+	cln := &Client{URL: srv.URL}
+	cln.Init()
+
+	// deadline exceeded
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := cln.ReadPVContext(ctx, "/a")
+	if err == nil || err.Code() != veap.StatusClientError {
+		t.Fatal(err)
+	}
+
+	// no deadline
+	pv, err := cln.ReadPV("/a")
+	if err != nil || pv.Value != 1.0 {
+		t.Fatal(pv, err)
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	// create simple test server
+	root := model.NewRoot(&model.RootCfg{})
+	buildTree(root, 2)
+	msvc := &veap.BasicMetaService{Service: &model.Service{Root: root}}
+	h := &server.Handler{Service: msvc}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// create client
+	cln := &Client{URL: srv.URL}
+	cln.Init()
+
+	res, err := cln.ExtendedQuery(context.Background(), veap.QueryParams{
+		PathPatterns: []string{"/*/*"},
+		Filters: []veap.Filter{
+			{Name: "title", Op: veap.FilterGlob, Value: "?98"},
+			{Name: veap.LinksMarker, Op: veap.FilterEqual, Value: "collection"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 {
+		t.Fatal(res)
+	}
+	for _, r := range res {
+		if r.Attributes["title"] != "b98" {
+			t.Error(r)
+		}
+	}
+
+	// invalid filter
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/~query?~path=/*&~filter=title~%3D[", nil)
+	resp, err2 := http.DefaultClient.Do(req)
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != veap.StatusBadRequest {
+		t.Error(resp.StatusCode)
+	}
+}
+
+func TestQueryPagination(t *testing.T) {
+	// create simple test server
+	root := model.NewRoot(&model.RootCfg{})
+	buildTree(root, 2)
+	msvc := &veap.BasicMetaService{Service: &model.Service{Root: root}}
+	h := &server.Handler{Service: msvc}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// create client
+	cln := &Client{URL: srv.URL}
+	cln.Init()
+
+	// all results
+	all, err := cln.ExtendedQuery(context.Background(), veap.QueryParams{PathPatterns: []string{"/*/*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 9 {
+		t.Fatal(all)
+	}
+
+	// page
+	page, err := cln.ExtendedQuery(context.Background(), veap.QueryParams{
+		PathPatterns: []string{"/*/*"},
+		Offset:       2,
+		Limit:        4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 4 {
+		t.Fatal(page)
+	}
+	for i, r := range page {
+		if r.Path != all[i+2].Path {
+			t.Error(i, r.Path)
+		}
+	}
+
+	// streamed results
+	var streamed []string
+	err = cln.QueryFunc(context.Background(), veap.QueryParams{PathPatterns: []string{"/*/*"}, Offset: 7},
+		func(item veap.QueryResult) veap.Error {
+			streamed = append(streamed, item.Path)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streamed) != 2 || streamed[0] != all[7].Path || streamed[1] != all[8].Path {
+		t.Error(streamed)
+	}
+
+	// abort by handler
+	var cnt int
+	err = cln.QueryFunc(context.Background(), veap.QueryParams{PathPatterns: []string{"/*/*"}},
+		func(item veap.QueryResult) veap.Error {
+			cnt++
+			return veap.NewErrorf(veap.StatusInternalServerError, "stop")
+		})
+	if err == nil || err.Code() != veap.StatusInternalServerError || cnt != 1 {
+		t.Error(err, cnt)
+	}
+}
+
+func TestReadAggregatedHistory(t *testing.T) {
+	var svc veap.MemoryService
+	if _, err := svc.WriteProperties("/a", veap.AttrValues{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.WriteHistory("/a", []veap.PV{
+		{Time: time.Unix(1, 0), Value: 1.0},
+		{Time: time.Unix(2, 0), Value: 3.0},
+		{Time: time.Unix(11, 0), Value: 5.0},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	aggr := veap.Aggregation{Func: veap.AggregateAvg, Interval: 10 * time.Second}
+	expected := []veap.PV{
+		{Time: time.Unix(0, 0), Value: 2.0},
+		{Time: time.Unix(10, 0), Value: 5.0},
+	}
+
+	// aggregation by server
+	var aggregated bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aggregated = r.URL.Query().Get("aggr") != ""
+		(&server.Handler{Service: &svc}).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	cln := Client{URL: srv.URL}
+	cln.Init()
+	hist, err := cln.ReadAggregatedHistory(context.Background(), "/a", time.Unix(0, 0), time.Unix(20, 0), aggr, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aggregated || !reflect.DeepEqual(hist, expected) {
+		t.Error(hist)
+	}
+
+	// fallback for servers without aggregation support
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		q.Del("aggr")
+		q.Del("interval")
+		r.URL.RawQuery = q.Encode()
+		(&server.Handler{Service: &svc}).ServeHTTP(w, r)
+	}))
+	defer srv2.Close()
+	cln2 := Client{URL: srv2.URL}
+	cln2.Init()
+	hist, err = cln2.ReadAggregatedHistory(context.Background(), "/a", time.Unix(0, 0), time.Unix(20, 0), aggr, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hist, expected) {
+		t.Error(hist)
+	}
+}
+
+func TestWriteLinks(t *testing.T) {
+	root := model.NewRoot(&model.RootCfg{})
+	model.NewDomain(&model.DomainCfg{Identifier: "room", Title: "Room", Collection: root})
+	model.NewLinkedDomain(&model.DomainCfg{Identifier: "d", Collection: root})
+	msvc := &veap.BasicMetaService{Service: &model.Service{Root: root}}
+	srv := httptest.NewServer(&server.Handler{Service: msvc, URLPrefix: "/veap"})
+	defer srv.Close()
+	cln := Client{URL: srv.URL + "/veap"}
+	cln.Init()
+
+	// links are changed
+	_, err := cln.WriteProperties("/d", veap.AttrValues{veap.LinksMarker: veap.LinkUpdate{
+		Add: []veap.Link{{Role: "room", Target: "/veap/room"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, links, err := cln.ReadProperties("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(links, []veap.Link{
+		{Role: "collection", Target: ".."},
+		{Role: "room", Target: "/veap/room", Title: "Room"},
+	}) {
+		t.Error(links)
+	}
+
+	// also with ExgData
+	results, err := cln.ExtendedExgData(context.Background(), veap.ExgDataParams{
+		WriteProperties: []veap.WritePropertiesParam{{Path: "/d", Attributes: veap.AttrValues{
+			veap.LinksMarker: &veap.LinkUpdate{Replace: map[string][]string{"room": {}}},
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.WritePropertiesResults[0].Error != nil {
+		t.Fatal(results.WritePropertiesResults[0].Error)
+	}
+	_, links, err = cln.ReadProperties("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 {
+		t.Error(links)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	var svc veap.MemoryService
+	if _, err := svc.WriteProperties("/a", veap.AttrValues{"title": "A"}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(&server.Handler{Service: &svc, URLPrefix: "/veap"})
+	defer srv.Close()
+	cln := Client{URL: srv.URL + "/veap"}
+	cln.Init()
+	ws, err := cln.DialWebSocket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// services of Client
+	pv := veap.PV{Time: time.Unix(1, 0), Value: 1.0}
+	if err := ws.WritePV("/a", pv); err != nil {
+		t.Fatal(err)
+	}
+	rpv, err := ws.ReadPV("/a")
+	if err != nil || !rpv.Equal(pv) {
+		t.Error(rpv, err)
+	}
+	attr, _, err := ws.ReadProperties("/a")
+	if err != nil || attr["title"] != "A" {
+		t.Error(attr, err)
+	}
+	if _, err := ws.ReadPV("/b"); err == nil || err.Code() != veap.StatusNotFound {
+		t.Error(err)
+	}
+	results, err := ws.Query([]string{"/veap/*"})
+	if err != nil || len(results) != 1 || results[0].Path != "/veap/a" {
+		t.Error(results, err)
+	}
+
+	// subscription
+	changes := make(chan veap.PV, 10)
+	id, err := ws.Subscribe([]string{"/a"}, func(path string, pv veap.PV) {
+		changes <- pv
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv = veap.PV{Time: time.Unix(2, 0), Value: 2.0}
+	svc.WritePV("/a", pv)
+	select {
+	case c := <-changes:
+		if !c.Equal(pv) {
+			t.Error(c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notification missing")
+	}
+	if err := ws.Unsubscribe(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Unsubscribe(id); err == nil || err.Code() != veap.StatusNotFound {
+		t.Error(err)
+	}
+	if _, err := ws.Subscribe([]string{}, func(string, veap.PV) {}); err == nil || err.Code() != veap.StatusBadRequest {
+		t.Error(err)
+	}
+
+	// closed connection
+	ws.Close()
+	if _, err := ws.ReadPV("/a"); err == nil || err.Code() != veap.StatusClientError {
+		t.Error(err)
+	}
+}
+
+func TestWaitPV(t *testing.T) {
+	var svc veap.MemoryService
+	if _, err := svc.WriteProperties("/a", veap.AttrValues{}); err != nil {
+		t.Fatal(err)
+	}
+	pv := veap.PV{Time: time.Unix(1, 0), Value: 1.0}
+	svc.WritePV("/a", pv)
+	srv := httptest.NewServer(&server.Handler{Service: &svc})
+	defer srv.Close()
+	cln := Client{URL: srv.URL}
+	cln.Init()
+
+	// timeout
+	rpv, err := cln.WaitPV("/a", pv.Time, 10*time.Millisecond)
+	if err != nil || !rpv.Equal(pv) {
+		t.Error(rpv, err)
+	}
+
+	// change
+	pv2 := veap.PV{Time: time.Unix(2, 0), Value: 2.0}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		svc.WritePV("/a", pv2)
+	}()
+	rpv, err = cln.WaitPV("/a", pv.Time, 5*time.Second)
+	if err != nil || !rpv.Equal(pv2) {
+		t.Error(rpv, err)
+	}
+
+	// unknown data point
+	if _, err := cln.WaitPV("/b", pv.Time, time.Second); err == nil || err.Code() != veap.StatusNotFound {
+		t.Error(err)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	var svc veap.MemoryService
+	if _, err := svc.WriteProperties("/a", veap.AttrValues{"title": "A"}); err != nil {
+		t.Fatal(err)
+	}
+	svc.WritePV("/a", veap.PV{Time: time.Unix(1, 0), Value: 1.0})
+	h := &server.Handler{Service: &svc}
+	var notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			notModified++
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	cln := Client{URL: srv.URL}
+	cln.Init()
+
+	// revalidation of cached responses
+	for i := 0; i < 2; i++ {
+		pv, err := cln.ReadPV("/a")
+		if err != nil || !pv.Equal(veap.PV{Time: time.Unix(1, 0), Value: 1.0}) {
+			t.Fatal(pv, err)
+		}
+		attrs, _, err := cln.ReadProperties("/a")
+		if err != nil || attrs["title"] != "A" {
+			t.Fatal(attrs, err)
+		}
+	}
+	if notModified != 2 {
+		t.Error(notModified)
+	}
+
+	// optimistic concurrency
+	_, etag, err := cln.ReadPVETag(context.Background(), "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithIfMatch(context.Background(), etag)
+	if err := cln.WritePVContext(ctx, "/a", veap.PV{Time: time.Unix(2, 0), Value: 2.0}); err != nil {
+		t.Error(err)
+	}
+	if err := cln.WritePVContext(ctx, "/a", veap.PV{Time: time.Unix(3, 0), Value: 3.0}); err == nil || err.Code() != veap.StatusPreconditionFailed {
+		t.Error(err)
+	}
+	pv, err := cln.ReadPV("/a")
+	if err != nil || !pv.Equal(veap.PV{Time: time.Unix(2, 0), Value: 2.0}) {
+		t.Error(pv, err)
+	}
+	_, _, etag, err = cln.ReadPropertiesETag(context.Background(), "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cln.WritePropertiesContext(WithIfMatch(context.Background(), etag), "/a", veap.AttrValues{"title": "B"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := cln.WritePropertiesContext(WithIfMatch(context.Background(), etag), "/a", veap.AttrValues{"title": "C"}); err == nil || err.Code() != veap.StatusPreconditionFailed {
+		t.Error(err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	root := model.NewRoot(&model.RootCfg{})
+	buildTree(root, 2)
+	var histOut []veap.PV
+	svc := &veap.BasicMetaService{Service: &model.Service{Root: root}}
+	fsvc := veap.FuncService{
+		ReadHistoryFunc: func(path string, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+			return histOut, nil
+		},
+		WriteHistoryFunc: func(path string, timeSeries []veap.PV) veap.Error {
+			histOut = timeSeries
+			return nil
+		},
+	}
+	hsvc := &server.Handler{Service: &fsvc}
+	hsrv := httptest.NewServer(hsvc)
+	defer hsrv.Close()
+	qsvc := &server.Handler{Service: svc}
+	qsrv := httptest.NewServer(qsvc)
+	defer qsrv.Close()
+
+	// compressed query results
+	cln := &Client{URL: qsrv.URL}
+	cln.Init()
+	res, err := cln.Query([]string{"/*/*"})
+	if err != nil || len(res) != 9 {
+		t.Fatal(res, err)
+	}
+	if atomic.LoadUint64(&qsvc.Stats.CompressedResponseBytes) == 0 {
+		t.Error(qsvc.Stats)
+	}
+
+	// compressed history request and response
+	var hist []veap.PV
+	for i := 0; i < 200; i++ {
+		hist = append(hist, veap.PV{Time: time.Unix(int64(i), 0), Value: float64(i)})
+	}
+	cln = &Client{URL: hsrv.URL, RequestCompressionThreshold: 1024}
+	cln.Init()
+	if err := cln.WriteHistory("/a", hist); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(histOut, hist) {
+		t.Error(histOut)
+	}
+	if atomic.LoadUint64(&hsvc.Stats.CompressedRequestBytes) == 0 {
+		t.Error(hsvc.Stats)
+	}
+	rhist, err := cln.ReadHistory("/a", time.Unix(0, 0), time.Unix(1000, 0), 1000)
+	if err != nil || !reflect.DeepEqual(rhist, hist) {
+		t.Error(rhist, err)
+	}
+	if atomic.LoadUint64(&hsvc.Stats.CompressedResponseBytes) == 0 {
+		t.Error(hsvc.Stats)
+	}
+
+	// response size limit applies to the decompressed response
+	cln.ResponseSizeLimit = 2048
+	if _, err := cln.ReadHistory("/a", time.Unix(0, 0), time.Unix(1000, 0), 1000); err == nil || err.Code() != veap.StatusClientError {
+		t.Error(err)
+	}
+
+	// no compression
+	cln = &Client{URL: hsrv.URL, DisableCompression: true}
+	cln.Init()
+	before := atomic.LoadUint64(&hsvc.Stats.CompressedResponseBytes)
+	if _, err := cln.ReadHistory("/a", time.Unix(0, 0), time.Unix(1000, 0), 1000); err != nil {
+		t.Error(err)
+	}
+	if atomic.LoadUint64(&hsvc.Stats.CompressedResponseBytes) != before {
+		t.Error(hsvc.Stats)
+	}
+}
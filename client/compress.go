@@ -0,0 +1,76 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// do sends an HTTP request. Compressed responses are negotiated explicitly and
+// decompressed, so that ResponseSizeLimit applies to the decompressed body.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.DisableCompression {
+		req.Header.Set("Accept-Encoding", "identity")
+	} else {
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	var dr io.ReadCloser
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return resp, nil
+	case "gzip":
+		dr, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		dr, err = zlib.NewReader(resp.Body)
+	default:
+		err = fmt.Errorf("Unsupported content encoding: %s", resp.Header.Get("Content-Encoding"))
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Decompression of response failed: %v", err)
+	}
+	resp.Body = &decompressedBody{ReadCloser: dr, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// requestBody returns the body for a request and its content coding. The
+// body is compressed with gzip, if RequestCompressionThreshold is set and
+// reached.
+func (c *Client) requestBody(b []byte) (io.Reader, string, error) {
+	if c.RequestCompressionThreshold <= 0 || len(b) < c.RequestCompressionThreshold {
+		return bytes.NewBuffer(b), "", nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", err
+	}
+	c.Log.Tracef("Request body compressed from %d to %d bytes", len(b), buf.Len())
+	return &buf, "gzip", nil
+}
+
+// decompressedBody closes the decompressor and the original response body.
+type decompressedBody struct {
+	io.ReadCloser
+	body io.ReadCloser
+}
+
+func (b *decompressedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.body.Close()
+}
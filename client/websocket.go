@@ -0,0 +1,296 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+	"github.com/mdzio/go-veap/internal/websocket"
+)
+
+const (
+	// additional size of a WebSocket message for the envelope of a response
+	wsMessageOverhead = 64 * 1024
+)
+
+// WebSocket forwards service calls over a single WebSocket connection to a
+// VEAP server (q.v. server.Handler). The embedded Client sends its requests
+// over this connection, so all services of Client are available.
+// Additionally PV changes are pushed by the server (veap.Subscriber).
+type WebSocket struct {
+	*Client
+
+	conn     *websocket.Conn
+	basePath string
+	done     chan struct{}
+
+	mutex   sync.Mutex
+	calls   map[uint64]*wsCall
+	nextID  uint64
+	connErr error
+
+	// callbacks are invoked with locked mutex, so that they are not invoked
+	// after Unsubscribe returns
+	subsMutex sync.Mutex
+	subs      map[veap.SubscriptionID]veap.PVChangeFunc
+}
+
+// Make sure that WebSocket implements veap.Subscriber.
+var _ veap.Subscriber = (*WebSocket)(nil)
+
+type wsCall struct {
+	resp chan encoding.WireWSMessage
+	// callback of a SUBSCRIBE, registered before further messages are read
+	callback veap.PVChangeFunc
+}
+
+// DialWebSocket opens a WebSocket connection to the VEAP server (URL of the
+// client with path /~ws). Init must be called before. The connection must be
+// closed with Close.
+func (c *Client) DialWebSocket(ctx context.Context) (*WebSocket, veap.Error) {
+	base, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, veap.NewErrorf(veap.StatusClientError, "Invalid URL %s: %v", c.URL, err)
+	}
+	header := make(http.Header)
+	if c.User != "" || c.Password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(c.User + ":" + c.Password))
+		header.Set("Authorization", "Basic "+auth)
+	}
+	var tlsConfig *tls.Config
+	transport, ok := c.Client.Transport.(*http.Transport)
+	if !ok && c.Client.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if ok {
+		tlsConfig = transport.TLSClientConfig
+	}
+	wsURL := c.URL + "/" + veap.WebSocketMarker
+	c.Log.Debugf("Opening WebSocket connection to %s", wsURL)
+	conn, err := websocket.Dial(ctx, wsURL, header, tlsConfig)
+	if err != nil {
+		if he, ok := err.(*websocket.HandshakeError); ok {
+			return nil, veap.NewErrorf(he.StatusCode, "Received HTTP status: %d (%s)", he.StatusCode, he.Body)
+		}
+		return nil, veap.NewErrorf(veap.StatusClientError, "Opening WebSocket connection to %s failed: %v", wsURL, err)
+	}
+	conn.ReadLimit = int64(c.ResponseSizeLimit) + wsMessageOverhead
+
+	ws := &WebSocket{
+		conn:     conn,
+		basePath: base.EscapedPath(),
+		done:     make(chan struct{}),
+		calls:    make(map[uint64]*wsCall),
+		subs:     make(map[veap.SubscriptionID]veap.PVChangeFunc),
+	}
+	ws.Client = &Client{
+		URL:               c.URL,
+		ResponseSizeLimit: c.ResponseSizeLimit,
+		Client:            &http.Client{Transport: wsTransport{ws}},
+		Log:               c.Log,
+	}
+	ws.Client.Init()
+	go ws.readLoop()
+	return ws, nil
+}
+
+// Close closes the WebSocket connection. Pending requests are aborted.
+func (ws *WebSocket) Close() {
+	ws.conn.Close()
+	<-ws.done
+}
+
+// Subscribe implements veap.Subscriber. The callback is invoked from the
+// receiving goroutine of the connection and must not block.
+func (ws *WebSocket) Subscribe(paths []string, callback veap.PVChangeFunc) (veap.SubscriptionID, veap.Error) {
+	m, err := ws.call(context.Background(), encoding.WireWSRequest{Method: encoding.WSMethodSubscribe, Paths: paths}, callback)
+	if err != nil {
+		return 0, err
+	}
+	return veap.SubscriptionID(m.Sub), nil
+}
+
+// Unsubscribe implements veap.Subscriber.
+func (ws *WebSocket) Unsubscribe(id veap.SubscriptionID) veap.Error {
+	ws.subsMutex.Lock()
+	_, ok := ws.subs[id]
+	delete(ws.subs, id)
+	ws.subsMutex.Unlock()
+	if !ok {
+		return veap.NewErrorf(veap.StatusNotFound, "Subscription not found: %d", id)
+	}
+	_, err := ws.call(context.Background(), encoding.WireWSRequest{Method: encoding.WSMethodUnsubscribe, Sub: uint64(id)}, nil)
+	return err
+}
+
+// call sends a request and waits for the response. A response with an error
+// status is returned as veap.Error.
+func (ws *WebSocket) call(ctx context.Context, req encoding.WireWSRequest, callback veap.PVChangeFunc) (encoding.WireWSMessage, veap.Error) {
+	m, err := ws.roundTrip(ctx, req, callback)
+	if err != nil {
+		return m, veap.NewErrorf(veap.StatusClientError, "WebSocket request failed: %v", err)
+	}
+	if m.Status != veap.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(m.Body, &e)
+		return m, veap.NewErrorf(m.Status, "Received status: %d (%s)", m.Status, e.Message)
+	}
+	return m, nil
+}
+
+func (ws *WebSocket) roundTrip(ctx context.Context, req encoding.WireWSRequest, callback veap.PVChangeFunc) (encoding.WireWSMessage, error) {
+	// register call
+	call := &wsCall{resp: make(chan encoding.WireWSMessage, 1), callback: callback}
+	ws.mutex.Lock()
+	if ws.connErr != nil {
+		err := ws.connErr
+		ws.mutex.Unlock()
+		return encoding.WireWSMessage{}, err
+	}
+	ws.nextID++
+	req.ID = ws.nextID
+	ws.calls[req.ID] = call
+	ws.mutex.Unlock()
+	unregister := func() {
+		ws.mutex.Lock()
+		delete(ws.calls, req.ID)
+		ws.mutex.Unlock()
+	}
+
+	// send request
+	b, err := json.Marshal(req)
+	if err != nil {
+		unregister()
+		return encoding.WireWSMessage{}, err
+	}
+	if err := ws.conn.WriteMessage(b); err != nil {
+		unregister()
+		return encoding.WireWSMessage{}, err
+	}
+
+	// wait for response
+	select {
+	case m, ok := <-call.resp:
+		if !ok {
+			ws.mutex.Lock()
+			defer ws.mutex.Unlock()
+			return encoding.WireWSMessage{}, ws.connErr
+		}
+		return m, nil
+	case <-ctx.Done():
+		unregister()
+		return encoding.WireWSMessage{}, ctx.Err()
+	}
+}
+
+func (ws *WebSocket) readLoop() {
+	defer close(ws.done)
+	var err error
+	for {
+		var b []byte
+		b, err = ws.conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		var m encoding.WireWSMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			ws.Log.Warningf("Invalid WebSocket message: %v", err)
+			continue
+		}
+		if m.ID != 0 {
+			ws.mutex.Lock()
+			call, ok := ws.calls[m.ID]
+			delete(ws.calls, m.ID)
+			ws.mutex.Unlock()
+			if !ok {
+				continue
+			}
+			if call.callback != nil && m.Status == veap.StatusOK {
+				ws.subsMutex.Lock()
+				ws.subs[veap.SubscriptionID(m.Sub)] = call.callback
+				ws.subsMutex.Unlock()
+			}
+			call.resp <- m
+		} else if m.Sub != 0 && m.PV != nil {
+			ws.subsMutex.Lock()
+			if callback, ok := ws.subs[veap.SubscriptionID(m.Sub)]; ok {
+				callback(m.Path, encoding.WireToPV(*m.PV))
+			}
+			ws.subsMutex.Unlock()
+		}
+	}
+
+	// abort pending calls
+	ws.Log.Debugf("WebSocket connection closed: %v", err)
+	ws.mutex.Lock()
+	ws.connErr = errors.New("WebSocket connection closed")
+	for _, call := range ws.calls {
+		close(call.resp)
+	}
+	ws.calls = nil
+	ws.mutex.Unlock()
+}
+
+// wsTransport transmits the HTTP requests of a Client over a WebSocket
+// connection.
+type wsTransport struct {
+	ws *WebSocket
+}
+
+func (t wsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p := req.URL.EscapedPath()
+	if !strings.HasPrefix(p, t.ws.basePath) {
+		return nil, errors.New("Path outside of the VEAP server URL: " + p)
+	}
+	wreq := encoding.WireWSRequest{Method: req.Method, Path: strings.TrimPrefix(p, t.ws.basePath)}
+	if req.URL.RawQuery != "" {
+		wreq.Path += "?" + req.URL.RawQuery
+	}
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		wreq.Body = b
+	}
+	m, err := t.ws.roundTrip(req.Context(), wreq, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// build HTTP response
+	body := []byte(m.Body)
+	contentType := "application/json"
+	if m.ContentType != "" {
+		var s string
+		if err := json.Unmarshal(m.Body, &s); err != nil {
+			return nil, err
+		}
+		body = []byte(s)
+		contentType = m.ContentType
+	}
+	return &http.Response{
+		Status:        http.StatusText(m.Status),
+		StatusCode:    m.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {contentType}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,234 @@
+package veap
+
+import (
+	"context"
+	"time"
+)
+
+// ContextService provides the VEAP base services like Service. Additionally
+// all functions accept a context.Context for cancellation and deadlines. The
+// path parameter is always escaped, use url.PathUnescape to unescape path
+// segments.
+type ContextService interface {
+	// ReadPVContext reads the process value of a data point.
+	ReadPVContext(ctx context.Context, path string) (PV, Error)
+
+	// WritePVContext sets the process value of a data point.
+	WritePVContext(ctx context.Context, path string, pv PV) Error
+
+	// ReadHistoryContext retrieves the history of a data point.
+	ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]PV, Error)
+
+	// WriteHistoryContext replaces the history of a data point.
+	WriteHistoryContext(ctx context.Context, path string, timeSeries []PV) Error
+
+	// ReadPropertiesContext returns the attributes and links of a VEAP object.
+	ReadPropertiesContext(ctx context.Context, path string) (attributes AttrValues, links []Link, err Error)
+
+	// WritePropertiesContext updates properties of an existing VEAP object or
+	// creates a new one.
+	WritePropertiesContext(ctx context.Context, path string, attributes AttrValues) (created bool, err Error)
+
+	// DeleteContext destroys a VEAP object.
+	DeleteContext(ctx context.Context, path string) Error
+}
+
+// ContextMetaService provides the services of MetaService with an additional
+// context.Context.
+type ContextMetaService interface {
+	// ExgDataContext executes multiple services in one request (q.v.
+	// MetaService.ExgData).
+	ExgDataContext(ctx context.Context, writePVs []WritePVParam, readPaths []string) (writeErrors []Error, readResults []ReadPVResult, serviceError Error)
+
+	// QueryContext searches for VEAP objects (q.v. MetaService.Query).
+	QueryContext(ctx context.Context, pathPatterns []string) (queryResults []QueryResult, serviceError Error)
+}
+
+// ContextSwitch is implemented by services, which are often embedded (e.g.
+// *BasicMetaService, *model.Service). Their ...Context methods are promoted
+// to the embedding type, which may only override e.g. ReadPV. Therefore the
+// ...Context methods are only used by AsContextService and
+// AsContextMetaService, if ContextEnabled returns true.
+type ContextSwitch interface {
+	ContextEnabled() bool
+}
+
+func contextEnabled(service interface{}) bool {
+	if cs, ok := service.(ContextSwitch); ok {
+		return cs.ContextEnabled()
+	}
+	return true
+}
+
+// AsContextService returns the service, if it implements ContextService and
+// the context is not disabled (q.v. ContextSwitch). Otherwise a
+// ContextAdapter is returned, which calls the methods without context.
+func AsContextService(service Service) ContextService {
+	if cs, ok := service.(ContextService); ok && contextEnabled(service) {
+		return cs
+	}
+	return &ContextAdapter{Service: service}
+}
+
+// AsContextMetaService returns the service, if it implements
+// ContextMetaService and the context is not disabled (q.v. ContextSwitch).
+// Otherwise a MetaContextAdapter is returned.
+func AsContextMetaService(service MetaService) ContextMetaService {
+	if cms, ok := service.(ContextMetaService); ok && contextEnabled(service) {
+		return cms
+	}
+	return &MetaContextAdapter{MetaService: service}
+}
+
+// AsService returns the service, if it implements Service. Otherwise a
+// ServiceAdapter is returned.
+func AsService(service ContextService) Service {
+	if s, ok := service.(Service); ok {
+		return s
+	}
+	return &ServiceAdapter{ContextService: service}
+}
+
+// ContextError converts the error of a done context to an Error.
+func ContextError(ctx context.Context) Error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+	return NewErrorf(StatusServiceUnavailable, "Service call aborted: %v", err)
+}
+
+// ContextAdapter implements ContextService on the basis of a Service. The
+// context is checked before the service is called. A running service call can
+// not be canceled.
+type ContextAdapter struct {
+	Service
+}
+
+// Make sure that ContextAdapter implements ContextService.
+var _ ContextService = (*ContextAdapter)(nil)
+
+// ReadPVContext implements ContextService.
+func (a *ContextAdapter) ReadPVContext(ctx context.Context, path string) (PV, Error) {
+	if err := ContextError(ctx); err != nil {
+		return PV{}, err
+	}
+	return a.Service.ReadPV(path)
+}
+
+// WritePVContext implements ContextService.
+func (a *ContextAdapter) WritePVContext(ctx context.Context, path string, pv PV) Error {
+	if err := ContextError(ctx); err != nil {
+		return err
+	}
+	return a.Service.WritePV(path, pv)
+}
+
+// ReadHistoryContext implements ContextService.
+func (a *ContextAdapter) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	if err := ContextError(ctx); err != nil {
+		return nil, err
+	}
+	return a.Service.ReadHistory(path, begin, end, limit)
+}
+
+// WriteHistoryContext implements ContextService.
+func (a *ContextAdapter) WriteHistoryContext(ctx context.Context, path string, timeSeries []PV) Error {
+	if err := ContextError(ctx); err != nil {
+		return err
+	}
+	return a.Service.WriteHistory(path, timeSeries)
+}
+
+// ReadPropertiesContext implements ContextService.
+func (a *ContextAdapter) ReadPropertiesContext(ctx context.Context, path string) (AttrValues, []Link, Error) {
+	if err := ContextError(ctx); err != nil {
+		return nil, nil, err
+	}
+	return a.Service.ReadProperties(path)
+}
+
+// WritePropertiesContext implements ContextService.
+func (a *ContextAdapter) WritePropertiesContext(ctx context.Context, path string, attributes AttrValues) (bool, Error) {
+	if err := ContextError(ctx); err != nil {
+		return false, err
+	}
+	return a.Service.WriteProperties(path, attributes)
+}
+
+// DeleteContext implements ContextService.
+func (a *ContextAdapter) DeleteContext(ctx context.Context, path string) Error {
+	if err := ContextError(ctx); err != nil {
+		return err
+	}
+	return a.Service.Delete(path)
+}
+
+// MetaContextAdapter implements ContextMetaService on the basis of a
+// MetaService. The context is checked before the service is called.
+type MetaContextAdapter struct {
+	MetaService
+}
+
+// Make sure that MetaContextAdapter implements ContextMetaService.
+var _ ContextMetaService = (*MetaContextAdapter)(nil)
+
+// ExgDataContext implements ContextMetaService.
+func (a *MetaContextAdapter) ExgDataContext(ctx context.Context, writePVs []WritePVParam, readPaths []string) ([]Error, []ReadPVResult, Error) {
+	if err := ContextError(ctx); err != nil {
+		return nil, nil, err
+	}
+	return a.MetaService.ExgData(writePVs, readPaths)
+}
+
+// QueryContext implements ContextMetaService.
+func (a *MetaContextAdapter) QueryContext(ctx context.Context, pathPatterns []string) ([]QueryResult, Error) {
+	if err := ContextError(ctx); err != nil {
+		return nil, err
+	}
+	return a.MetaService.Query(pathPatterns)
+}
+
+// ServiceAdapter implements Service on the basis of a ContextService. All
+// service calls use context.Background().
+type ServiceAdapter struct {
+	ContextService
+}
+
+// Make sure that ServiceAdapter implements Service.
+var _ Service = (*ServiceAdapter)(nil)
+
+// ReadPV implements Service.
+func (a *ServiceAdapter) ReadPV(path string) (PV, Error) {
+	return a.ContextService.ReadPVContext(context.Background(), path)
+}
+
+// WritePV implements Service.
+func (a *ServiceAdapter) WritePV(path string, pv PV) Error {
+	return a.ContextService.WritePVContext(context.Background(), path, pv)
+}
+
+// ReadHistory implements Service.
+func (a *ServiceAdapter) ReadHistory(path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	return a.ContextService.ReadHistoryContext(context.Background(), path, begin, end, limit)
+}
+
+// WriteHistory implements Service.
+func (a *ServiceAdapter) WriteHistory(path string, timeSeries []PV) Error {
+	return a.ContextService.WriteHistoryContext(context.Background(), path, timeSeries)
+}
+
+// ReadProperties implements Service.
+func (a *ServiceAdapter) ReadProperties(path string) (AttrValues, []Link, Error) {
+	return a.ContextService.ReadPropertiesContext(context.Background(), path)
+}
+
+// WriteProperties implements Service.
+func (a *ServiceAdapter) WriteProperties(path string, attributes AttrValues) (bool, Error) {
+	return a.ContextService.WritePropertiesContext(context.Background(), path, attributes)
+}
+
+// Delete implements Service.
+func (a *ServiceAdapter) Delete(path string) Error {
+	return a.ContextService.DeleteContext(context.Background(), path)
+}
@@ -0,0 +1,95 @@
+package veap
+
+import (
+	"context"
+	"testing"
+)
+
+func TestContextAdapter(t *testing.T) {
+	calls := 0
+	svc := &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			calls++
+			return PV{Value: path}, nil
+		},
+	}
+	cs := AsContextService(svc)
+
+	// active context
+	pv, err := cs.ReadPVContext(context.Background(), "/a")
+	if err != nil || pv.Value != "/a" || calls != 1 {
+		t.Fatal(pv, err, calls)
+	}
+
+	// canceled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cs.ReadPVContext(ctx, "/a")
+	if err == nil || err.Code() != StatusServiceUnavailable || calls != 1 {
+		t.Fatal(err, calls)
+	}
+
+	// back to Service
+	if AsService(cs) != cs.(Service) {
+		t.Error("expected same service")
+	}
+	s := &ServiceAdapter{ContextService: cs}
+	pv, err = s.ReadPV("/b")
+	if err != nil || pv.Value != "/b" || calls != 2 {
+		t.Fatal(pv, err, calls)
+	}
+}
+
+func TestBasicMetaServiceContext(t *testing.T) {
+	svc := &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			return PV{Value: path}, nil
+		},
+	}
+	ms := &BasicMetaService{Service: svc}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, readResults, err := ms.ExgDataContext(ctx, nil, []string{"/a"})
+	if err != nil || len(readResults) != 1 {
+		t.Fatal(err)
+	}
+	if readResults[0].Error == nil || readResults[0].Error.Code() != StatusServiceUnavailable {
+		t.Error(readResults[0].Error)
+	}
+	if _, err := ms.QueryContext(ctx, []string{"/"}); err == nil || err.Code() != StatusServiceUnavailable {
+		t.Error(err)
+	}
+}
+
+// overridingService embeds *BasicMetaService and overrides only ReadPV.
+type overridingService struct {
+	*BasicMetaService
+}
+
+func (s *overridingService) ReadPV(path string) (PV, Error) {
+	return PV{Value: "overridden"}, nil
+}
+
+func TestContextSwitch(t *testing.T) {
+	svc := &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			return PV{Value: path}, nil
+		},
+	}
+
+	// override is not bypassed
+	s := &overridingService{&BasicMetaService{Service: svc}}
+	pv, err := AsContextService(s).ReadPVContext(context.Background(), "/a")
+	if err != nil || pv.Value != "overridden" {
+		t.Error(pv, err)
+	}
+	if _, ok := AsContextMetaService(s).(*MetaContextAdapter); !ok {
+		t.Error("expected adapter")
+	}
+
+	// opt-in
+	ms := &BasicMetaService{Service: svc, EnableContext: true}
+	if AsContextService(ms) != ContextService(ms) || AsContextMetaService(ms) != ContextMetaService(ms) {
+		t.Error("expected same service")
+	}
+}
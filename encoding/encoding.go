@@ -101,6 +101,9 @@ type WireHist struct {
 	Times  []int64       `json:"ts"`
 	Values []interface{} `json:"v"`
 	States []veap.State  `json:"s"`
+	// for aggregated histories: function and interval in milliseconds
+	Aggregate string `json:"aggr,omitempty"`
+	Interval  int64  `json:"interval,omitempty"`
 }
 
 func HistToWire(hist []veap.PV) WireHist {
@@ -132,12 +135,176 @@ func WireToHist(w WireHist) ([]veap.PV, error) {
 	return hist, nil
 }
 
+// StateMode selects the JSON representation of states.
+type StateMode int
+
+const (
+	// NumericStates encodes states as numbers (e.g. 201). This is the default.
+	NumericStates StateMode = iota
+	// TextStates encodes states as text (e.g. "NOT_CONNECTED").
+	TextStates
+)
+
+// TextState is a veap.State, which is encoded as text in JSON. Unmarshalling
+// accepts the numeric and the textual representation.
+type TextState veap.State
+
+// MarshalJSON encodes the state as text (q.v. veap.State.String).
+func (s TextState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(veap.State(s).String())
+}
+
+// UnmarshalJSON accepts the numeric and the textual representation of a
+// state (q.v. veap.State.UnmarshalJSON).
+func (s *TextState) UnmarshalJSON(b []byte) error {
+	return (*veap.State)(s).UnmarshalJSON(b)
+}
+
+type wireTextPV struct {
+	Time  int64       `json:"ts"`
+	Value interface{} `json:"v"`
+	State TextState   `json:"s"`
+}
+
+type wireTextHist struct {
+	Times     []int64       `json:"ts"`
+	Values    []interface{} `json:"v"`
+	States    []TextState   `json:"s"`
+	Aggregate string        `json:"aggr,omitempty"`
+	Interval  int64         `json:"interval,omitempty"`
+}
+
+// MarshalPV converts a PV to JSON. The states are encoded as specified by
+// mode.
+func MarshalPV(pv veap.PV, mode StateMode) ([]byte, error) {
+	w := PVToWire(pv)
+	if mode == TextStates {
+		return json.Marshal(wireTextPV{w.Time, w.Value, TextState(w.State)})
+	}
+	return json.Marshal(w)
+}
+
+// MarshalHist converts a history to JSON. The states are encoded as specified
+// by mode.
+func MarshalHist(hist []veap.PV, mode StateMode) ([]byte, error) {
+	return marshalHist(HistToWire(hist), mode)
+}
+
+// MarshalAggregatedHist converts an aggregated history to JSON. The
+// aggregation is added, so that receivers can distinguish aggregated from raw
+// histories.
+func MarshalAggregatedHist(hist []veap.PV, aggr veap.Aggregation, mode StateMode) ([]byte, error) {
+	w := HistToWire(hist)
+	w.Aggregate = string(aggr.Func)
+	w.Interval = int64(aggr.Interval / time.Millisecond)
+	return marshalHist(w, mode)
+}
+
+func marshalHist(w WireHist, mode StateMode) ([]byte, error) {
+	if mode == TextStates {
+		states := make([]TextState, len(w.States))
+		for i, s := range w.States {
+			states[i] = TextState(s)
+		}
+		return json.Marshal(wireTextHist{w.Times, w.Values, states, w.Aggregate, w.Interval})
+	}
+	return json.Marshal(w)
+}
+
 type WireLink struct {
 	Role   string `json:"rel"`
 	Target string `json:"href"`
 	Title  string `json:"title,omitempty"`
 }
 
+func LinksToWire(links []veap.Link) []WireLink {
+	if len(links) == 0 {
+		return nil
+	}
+	w := make([]WireLink, len(links))
+	for i, l := range links {
+		w[i] = WireLink{Role: l.Role, Target: l.Target, Title: l.Title}
+	}
+	return w
+}
+
+func WireToLinks(w []WireLink) []veap.Link {
+	if len(w) == 0 {
+		return nil
+	}
+	links := make([]veap.Link, len(w))
+	for i, l := range w {
+		links[i] = veap.Link{Role: l.Role, Target: l.Target, Title: l.Title}
+	}
+	return links
+}
+
+// WireLinkUpdate is the wire format of veap.LinkUpdate. It is sent as
+// property ~links with a HTTP-PUT on an object.
+type WireLinkUpdate struct {
+	Replace map[string][]string `json:"replace,omitempty"`
+	Remove  []WireLink          `json:"remove,omitempty"`
+	Add     []WireLink          `json:"add,omitempty"`
+}
+
+func LinkUpdateToWire(u veap.LinkUpdate) WireLinkUpdate {
+	return WireLinkUpdate{Replace: u.Replace, Remove: LinksToWire(u.Remove), Add: LinksToWire(u.Add)}
+}
+
+func WireToLinkUpdate(w WireLinkUpdate) veap.LinkUpdate {
+	return veap.LinkUpdate{Replace: w.Replace, Remove: WireToLinks(w.Remove), Add: WireToLinks(w.Add)}
+}
+
+// AttributesToWire converts a veap.LinkUpdate in the attributes of a
+// WriteProperties to the wire format. The passed attributes are not modified.
+func AttributesToWire(attr veap.AttrValues) map[string]interface{} {
+	if attr == nil {
+		return nil
+	}
+	w := make(map[string]interface{}, len(attr))
+	for k, v := range attr {
+		w[k] = v
+	}
+	switch u := attr[veap.LinksMarker].(type) {
+	case veap.LinkUpdate:
+		w[veap.LinksMarker] = LinkUpdateToWire(u)
+	case *veap.LinkUpdate:
+		if u != nil {
+			w[veap.LinksMarker] = LinkUpdateToWire(*u)
+		}
+	}
+	return w
+}
+
+// WireToAttributes converts the property ~links of unmarshalled attributes to
+// a veap.LinkUpdate. An invalid ~links property is left unchanged, so that it
+// is rejected by the service (q.v. veap.ExtractLinkUpdate).
+func WireToAttributes(w map[string]interface{}) veap.AttrValues {
+	if w == nil {
+		return nil
+	}
+	attr := make(veap.AttrValues, len(w))
+	for k, v := range w {
+		attr[k] = v
+	}
+	v, ok := w[veap.LinksMarker]
+	if !ok {
+		return attr
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return attr
+	}
+	var u WireLinkUpdate
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&u); err != nil {
+		return attr
+	}
+	attr[veap.LinksMarker] = WireToLinkUpdate(u)
+	return attr
+}
+
 type WireError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message,omitempty"`
@@ -162,9 +329,28 @@ type WireWritePVParam struct {
 	PV   WirePV `json:"pv"`
 }
 
+type WireWritePropertiesParam struct {
+	Path       string                 `json:"path"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+type WireReadHistoryParam struct {
+	Path  string `json:"path"`
+	Begin int64  `json:"begin"`
+	End   int64  `json:"end"`
+	Limit int64  `json:"limit,omitempty"`
+}
+
+// WireExgDataParams are the parameters of the ExgData service. The flag atomic
+// and the sections writeProperties, readProperties and readHistory are
+// optional.
 type WireExgDataParams struct {
-	WritePVs  []WireWritePVParam `json:"writePVs"`
-	ReadPaths []string           `json:"readPaths"`
+	Atomic          bool                       `json:"atomic,omitempty"`
+	WritePVs        []WireWritePVParam         `json:"writePVs"`
+	ReadPaths       []string                   `json:"readPaths"`
+	WriteProperties []WireWritePropertiesParam `json:"writeProperties,omitempty"`
+	ReadProperties  []string                   `json:"readProperties,omitempty"`
+	ReadHistory     []WireReadHistoryParam     `json:"readHistory,omitempty"`
 }
 
 type WireReadPVResult struct {
@@ -172,49 +358,152 @@ type WireReadPVResult struct {
 	Error *WireError `json:"error,omitempty"`
 }
 
+type WireWritePropertiesResult struct {
+	Created bool       `json:"created,omitempty"`
+	Error   *WireError `json:"error,omitempty"`
+}
+
+type WireReadPropertiesResult struct {
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Links      []WireLink             `json:"links,omitempty"`
+	Error      *WireError             `json:"error,omitempty"`
+}
+
+type WireReadHistoryResult struct {
+	Hist  *WireHist  `json:"hist,omitempty"`
+	Error *WireError `json:"error,omitempty"`
+}
+
+// WireExgDataResults are the results of the ExgData service. The sections
+// for properties and histories are only present, if requested.
 type WireExgDataResults struct {
-	WriteErrors []*WireError       `json:"writeErrors"`
-	ReadResults []WireReadPVResult `json:"readResults"`
+	WriteErrors            []*WireError                `json:"writeErrors"`
+	ReadResults            []WireReadPVResult          `json:"readResults"`
+	WritePropertiesResults []WireWritePropertiesResult `json:"writePropertiesResults,omitempty"`
+	ReadPropertiesResults  []WireReadPropertiesResult  `json:"readPropertiesResults,omitempty"`
+	ReadHistoryResults     []WireReadHistoryResult     `json:"readHistoryResults,omitempty"`
 }
 
 func ExgDataParamsToWire(writePVs []veap.WritePVParam, readPaths []string) *WireExgDataParams {
-	w := &WireExgDataParams{}
-	w.WritePVs = make([]WireWritePVParam, len(writePVs))
-	for i := range writePVs {
+	return ExtendedExgDataParamsToWire(veap.ExgDataParams{WritePVs: writePVs, ReadPaths: readPaths})
+}
+
+func ExtendedExgDataParamsToWire(params veap.ExgDataParams) *WireExgDataParams {
+	w := &WireExgDataParams{Atomic: params.Atomic}
+	w.WritePVs = make([]WireWritePVParam, len(params.WritePVs))
+	for i := range params.WritePVs {
 		w.WritePVs[i] = WireWritePVParam{
-			Path: writePVs[i].Path,
-			PV:   PVToWire(writePVs[i].PV),
+			Path: params.WritePVs[i].Path,
+			PV:   PVToWire(params.WritePVs[i].PV),
+		}
+	}
+	w.ReadPaths = params.ReadPaths
+	if len(params.WriteProperties) > 0 {
+		w.WriteProperties = make([]WireWritePropertiesParam, len(params.WriteProperties))
+		for i, p := range params.WriteProperties {
+			w.WriteProperties[i] = WireWritePropertiesParam{Path: p.Path, Attributes: AttributesToWire(p.Attributes)}
+		}
+	}
+	w.ReadProperties = params.ReadProperties
+	if len(params.ReadHistory) > 0 {
+		w.ReadHistory = make([]WireReadHistoryParam, len(params.ReadHistory))
+		for i, p := range params.ReadHistory {
+			w.ReadHistory[i] = WireReadHistoryParam{
+				Path:  p.Path,
+				Begin: p.Begin.UnixNano() / 1000000,
+				End:   p.End.UnixNano() / 1000000,
+				Limit: p.Limit,
+			}
 		}
 	}
-	w.ReadPaths = readPaths
 	return w
 }
 
 func WireToExgDataParams(w *WireExgDataParams) (writePVs []veap.WritePVParam, readPaths []string) {
-	writePVs = make([]veap.WritePVParam, len(w.WritePVs))
+	params := WireToExtendedExgDataParams(w)
+	return params.WritePVs, params.ReadPaths
+}
+
+func WireToExtendedExgDataParams(w *WireExgDataParams) veap.ExgDataParams {
+	var params veap.ExgDataParams
+	params.Atomic = w.Atomic
+	params.WritePVs = make([]veap.WritePVParam, len(w.WritePVs))
 	for i := range w.WritePVs {
-		writePVs[i].Path = w.WritePVs[i].Path
-		writePVs[i].PV = WireToPV(w.WritePVs[i].PV)
+		params.WritePVs[i].Path = w.WritePVs[i].Path
+		params.WritePVs[i].PV = WireToPV(w.WritePVs[i].PV)
+	}
+	params.ReadPaths = w.ReadPaths
+	if len(w.WriteProperties) > 0 {
+		params.WriteProperties = make([]veap.WritePropertiesParam, len(w.WriteProperties))
+		for i, p := range w.WriteProperties {
+			params.WriteProperties[i] = veap.WritePropertiesParam{Path: p.Path, Attributes: WireToAttributes(p.Attributes)}
+		}
 	}
-	readPaths = w.ReadPaths
-	return
+	params.ReadProperties = w.ReadProperties
+	if len(w.ReadHistory) > 0 {
+		params.ReadHistory = make([]veap.ReadHistoryParam, len(w.ReadHistory))
+		for i, p := range w.ReadHistory {
+			params.ReadHistory[i] = veap.ReadHistoryParam{
+				Path:  p.Path,
+				Begin: time.Unix(0, p.Begin*1000000),
+				End:   time.Unix(0, p.End*1000000),
+				Limit: p.Limit,
+			}
+		}
+	}
+	return params
 }
 
 func ExgDataResultsToWire(writeErrors []veap.Error, readResults []veap.ReadPVResult) *WireExgDataResults {
+	return ExtendedExgDataResultsToWire(veap.ExgDataResults{WriteErrors: writeErrors, ReadResults: readResults})
+}
+
+func ExtendedExgDataResultsToWire(results veap.ExgDataResults) *WireExgDataResults {
 	w := &WireExgDataResults{}
-	w.WriteErrors = make([]*WireError, len(writeErrors))
-	for i := range writeErrors {
-		w.WriteErrors[i] = ErrorToWire(writeErrors[i])
+	w.WriteErrors = make([]*WireError, len(results.WriteErrors))
+	for i := range results.WriteErrors {
+		w.WriteErrors[i] = ErrorToWire(results.WriteErrors[i])
 	}
-	w.ReadResults = make([]WireReadPVResult, len(readResults))
-	for i := range readResults {
-		if err := readResults[i].Error; err != nil {
+	w.ReadResults = make([]WireReadPVResult, len(results.ReadResults))
+	for i := range results.ReadResults {
+		if err := results.ReadResults[i].Error; err != nil {
 			w.ReadResults[i].Error = ErrorToWire(err)
 		} else {
-			wpv := PVToWire(readResults[i].PV)
+			wpv := PVToWire(results.ReadResults[i].PV)
 			w.ReadResults[i].PV = &wpv
 		}
 	}
+	if len(results.WritePropertiesResults) > 0 {
+		w.WritePropertiesResults = make([]WireWritePropertiesResult, len(results.WritePropertiesResults))
+		for i, r := range results.WritePropertiesResults {
+			w.WritePropertiesResults[i] = WireWritePropertiesResult{r.Created, ErrorToWire(r.Error)}
+		}
+	}
+	if len(results.ReadPropertiesResults) > 0 {
+		w.ReadPropertiesResults = make([]WireReadPropertiesResult, len(results.ReadPropertiesResults))
+		for i, r := range results.ReadPropertiesResults {
+			if r.Error != nil {
+				w.ReadPropertiesResults[i].Error = ErrorToWire(r.Error)
+				continue
+			}
+			w.ReadPropertiesResults[i].Attributes = r.Attributes
+			if w.ReadPropertiesResults[i].Attributes == nil {
+				w.ReadPropertiesResults[i].Attributes = map[string]interface{}{}
+			}
+			w.ReadPropertiesResults[i].Links = LinksToWire(r.Links)
+		}
+	}
+	if len(results.ReadHistoryResults) > 0 {
+		w.ReadHistoryResults = make([]WireReadHistoryResult, len(results.ReadHistoryResults))
+		for i, r := range results.ReadHistoryResults {
+			if r.Error != nil {
+				w.ReadHistoryResults[i].Error = ErrorToWire(r.Error)
+				continue
+			}
+			wh := HistToWire(r.History)
+			w.ReadHistoryResults[i].Hist = &wh
+		}
+	}
 	return w
 }
 
@@ -233,3 +522,43 @@ func WireToExgDataResults(w *WireExgDataResults) ([]veap.Error, []veap.ReadPVRes
 	}
 	return writeErrors, readResults
 }
+
+func WireToExtendedExgDataResults(w *WireExgDataResults) (veap.ExgDataResults, error) {
+	var results veap.ExgDataResults
+	results.WriteErrors, results.ReadResults = WireToExgDataResults(w)
+	if len(w.WritePropertiesResults) > 0 {
+		results.WritePropertiesResults = make([]veap.WritePropertiesResult, len(w.WritePropertiesResults))
+		for i, r := range w.WritePropertiesResults {
+			results.WritePropertiesResults[i] = veap.WritePropertiesResult{Created: r.Created, Error: WireToError(r.Error)}
+		}
+	}
+	if len(w.ReadPropertiesResults) > 0 {
+		results.ReadPropertiesResults = make([]veap.ReadPropertiesResult, len(w.ReadPropertiesResults))
+		for i, r := range w.ReadPropertiesResults {
+			if r.Error != nil {
+				results.ReadPropertiesResults[i].Error = WireToError(r.Error)
+				continue
+			}
+			results.ReadPropertiesResults[i].Attributes = r.Attributes
+			results.ReadPropertiesResults[i].Links = WireToLinks(r.Links)
+		}
+	}
+	if len(w.ReadHistoryResults) > 0 {
+		results.ReadHistoryResults = make([]veap.ReadHistoryResult, len(w.ReadHistoryResults))
+		for i, r := range w.ReadHistoryResults {
+			if r.Error != nil {
+				results.ReadHistoryResults[i].Error = WireToError(r.Error)
+				continue
+			}
+			if r.Hist == nil {
+				return veap.ExgDataResults{}, errors.New("Missing history in ExgData results")
+			}
+			hist, err := WireToHist(*r.Hist)
+			if err != nil {
+				return veap.ExgDataResults{}, err
+			}
+			results.ReadHistoryResults[i].History = hist
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,40 @@
+package encoding
+
+import "encoding/json"
+
+// Methods of the WebSocket protocol for subscriptions. All other methods are
+// HTTP methods (q.v. WireWSRequest).
+const (
+	WSMethodSubscribe   = "SUBSCRIBE"
+	WSMethodUnsubscribe = "UNSUBSCRIBE"
+)
+
+// WireWSRequest is a request of the VEAP WebSocket protocol. A request with an
+// HTTP method is processed like an HTTP request with the specified path
+// (without URL prefix, optionally with query parameters) and body. SUBSCRIBE
+// registers the PV paths in Paths, UNSUBSCRIBE removes the subscription Sub.
+// The server answers every request with a WireWSMessage with the same ID.
+type WireWSRequest struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method"`
+	Path   string          `json:"path,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Paths  []string        `json:"paths,omitempty"`
+	Sub    uint64          `json:"sub,omitempty"`
+}
+
+// WireWSMessage is sent by the server of the VEAP WebSocket protocol. A
+// response has the ID of the request, the HTTP status code and the body of the
+// corresponding HTTP response. If the body is not JSON, it is sent as JSON
+// string and ContentType is set. The response of a SUBSCRIBE contains the
+// subscription ID in Sub. A notification about a PV change has no ID, but
+// Sub, Path and PV.
+type WireWSMessage struct {
+	ID          uint64          `json:"id,omitempty"`
+	Status      int             `json:"status,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	Body        json.RawMessage `json:"body,omitempty"`
+	Sub         uint64          `json:"sub,omitempty"`
+	Path        string          `json:"path,omitempty"`
+	PV          *WirePV         `json:"pv,omitempty"`
+}
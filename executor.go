@@ -0,0 +1,102 @@
+package veap
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// executor runs service calls with bounded parallelism and an optional
+// timeout for each call. The zero value executes all calls sequentially
+// without timeout.
+type executor struct {
+	// max. number of concurrent calls, values less than 2 disable parallelism
+	workers int
+	// timeout for a single call, 0 disables the timeout
+	timeout time.Duration
+}
+
+// call executes a reading service call. If the call does not return within
+// the timeout, an error with code StatusGatewayTimeout is returned. In this
+// case the call continues in the background and its result is discarded.
+// Therefore the call must not modify shared state (q.v. callWrite).
+func (e executor) call(ctx context.Context, call func(ctx context.Context) (interface{}, Error)) (interface{}, Error) {
+	if e.timeout <= 0 {
+		return call(ctx)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	type result struct {
+		value interface{}
+		err   Error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := call(callCtx)
+		done <- result{v, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-callCtx.Done():
+		// parent context canceled?
+		if err := ContextError(ctx); err != nil {
+			return nil, err
+		}
+		return nil, NewErrorf(StatusGatewayTimeout, "Service call timed out after %v", e.timeout)
+	}
+}
+
+// callWrite executes a writing service call. The call is executed in the
+// calling goroutine, so that writes never overlap. On timeout only the context
+// of the call is canceled, the service must observe it. If the call fails
+// after the timeout expired, an error with code StatusGatewayTimeout is
+// returned.
+func (e executor) callWrite(ctx context.Context, call func(ctx context.Context) (interface{}, Error)) (interface{}, Error) {
+	if e.timeout <= 0 {
+		return call(ctx)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	v, err := call(callCtx)
+	if err != nil && callCtx.Err() != nil {
+		// parent context canceled?
+		if err := ContextError(ctx); err != nil {
+			return nil, err
+		}
+		return nil, NewErrorf(StatusGatewayTimeout, "Service call timed out after %v", e.timeout)
+	}
+	return v, err
+}
+
+// forEach calls fn for every index from 0 to n-1. At most workers calls are
+// executed concurrently. forEach returns, after all calls have finished. fn
+// must only modify state associated with its index.
+func (e executor) forEach(n int, fn func(idx int)) {
+	if e.workers < 2 || n < 2 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	workers := e.workers
+	if workers > n {
+		workers = n
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
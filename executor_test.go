@@ -0,0 +1,169 @@
+package veap
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyProbe tracks the max. number of concurrent calls.
+type concurrencyProbe struct {
+	mutex   sync.Mutex
+	current int
+	max     int
+}
+
+func (p *concurrencyProbe) enter() {
+	p.mutex.Lock()
+	p.current++
+	if p.current > p.max {
+		p.max = p.current
+	}
+	p.mutex.Unlock()
+}
+
+func (p *concurrencyProbe) leave() {
+	p.mutex.Lock()
+	p.current--
+	p.mutex.Unlock()
+}
+
+func TestParallelExgData(t *testing.T) {
+	probe := &concurrencyProbe{}
+	svc := &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			probe.enter()
+			defer probe.leave()
+			switch path {
+			case "/missing":
+				return PV{}, NewErrorf(StatusNotFound, "Not found: %s", path)
+			case "/slow":
+				time.Sleep(200 * time.Millisecond)
+				return PV{Value: path}, nil
+			}
+			// later paths return earlier
+			i, _ := strconv.Atoi(path[1:])
+			time.Sleep(time.Duration(20-i) * time.Millisecond)
+			return PV{Value: path}, nil
+		},
+	}
+	m := &BasicMetaService{Service: svc, Workers: 4, CallTimeout: 100 * time.Millisecond}
+
+	var paths []string
+	for i := 0; i < 20; i++ {
+		paths = append(paths, "/"+strconv.Itoa(i))
+	}
+	paths = append(paths, "/missing", "/slow")
+	_, results, err := m.ExgData(nil, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(paths) {
+		t.Fatal(results)
+	}
+
+	// order is preserved
+	for i := 0; i < 20; i++ {
+		if results[i].Error != nil || results[i].PV.Value != paths[i] {
+			t.Errorf("Wrong result %d: %v", i, results[i])
+		}
+	}
+
+	// errors are mapped to the paths
+	if e := results[20].Error; e == nil || e.Code() != StatusNotFound {
+		t.Error(e)
+	}
+	if e := results[21].Error; e == nil || e.Code() != StatusGatewayTimeout {
+		t.Error(e)
+	}
+
+	// bounded parallelism
+	probe.mutex.Lock()
+	max := probe.max
+	probe.mutex.Unlock()
+	if max < 2 || max > 4 {
+		t.Error(max)
+	}
+}
+
+func TestParallelQuery(t *testing.T) {
+	// tree with 3 levels, 4 children each
+	probe := &concurrencyProbe{}
+	svc := &FuncService{
+		ReadPropertiesFunc: func(path string) (AttrValues, []Link, Error) {
+			probe.enter()
+			defer probe.leave()
+			time.Sleep(time.Millisecond)
+			if pathDepth(path) == 3 {
+				return AttrValues{}, nil, nil
+			}
+			var links []Link
+			for i := 3; i >= 0; i-- {
+				links = append(links, Link{Role: "item", Target: strconv.Itoa(i)})
+			}
+			return AttrValues{}, links, nil
+		},
+	}
+	seq := &BasicMetaService{Service: svc}
+	par := &BasicMetaService{Service: svc, Workers: 8}
+	for _, pattern := range []string{"/*/*/*", "/**"} {
+		expected, err := seq.Query([]string{pattern})
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := par.Query([]string{pattern})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != len(expected) {
+			t.Fatal(len(actual), len(expected))
+		}
+		for i := range expected {
+			if actual[i].Path != expected[i].Path {
+				t.Errorf("Wrong order for %s at %d: %s", pattern, i, actual[i].Path)
+			}
+		}
+	}
+	if probe.max < 2 {
+		t.Error(probe.max)
+	}
+}
+
+func TestExecutorCanceled(t *testing.T) {
+	e := executor{timeout: time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := e.call(ctx, func(ctx context.Context) (interface{}, Error) {
+		<-ctx.Done()
+		return nil, ContextError(ctx)
+	})
+	if err == nil || err.Code() != StatusServiceUnavailable {
+		t.Error(err)
+	}
+}
+
+func TestExecutorWriteTimeout(t *testing.T) {
+	e := executor{timeout: 10 * time.Millisecond}
+
+	// write is not abandoned
+	var done bool
+	_, err := e.callWrite(context.Background(), func(ctx context.Context) (interface{}, Error) {
+		time.Sleep(50 * time.Millisecond)
+		done = true
+		return nil, nil
+	})
+	if err != nil || !done {
+		t.Error(err, done)
+	}
+
+	// write observes the context
+	_, err = e.callWrite(context.Background(), func(ctx context.Context) (interface{}, Error) {
+		<-ctx.Done()
+		return nil, ContextError(ctx)
+	})
+	if err == nil || err.Code() != StatusGatewayTimeout {
+		t.Error(err)
+	}
+}
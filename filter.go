@@ -0,0 +1,272 @@
+package veap
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// FilterOp is the operator of a Filter.
+type FilterOp int
+
+// Filter operators
+const (
+	FilterExists FilterOp = iota
+	FilterNotExists
+	FilterEqual
+	FilterNotEqual
+	FilterLess
+	FilterLessEqual
+	FilterGreater
+	FilterGreaterEqual
+	FilterGlob
+	FilterContains
+)
+
+// textual representation of the binary operators, two character operators
+// must be checked first, = is an alias of ==
+var filterOpTexts = []struct {
+	text string
+	op   FilterOp
+}{
+	{"==", FilterEqual},
+	{"!=", FilterNotEqual},
+	{"<=", FilterLessEqual},
+	{">=", FilterGreaterEqual},
+	{"~=", FilterGlob},
+	{"*=", FilterContains},
+	{"<", FilterLess},
+	{">", FilterGreater},
+	{"=", FilterEqual},
+}
+
+// Filter checks an attribute of a VEAP object. If Name is LinksMarker, the
+// roles of the links are checked. If an attribute value is an array, the
+// filter matches, if any element matches.
+type Filter struct {
+	Name  string
+	Op    FilterOp
+	Value interface{}
+}
+
+// ParseFilter parses a filter expression. Supported expressions:
+//
+//	name            attribute exists
+//	!name           attribute does not exist
+//	name==value     equal (also name=value)
+//	name!=value     not equal
+//	name<value      less than (also <=, >, >=)
+//	name~=pattern   string matches glob pattern (q.v. path.Match)
+//	name*=text      string contains text
+//
+// The value is parsed as JSON. If this fails, the value is taken as string.
+func ParseFilter(expr string) (Filter, Error) {
+	// find first operator
+	pos := -1
+	var op FilterOp
+	var opLen int
+	for _, o := range filterOpTexts {
+		p := strings.Index(expr, o.text)
+		if p != -1 && (pos == -1 || p < pos) {
+			pos, op, opLen = p, o.op, len(o.text)
+		}
+	}
+
+	// unary expression?
+	if pos == -1 {
+		name := strings.TrimSpace(expr)
+		op = FilterExists
+		if strings.HasPrefix(name, "!") {
+			name = strings.TrimSpace(name[1:])
+			op = FilterNotExists
+		}
+		if name == "" {
+			return Filter{}, NewErrorf(StatusBadRequest, "Missing attribute name in filter: %s", expr)
+		}
+		return Filter{Name: name, Op: op}, nil
+	}
+
+	// binary expression
+	name := strings.TrimSpace(expr[:pos])
+	if name == "" {
+		return Filter{}, NewErrorf(StatusBadRequest, "Missing attribute name in filter: %s", expr)
+	}
+	rawValue := strings.TrimSpace(expr[pos+opLen:])
+	var value interface{}
+	if err := json.Unmarshal([]byte(rawValue), &value); err != nil {
+		value = rawValue
+	}
+	if op == FilterGlob || op == FilterContains {
+		s, ok := value.(string)
+		if !ok {
+			s = rawValue
+		}
+		if op == FilterGlob {
+			if _, err := path.Match(s, ""); err != nil {
+				return Filter{}, NewErrorf(StatusBadRequest, "Invalid pattern in filter %s: %v", expr, err)
+			}
+		}
+		value = s
+	}
+	return Filter{Name: name, Op: op, Value: value}, nil
+}
+
+// String returns the filter as expression (q.v. ParseFilter).
+func (f Filter) String() string {
+	switch f.Op {
+	case FilterExists:
+		return f.Name
+	case FilterNotExists:
+		return "!" + f.Name
+	}
+	var opText string
+	for _, o := range filterOpTexts {
+		if o.op == f.Op {
+			opText = o.text
+			break
+		}
+	}
+	var valueText string
+	if s, ok := f.Value.(string); ok && (f.Op == FilterGlob || f.Op == FilterContains) {
+		valueText = s
+	} else {
+		b, err := json.Marshal(f.Value)
+		if err != nil {
+			valueText = fmt.Sprint(f.Value)
+		} else {
+			valueText = string(b)
+		}
+	}
+	return f.Name + opText + valueText
+}
+
+// Match checks the filter against the properties of a VEAP object.
+func (f Filter) Match(attributes AttrValues, links []Link) bool {
+	// collect values
+	var values []interface{}
+	if f.Name == LinksMarker {
+		for _, l := range links {
+			values = append(values, l.Role)
+		}
+	} else if v, ok := attributes[f.Name]; ok {
+		values = flattenValue(v)
+	}
+
+	// check values
+	switch f.Op {
+	case FilterExists:
+		return len(values) > 0
+	case FilterNotExists:
+		return len(values) == 0
+	case FilterNotEqual:
+		for _, v := range values {
+			if c, ok := compareValues(v, f.Value); ok && c == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		if f.matchValue(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Filter) matchValue(v interface{}) bool {
+	switch f.Op {
+	case FilterGlob:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		m, _ := path.Match(f.Value.(string), s)
+		return m
+	case FilterContains:
+		s, ok := v.(string)
+		return ok && strings.Contains(s, f.Value.(string))
+	}
+	c, ok := compareValues(v, f.Value)
+	if !ok {
+		return false
+	}
+	// booleans can only be checked for equality
+	if _, isBool := v.(bool); isBool && f.Op != FilterEqual {
+		return false
+	}
+	switch f.Op {
+	case FilterEqual:
+		return c == 0
+	case FilterLess:
+		return c < 0
+	case FilterLessEqual:
+		return c <= 0
+	case FilterGreater:
+		return c > 0
+	case FilterGreaterEqual:
+		return c >= 0
+	}
+	return false
+}
+
+// MatchFilters checks all filters against the properties of a VEAP object.
+func MatchFilters(filters []Filter, attributes AttrValues, links []Link) bool {
+	for _, f := range filters {
+		if !f.Match(attributes, links) {
+			return false
+		}
+	}
+	return true
+}
+
+// flattenValue returns the elements of an array or the value itself.
+func flattenValue(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	if v == nil || rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return []interface{}{v}
+	}
+	r := make([]interface{}, rv.Len())
+	for i := range r {
+		r[i] = rv.Index(i).Interface()
+	}
+	return r
+}
+
+// compareValues compares numbers, strings and booleans. For booleans only the
+// result 0 is meaningful. Returns false, if the values are not comparable.
+func compareValues(a, b interface{}) (int, bool) {
+	if fa, ok := ToFloat64(a); ok {
+		fb, ok := ToFloat64(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch va := a.(type) {
+	case string:
+		vb, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(va, vb), true
+	case bool:
+		vb, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if va == vb {
+			return 0, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
@@ -0,0 +1,88 @@
+package veap
+
+import (
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	cases := []struct {
+		expr   string
+		filter Filter
+		text   string
+	}{
+		{"title", Filter{Name: "title", Op: FilterExists}, "title"},
+		{" !title ", Filter{Name: "title", Op: FilterNotExists}, "!title"},
+		{"role==device", Filter{Name: "role", Op: FilterEqual, Value: "device"}, `role=="device"`},
+		{"role=device", Filter{Name: "role", Op: FilterEqual, Value: "device"}, `role=="device"`},
+		{`role!="device"`, Filter{Name: "role", Op: FilterNotEqual, Value: "device"}, `role!="device"`},
+		{"level<=2.5", Filter{Name: "level", Op: FilterLessEqual, Value: 2.5}, "level<=2.5"},
+		{"level>3", Filter{Name: "level", Op: FilterGreater, Value: 3.0}, "level>3"},
+		{"active==true", Filter{Name: "active", Op: FilterEqual, Value: true}, "active==true"},
+		{"title~=Kit*", Filter{Name: "title", Op: FilterGlob, Value: "Kit*"}, "title~=Kit*"},
+		{"title*=chen", Filter{Name: "title", Op: FilterContains, Value: "chen"}, "title*=chen"},
+	}
+	for _, c := range cases {
+		f, err := ParseFilter(c.expr)
+		if err != nil {
+			t.Errorf("Parsing of %s failed: %v", c.expr, err)
+			continue
+		}
+		if f != c.filter {
+			t.Errorf("Wrong filter for %s: %+v", c.expr, f)
+		}
+		if f.String() != c.text {
+			t.Errorf("Wrong text for %s: %s", c.expr, f.String())
+		}
+	}
+	for _, expr := range []string{"", "!", "==1", "=1", "title~=["} {
+		if _, err := ParseFilter(expr); err == nil || err.Code() != StatusBadRequest {
+			t.Errorf("Expected error for %s: %v", expr, err)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	attrs := AttrValues{
+		"title":  "Kitchen Light",
+		"level":  2,
+		"active": true,
+		"tags":   []interface{}{"light", "dimmer"},
+	}
+	links := []Link{{Role: "device"}, {Role: ServiceMarker}}
+	cases := []struct {
+		expr  string
+		match bool
+	}{
+		{"title", true},
+		{"!title", false},
+		{"!missing", true},
+		{"title==Kitchen Light", true},
+		{"title!=Kitchen Light", false},
+		{"missing!=x", true},
+		{"title*=Kitchen", true},
+		{"title*=kitchen", false},
+		{"title~=K*Light", true},
+		{"level==2", true},
+		{"level<2", false},
+		{"level<=2", true},
+		{"level>1.5", true},
+		{"level>=3", false},
+		{"level==abc", false},
+		{"active==true", true},
+		{"active>false", false},
+		{"tags==dimmer", true},
+		{"tags==switch", false},
+		{"~links==device", true},
+		{"~links==channel", false},
+		{"~links", true},
+	}
+	for _, c := range cases {
+		f, err := ParseFilter(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Match(attrs, links) != c.match {
+			t.Errorf("Wrong result for %s", c.expr)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+/*
+Package history implements a durable, file-backed store for the histories of
+data points. The histories can be used with model.HistoryReader and
+model.HistoryWriter.
+
+Each data point has its own directory with append-only segment files. A
+segment contains entries in ascending time order, the time ranges of the
+segments do not overlap. The list of valid segments is kept in a manifest
+file, which is replaced atomically. New entries after the end of the history
+are appended to the last segment. Writes into the existing time range rewrite
+the affected segments into new segment files before the manifest is updated.
+On opening, incomplete records at the end of a segment (e.g. after a crash)
+are truncated and files not referenced by the manifest are removed. Therefore
+a rewrite is either completely applied or not at all. Of an interrupted append
+the leading entries may be kept.
+*/
+package history
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+)
+
+const (
+	// default max. number of entries in a segment
+	defaultSegmentSize = 10000
+
+	manifestFile  = "manifest.json"
+	segmentSuffix = ".seg"
+	tempSuffix    = ".tmp"
+	segmentMagic  = "VEAPHST1"
+
+	// size of the record header: payload length and checksum
+	recordHeaderSize = 8
+	// size of the fixed payload part: time and state
+	recordFixedSize = 12
+)
+
+var log = logging.Get("veap-history")
+
+// Store manages the histories of data points in a directory. Each data point
+// is identified by an arbitrary string (e.g. the VEAP path).
+type Store struct {
+	// Dir is the base directory of the store. It is created, if it does not
+	// exist.
+	Dir string
+
+	// SegmentSize is the maximum number of entries in a segment file. If not
+	// set, the limit is 10000 entries.
+	SegmentSize int
+
+	mutex  sync.Mutex
+	series map[string]*Series
+}
+
+// Series returns the history of a data point. The history is opened on first
+// access.
+func (s *Store) Series(id string) (*Series, veap.Error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ser, ok := s.series[id]; ok {
+		return ser, nil
+	}
+	if id == "" {
+		return nil, veap.NewErrorf(veap.StatusBadRequest, "Empty history identifier")
+	}
+	segmentSize := s.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+	ser := &Series{dir: filepath.Join(s.Dir, dirName(id)), segmentSize: segmentSize}
+	if err := ser.open(); err != nil {
+		return nil, veap.NewErrorf(veap.StatusInternalServerError, "Opening of history %s failed: %v", id, err)
+	}
+	if s.series == nil {
+		s.series = make(map[string]*Series)
+	}
+	s.series[id] = ser
+	return ser, nil
+}
+
+// dirName escapes all characters except letters, digits, - and _.
+func dirName(id string) string {
+	var sb strings.Builder
+	for _, b := range []byte(id) {
+		if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '-' || b == '_' {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+// Series is the history of a single data point. It implements
+// model.HistoryReader and model.HistoryWriter. ReadHistory returns the entries
+// from begin (inclusive) to end (exclusive), at most limit entries.
+type Series struct {
+	dir         string
+	segmentSize int
+
+	mutex sync.RWMutex
+	// ordered by time
+	segments []*segment
+	nextSeq  uint64
+}
+
+// Make sure that Series implements the history interfaces of package model.
+var _ model.HistoryReader = (*Series)(nil)
+var _ model.HistoryWriter = (*Series)(nil)
+var _ model.ContextHistoryReader = (*Series)(nil)
+var _ model.ContextHistoryWriter = (*Series)(nil)
+
+// segment is the index entry of a segment file.
+type segment struct {
+	name        string
+	first, last time.Time
+	count       int
+	// size of the valid content
+	size int64
+}
+
+type manifest struct {
+	NextSeq  uint64   `json:"nextSeq"`
+	Segments []string `json:"segments"`
+}
+
+// ReadHistory implements model.HistoryReader.
+func (s *Series) ReadHistory(begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	return s.ReadHistoryContext(context.Background(), begin, end, limit)
+}
+
+// ReadHistoryContext implements model.ContextHistoryReader.
+func (s *Series) ReadHistoryContext(ctx context.Context, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	hist := make([]veap.PV, 0)
+	// skip segments before begin
+	idx := sort.Search(len(s.segments), func(i int) bool { return !s.segments[i].last.Before(begin) })
+	for ; idx < len(s.segments) && s.segments[idx].first.Before(end); idx++ {
+		if err := veap.ContextError(ctx); err != nil {
+			return nil, err
+		}
+		entries, _, err := readSegment(filepath.Join(s.dir, s.segments[idx].name))
+		if err != nil {
+			return nil, veap.NewErrorf(veap.StatusInternalServerError, "Reading of history failed: %v", err)
+		}
+		first := sort.Search(len(entries), func(i int) bool { return !entries[i].Time.Before(begin) })
+		for _, e := range entries[first:] {
+			if !e.Time.Before(end) {
+				break
+			}
+			if limit >= 0 && int64(len(hist)) >= limit {
+				return hist, nil
+			}
+			hist = append(hist, e)
+		}
+	}
+	return hist, nil
+}
+
+// WriteHistory implements model.HistoryWriter.
+func (s *Series) WriteHistory(timeSeries []veap.PV) veap.Error {
+	return s.WriteHistoryContext(context.Background(), timeSeries)
+}
+
+// WriteHistoryContext implements model.ContextHistoryWriter. Existing entries
+// within the time range of the time series are replaced.
+func (s *Series) WriteHistoryContext(ctx context.Context, timeSeries []veap.PV) veap.Error {
+	if err := veap.ContextError(ctx); err != nil {
+		return err
+	}
+	if len(timeSeries) == 0 {
+		return nil
+	}
+	// sort entries
+	entries := make([]veap.PV, len(timeSeries))
+	copy(entries, timeSeries)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	// check values
+	for _, e := range entries {
+		if _, err := json.Marshal(e.Value); err != nil {
+			return veap.NewErrorf(veap.StatusBadRequest, "Invalid value in history: %v", err)
+		}
+	}
+	from, to := entries[0].Time, entries[len(entries)-1].Time
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var err error
+	if len(s.segments) == 0 || s.segments[len(s.segments)-1].last.Before(from) {
+		err = s.appendEntries(entries)
+	} else {
+		err = s.replaceRange(from, to, entries)
+	}
+	if err != nil {
+		return veap.NewErrorf(veap.StatusInternalServerError, "Writing of history failed: %v", err)
+	}
+	return nil
+}
+
+// appendEntries appends entries after the end of the history. mutex must be
+// locked.
+func (s *Series) appendEntries(entries []veap.PV) error {
+	// fill last segment
+	if len(s.segments) > 0 {
+		last := s.segments[len(s.segments)-1]
+		n := s.segmentSize - last.count
+		if n > len(entries) {
+			n = len(entries)
+		}
+		if n > 0 {
+			if err := appendSegment(filepath.Join(s.dir, last.name), last.size, entries[:n]); err != nil {
+				return err
+			}
+			last.last = entries[n-1].Time
+			last.count += n
+			last.size += encodedSize(entries[:n])
+			entries = entries[n:]
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	// create new segments
+	created, err := s.writeSegments(entries)
+	if err != nil {
+		return err
+	}
+	segments := append(append([]*segment{}, s.segments...), created...)
+	if err := s.commit(segments, nil); err != nil {
+		removeSegments(s.dir, created)
+		return err
+	}
+	return nil
+}
+
+// replaceRange replaces the entries from..to with the provided entries. mutex
+// must be locked.
+func (s *Series) replaceRange(from, to time.Time, entries []veap.PV) error {
+	// find affected segments
+	first := sort.Search(len(s.segments), func(i int) bool { return !s.segments[i].last.Before(from) })
+	last := first
+	for last < len(s.segments) && !s.segments[last].first.After(to) {
+		last++
+	}
+	affected := s.segments[first:last]
+
+	// merge entries
+	var merged []veap.PV
+	var after []veap.PV
+	for _, seg := range affected {
+		segEntries, _, err := readSegment(filepath.Join(s.dir, seg.name))
+		if err != nil {
+			return err
+		}
+		for _, e := range segEntries {
+			if e.Time.Before(from) {
+				merged = append(merged, e)
+			} else if e.Time.After(to) {
+				after = append(after, e)
+			}
+		}
+	}
+	merged = append(merged, entries...)
+	merged = append(merged, after...)
+
+	// write new segments
+	created, err := s.writeSegments(merged)
+	if err != nil {
+		return err
+	}
+	segments := make([]*segment, 0, len(s.segments)-len(affected)+len(created))
+	segments = append(segments, s.segments[:first]...)
+	segments = append(segments, created...)
+	segments = append(segments, s.segments[last:]...)
+	if err := s.commit(segments, affected); err != nil {
+		removeSegments(s.dir, created)
+		return err
+	}
+	return nil
+}
+
+// writeSegments writes the entries into new segment files. The files are not
+// referenced by the manifest yet. mutex must be locked.
+func (s *Series) writeSegments(entries []veap.PV) ([]*segment, error) {
+	var created []*segment
+	for len(entries) > 0 {
+		n := s.segmentSize
+		if n > len(entries) {
+			n = len(entries)
+		}
+		seg := &segment{
+			name:  fmt.Sprintf("%016x%s", s.nextSeq, segmentSuffix),
+			first: entries[0].Time,
+			last:  entries[n-1].Time,
+			count: n,
+			size:  int64(len(segmentMagic)) + encodedSize(entries[:n]),
+		}
+		s.nextSeq++
+		if err := writeFileSync(filepath.Join(s.dir, seg.name), encodeSegment(entries[:n])); err != nil {
+			removeSegments(s.dir, created)
+			return nil, err
+		}
+		created = append(created, seg)
+		entries = entries[n:]
+	}
+	return created, nil
+}
+
+// commit stores the new list of segments in the manifest and removes the
+// obsolete segment files. mutex must be locked.
+func (s *Series) commit(segments, obsolete []*segment) error {
+	m := manifest{NextSeq: s.nextSeq, Segments: make([]string, len(segments))}
+	for i, seg := range segments {
+		m.Segments[i] = seg.name
+	}
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	// replace manifest atomically
+	tmpFile := filepath.Join(s.dir, manifestFile+tempSuffix)
+	if err := writeFileSync(tmpFile, content); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, filepath.Join(s.dir, manifestFile)); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	syncDir(s.dir)
+	s.segments = segments
+	removeSegments(s.dir, obsolete)
+	return nil
+}
+
+// open reads the manifest and the segment index.
+func (s *Series) open() error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	// read manifest
+	var m manifest
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, manifestFile))
+	if err == nil {
+		if err := json.Unmarshal(content, &m); err != nil {
+			return fmt.Errorf("Invalid manifest: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	s.nextSeq = m.NextSeq
+
+	// build index
+	referenced := make(map[string]bool)
+	for _, name := range m.Segments {
+		referenced[name] = true
+		segFile := filepath.Join(s.dir, name)
+		entries, size, err := readSegment(segFile)
+		if err != nil {
+			return err
+		}
+		// truncate incomplete records
+		if fi, err := os.Stat(segFile); err == nil && fi.Size() > size {
+			log.Warningf("Truncating history segment %s from %d to %d bytes", segFile, fi.Size(), size)
+			if err := os.Truncate(segFile, size); err != nil {
+				return err
+			}
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		s.segments = append(s.segments, &segment{
+			name:  name,
+			first: entries[0].Time,
+			last:  entries[len(entries)-1].Time,
+			count: len(entries),
+			size:  size,
+		})
+	}
+
+	// remove unreferenced files of interrupted writes
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		name := fi.Name()
+		if (strings.HasSuffix(name, segmentSuffix) && !referenced[name]) || strings.HasSuffix(name, tempSuffix) {
+			log.Debugf("Removing unreferenced history file %s", filepath.Join(s.dir, name))
+			os.Remove(filepath.Join(s.dir, name))
+		}
+	}
+	return nil
+}
+
+// encodeSegment creates the content of a segment file.
+func encodeSegment(entries []veap.PV) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(segmentMagic)
+	for _, e := range entries {
+		buf.Write(encodeRecord(e))
+	}
+	return buf.Bytes()
+}
+
+// encodeRecord creates a record: payload length (uint32), CRC-32 of the
+// payload (uint32), payload. The payload consists of the time in nanoseconds
+// (int64), the state (int32) and the value in JSON. The value must have been
+// checked before.
+func encodeRecord(pv veap.PV) []byte {
+	value, _ := json.Marshal(pv.Value)
+	rec := make([]byte, recordHeaderSize+recordFixedSize+len(value))
+	payload := rec[recordHeaderSize:]
+	binary.BigEndian.PutUint64(payload[0:], uint64(pv.Time.UnixNano()))
+	binary.BigEndian.PutUint32(payload[8:], uint32(int32(pv.State)))
+	copy(payload[recordFixedSize:], value)
+	binary.BigEndian.PutUint32(rec[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(payload))
+	return rec
+}
+
+func encodedSize(entries []veap.PV) int64 {
+	var size int64
+	for _, e := range entries {
+		size += int64(len(encodeRecord(e)))
+	}
+	return size
+}
+
+// readSegment reads all valid records of a segment file. Additionally the
+// size of the valid content is returned. Reading stops at the first
+// incomplete or corrupted record.
+func readSegment(segFile string) ([]veap.PV, int64, error) {
+	content, err := ioutil.ReadFile(segFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !bytes.HasPrefix(content, []byte(segmentMagic)) {
+		if len(content) < len(segmentMagic) {
+			// file creation interrupted
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("Invalid history segment: %s", segFile)
+	}
+	pos := len(segmentMagic)
+	var entries []veap.PV
+	for {
+		rem := content[pos:]
+		if len(rem) < recordHeaderSize {
+			break
+		}
+		length := int(binary.BigEndian.Uint32(rem[0:]))
+		if length < recordFixedSize || len(rem) < recordHeaderSize+length {
+			break
+		}
+		payload := rem[recordHeaderSize : recordHeaderSize+length]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(rem[4:]) {
+			break
+		}
+		var value interface{}
+		if err := json.Unmarshal(payload[recordFixedSize:], &value); err != nil {
+			break
+		}
+		entries = append(entries, veap.PV{
+			Time:  time.Unix(0, int64(binary.BigEndian.Uint64(payload[0:]))),
+			State: veap.State(int32(binary.BigEndian.Uint32(payload[8:]))),
+			Value: value,
+		})
+		pos += recordHeaderSize + length
+	}
+	return entries, int64(pos), nil
+}
+
+// appendSegment appends entries to a segment file. On error the file is
+// truncated to its previous size.
+func appendSegment(segFile string, size int64, entries []veap.PV) error {
+	f, err := os.OpenFile(segFile, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		buf.Write(encodeRecord(e))
+	}
+	_, err = f.WriteAt(buf.Bytes(), size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(size)
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeFileSync writes a file and flushes it to the storage.
+func writeFileSync(name string, content []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes a directory, so that renames are durable. Not all operating
+// systems support this, errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+func removeSegments(dir string, segments []*segment) {
+	for _, seg := range segments {
+		if err := os.Remove(filepath.Join(dir, seg.name)); err != nil {
+			log.Warningf("Removing of history segment failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-veap"
+)
+
+func entries(secs ...int64) []veap.PV {
+	var hist []veap.PV
+	for _, s := range secs {
+		hist = append(hist, veap.PV{Time: time.Unix(s, 0), Value: float64(s), State: veap.StateGood})
+	}
+	return hist
+}
+
+func checkHistory(t *testing.T, ser *Series, expected []veap.PV) {
+	t.Helper()
+	hist, err := ser.ReadHistory(time.Unix(0, 0), time.Unix(1000, 0), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, hist)
+	}
+	for i := range hist {
+		if !hist[i].Equal(expected[i]) {
+			t.Fatalf("Expected %v, got %v", expected, hist)
+		}
+	}
+}
+
+func TestSeries(t *testing.T) {
+	dir := t.TempDir()
+	store := &Store{Dir: dir, SegmentSize: 3}
+	ser, err := store.Series("/dev/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// append
+	if err := ser.WriteHistory(entries(2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ser.WriteHistory(entries(3, 4, 5, 6, 7)); err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(t, ser, entries(1, 2, 3, 4, 5, 6, 7))
+	if len(ser.segments) != 3 {
+		t.Error(len(ser.segments))
+	}
+
+	// replace range
+	if err := ser.WriteHistory(entries(3, 6)); err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(t, ser, entries(1, 2, 3, 6, 7))
+	if err := ser.WriteHistory(entries(0)); err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(t, ser, entries(0, 1, 2, 3, 6, 7))
+
+	// time range and limit
+	hist, err := ser.ReadHistory(time.Unix(2, 0), time.Unix(7, 0), 10)
+	if err != nil || !reflect.DeepEqual(hist, entries(2, 3, 6)) {
+		t.Error(hist, err)
+	}
+	hist, err = ser.ReadHistory(time.Unix(1, 0), time.Unix(7, 0), 2)
+	if err != nil || !reflect.DeepEqual(hist, entries(1, 2)) {
+		t.Error(hist, err)
+	}
+
+	// only referenced segments are kept
+	files, _ := filepath.Glob(filepath.Join(ser.dir, "*"+segmentSuffix))
+	if len(files) != len(ser.segments) {
+		t.Error(files)
+	}
+
+	// reopen
+	ser2, err := (&Store{Dir: dir, SegmentSize: 3}).Series("/dev/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(t, ser2, entries(0, 1, 2, 3, 6, 7))
+}
+
+func TestSeriesRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ser, err := (&Store{Dir: dir}).Series("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ser.WriteHistory(entries(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ser.WriteHistory(entries(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate crash: torn record and unreferenced segment
+	segFile := filepath.Join(ser.dir, ser.segments[0].name)
+	fi, statErr := os.Stat(segFile)
+	if statErr != nil {
+		t.Fatal(statErr)
+	}
+	if err := os.Truncate(segFile, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(ser.dir, "00000000000000ff"+segmentSuffix)
+	if err := ioutil.WriteFile(orphan, encodeSegment(entries(9)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ser, err = (&Store{Dir: dir}).Series("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(t, ser, entries(1, 2))
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("unreferenced segment not removed")
+	}
+	// append after truncation
+	if err := ser.WriteHistory(entries(4)); err != nil {
+		t.Fatal(err)
+	}
+	ser, err = (&Store{Dir: dir}).Series("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(t, ser, entries(1, 2, 4))
+}
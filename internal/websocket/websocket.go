@@ -0,0 +1,464 @@
+// Package websocket implements the parts of the WebSocket protocol (RFC 6455)
+// needed by the VEAP WebSocket transport: the opening handshake, text and
+// binary messages, ping/pong and the closing handshake. Extensions and
+// subprotocols are not supported.
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// frame opcodes
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	finBit  = 0x80
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	// max. payload of a control frame
+	maxControlPayload = 125
+
+	// default max. size of a received message: 1 MB
+	defaultReadLimit = 1 * 1024 * 1024
+
+	// max. size of the body of a failed handshake response
+	handshakeBodyLimit = 4 * 1024
+
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// Close status codes
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseNoStatus      = 1005
+	CloseTooBig        = 1009
+)
+
+// ErrClosed is returned, if the connection is already closed.
+var ErrClosed = errors.New("WebSocket connection closed")
+
+// CloseError is returned by ReadMessage, if the peer closed the connection.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("WebSocket closed by peer: %d", e.Code)
+	}
+	return fmt.Sprintf("WebSocket closed by peer: %d (%s)", e.Code, e.Text)
+}
+
+// HandshakeError is returned by Dial, if the server rejected the opening
+// handshake.
+type HandshakeError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("WebSocket handshake failed with HTTP status %d (%s)", e.StatusCode, e.Body)
+}
+
+// Conn is a WebSocket connection. ReadMessage must not be called concurrently.
+// WriteMessage and Close can be called from any goroutine.
+type Conn struct {
+	// ReadLimit is the maximum size of a received message. If not set, the
+	// limit is 1 MB. It must be set before the first ReadMessage.
+	ReadLimit int64
+
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool
+
+	writeMutex sync.Mutex
+	closeSent  bool
+}
+
+// IsHandshake checks whether the HTTP request starts a WebSocket opening
+// handshake.
+func IsHandshake(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") &&
+		headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// Upgrade completes the opening handshake of a server and takes over the
+// underlying connection of the HTTP request. If the request is not a valid
+// opening handshake, an error is returned and nothing is written to w. The
+// Origin header is not checked, this must be done by the caller.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("Invalid method for WebSocket handshake: %s", r.Method)
+	}
+	if !IsHandshake(r) {
+		return nil, errors.New("Missing WebSocket upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("Unsupported WebSocket version: %s", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		return nil, fmt.Errorf("Invalid WebSocket key: %s", key)
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("HTTP connection can not be taken over")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("Taking over HTTP connection failed: %v", err)
+	}
+	// timeouts of the HTTP server are not applicable
+	conn.SetDeadline(time.Time{})
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Sending of WebSocket handshake failed: %v", err)
+	}
+	return &Conn{conn: conn, reader: rw.Reader}, nil
+}
+
+// Dial opens a WebSocket connection as client. The scheme of the URL must be
+// ws, wss, http or https. The header is added to the opening handshake (e.g.
+// for authentication). tlsConfig is used for wss and https, it may be nil.
+func Dial(ctx context.Context, rawURL string, header http.Header, tlsConfig *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid WebSocket URL %s: %v", rawURL, err)
+	}
+	var secure bool
+	switch u.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		secure = true
+	default:
+		return nil, fmt.Errorf("Invalid scheme of WebSocket URL: %s", rawURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	// connect
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting to %s failed: %v", addr, err)
+	}
+
+	// abort the handshake, if the context is done
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	c, err := handshake(conn, u, secure, header, tlsConfig)
+	close(stop)
+	<-stopped
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func handshake(conn net.Conn, u *url.URL, secure bool, header http.Header, tlsConfig *tls.Config) (*Conn, error) {
+	if secure {
+		cfg := &tls.Config{}
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		conn = tlsConn
+	}
+
+	// send request
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Creating WebSocket key failed: %v", err)
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("Sending of WebSocket handshake failed: %v", err)
+	}
+
+	// receive response
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("Receiving of WebSocket handshake failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, handshakeBodyLimit))
+		resp.Body.Close()
+		return nil, &HandshakeError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	if !headerContains(resp.Header, "Upgrade", "websocket") ||
+		!headerContains(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, errors.New("Invalid WebSocket handshake response")
+	}
+	return &Conn{conn: conn, reader: reader, client: true}, nil
+}
+
+// ReadMessage reads the next text or binary message. Ping frames are answered
+// automatically. If the peer closes the connection, the closing handshake is
+// completed and a *CloseError is returned.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	limit := c.ReadLimit
+	if limit <= 0 {
+		limit = defaultReadLimit
+	}
+	var msg []byte
+	var fragmented bool
+	for {
+		fin, op, payload, err := c.readFrame(limit - int64(len(msg)))
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			code, text := CloseNoStatus, ""
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+				text = string(payload[2:])
+			}
+			c.closeWith(code)
+			return nil, &CloseError{Code: code, Text: text}
+		case opText, opBinary:
+			if fragmented {
+				return nil, c.fail(CloseProtocolError, "Unexpected start of WebSocket message")
+			}
+			msg = payload
+		case opContinuation:
+			if !fragmented {
+				return nil, c.fail(CloseProtocolError, "Unexpected WebSocket continuation frame")
+			}
+			msg = append(msg, payload...)
+		default:
+			return nil, c.fail(CloseProtocolError, fmt.Sprintf("Invalid WebSocket opcode: %d", op))
+		}
+		if fin {
+			return msg, nil
+		}
+		fragmented = true
+	}
+}
+
+// readFrame reads a single frame. The payload is unmasked.
+func (c *Conn) readFrame(limit int64) (fin bool, op byte, payload []byte, err error) {
+	var hdr [8]byte
+	if _, err = io.ReadFull(c.reader, hdr[:2]); err != nil {
+		return
+	}
+	fin = hdr[0]&finBit != 0
+	op = hdr[0] & 0x0f
+	masked := hdr[1]&maskBit != 0
+	length := uint64(hdr[1] & 0x7f)
+	if hdr[0]&rsvBits != 0 {
+		err = c.fail(CloseProtocolError, "Unsupported WebSocket extension")
+		return
+	}
+	if masked == c.client {
+		err = c.fail(CloseProtocolError, "Invalid masking of WebSocket frame")
+		return
+	}
+	switch length {
+	case 126:
+		if _, err = io.ReadFull(c.reader, hdr[:2]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.reader, hdr[:8]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(hdr[:8])
+	}
+	if op >= opClose && (!fin || length > maxControlPayload) {
+		err = c.fail(CloseProtocolError, "Invalid WebSocket control frame")
+		return
+	}
+	if op < opClose && length > uint64(limit) {
+		err = c.fail(CloseTooBig, "WebSocket message too big")
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// WriteMessage sends a text message.
+func (c *Conn) WriteMessage(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// Close starts the closing handshake and closes the underlying connection.
+func (c *Conn) Close() error {
+	return c.closeWith(CloseNormal)
+}
+
+func (c *Conn) closeWith(code int) error {
+	var payload []byte
+	if code != CloseNoStatus {
+		payload = make([]byte, 2)
+		binary.BigEndian.PutUint16(payload, uint16(code))
+	}
+	// the peer may already be gone
+	c.writeFrame(opClose, payload)
+	return c.conn.Close()
+}
+
+// fail closes the connection because of a protocol violation.
+func (c *Conn) fail(code int, reason string) error {
+	c.closeWith(code)
+	return errors.New(reason)
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	// build frame
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, finBit|op)
+	var maskFlag byte
+	if c.client {
+		maskFlag = maskBit
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskFlag|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskFlag|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskFlag|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return fmt.Errorf("Creating WebSocket mask failed: %v", err)
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains checks whether a comma separated header contains a token
+// (case insensitive).
+func headerContains(header http.Header, name, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
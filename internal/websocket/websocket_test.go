@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEcho(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "secret" {
+			http.Error(w, "not authorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		conn.ReadLimit = 100000
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msg); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	// handshake errors
+	_, err := Dial(context.Background(), srv.URL, nil, nil)
+	if he, ok := err.(*HandshakeError); !ok || he.StatusCode != http.StatusUnauthorized {
+		t.Fatal(err)
+	}
+
+	// echo messages of different sizes
+	header := http.Header{"Authorization": {"secret"}}
+	conn, err := Dial(context.Background(), strings.Replace(srv.URL, "http", "ws", 1), header, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, 125, 126, 65535, 65536, 100000} {
+		msg := bytes.Repeat([]byte{'x'}, size)
+		if err := conn.WriteMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+		echo, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, echo) {
+			t.Errorf("Echo of %d bytes failed", size)
+		}
+	}
+
+	// ping and fragmented message
+	writeRaw(t, conn, opText, false, []byte("ab"))
+	writeRaw(t, conn, opPing, true, []byte("ping"))
+	writeRaw(t, conn, opContinuation, true, []byte("cd"))
+	fin, op, payload, err := conn.readFrame(1000)
+	if err != nil || !fin || op != opPong || string(payload) != "ping" {
+		t.Error(fin, op, string(payload), err)
+	}
+	echo, err := conn.ReadMessage()
+	if err != nil || string(echo) != "abcd" {
+		t.Error(string(echo), err)
+	}
+
+	// too big
+	if err := conn.WriteMessage(make([]byte, 100001)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.ReadMessage()
+	if ce, ok := err.(*CloseError); !ok || ce.Code != CloseTooBig {
+		t.Error(err)
+	}
+	if err := conn.WriteMessage(nil); err != ErrClosed {
+		t.Error(err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	done := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err = conn.ReadMessage()
+		done <- err
+	}))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), srv.URL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if ce, ok := (<-done).(*CloseError); !ok || ce.Code != CloseNormal {
+		t.Error(ce)
+	}
+
+	// invalid handshake
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error(resp.StatusCode)
+	}
+}
+
+// writeRaw writes a single masked frame.
+func writeRaw(t *testing.T, c *Conn, op byte, fin bool, payload []byte) {
+	b0 := op
+	if fin {
+		b0 |= finBit
+	}
+	frame := append([]byte{b0, maskBit | byte(len(payload)), 0, 0, 0, 0}, payload...)
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,566 @@
+package veap
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryService is a complete in-memory implementation of Service and
+// MetaService. It stores objects with attributes, PVs and histories. It can be
+// used as backend for prototypes and as reference for the expected behavior
+// of services. The zero value is an empty object tree with only the root
+// object.
+//
+// Objects are created with WriteProperties, the parent object must exist.
+// WriteProperties on an existing object replaces its attributes. The
+// attribute title is used as title of the links to the object. Delete removes
+// the object and all its descendants. The root object can not be deleted.
+//
+// ReadPV and ReadHistory fail with StatusNotFound, if no PV or history was
+// written. ReadHistory returns the entries from begin (inclusive) to end
+// (exclusive), at most limit entries. WriteHistory replaces the stored
+// entries in the time range of the time series.
+//
+// Additionally MemoryService implements Subscriber and WritePreparer for
+// atomic writes.
+type MemoryService struct {
+	// Workers and CallTimeout are passed to the BasicMetaService used for
+	// ExgData and Query. They must be set before first use.
+	Workers     int
+	CallTimeout time.Duration
+
+	store    memoryStore
+	meta     BasicMetaService
+	metaOnce sync.Once
+}
+
+// Make sure that MemoryService implements all service interfaces.
+var _ Service = (*MemoryService)(nil)
+var _ ContextService = (*MemoryService)(nil)
+var _ MetaService = (*MemoryService)(nil)
+var _ ContextMetaService = (*MemoryService)(nil)
+var _ ExtendedExgDataService = (*MemoryService)(nil)
+var _ ExtendedQueryService = (*MemoryService)(nil)
+var _ StreamingQueryService = (*MemoryService)(nil)
+var _ Subscriber = (*MemoryService)(nil)
+var _ WritePreparer = (*MemoryService)(nil)
+
+// ReadPV implements Service.
+func (m *MemoryService) ReadPV(path string) (PV, Error) {
+	return m.metaService().ReadPVContext(context.Background(), path)
+}
+
+// ReadPVContext implements ContextService.
+func (m *MemoryService) ReadPVContext(ctx context.Context, path string) (PV, Error) {
+	return m.metaService().ReadPVContext(ctx, path)
+}
+
+// WritePV implements Service.
+func (m *MemoryService) WritePV(path string, pv PV) Error {
+	return m.metaService().WritePVContext(context.Background(), path, pv)
+}
+
+// WritePVContext implements ContextService.
+func (m *MemoryService) WritePVContext(ctx context.Context, path string, pv PV) Error {
+	return m.metaService().WritePVContext(ctx, path, pv)
+}
+
+// PrepareWritePV implements WritePreparer.
+func (m *MemoryService) PrepareWritePV(ctx context.Context, path string, pv PV) (PreparedWrite, Error) {
+	return m.metaService().PrepareWritePV(ctx, path, pv)
+}
+
+// ReadHistory implements Service.
+func (m *MemoryService) ReadHistory(path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	return m.metaService().ReadHistoryContext(context.Background(), path, begin, end, limit)
+}
+
+// ReadHistoryContext implements ContextService.
+func (m *MemoryService) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	return m.metaService().ReadHistoryContext(ctx, path, begin, end, limit)
+}
+
+// WriteHistory implements Service.
+func (m *MemoryService) WriteHistory(path string, timeSeries []PV) Error {
+	return m.metaService().WriteHistoryContext(context.Background(), path, timeSeries)
+}
+
+// WriteHistoryContext implements ContextService.
+func (m *MemoryService) WriteHistoryContext(ctx context.Context, path string, timeSeries []PV) Error {
+	return m.metaService().WriteHistoryContext(ctx, path, timeSeries)
+}
+
+// ReadProperties implements Service.
+func (m *MemoryService) ReadProperties(path string) (AttrValues, []Link, Error) {
+	return m.metaService().ReadPropertiesContext(context.Background(), path)
+}
+
+// ReadPropertiesContext implements ContextService.
+func (m *MemoryService) ReadPropertiesContext(ctx context.Context, path string) (AttrValues, []Link, Error) {
+	return m.metaService().ReadPropertiesContext(ctx, path)
+}
+
+// WriteProperties implements Service.
+func (m *MemoryService) WriteProperties(path string, attributes AttrValues) (bool, Error) {
+	return m.metaService().WritePropertiesContext(context.Background(), path, attributes)
+}
+
+// WritePropertiesContext implements ContextService.
+func (m *MemoryService) WritePropertiesContext(ctx context.Context, path string, attributes AttrValues) (bool, Error) {
+	return m.metaService().WritePropertiesContext(ctx, path, attributes)
+}
+
+// Delete implements Service.
+func (m *MemoryService) Delete(path string) Error {
+	return m.metaService().DeleteContext(context.Background(), path)
+}
+
+// DeleteContext implements ContextService.
+func (m *MemoryService) DeleteContext(ctx context.Context, path string) Error {
+	return m.metaService().DeleteContext(ctx, path)
+}
+
+// ExgData implements MetaService.
+func (m *MemoryService) ExgData(writePVs []WritePVParam, readPaths []string) ([]Error, []ReadPVResult, Error) {
+	return m.metaService().ExgDataContext(context.Background(), writePVs, readPaths)
+}
+
+// ExgDataContext implements ContextMetaService.
+func (m *MemoryService) ExgDataContext(ctx context.Context, writePVs []WritePVParam, readPaths []string) ([]Error, []ReadPVResult, Error) {
+	return m.metaService().ExgDataContext(ctx, writePVs, readPaths)
+}
+
+// ExtendedExgData implements ExtendedExgDataService.
+func (m *MemoryService) ExtendedExgData(ctx context.Context, params ExgDataParams) (ExgDataResults, Error) {
+	return m.metaService().ExtendedExgData(ctx, params)
+}
+
+// Query implements MetaService.
+func (m *MemoryService) Query(pathPatterns []string) ([]QueryResult, Error) {
+	return m.metaService().QueryContext(context.Background(), pathPatterns)
+}
+
+// QueryContext implements ContextMetaService.
+func (m *MemoryService) QueryContext(ctx context.Context, pathPatterns []string) ([]QueryResult, Error) {
+	return m.metaService().QueryContext(ctx, pathPatterns)
+}
+
+// ExtendedQuery implements ExtendedQueryService.
+func (m *MemoryService) ExtendedQuery(ctx context.Context, params QueryParams) ([]QueryResult, Error) {
+	return m.metaService().ExtendedQuery(ctx, params)
+}
+
+// QueryFunc implements StreamingQueryService.
+func (m *MemoryService) QueryFunc(ctx context.Context, params QueryParams, handle func(item QueryResult) Error) Error {
+	return m.metaService().QueryFunc(ctx, params, handle)
+}
+
+// Subscribe implements Subscriber. The callback is invoked for every written
+// PV, also if the value does not change.
+func (m *MemoryService) Subscribe(paths []string, callback PVChangeFunc) (SubscriptionID, Error) {
+	return m.store.Subscribe(paths, callback)
+}
+
+// Unsubscribe implements Subscriber.
+func (m *MemoryService) Unsubscribe(id SubscriptionID) Error {
+	return m.store.Unsubscribe(id)
+}
+
+// metaService returns the BasicMetaService, which wraps the store. It adds
+// the meta service links to the root object.
+func (m *MemoryService) metaService() *BasicMetaService {
+	m.metaOnce.Do(func() {
+		m.meta.Service = &m.store
+		m.meta.Workers = m.Workers
+		m.meta.CallTimeout = m.CallTimeout
+	})
+	return &m.meta
+}
+
+type memoryObject struct {
+	attributes AttrValues
+	// identifiers (escaped) of the children
+	children map[string]bool
+	pv       *PV
+	// sorted by time
+	history []PV
+}
+
+type memorySub struct {
+	paths    map[string]bool
+	callback PVChangeFunc
+
+	// mutex is locked during callbacks, so that no callback is invoked after
+	// Unsubscribe returns
+	mutex   sync.Mutex
+	removed bool
+}
+
+// memoryStore holds the objects of a MemoryService.
+type memoryStore struct {
+	mutex   sync.RWMutex
+	objects map[string]*memoryObject
+
+	subsMutex sync.Mutex
+	subs      map[SubscriptionID]*memorySub
+	nextSubID SubscriptionID
+}
+
+// Make sure that memoryStore implements ContextService, WritePreparer and
+// Subscriber.
+var _ ContextService = (*memoryStore)(nil)
+var _ WritePreparer = (*memoryStore)(nil)
+var _ Subscriber = (*memoryStore)(nil)
+
+// mutex must be locked.
+func (s *memoryStore) init() {
+	if s.objects == nil {
+		s.objects = map[string]*memoryObject{"/": {children: make(map[string]bool)}}
+	}
+}
+
+// mutex must be locked (at least for reading).
+func (s *memoryStore) lookup(objPath string) (*memoryObject, Error) {
+	if s.objects == nil && objPath == "/" {
+		// root of an uninitialized store
+		return &memoryObject{}, nil
+	}
+	obj, ok := s.objects[objPath]
+	if !ok {
+		return nil, NewErrorf(StatusNotFound, "Object not found: %s", objPath)
+	}
+	return obj, nil
+}
+
+func (s *memoryStore) ReadPV(path string) (PV, Error) {
+	return s.ReadPVContext(context.Background(), path)
+}
+
+func (s *memoryStore) ReadPVContext(ctx context.Context, path string) (PV, Error) {
+	if err := ContextError(ctx); err != nil {
+		return PV{}, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	obj, err := s.lookup(path)
+	if err != nil {
+		return PV{}, err
+	}
+	if obj.pv == nil {
+		return PV{}, NewErrorf(StatusNotFound, "PV not available: %s", path)
+	}
+	return *obj.pv, nil
+}
+
+func (s *memoryStore) WritePV(path string, pv PV) Error {
+	return s.WritePVContext(context.Background(), path, pv)
+}
+
+func (s *memoryStore) WritePVContext(ctx context.Context, path string, pv PV) Error {
+	if err := ContextError(ctx); err != nil {
+		return err
+	}
+	if err := s.checkWritePV(path); err != nil {
+		return err
+	}
+	return s.writePV(path, pv)
+}
+
+func (s *memoryStore) PrepareWritePV(ctx context.Context, path string, pv PV) (PreparedWrite, Error) {
+	if err := s.checkWritePV(path); err != nil {
+		return nil, err
+	}
+	return &FuncPreparedWrite{
+		CommitFunc: func(ctx context.Context) Error {
+			return s.writePV(path, pv)
+		},
+	}, nil
+}
+
+func (s *memoryStore) checkWritePV(path string) Error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, err := s.lookup(path)
+	return err
+}
+
+func (s *memoryStore) writePV(path string, pv PV) Error {
+	s.mutex.Lock()
+	s.init()
+	obj, err := s.lookup(path)
+	if err != nil {
+		// deleted meanwhile
+		s.mutex.Unlock()
+		return err
+	}
+	obj.pv = &pv
+	s.mutex.Unlock()
+	s.notify(path, pv)
+	return nil
+}
+
+func (s *memoryStore) ReadHistory(path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	return s.ReadHistoryContext(context.Background(), path, begin, end, limit)
+}
+
+func (s *memoryStore) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	if err := ContextError(ctx); err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	obj, err := s.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if obj.history == nil {
+		return nil, NewErrorf(StatusNotFound, "History not available: %s", path)
+	}
+	// binary search for the time range
+	first := sort.Search(len(obj.history), func(i int) bool { return !obj.history[i].Time.Before(begin) })
+	last := sort.Search(len(obj.history), func(i int) bool { return !obj.history[i].Time.Before(end) })
+	if last < first {
+		last = first
+	}
+	if limit >= 0 && int64(last-first) > limit {
+		last = first + int(limit)
+	}
+	hist := make([]PV, last-first)
+	copy(hist, obj.history[first:last])
+	return hist, nil
+}
+
+func (s *memoryStore) WriteHistory(path string, timeSeries []PV) Error {
+	return s.WriteHistoryContext(context.Background(), path, timeSeries)
+}
+
+func (s *memoryStore) WriteHistoryContext(ctx context.Context, path string, timeSeries []PV) Error {
+	if err := ContextError(ctx); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.init()
+	obj, err := s.lookup(path)
+	if err != nil {
+		return err
+	}
+	if obj.history == nil {
+		obj.history = make([]PV, 0)
+	}
+	if len(timeSeries) == 0 {
+		return nil
+	}
+	// sort time series
+	entries := make([]PV, len(timeSeries))
+	copy(entries, timeSeries)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	from, to := entries[0].Time, entries[len(entries)-1].Time
+	// replace time range
+	hist := make([]PV, 0, len(obj.history)+len(entries))
+	inserted := false
+	for _, e := range obj.history {
+		if !e.Time.Before(from) && !e.Time.After(to) {
+			continue
+		}
+		if !inserted && e.Time.After(to) {
+			hist = append(hist, entries...)
+			inserted = true
+		}
+		hist = append(hist, e)
+	}
+	if !inserted {
+		hist = append(hist, entries...)
+	}
+	obj.history = hist
+	return nil
+}
+
+func (s *memoryStore) ReadProperties(path string) (AttrValues, []Link, Error) {
+	return s.ReadPropertiesContext(context.Background(), path)
+}
+
+func (s *memoryStore) ReadPropertiesContext(ctx context.Context, objPath string) (AttrValues, []Link, Error) {
+	if err := ContextError(ctx); err != nil {
+		return nil, nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	obj, err := s.lookup(objPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	// copy attributes
+	attr := make(AttrValues)
+	for k, v := range obj.attributes {
+		attr[k] = v
+	}
+	links := make([]Link, 0)
+	// items in ascending order
+	idents := make([]string, 0, len(obj.children))
+	for ident := range obj.children {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+	for _, ident := range idents {
+		links = append(links, Link{
+			Role:   "item",
+			Target: ident,
+			Title:  s.title(path.Join(objPath, ident)),
+		})
+	}
+	// collection
+	if objPath != "/" {
+		links = append(links, Link{
+			Role:   "collection",
+			Target: "..",
+			Title:  s.title(path.Dir(objPath)),
+		})
+		// services
+		links = append(links, Link{
+			Role:   ServiceMarker,
+			Target: PVMarker,
+			Title:  "PV Service",
+		})
+		links = append(links, Link{
+			Role:   ServiceMarker,
+			Target: HistMarker,
+			Title:  "History Service",
+		})
+	}
+	return attr, links, nil
+}
+
+// mutex must be locked (at least for reading).
+func (s *memoryStore) title(objPath string) string {
+	if obj, ok := s.objects[objPath]; ok {
+		if t, ok := obj.attributes["title"].(string); ok {
+			return t
+		}
+	}
+	return ""
+}
+
+func (s *memoryStore) WriteProperties(path string, attributes AttrValues) (bool, Error) {
+	return s.WritePropertiesContext(context.Background(), path, attributes)
+}
+
+func (s *memoryStore) WritePropertiesContext(ctx context.Context, objPath string, attributes AttrValues) (bool, Error) {
+	if err := ContextError(ctx); err != nil {
+		return false, err
+	}
+	if !path.IsAbs(objPath) || (objPath != "/" && strings.HasSuffix(objPath, "/")) || path.Clean(objPath) != objPath {
+		return false, NewErrorf(StatusBadRequest, "Invalid path: %s", objPath)
+	}
+	if _, ok := attributes[LinksMarker]; ok {
+		return false, NewErrorf(StatusMethodNotAllowed, "Writing of links not supported: %s", objPath)
+	}
+	// copy attributes
+	attr := make(AttrValues)
+	for k, v := range attributes {
+		attr[k] = v
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.init()
+	// update existing object
+	if obj, ok := s.objects[objPath]; ok {
+		obj.attributes = attr
+		return false, nil
+	}
+	// create object
+	ident := path.Base(objPath)
+	if _, err := url.PathUnescape(ident); err != nil {
+		return false, NewErrorf(StatusBadRequest, "Invalid identifier %s: %v", ident, err)
+	}
+	parent, ok := s.objects[path.Dir(objPath)]
+	if !ok {
+		return false, NewErrorf(StatusNotFound, "Parent object not found: %s", objPath)
+	}
+	parent.children[ident] = true
+	s.objects[objPath] = &memoryObject{attributes: attr, children: make(map[string]bool)}
+	return true, nil
+}
+
+func (s *memoryStore) Delete(path string) Error {
+	return s.DeleteContext(context.Background(), path)
+}
+
+func (s *memoryStore) DeleteContext(ctx context.Context, objPath string) Error {
+	if err := ContextError(ctx); err != nil {
+		return err
+	}
+	if objPath == "/" {
+		return NewErrorf(StatusMethodNotAllowed, "Root object can not be deleted")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.init()
+	if _, ok := s.objects[objPath]; !ok {
+		return NewErrorf(StatusNotFound, "Object not found: %s", objPath)
+	}
+	// remove subtree
+	prefix := objPath + "/"
+	for p := range s.objects {
+		if p == objPath || strings.HasPrefix(p, prefix) {
+			delete(s.objects, p)
+		}
+	}
+	delete(s.objects[path.Dir(objPath)].children, path.Base(objPath))
+	return nil
+}
+
+func (s *memoryStore) Subscribe(paths []string, callback PVChangeFunc) (SubscriptionID, Error) {
+	sub := &memorySub{paths: make(map[string]bool), callback: callback}
+	for _, p := range paths {
+		sub.paths[p] = true
+	}
+	s.subsMutex.Lock()
+	defer s.subsMutex.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[SubscriptionID]*memorySub)
+	}
+	s.nextSubID++
+	s.subs[s.nextSubID] = sub
+	return s.nextSubID, nil
+}
+
+func (s *memoryStore) Unsubscribe(id SubscriptionID) Error {
+	s.subsMutex.Lock()
+	sub, ok := s.subs[id]
+	delete(s.subs, id)
+	s.subsMutex.Unlock()
+	if !ok {
+		return NewErrorf(StatusNotFound, "Subscription not found: %d", id)
+	}
+	// wait for a running callback
+	sub.mutex.Lock()
+	sub.removed = true
+	sub.mutex.Unlock()
+	return nil
+}
+
+func (s *memoryStore) notify(path string, pv PV) {
+	// callbacks are invoked without locked subsMutex, so that they can
+	// subscribe and unsubscribe
+	var subs []*memorySub
+	s.subsMutex.Lock()
+	for _, sub := range s.subs {
+		if sub.paths[path] {
+			subs = append(subs, sub)
+		}
+	}
+	s.subsMutex.Unlock()
+	for _, sub := range subs {
+		sub.mutex.Lock()
+		if !sub.removed {
+			sub.callback(path, pv)
+		}
+		sub.mutex.Unlock()
+	}
+}
@@ -0,0 +1,176 @@
+package veap
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryService(t *testing.T) {
+	var svc MemoryService
+
+	// create objects
+	created, err := svc.WriteProperties("/a", AttrValues{"title": "A"})
+	if err != nil || !created {
+		t.Fatal(created, err)
+	}
+	created, err = svc.WriteProperties("/a", AttrValues{"title": "A2"})
+	if err != nil || created {
+		t.Fatal(created, err)
+	}
+	for _, p := range []string{"/a/x", "/a/y", "/b"} {
+		if _, err := svc.WriteProperties(p, AttrValues{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := svc.WriteProperties("/c/x", AttrValues{}); err == nil || err.Code() != StatusNotFound {
+		t.Error(err)
+	}
+	if _, err := svc.WriteProperties("/b", AttrValues{LinksMarker: LinkUpdate{}}); err == nil || err.Code() != StatusMethodNotAllowed {
+		t.Error(err)
+	}
+
+	// properties
+	attr, links, err := svc.ReadProperties("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(attr, AttrValues{"title": "A2"}) {
+		t.Error(attr)
+	}
+	if len(links) != 5 || links[0] != (Link{Role: "item", Target: "x"}) || links[2].Target != ".." {
+		t.Error(links)
+	}
+	_, links, err = svc.ReadProperties("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 4 || links[0] != (Link{Role: "item", Target: "a", Title: "A2"}) {
+		t.Error(links)
+	}
+
+	// PV
+	if _, err := svc.ReadPV("/a/x"); err == nil || err.Code() != StatusNotFound {
+		t.Error(err)
+	}
+	var notified []PV
+	id, err := svc.Subscribe([]string{"/a/x"}, func(path string, pv PV) { notified = append(notified, pv) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv := PV{Time: time.Unix(1, 0), Value: 1.0}
+	if err := svc.WritePV("/a/x", pv); err != nil {
+		t.Fatal(err)
+	}
+	if rpv, err := svc.ReadPV("/a/x"); err != nil || !rpv.Equal(pv) {
+		t.Error(rpv, err)
+	}
+	if err := svc.Unsubscribe(id); err != nil {
+		t.Fatal(err)
+	}
+	svc.WritePV("/a/x", pv)
+	if len(notified) != 1 {
+		t.Error(notified)
+	}
+	if err := svc.WritePV("/nope", pv); err == nil || err.Code() != StatusNotFound {
+		t.Error(err)
+	}
+
+	// history
+	ts := func(s ...int64) []PV {
+		var hist []PV
+		for _, i := range s {
+			hist = append(hist, PV{Time: time.Unix(i, 0), Value: float64(i)})
+		}
+		return hist
+	}
+	if err := svc.WriteHistory("/a/y", ts(3, 1, 2, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.WriteHistory("/a/y", ts(2, 4)); err != nil {
+		t.Fatal(err)
+	}
+	hist, err := svc.ReadHistory("/a/y", time.Unix(0, 0), time.Unix(10, 0), 10)
+	if err != nil || !reflect.DeepEqual(hist, ts(1, 2, 4, 5)) {
+		t.Error(hist, err)
+	}
+	hist, err = svc.ReadHistory("/a/y", time.Unix(2, 0), time.Unix(5, 0), 1)
+	if err != nil || !reflect.DeepEqual(hist, ts(2)) {
+		t.Error(hist, err)
+	}
+
+	// meta service
+	_, readResults, err := svc.ExgData([]WritePVParam{{Path: "/b", PV: pv}}, []string{"/b"})
+	if err != nil || readResults[0].Error != nil || !readResults[0].PV.Equal(pv) {
+		t.Error(readResults, err)
+	}
+	_, err = svc.ExtendedExgData(context.Background(), ExgDataParams{Atomic: true,
+		WritePVs: []WritePVParam{{Path: "/b", PV: PV{Value: 2.0}}, {Path: "/nope"}}})
+	if err == nil {
+		t.Error("atomic write must fail")
+	}
+	if rpv, _ := svc.ReadPV("/b"); rpv.Value != 1.0 {
+		t.Error(rpv)
+	}
+	res, err := svc.Query([]string{"/a/*"})
+	if err != nil || len(res) != 2 || res[0].Path != "/a/x" || res[1].Path != "/a/y" {
+		t.Error(res, err)
+	}
+
+	// delete
+	if err := svc.Delete("/a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a", "/a/x"} {
+		if _, _, err := svc.ReadProperties(p); err == nil || err.Code() != StatusNotFound {
+			t.Error(err)
+		}
+	}
+	if err := svc.Delete("/"); err == nil {
+		t.Error("delete of root must fail")
+	}
+}
+
+func TestMemoryServiceSubscribeInCallback(t *testing.T) {
+	var svc MemoryService
+	if _, err := svc.WriteProperties("/a", AttrValues{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the callback replaces another subscription
+	var other SubscriptionID
+	var err Error
+	other, err = svc.Subscribe([]string{"/a"}, func(path string, pv PV) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notified int
+	id, err := svc.Subscribe([]string{"/a"}, func(path string, pv PV) {
+		notified++
+		if err := svc.Unsubscribe(other); err != nil {
+			t.Error(err)
+		}
+		other, err = svc.Subscribe([]string{"/a"}, func(path string, pv PV) {})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := svc.WritePV("/a", PV{Time: time.Unix(int64(i), 0), Value: float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if notified != 3 {
+		t.Error(notified)
+	}
+	if err := svc.Unsubscribe(id); err != nil {
+		t.Error(err)
+	}
+	if err := svc.Unsubscribe(other); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,14 +1,26 @@
 package veap
 
-import "strings"
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
 
 const (
 	// meta service markers
-	ExgDataMarker = "~exgdata"
-	QueryMarker   = "~query"
+	ExgDataMarker   = "~exgdata"
+	QueryMarker     = "~query"
+	WebSocketMarker = "~ws"
 
 	// property markers
 	PathMarker = "~path"
+
+	// query parameter markers
+	FilterMarker   = "~filter"
+	MaxDepthMarker = "~maxdepth"
+	OffsetMarker   = "~offset"
+	LimitMarker    = "~limit"
 )
 
 // Parameters for a single WritePV (q.v. MetaService).
@@ -23,6 +35,39 @@ type ReadPVResult struct {
 	Error Error
 }
 
+// Parameters for a single WriteProperties (q.v. ExgDataParams).
+type WritePropertiesParam struct {
+	Path       string
+	Attributes AttrValues
+}
+
+// Results of a single WriteProperties (q.v. ExgDataResults).
+type WritePropertiesResult struct {
+	Created bool
+	Error   Error
+}
+
+// Results of a single ReadProperties (q.v. ExgDataResults).
+type ReadPropertiesResult struct {
+	Attributes AttrValues
+	Links      []Link
+	Error      Error
+}
+
+// Parameters for a single ReadHistory (q.v. ExgDataParams).
+type ReadHistoryParam struct {
+	Path  string
+	Begin time.Time
+	End   time.Time
+	Limit int64
+}
+
+// Results of a single ReadHistory (q.v. ExgDataResults).
+type ReadHistoryResult struct {
+	History []PV
+	Error   Error
+}
+
 // QueryResult (q.v. MetaService)
 type QueryResult struct {
 	Path       string
@@ -41,54 +86,465 @@ type MetaService interface {
 	ExgData(writePVs []WritePVParam, readPaths []string) (writeErrors []Error, readResults []ReadPVResult, serviceError Error)
 
 	// Query searches for VEAP objects that match any of the specified path
-	// masks.
+	// masks. A path mask segment ** matches zero or more levels of the object
+	// tree.
 	Query(pathPatterns []string) (queryResults []QueryResult, serviceError Error)
 }
 
+// ExgDataParams configures an extended data exchange (q.v.
+// ExtendedExgDataService). All sections are optional.
+type ExgDataParams struct {
+	// Atomic requests that either all or none of the WritePVs are executed
+	// (q.v. WritePVsAtomic). If a write fails, a service error is returned and
+	// the other sections are not executed.
+	Atomic bool
+
+	WritePVs        []WritePVParam
+	WriteProperties []WritePropertiesParam
+	ReadPaths       []string
+	ReadProperties  []string
+	ReadHistory     []ReadHistoryParam
+}
+
+// ExgDataResults contains the results of an extended data exchange. For every
+// entry in a section of the ExgDataParams an entry in the corresponding
+// section is returned.
+type ExgDataResults struct {
+	WriteErrors            []Error
+	WritePropertiesResults []WritePropertiesResult
+	ReadResults            []ReadPVResult
+	ReadPropertiesResults  []ReadPropertiesResult
+	ReadHistoryResults     []ReadHistoryResult
+}
+
+// ExtendedExgDataService provides a data exchange service, which additionally
+// supports properties and histories. It can optionally be implemented by a
+// MetaService.
+type ExtendedExgDataService interface {
+	// ExtendedExgData executes multiple services in one request. The services
+	// are executed in the following order: WritePV, WriteProperties, ReadPV,
+	// ReadProperties, ReadHistory.
+	ExtendedExgData(ctx context.Context, params ExgDataParams) (results ExgDataResults, serviceError Error)
+}
+
+// AsExtendedExgDataService returns the meta service, if it implements
+// ExtendedExgDataService. Otherwise PVs are exchanged with
+// ContextMetaService.ExgDataContext and the additional sections are executed
+// with the provided service.
+func AsExtendedExgDataService(metaService ContextMetaService, service ContextService) ExtendedExgDataService {
+	if eeds, ok := metaService.(ExtendedExgDataService); ok {
+		return eeds
+	}
+	return exgDataAdapter{metaService, service}
+}
+
+type exgDataAdapter struct {
+	metaService ContextMetaService
+	service     ContextService
+}
+
+func (a exgDataAdapter) ExtendedExgData(ctx context.Context, params ExgDataParams) (ExgDataResults, Error) {
+	var results ExgDataResults
+	var err Error
+	if params.Atomic {
+		// PVs are written with the provided service
+		preparer, ok := a.service.(WritePreparer)
+		if !ok {
+			return ExgDataResults{}, NewErrorf(StatusBadRequest, "Atomic writes not supported by service")
+		}
+		if err := WritePVsAtomic(ctx, preparer, params.WritePVs); err != nil {
+			return ExgDataResults{}, err
+		}
+		results.WriteErrors = make([]Error, len(params.WritePVs))
+		results.WritePropertiesResults = writeProperties(ctx, executor{}, a.service, params.WriteProperties)
+		_, results.ReadResults, err = a.metaService.ExgDataContext(ctx, nil, params.ReadPaths)
+		if err != nil {
+			return ExgDataResults{}, err
+		}
+	} else if len(params.WriteProperties) == 0 {
+		// only one call to the meta service is needed
+		results.WriteErrors, results.ReadResults, err = a.metaService.ExgDataContext(ctx, params.WritePVs, params.ReadPaths)
+		if err != nil {
+			return ExgDataResults{}, err
+		}
+		results.WritePropertiesResults = writeProperties(ctx, executor{}, a.service, params.WriteProperties)
+	} else {
+		// keep order of execution
+		results.WriteErrors, _, err = a.metaService.ExgDataContext(ctx, params.WritePVs, nil)
+		if err != nil {
+			return ExgDataResults{}, err
+		}
+		results.WritePropertiesResults = writeProperties(ctx, executor{}, a.service, params.WriteProperties)
+		_, results.ReadResults, err = a.metaService.ExgDataContext(ctx, nil, params.ReadPaths)
+		if err != nil {
+			return ExgDataResults{}, err
+		}
+	}
+	results.ReadPropertiesResults = readProperties(ctx, executor{}, a.service, params.ReadProperties)
+	results.ReadHistoryResults = readHistory(ctx, executor{}, a.service, params.ReadHistory)
+	return results, nil
+}
+
+func writeProperties(ctx context.Context, exec executor, svc ContextService, params []WritePropertiesParam) []WritePropertiesResult {
+	if len(params) == 0 {
+		return nil
+	}
+	// writes are executed sequentially
+	results := make([]WritePropertiesResult, len(params))
+	for i := range params {
+		p := &params[i]
+		v, err := exec.callWrite(ctx, func(ctx context.Context) (interface{}, Error) {
+			return svc.WritePropertiesContext(ctx, p.Path, p.Attributes)
+		})
+		created, _ := v.(bool)
+		results[i] = WritePropertiesResult{created, err}
+	}
+	return results
+}
+
+func readPVs(ctx context.Context, exec executor, svc ContextService, paths []string) []ReadPVResult {
+	results := make([]ReadPVResult, len(paths))
+	exec.forEach(len(paths), func(i int) {
+		v, err := exec.call(ctx, func(ctx context.Context) (interface{}, Error) {
+			return svc.ReadPVContext(ctx, paths[i])
+		})
+		pv, _ := v.(PV)
+		results[i] = ReadPVResult{pv, err}
+	})
+	return results
+}
+
+func readProperties(ctx context.Context, exec executor, svc ContextService, paths []string) []ReadPropertiesResult {
+	if len(paths) == 0 {
+		return nil
+	}
+	results := make([]ReadPropertiesResult, len(paths))
+	exec.forEach(len(paths), func(i int) {
+		v, err := exec.call(ctx, func(ctx context.Context) (interface{}, Error) {
+			attr, links, err := svc.ReadPropertiesContext(ctx, paths[i])
+			return ReadPropertiesResult{attr, links, nil}, err
+		})
+		r, _ := v.(ReadPropertiesResult)
+		r.Error = err
+		results[i] = r
+	})
+	return results
+}
+
+func readHistory(ctx context.Context, exec executor, svc ContextService, params []ReadHistoryParam) []ReadHistoryResult {
+	if len(params) == 0 {
+		return nil
+	}
+	results := make([]ReadHistoryResult, len(params))
+	exec.forEach(len(params), func(i int) {
+		p := &params[i]
+		v, err := exec.call(ctx, func(ctx context.Context) (interface{}, Error) {
+			return svc.ReadHistoryContext(ctx, p.Path, p.Begin, p.End, p.Limit)
+		})
+		hist, _ := v.([]PV)
+		results[i] = ReadHistoryResult{hist, err}
+	})
+	return results
+}
+
+// QueryParams configures an extended query (q.v. ExtendedQueryService).
+type QueryParams struct {
+	// PathPatterns specifies path masks. An object must match any of them.
+	PathPatterns []string
+
+	// Filters are checked against the properties of the objects. An object
+	// must match all of them.
+	Filters []Filter
+
+	// MaxDepth limits the search to objects, which are at most MaxDepth
+	// levels below the root. This is useful for path patterns with recursive
+	// wildcards (**). If 0, the depth is not limited.
+	MaxDepth int
+
+	// Offset is the number of matching objects to skip. Together with Limit
+	// the results can be paginated.
+	Offset int
+
+	// Limit is the maximum number of results. If 0, the number is not
+	// limited. If the number of results equals the limit, further results may
+	// be available.
+	Limit int
+}
+
+// ExtendedQueryService provides a query service with additional parameters.
+// It can optionally be implemented by a MetaService.
+type ExtendedQueryService interface {
+	// ExtendedQuery searches for VEAP objects that match the specified
+	// parameters.
+	ExtendedQuery(ctx context.Context, params QueryParams) (queryResults []QueryResult, serviceError Error)
+}
+
+// StreamingQueryService provides a query service, which passes the results
+// one by one to a callback function. This avoids collecting all results in
+// memory. It can optionally be implemented by a MetaService.
+type StreamingQueryService interface {
+	// QueryFunc calls handle for every VEAP object that matches the specified
+	// parameters. If handle returns an error, the query is aborted and the
+	// error is returned.
+	QueryFunc(ctx context.Context, params QueryParams, handle func(item QueryResult) Error) Error
+}
+
+// AsStreamingQueryService returns the service, if it implements
+// StreamingQueryService. Otherwise the results are collected with
+// AsExtendedQueryService and then passed to the callback function.
+func AsStreamingQueryService(service ContextMetaService) StreamingQueryService {
+	if sqs, ok := service.(StreamingQueryService); ok {
+		return sqs
+	}
+	return collectingQueryAdapter{AsExtendedQueryService(service)}
+}
+
+type collectingQueryAdapter struct {
+	ExtendedQueryService
+}
+
+func (a collectingQueryAdapter) QueryFunc(ctx context.Context, params QueryParams, handle func(item QueryResult) Error) Error {
+	results, err := a.ExtendedQueryService.ExtendedQuery(ctx, params)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if err := handle(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AsExtendedQueryService returns the service, if it implements
+// ExtendedQueryService. Otherwise the query is executed with
+// ContextMetaService.QueryContext and the results are filtered afterwards
+// (filters, max. depth and pagination).
+func AsExtendedQueryService(service ContextMetaService) ExtendedQueryService {
+	if eqs, ok := service.(ExtendedQueryService); ok {
+		return eqs
+	}
+	return filteringQueryAdapter{service}
+}
+
+type filteringQueryAdapter struct {
+	ContextMetaService
+}
+
+func (a filteringQueryAdapter) ExtendedQuery(ctx context.Context, params QueryParams) ([]QueryResult, Error) {
+	results, err := a.ContextMetaService.QueryContext(ctx, params.PathPatterns)
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]QueryResult, 0, len(results))
+	for _, r := range results {
+		if params.MaxDepth > 0 && pathDepth(r.Path) > params.MaxDepth {
+			continue
+		}
+		if MatchFilters(params.Filters, r.Attributes, r.Links) {
+			filtered = append(filtered, r)
+		}
+	}
+	// paginate
+	if params.Offset >= len(filtered) {
+		return []QueryResult{}, nil
+	}
+	filtered = filtered[params.Offset:]
+	if params.Limit > 0 && len(filtered) > params.Limit {
+		filtered = filtered[:params.Limit]
+	}
+	return filtered, nil
+}
+
 // BasicMetaService implements MetaService based on a provided Service.
+// Additionally it implements Subscriber. If the provided Service does not
+// support subscriptions, the PVs are polled.
 type BasicMetaService struct {
 	Service
+
+	// EnableContext enables the ...Context methods for AsContextService and
+	// AsContextMetaService (e.g. used by server.Handler). If not set, the
+	// methods without context are called, so that the overridden methods of a
+	// type, which embeds *BasicMetaService, are not bypassed. Such a type
+	// must also override the ...Context methods, if this is set.
+	EnableContext bool
+
+	// Workers is the maximum number of concurrent service calls for reading
+	// in ExgData and Query. The order of the results is preserved. If less
+	// than 2, the service calls are executed sequentially. Writes are always
+	// executed sequentially.
+	Workers int
+
+	// CallTimeout limits the duration of a single service call in ExgData and
+	// Query. On timeout an error with code StatusGatewayTimeout is reported.
+	// Reads are abandoned on timeout. Writes are never abandoned, only their
+	// context is canceled, so that they are still executed sequentially. If
+	// 0, the duration is not limited.
+	CallTimeout time.Duration
+
+	// PollingInterval is used, if the provided Service does not implement
+	// Subscriber. If not set, the PVs are read every second.
+	PollingInterval time.Duration
+
+	poller     *PollingSubscriber
+	pollerOnce sync.Once
 }
 
-// Make sure that BasicMetaService implements MetaService.
+// Make sure that BasicMetaService implements all service interfaces.
 var _ MetaService = (*BasicMetaService)(nil)
+var _ ContextMetaService = (*BasicMetaService)(nil)
+var _ ExtendedExgDataService = (*BasicMetaService)(nil)
+var _ ExtendedQueryService = (*BasicMetaService)(nil)
+var _ StreamingQueryService = (*BasicMetaService)(nil)
+var _ ContextService = (*BasicMetaService)(nil)
+var _ WritePreparer = (*BasicMetaService)(nil)
+var _ Subscriber = (*BasicMetaService)(nil)
+var _ ContextSwitch = (*BasicMetaService)(nil)
+
+// ContextEnabled implements ContextSwitch.
+func (m *BasicMetaService) ContextEnabled() bool {
+	return m.EnableContext
+}
 
 // ExgData implements MetaService.ExgData.
 func (m *BasicMetaService) ExgData(writePVs []WritePVParam, readPaths []string) (writeErrors []Error, readResults []ReadPVResult, serviceError Error) {
+	return m.ExgDataContext(context.Background(), writePVs, readPaths)
+}
+
+// ExgDataContext implements ContextMetaService.ExgDataContext.
+func (m *BasicMetaService) ExgDataContext(ctx context.Context, writePVs []WritePVParam, readPaths []string) (writeErrors []Error, readResults []ReadPVResult, serviceError Error) {
+	results, serviceError := m.ExtendedExgData(ctx, ExgDataParams{WritePVs: writePVs, ReadPaths: readPaths})
+	return results.WriteErrors, results.ReadResults, serviceError
+}
+
+// ExtendedExgData implements ExtendedExgDataService.ExtendedExgData.
+func (m *BasicMetaService) ExtendedExgData(ctx context.Context, params ExgDataParams) (ExgDataResults, Error) {
+	svc := AsContextService(m.Service)
+	exec := m.executor()
+	var results ExgDataResults
 	// service WritePV
-	writeErrors = make([]Error, len(writePVs))
-	for i := range writePVs {
-		writeErrors[i] = m.WritePV(writePVs[i].Path, writePVs[i].PV)
+	results.WriteErrors = make([]Error, len(params.WritePVs))
+	if params.Atomic {
+		if err := WritePVsAtomic(ctx, m, params.WritePVs); err != nil {
+			return ExgDataResults{}, err
+		}
+	} else {
+		for i := range params.WritePVs {
+			p := &params.WritePVs[i]
+			_, results.WriteErrors[i] = exec.callWrite(ctx, func(ctx context.Context) (interface{}, Error) {
+				return nil, svc.WritePVContext(ctx, p.Path, p.PV)
+			})
+		}
 	}
+	// service WriteProperties
+	results.WritePropertiesResults = writeProperties(ctx, exec, svc, params.WriteProperties)
 	// service ReadPV
-	readResults = make([]ReadPVResult, len(readPaths))
-	for i := range readPaths {
-		pv, err := m.ReadPV(readPaths[i])
-		readResults[i] = ReadPVResult{pv, err}
-	}
+	results.ReadResults = readPVs(ctx, exec, svc, params.ReadPaths)
+	// service ReadProperties, links to the meta services are included
+	results.ReadPropertiesResults = readProperties(ctx, exec, m, params.ReadProperties)
+	// service ReadHistory
+	results.ReadHistoryResults = readHistory(ctx, exec, svc, params.ReadHistory)
 	// no serviceError
-	return
+	return results, nil
 }
 
-// Query implements MetaService.ExgData.
+// Query implements MetaService.Query.
 func (m *BasicMetaService) Query(pathPatterns []string) ([]QueryResult, Error) {
+	return m.QueryContext(context.Background(), pathPatterns)
+}
+
+// QueryContext implements ContextMetaService.QueryContext.
+func (m *BasicMetaService) QueryContext(ctx context.Context, pathPatterns []string) ([]QueryResult, Error) {
+	return m.ExtendedQuery(ctx, QueryParams{PathPatterns: pathPatterns})
+}
+
+// ExtendedQuery implements ExtendedQueryService.ExtendedQuery.
+func (m *BasicMetaService) ExtendedQuery(ctx context.Context, params QueryParams) ([]QueryResult, Error) {
 	results := make([]QueryResult, 0)
+	if err := m.QueryFunc(ctx, params, func(item QueryResult) Error {
+		results = append(results, item)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// signals that the query limit is reached
+var errQueryLimitReached = NewErrorf(StatusOK, "Query limit reached")
+
+// QueryFunc implements StreamingQueryService.QueryFunc.
+func (m *BasicMetaService) QueryFunc(ctx context.Context, params QueryParams, handle func(item QueryResult) Error) Error {
+	var matches, results int
 	// loop over all path masks
-	for _, pathPattern := range pathPatterns {
+	for _, pathPattern := range params.PathPatterns {
 		// find matching VEAP objects
-		if err := traverseTree(m, strings.TrimPrefix(pathPattern, "/"), "/", func(item QueryResult) Error {
-			results = append(results, item)
+		err := traverseTree(ctx, m, strings.TrimPrefix(pathPattern, "/"), "/", params.MaxDepth, m.executor(), func(item QueryResult) Error {
+			if !MatchFilters(params.Filters, item.Attributes, item.Links) {
+				return nil
+			}
+			// paginate
+			matches++
+			if matches <= params.Offset {
+				return nil
+			}
+			if err := handle(item); err != nil {
+				return err
+			}
+			results++
+			if params.Limit > 0 && results >= params.Limit {
+				return errQueryLimitReached
+			}
 			return nil
-		}); err != nil {
-			return nil, err
+		})
+		if err == errQueryLimitReached {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
 	}
-	return results, nil
+	return nil
 }
 
 // ReadProperties overrides Service.ReadProperties.
 func (m *BasicMetaService) ReadProperties(path string) (attr AttrValues, links []Link, err Error) {
-	attr, links, err = m.Service.ReadProperties(path)
+	return m.ReadPropertiesContext(context.Background(), path)
+}
+
+// ReadPVContext implements ContextService.
+func (m *BasicMetaService) ReadPVContext(ctx context.Context, path string) (PV, Error) {
+	return AsContextService(m.Service).ReadPVContext(ctx, path)
+}
+
+// WritePVContext implements ContextService.
+func (m *BasicMetaService) WritePVContext(ctx context.Context, path string, pv PV) Error {
+	return AsContextService(m.Service).WritePVContext(ctx, path, pv)
+}
+
+// ReadHistoryContext implements ContextService.
+func (m *BasicMetaService) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	return AsContextService(m.Service).ReadHistoryContext(ctx, path, begin, end, limit)
+}
+
+// PrepareWritePV implements WritePreparer. An error is returned, if the
+// provided Service does not implement WritePreparer.
+func (m *BasicMetaService) PrepareWritePV(ctx context.Context, path string, pv PV) (PreparedWrite, Error) {
+	if wp, ok := m.Service.(WritePreparer); ok {
+		return wp.PrepareWritePV(ctx, path, pv)
+	}
+	return nil, NewErrorf(StatusBadRequest, "Atomic writes not supported by service")
+}
+
+// WriteHistoryContext implements ContextService.
+func (m *BasicMetaService) WriteHistoryContext(ctx context.Context, path string, timeSeries []PV) Error {
+	return AsContextService(m.Service).WriteHistoryContext(ctx, path, timeSeries)
+}
+
+// ReadPropertiesContext implements ContextService. For the root object links
+// to the meta services are added.
+func (m *BasicMetaService) ReadPropertiesContext(ctx context.Context, path string) (attr AttrValues, links []Link, err Error) {
+	attr, links, err = AsContextService(m.Service).ReadPropertiesContext(ctx, path)
 	if path != "/" || err != nil {
 		return
 	}
@@ -106,3 +562,37 @@ func (m *BasicMetaService) ReadProperties(path string) (attr AttrValues, links [
 	})
 	return
 }
+
+// WritePropertiesContext implements ContextService.
+func (m *BasicMetaService) WritePropertiesContext(ctx context.Context, path string, attributes AttrValues) (bool, Error) {
+	return AsContextService(m.Service).WritePropertiesContext(ctx, path, attributes)
+}
+
+// DeleteContext implements ContextService.
+func (m *BasicMetaService) DeleteContext(ctx context.Context, path string) Error {
+	return AsContextService(m.Service).DeleteContext(ctx, path)
+}
+
+// Subscribe implements Subscriber.Subscribe.
+func (m *BasicMetaService) Subscribe(paths []string, callback PVChangeFunc) (SubscriptionID, Error) {
+	return m.subscriber().Subscribe(paths, callback)
+}
+
+// Unsubscribe implements Subscriber.Unsubscribe.
+func (m *BasicMetaService) Unsubscribe(id SubscriptionID) Error {
+	return m.subscriber().Unsubscribe(id)
+}
+
+func (m *BasicMetaService) executor() executor {
+	return executor{workers: m.Workers, timeout: m.CallTimeout}
+}
+
+func (m *BasicMetaService) subscriber() Subscriber {
+	if s, ok := m.Service.(Subscriber); ok {
+		return s
+	}
+	m.pollerOnce.Do(func() {
+		m.poller = &PollingSubscriber{Service: m.Service, Interval: m.PollingInterval}
+	})
+	return m.poller
+}
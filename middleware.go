@@ -0,0 +1,444 @@
+package veap
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-logging"
+)
+
+var middlewareLog = logging.Get("veap-middleware")
+
+// Middleware wraps a Service with cross-cutting behavior (e.g. logging).
+type Middleware func(Service) Service
+
+// Chain wraps the service with the middlewares. The first middleware is the
+// outermost one. If a service implements optional interfaces (MetaService,
+// Subscriber, WritePreparer, AggregatingHistoryReader) and the service
+// returned by a middleware does not, they are added based on the service
+// returned by the middleware, so that the middleware is never bypassed:
+// MetaService is provided by a BasicMetaService, the PVs are polled every
+// second, atomic writes are rejected and the raw history is aggregated.
+func Chain(service Service, middlewares ...Middleware) Service {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		service = forward(service, middlewares[i](service))
+	}
+	return service
+}
+
+// forward adds the optional interfaces of the inner service to the wrapped
+// service, if they are missing.
+func forward(inner, wrapped Service) Service {
+	_, isInnerMeta := inner.(MetaService)
+	wrappedMeta, isWrappedMeta := wrapped.(MetaService)
+	missing := (!isWrappedMeta && isInnerMeta) ||
+		(!implementsSubscriber(wrapped) && implementsSubscriber(inner)) ||
+		(!implementsWritePreparer(wrapped) && implementsWritePreparer(inner)) ||
+		(!implementsAggregation(wrapped) && implementsAggregation(inner))
+	if !missing {
+		return wrapped
+	}
+	f := &forwarder{Service: wrapped}
+	switch {
+	case isWrappedMeta:
+		return &metaForwarder{forwarder: f, meta: AsContextMetaService(wrappedMeta)}
+	case isInnerMeta:
+		return &metaForwarder{forwarder: f, meta: &BasicMetaService{Service: f}}
+	}
+	return f
+}
+
+func implementsSubscriber(s Service) bool {
+	_, ok := s.(Subscriber)
+	return ok
+}
+
+func implementsWritePreparer(s Service) bool {
+	_, ok := s.(WritePreparer)
+	return ok
+}
+
+func implementsAggregation(s Service) bool {
+	_, ok := s.(AggregatingHistoryReader)
+	return ok
+}
+
+// InterceptFunc is called around every service call of an intercepted
+// service. method is the name of the service (e.g. ReadPV) and path the path
+// of the VEAP object. For MetaService calls, Subscribe and Unsubscribe path is
+// empty. call executes the service call and returns its error.
+type InterceptFunc func(ctx context.Context, method, path string, call func() Error) Error
+
+// Intercept creates a Middleware, which calls f around every service call. If
+// the inner service implements MetaService, the calls of the MetaService are
+// also intercepted. The intercepted service always implements Subscriber,
+// WritePreparer and AggregatingHistoryReader. If the inner service does not
+// implement Subscriber, the PVs are polled every second through the
+// intercepted service. If it does not implement WritePreparer, atomic writes
+// are rejected. Commits of prepared writes are intercepted as WritePV.
+func Intercept(f InterceptFunc) Middleware {
+	return func(service Service) Service {
+		is := &interceptedService{next: AsContextService(service), inner: service, intercept: f}
+		ms, ok := service.(MetaService)
+		if !ok {
+			return is
+		}
+		return &metaForwarder{
+			forwarder: &forwarder{Service: is},
+			meta:      &interceptedMetaService{next: AsContextMetaService(ms), service: is, intercept: f},
+		}
+	}
+}
+
+// LoggingMiddleware logs every service call and its result. If log is nil,
+// logging.Get("veap-middleware") is used.
+func LoggingMiddleware(log logging.Logger) Middleware {
+	if log == nil {
+		log = middlewareLog
+	}
+	return Intercept(func(ctx context.Context, method, path string, call func() Error) Error {
+		log.Tracef("Calling %s %s", method, path)
+		err := call()
+		if err != nil {
+			log.Debugf("Service %s %s failed: %v", method, path, err)
+		} else {
+			log.Tracef("Service %s %s succeeded", method, path)
+		}
+		return err
+	})
+}
+
+// TimingMiddleware measures the duration of every service call. The duration
+// is passed to observe together with the result of the call.
+func TimingMiddleware(observe func(method, path string, duration time.Duration, err Error)) Middleware {
+	return Intercept(func(ctx context.Context, method, path string, call func() Error) Error {
+		start := time.Now()
+		err := call()
+		observe(method, path, time.Since(start), err)
+		return err
+	})
+}
+
+// RecoveryMiddleware converts panics in service calls to errors with code
+// StatusInternalServerError. The panic is logged with a stack trace.
+func RecoveryMiddleware() Middleware {
+	return Intercept(func(ctx context.Context, method, path string, call func() Error) (err Error) {
+		defer func() {
+			if r := recover(); r != nil {
+				middlewareLog.Errorf("Panic in service %s %s: %v\n%s", method, path, r, debug.Stack())
+				err = NewErrorf(StatusInternalServerError, "Service %s failed: %v", method, fmt.Sprint(r))
+			}
+		}()
+		return call()
+	})
+}
+
+// interceptedService implements Service, ContextService, Subscriber,
+// WritePreparer and AggregatingHistoryReader.
+type interceptedService struct {
+	next      ContextService
+	inner     Service
+	intercept InterceptFunc
+
+	poller     *PollingSubscriber
+	pollerOnce sync.Once
+}
+
+func (s *interceptedService) ReadPV(path string) (PV, Error) {
+	return s.ReadPVContext(context.Background(), path)
+}
+
+func (s *interceptedService) ReadPVContext(ctx context.Context, path string) (pv PV, err Error) {
+	err = s.intercept(ctx, "ReadPV", path, func() Error {
+		pv, err = s.next.ReadPVContext(ctx, path)
+		return err
+	})
+	return
+}
+
+func (s *interceptedService) WritePV(path string, pv PV) Error {
+	return s.WritePVContext(context.Background(), path, pv)
+}
+
+func (s *interceptedService) WritePVContext(ctx context.Context, path string, pv PV) Error {
+	return s.intercept(ctx, "WritePV", path, func() Error {
+		return s.next.WritePVContext(ctx, path, pv)
+	})
+}
+
+func (s *interceptedService) ReadHistory(path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	return s.ReadHistoryContext(context.Background(), path, begin, end, limit)
+}
+
+func (s *interceptedService) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) (hist []PV, err Error) {
+	err = s.intercept(ctx, "ReadHistory", path, func() Error {
+		hist, err = s.next.ReadHistoryContext(ctx, path, begin, end, limit)
+		return err
+	})
+	return
+}
+
+func (s *interceptedService) WriteHistory(path string, timeSeries []PV) Error {
+	return s.WriteHistoryContext(context.Background(), path, timeSeries)
+}
+
+func (s *interceptedService) WriteHistoryContext(ctx context.Context, path string, timeSeries []PV) Error {
+	return s.intercept(ctx, "WriteHistory", path, func() Error {
+		return s.next.WriteHistoryContext(ctx, path, timeSeries)
+	})
+}
+
+func (s *interceptedService) ReadProperties(path string) (AttrValues, []Link, Error) {
+	return s.ReadPropertiesContext(context.Background(), path)
+}
+
+func (s *interceptedService) ReadPropertiesContext(ctx context.Context, path string) (attr AttrValues, links []Link, err Error) {
+	err = s.intercept(ctx, "ReadProperties", path, func() Error {
+		attr, links, err = s.next.ReadPropertiesContext(ctx, path)
+		return err
+	})
+	return
+}
+
+func (s *interceptedService) WriteProperties(path string, attributes AttrValues) (bool, Error) {
+	return s.WritePropertiesContext(context.Background(), path, attributes)
+}
+
+func (s *interceptedService) WritePropertiesContext(ctx context.Context, path string, attributes AttrValues) (created bool, err Error) {
+	err = s.intercept(ctx, "WriteProperties", path, func() Error {
+		created, err = s.next.WritePropertiesContext(ctx, path, attributes)
+		return err
+	})
+	return
+}
+
+func (s *interceptedService) Delete(path string) Error {
+	return s.DeleteContext(context.Background(), path)
+}
+
+func (s *interceptedService) DeleteContext(ctx context.Context, path string) Error {
+	return s.intercept(ctx, "Delete", path, func() Error {
+		return s.next.DeleteContext(ctx, path)
+	})
+}
+
+func (s *interceptedService) subscriber() Subscriber {
+	if sub, ok := s.inner.(Subscriber); ok {
+		return sub
+	}
+	s.pollerOnce.Do(func() {
+		s.poller = &PollingSubscriber{Service: s}
+	})
+	return s.poller
+}
+
+func (s *interceptedService) Subscribe(paths []string, callback PVChangeFunc) (id SubscriptionID, err Error) {
+	err = s.intercept(context.Background(), "Subscribe", "", func() Error {
+		id, err = s.subscriber().Subscribe(paths, callback)
+		return err
+	})
+	return
+}
+
+func (s *interceptedService) Unsubscribe(id SubscriptionID) Error {
+	return s.intercept(context.Background(), "Unsubscribe", "", func() Error {
+		return s.subscriber().Unsubscribe(id)
+	})
+}
+
+func (s *interceptedService) PrepareWritePV(ctx context.Context, path string, pv PV) (pw PreparedWrite, err Error) {
+	err = s.intercept(ctx, "PrepareWritePV", path, func() Error {
+		wp, ok := s.inner.(WritePreparer)
+		if !ok {
+			return NewErrorf(StatusBadRequest, "Atomic writes not supported by service")
+		}
+		pw, err = wp.PrepareWritePV(ctx, path, pv)
+		return err
+	})
+	if pw == nil {
+		return
+	}
+	inner := pw
+	pw = &FuncPreparedWrite{
+		CommitFunc: func(ctx context.Context) Error {
+			return s.intercept(ctx, "WritePV", path, func() Error {
+				return inner.Commit(ctx)
+			})
+		},
+		RollbackFunc: inner.Rollback,
+	}
+	return
+}
+
+func (s *interceptedService) ReadAggregatedHistory(ctx context.Context, path string, begin time.Time, end time.Time, aggr Aggregation, limit int64) (hist []PV, err Error) {
+	err = s.intercept(ctx, "ReadAggregatedHistory", path, func() Error {
+		hist, err = AsAggregatingHistoryReader(s.inner).ReadAggregatedHistory(ctx, path, begin, end, aggr, limit)
+		return err
+	})
+	return
+}
+
+// interceptedMetaService implements ContextMetaService, ExtendedExgDataService,
+// ExtendedQueryService and StreamingQueryService.
+type interceptedMetaService struct {
+	next ContextMetaService
+	// intercepted service for the fallback of ExtendedExgData
+	service   ContextService
+	intercept InterceptFunc
+}
+
+func (s *interceptedMetaService) ExgDataContext(ctx context.Context, writePVs []WritePVParam, readPaths []string) (writeErrors []Error, readResults []ReadPVResult, err Error) {
+	err = s.intercept(ctx, "ExgData", "", func() Error {
+		writeErrors, readResults, err = s.next.ExgDataContext(ctx, writePVs, readPaths)
+		return err
+	})
+	return
+}
+
+func (s *interceptedMetaService) ExtendedExgData(ctx context.Context, params ExgDataParams) (results ExgDataResults, err Error) {
+	err = s.intercept(ctx, "ExgData", "", func() Error {
+		results, err = AsExtendedExgDataService(s.next, s.service).ExtendedExgData(ctx, params)
+		return err
+	})
+	return
+}
+
+func (s *interceptedMetaService) QueryContext(ctx context.Context, pathPatterns []string) (results []QueryResult, err Error) {
+	err = s.intercept(ctx, "Query", "", func() Error {
+		results, err = s.next.QueryContext(ctx, pathPatterns)
+		return err
+	})
+	return
+}
+
+func (s *interceptedMetaService) ExtendedQuery(ctx context.Context, params QueryParams) (results []QueryResult, err Error) {
+	err = s.intercept(ctx, "Query", "", func() Error {
+		results, err = AsExtendedQueryService(s.next).ExtendedQuery(ctx, params)
+		return err
+	})
+	return
+}
+
+func (s *interceptedMetaService) QueryFunc(ctx context.Context, params QueryParams, handle func(item QueryResult) Error) Error {
+	return s.intercept(ctx, "Query", "", func() Error {
+		return AsStreamingQueryService(s.next).QueryFunc(ctx, params, handle)
+	})
+}
+
+// forwarder adds the optional interfaces to a wrapped service (q.v. Chain).
+// The implementation of the wrapped service is used, if available. Otherwise
+// the PVs are polled every second, atomic writes are rejected and the raw
+// history is aggregated. All calls pass the wrapped service.
+type forwarder struct {
+	Service
+
+	poller     *PollingSubscriber
+	pollerOnce sync.Once
+}
+
+// metaForwarder additionally forwards the MetaService.
+type metaForwarder struct {
+	*forwarder
+	meta ContextMetaService
+}
+
+// Make sure that forwarder and metaForwarder implement all service interfaces.
+var _ ContextService = (*forwarder)(nil)
+var _ Subscriber = (*forwarder)(nil)
+var _ WritePreparer = (*forwarder)(nil)
+var _ AggregatingHistoryReader = (*forwarder)(nil)
+var _ MetaService = (*metaForwarder)(nil)
+var _ ContextMetaService = (*metaForwarder)(nil)
+var _ ExtendedExgDataService = (*metaForwarder)(nil)
+var _ ExtendedQueryService = (*metaForwarder)(nil)
+var _ StreamingQueryService = (*metaForwarder)(nil)
+var _ ContextService = (*metaForwarder)(nil)
+var _ Subscriber = (*metaForwarder)(nil)
+
+func (f *forwarder) subscriber() Subscriber {
+	if sub, ok := f.Service.(Subscriber); ok {
+		return sub
+	}
+	f.pollerOnce.Do(func() {
+		f.poller = &PollingSubscriber{Service: f.Service}
+	})
+	return f.poller
+}
+
+func (f *forwarder) Subscribe(paths []string, callback PVChangeFunc) (SubscriptionID, Error) {
+	return f.subscriber().Subscribe(paths, callback)
+}
+
+func (f *forwarder) Unsubscribe(id SubscriptionID) Error {
+	return f.subscriber().Unsubscribe(id)
+}
+
+func (f *forwarder) PrepareWritePV(ctx context.Context, path string, pv PV) (PreparedWrite, Error) {
+	if wp, ok := f.Service.(WritePreparer); ok {
+		return wp.PrepareWritePV(ctx, path, pv)
+	}
+	return nil, NewErrorf(StatusBadRequest, "Atomic writes not supported by service")
+}
+
+func (f *forwarder) ReadAggregatedHistory(ctx context.Context, path string, begin time.Time, end time.Time, aggr Aggregation, limit int64) ([]PV, Error) {
+	return AsAggregatingHistoryReader(f.Service).ReadAggregatedHistory(ctx, path, begin, end, aggr, limit)
+}
+
+func (f *metaForwarder) ExgData(writePVs []WritePVParam, readPaths []string) ([]Error, []ReadPVResult, Error) {
+	return f.meta.ExgDataContext(context.Background(), writePVs, readPaths)
+}
+
+func (f *metaForwarder) ExgDataContext(ctx context.Context, writePVs []WritePVParam, readPaths []string) ([]Error, []ReadPVResult, Error) {
+	return f.meta.ExgDataContext(ctx, writePVs, readPaths)
+}
+
+func (f *metaForwarder) ExtendedExgData(ctx context.Context, params ExgDataParams) (ExgDataResults, Error) {
+	return AsExtendedExgDataService(f.meta, f).ExtendedExgData(ctx, params)
+}
+
+func (f *metaForwarder) Query(pathPatterns []string) ([]QueryResult, Error) {
+	return f.meta.QueryContext(context.Background(), pathPatterns)
+}
+
+func (f *metaForwarder) QueryContext(ctx context.Context, pathPatterns []string) ([]QueryResult, Error) {
+	return f.meta.QueryContext(ctx, pathPatterns)
+}
+
+func (f *metaForwarder) ExtendedQuery(ctx context.Context, params QueryParams) ([]QueryResult, Error) {
+	return AsExtendedQueryService(f.meta).ExtendedQuery(ctx, params)
+}
+
+func (f *metaForwarder) QueryFunc(ctx context.Context, params QueryParams, handle func(item QueryResult) Error) Error {
+	return AsStreamingQueryService(f.meta).QueryFunc(ctx, params, handle)
+}
+
+func (f *forwarder) ReadPVContext(ctx context.Context, path string) (PV, Error) {
+	return AsContextService(f.Service).ReadPVContext(ctx, path)
+}
+
+func (f *forwarder) WritePVContext(ctx context.Context, path string, pv PV) Error {
+	return AsContextService(f.Service).WritePVContext(ctx, path, pv)
+}
+
+func (f *forwarder) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	return AsContextService(f.Service).ReadHistoryContext(ctx, path, begin, end, limit)
+}
+
+func (f *forwarder) WriteHistoryContext(ctx context.Context, path string, timeSeries []PV) Error {
+	return AsContextService(f.Service).WriteHistoryContext(ctx, path, timeSeries)
+}
+
+func (f *forwarder) ReadPropertiesContext(ctx context.Context, path string) (AttrValues, []Link, Error) {
+	return AsContextService(f.Service).ReadPropertiesContext(ctx, path)
+}
+
+func (f *forwarder) WritePropertiesContext(ctx context.Context, path string, attributes AttrValues) (bool, Error) {
+	return AsContextService(f.Service).WritePropertiesContext(ctx, path, attributes)
+}
+
+func (f *forwarder) DeleteContext(ctx context.Context, path string) Error {
+	return AsContextService(f.Service).DeleteContext(ctx, path)
+}
@@ -0,0 +1,234 @@
+package veap
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	var log []string
+	logMiddleware := func(name string) Middleware {
+		return Intercept(func(ctx context.Context, method, path string, call func() Error) Error {
+			log = append(log, name+" "+method+" "+path)
+			return call()
+		})
+	}
+	svc := &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			return PV{Value: path}, nil
+		},
+		ReadPropertiesFunc: func(path string) (AttrValues, []Link, Error) {
+			return AttrValues{}, nil, nil
+		},
+	}
+
+	// service without MetaService
+	s := Chain(svc, logMiddleware("a"), logMiddleware("b"))
+	pv, err := s.ReadPV("/x")
+	if err != nil || pv.Value != "/x" {
+		t.Fatal(pv, err)
+	}
+	if fmt.Sprint(log) != "[a ReadPV /x b ReadPV /x]" {
+		t.Error(log)
+	}
+	if _, ok := s.(MetaService); ok {
+		t.Error("unexpected MetaService")
+	}
+
+	// MetaService is forwarded
+	log = nil
+	s = Chain(&BasicMetaService{Service: svc}, logMiddleware("a"))
+	ms, ok := s.(MetaService)
+	if !ok {
+		t.Fatal("MetaService expected")
+	}
+	_, res, err := ms.ExgData(nil, []string{"/y"})
+	if err != nil || len(res) != 1 || res[0].PV.Value != "/y" {
+		t.Fatal(res, err)
+	}
+	if fmt.Sprint(log) != "[a ExgData ]" {
+		t.Error(log)
+	}
+
+	// MetaService bypasses a plain middleware
+	log = nil
+	plain := func(inner Service) Service {
+		return &FuncService{ReadPVFunc: inner.ReadPV}
+	}
+	s = Chain(&BasicMetaService{Service: svc}, logMiddleware("a"), plain)
+	_, res, err = s.(MetaService).ExgData(nil, []string{"/z"})
+	if err != nil || len(res) != 1 || res[0].PV.Value != "/z" {
+		t.Fatal(res, err)
+	}
+	if fmt.Sprint(log) != "[a ExgData ]" {
+		t.Error(log)
+	}
+}
+
+func TestStandardMiddlewares(t *testing.T) {
+	svc := &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			if path == "/panic" {
+				panic("boom")
+			}
+			return PV{Value: path}, nil
+		},
+	}
+	var timings []string
+	s := Chain(svc,
+		LoggingMiddleware(nil),
+		TimingMiddleware(func(method, path string, duration time.Duration, err Error) {
+			timings = append(timings, fmt.Sprint(method, " ", path, " ", err != nil))
+		}),
+		RecoveryMiddleware(),
+	)
+
+	// normal call
+	pv, err := s.ReadPV("/a")
+	if err != nil || pv.Value != "/a" {
+		t.Error(pv, err)
+	}
+
+	// panic
+	_, err = s.ReadPV("/panic")
+	if err == nil || err.Code() != StatusInternalServerError {
+		t.Error(err)
+	}
+	if fmt.Sprint(timings) != "[ReadPV /a false ReadPV /panic true]" {
+		t.Error(timings)
+	}
+
+	// context is passed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = AsContextService(s).ReadPVContext(ctx, "/a")
+	if err == nil || err.Code() != StatusServiceUnavailable {
+		t.Error(err)
+	}
+}
+
+func TestChainOptionalInterfaces(t *testing.T) {
+	var mem MemoryService
+	if _, err := mem.WriteProperties("/a", AttrValues{}); err != nil {
+		t.Fatal(err)
+	}
+	var log []string
+	logMiddleware := Intercept(func(ctx context.Context, method, path string, call func() Error) Error {
+		log = append(log, method+" "+path)
+		return call()
+	})
+	plain := func(inner Service) Service {
+		return &FuncService{ReadPVFunc: inner.ReadPV, WritePVFunc: inner.WritePV}
+	}
+
+	// native subscriptions
+	s := Chain(&mem, logMiddleware)
+	sub, ok := s.(Subscriber)
+	if !ok {
+		t.Fatal("Subscriber expected")
+	}
+	var changes []PV
+	id, err := sub.Subscribe([]string{"/a"}, func(path string, pv PV) {
+		changes = append(changes, pv)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv := PV{Time: time.Unix(1, 0), Value: 1.0}
+	if err := mem.WritePV("/a", pv); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || !changes[0].Equal(pv) {
+		t.Error(changes)
+	}
+	if err := sub.Unsubscribe(id); err != nil {
+		t.Error(err)
+	}
+
+	// atomic writes
+	wp, ok := s.(WritePreparer)
+	if !ok {
+		t.Fatal("WritePreparer expected")
+	}
+	if err := WritePVsAtomic(context.Background(), wp, []WritePVParam{{Path: "/b", PV: pv}}); err == nil {
+		t.Error("expected error")
+	}
+	pv.Value = 2.0
+	if err := WritePVsAtomic(context.Background(), wp, []WritePVParam{{Path: "/a", PV: pv}}); err != nil {
+		t.Error(err)
+	}
+	if rpv, _ := mem.ReadPV("/a"); rpv.Value != 2.0 {
+		t.Error(rpv)
+	}
+
+	// aggregation
+	if _, ok := s.(AggregatingHistoryReader); !ok {
+		t.Error("AggregatingHistoryReader expected")
+	}
+	if fmt.Sprint(log) != "[Subscribe  Unsubscribe  PrepareWritePV /b PrepareWritePV /a WritePV /a]" {
+		t.Error(log)
+	}
+
+	// middleware without optional interfaces, the inner service is not used
+	s = Chain(&mem, plain)
+	if _, err := s.(Subscriber).Subscribe([]string{"/b"}, func(path string, pv PV) {}); err == nil || err.Code() != StatusNotFound {
+		t.Error(err)
+	}
+	if _, err := s.(WritePreparer).PrepareWritePV(context.Background(), "/a", PV{}); err == nil || err.Code() != StatusBadRequest {
+		t.Error(err)
+	}
+	if _, err := s.(MetaService).Query([]string{"/*"}); err == nil {
+		t.Error("expected error")
+	}
+
+	// without native support
+	svc := &FuncService{ReadPVFunc: func(path string) (PV, Error) { return PV{}, nil }}
+	wp = Chain(svc, logMiddleware).(WritePreparer)
+	if _, err := wp.PrepareWritePV(context.Background(), "/a", PV{}); err == nil || err.Code() != StatusBadRequest {
+		t.Error(err)
+	}
+}
+
+func TestChainAccessControl(t *testing.T) {
+	var mem MemoryService
+	for _, p := range []string{"/a", "/b"} {
+		if _, err := mem.WriteProperties(p, AttrValues{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mem.WritePV(p, PV{Time: time.Unix(1, 0), Value: 1.0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acl := func(inner Service) Service {
+		return &AccessControlService{
+			Service: inner,
+			Rules:   []AccessRule{{Principal: AnyPrincipal, PathPattern: "/a", Operations: OpRead}},
+		}
+	}
+	s := Chain(&mem, acl)
+
+	// subscriptions
+	sub := s.(Subscriber)
+	if _, err := sub.Subscribe([]string{"/b"}, func(path string, pv PV) {}); err == nil || err.Code() != StatusForbidden {
+		t.Error(err)
+	}
+	id, err := sub.Subscribe([]string{"/a"}, func(path string, pv PV) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Unsubscribe(id)
+
+	// aggregation
+	ahr := s.(AggregatingHistoryReader)
+	aggr := Aggregation{Func: AggregateCount, Interval: time.Hour}
+	if _, err := ahr.ReadAggregatedHistory(context.Background(), "/b", time.Unix(0, 0), time.Unix(10, 0), aggr, 10); err == nil || err.Code() != StatusForbidden {
+		t.Error(err)
+	}
+
+	// atomic writes
+	if _, err := s.(WritePreparer).PrepareWritePV(context.Background(), "/a", PV{}); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"context"
 	"time"
 
 	"github.com/mdzio/go-veap"
@@ -57,6 +58,18 @@ type LinkReader interface {
 	ReadLinks() []Link
 }
 
+// LinkWriter specifies functions for changing the links of an Object. With
+// this interface VEAP clients can modify the links (q.v. veap.LinkUpdate).
+type LinkWriter interface {
+	LinkReader
+
+	// PutLink adds a link. Returns false, if the link already exists.
+	PutLink(target Object, role string) bool
+
+	// RemoveLink removes a link. Returns false, if the link does not exist.
+	RemoveLink(target Object, role string) bool
+}
+
 // Collection is the interface for collection objects, which can contain other
 // objects. Only one item role is supported. Different item roles can be
 // realized via intermediate collections.
@@ -115,6 +128,49 @@ type PVWriter interface {
 	WritePV(veap.PV) veap.Error
 }
 
+// ValueSpecReader specifies a function for getting the value specification of
+// a PV.
+type ValueSpecReader interface {
+	// ReadValueSpec returns the value specification or nil, if the value is
+	// not specified.
+	ReadValueSpec() *ValueSpec
+}
+
+// ContextPVReader specifies a function for reading a PV with a
+// context.Context. If implemented, it is preferred over PVReader.
+type ContextPVReader interface {
+	// ReadPVContext gets the PV of the VEAP object.
+	ReadPVContext(ctx context.Context) (veap.PV, veap.Error)
+}
+
+// ContextPVWriter specifies a function for writing a PV with a
+// context.Context. If implemented, it is preferred over PVWriter.
+type ContextPVWriter interface {
+	// WritePVContext sets the PV of the VEAP object.
+	WritePVContext(ctx context.Context, pv veap.PV) veap.Error
+}
+
+// PVPreparer specifies a function for validating a PV write without executing
+// it. It is used for atomic writes (q.v. veap.WritePreparer). If not
+// implemented, a PVWriter is only checked against its value specification.
+type PVPreparer interface {
+	// PreparePV validates the PV. The PV is written, when Commit is called on
+	// the returned veap.PreparedWrite.
+	PreparePV(ctx context.Context, pv veap.PV) (veap.PreparedWrite, veap.Error)
+}
+
+// PVNotifier specifies functions for observing the PV of a VEAP object.
+type PVNotifier interface {
+	// AddPVListener registers a function, which is called on every PV change.
+	// The returned ID is used for removing the listener.
+	AddPVListener(listener func(veap.PV)) uint64
+
+	// RemovePVListener removes a previously added listener. After returning,
+	// the listener is no longer called. It must not be called from within the
+	// listener itself.
+	RemovePVListener(id uint64)
+}
+
 // HistoryReader specifies functions for reading the history of a VEAP object.
 type HistoryReader interface {
 	// ReadHistory gets the history of the VEAP object.
@@ -127,3 +183,17 @@ type HistoryWriter interface {
 	// entries within the time range of the entries are deleted.
 	WriteHistory(timeSeries []veap.PV) veap.Error
 }
+
+// ContextHistoryReader specifies a function for reading the history with a
+// context.Context. If implemented, it is preferred over HistoryReader.
+type ContextHistoryReader interface {
+	// ReadHistoryContext gets the history of the VEAP object.
+	ReadHistoryContext(ctx context.Context, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error)
+}
+
+// ContextHistoryWriter specifies a function for writing the history with a
+// context.Context. If implemented, it is preferred over HistoryWriter.
+type ContextHistoryWriter interface {
+	// WriteHistoryContext inserts into the history of the VEAP object.
+	WriteHistoryContext(ctx context.Context, timeSeries []veap.PV) veap.Error
+}
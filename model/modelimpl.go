@@ -168,11 +168,13 @@ func NewModifiableDomain(c *ModifiableDomainCfg) *ModifiableDomain {
 	return domain
 }
 
-// ROVariable is a read only PV.
+// ROVariable is a read only PV. PV changes can be signaled with NotifyPV.
 type ROVariable struct {
 	BasicObject
 	BasicItem
+	BasicValueSpec
 	FuncPVReader
+	BasicPVNotifier
 }
 
 // ROVariableCfg configures a ROVariable.
@@ -183,6 +185,7 @@ type ROVariableCfg struct {
 	AdditionalAttr veap.AttrValues
 	Collection     ChangeableCollection
 	CollectionRole string
+	ValueSpec      *ValueSpec
 	ReadPVFunc     func() (veap.PV, veap.Error)
 }
 
@@ -199,6 +202,9 @@ func NewROVariable(c *ROVariableCfg) *ROVariable {
 			Collection:     c.Collection,
 			CollectionRole: c.CollectionRole,
 		},
+		BasicValueSpec: BasicValueSpec{
+			ValueSpec: c.ValueSpec,
+		},
 		FuncPVReader: FuncPVReader{
 			ReadPVFunc: c.ReadPVFunc,
 		},
@@ -209,11 +215,14 @@ func NewROVariable(c *ROVariableCfg) *ROVariable {
 	return domain
 }
 
-// Variable is a readable and writeable PV.
+// Variable is a readable and writeable PV. PV changes can be signaled with
+// NotifyPV.
 type Variable struct {
 	BasicObject
 	BasicItem
+	BasicValueSpec
 	FuncPVReader
+	BasicPVNotifier
 	FuncPVWriter
 }
 
@@ -225,6 +234,7 @@ type VariableCfg struct {
 	AdditionalAttr veap.AttrValues
 	Collection     ChangeableCollection
 	CollectionRole string
+	ValueSpec      *ValueSpec
 	ReadPVFunc     func() (veap.PV, veap.Error)
 	WritePVFunc    func(veap.PV) veap.Error
 }
@@ -242,6 +252,9 @@ func NewVariable(c *VariableCfg) *Variable {
 			Collection:     c.Collection,
 			CollectionRole: c.CollectionRole,
 		},
+		BasicValueSpec: BasicValueSpec{
+			ValueSpec: c.ValueSpec,
+		},
 		FuncPVReader: FuncPVReader{
 			ReadPVFunc: c.ReadPVFunc,
 		},
@@ -346,7 +359,9 @@ func NewHistory(c *HistoryCfg) *History {
 type ROVariableWithHistory struct {
 	BasicObject
 	BasicItem
+	BasicValueSpec
 	FuncPVReader
+	BasicPVNotifier
 	FuncHistoryReader
 }
 
@@ -358,6 +373,7 @@ type ROVariableWithHistoryCfg struct {
 	AdditionalAttr  veap.AttrValues
 	Collection      ChangeableCollection
 	CollectionRole  string
+	ValueSpec       *ValueSpec
 	ReadPVFunc      func() (veap.PV, veap.Error)
 	ReadHistoryFunc func(begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error)
 }
@@ -375,6 +391,9 @@ func NewROVariableWithHistory(c *ROVariableWithHistoryCfg) *ROVariableWithHistor
 			Collection:     c.Collection,
 			CollectionRole: c.CollectionRole,
 		},
+		BasicValueSpec: BasicValueSpec{
+			ValueSpec: c.ValueSpec,
+		},
 		FuncPVReader: FuncPVReader{
 			ReadPVFunc: c.ReadPVFunc,
 		},
@@ -392,7 +411,9 @@ func NewROVariableWithHistory(c *ROVariableWithHistoryCfg) *ROVariableWithHistor
 type VariableWithHistory struct {
 	BasicObject
 	BasicItem
+	BasicValueSpec
 	FuncPVReader
+	BasicPVNotifier
 	FuncPVWriter
 	FuncHistoryReader
 	FuncHistoryWriter
@@ -406,6 +427,7 @@ type VariableWithHistoryCfg struct {
 	AdditionalAttr   veap.AttrValues
 	Collection       ChangeableCollection
 	CollectionRole   string
+	ValueSpec        *ValueSpec
 	ReadPVFunc       func() (veap.PV, veap.Error)
 	WritePVFunc      func(veap.PV) veap.Error
 	ReadHistoryFunc  func(begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error)
@@ -425,6 +447,9 @@ func NewVariableWithHistory(c *VariableWithHistoryCfg) *VariableWithHistory {
 			Collection:     c.Collection,
 			CollectionRole: c.CollectionRole,
 		},
+		BasicValueSpec: BasicValueSpec{
+			ValueSpec: c.ValueSpec,
+		},
 		FuncPVReader: FuncPVReader{
 			ReadPVFunc: c.ReadPVFunc,
 		},
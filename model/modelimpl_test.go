@@ -2,6 +2,8 @@ package model
 
 import (
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -319,6 +321,17 @@ func TestModifiableDomain(t *testing.T) {
 		t.Error(attr)
 	}
 
+	// new item does not support links
+	created, err = s.WriteProperties("/domain/comp2", veap.AttrValues{veap.LinksMarker: veap.LinkUpdate{
+		Add: []veap.Link{{Role: "room", Target: "/domain"}},
+	}})
+	if err == nil || err.Code() != veap.StatusMethodNotAllowed || created {
+		t.Error(err, created)
+	}
+	if _, _, err = s.ReadProperties("/domain/comp2"); err == nil || err.Code() != veap.StatusNotFound {
+		t.Error(err)
+	}
+
 	err = s.Delete("/domain/comp1")
 	if err != nil {
 		t.Error(err)
@@ -440,3 +453,191 @@ func TestLinkedDomain(t *testing.T) {
 		t.Errorf("%+v", links)
 	}
 }
+
+func TestSubscribe(t *testing.T) {
+	r := NewRoot(&RootCfg{})
+	s := &Service{Root: r}
+	v := NewVariable(&VariableCfg{
+		Identifier: "var",
+		Collection: r,
+	})
+	NewDomain(&DomainCfg{
+		Identifier: "dom",
+		Collection: r,
+	})
+
+	// not supported
+	if _, err := s.Subscribe([]string{"/dom"}, func(string, veap.PV) {}); err == nil || err.Code() != veap.StatusMethodNotAllowed {
+		t.Fatal(err)
+	}
+
+	// subscribe
+	var paths []string
+	var pvs []veap.PV
+	id, err := s.Subscribe([]string{"/var"}, func(path string, pv veap.PV) {
+		paths = append(paths, path)
+		pvs = append(pvs, pv)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv := veap.PV{Time: time.Unix(1, 0), Value: 42.0}
+	v.NotifyPV(pv)
+	if !reflect.DeepEqual(paths, []string{"/var"}) || !reflect.DeepEqual(pvs, []veap.PV{pv}) {
+		t.Error(paths, pvs)
+	}
+
+	// unsubscribe
+	if err := s.Unsubscribe(id); err != nil {
+		t.Fatal(err)
+	}
+	v.NotifyPV(pv)
+	if len(pvs) != 1 {
+		t.Error(pvs)
+	}
+}
+
+func TestNotifierRemoveInListener(t *testing.T) {
+	var n BasicPVNotifier
+	var other uint64
+	var cnt, otherCnt int
+	other = n.AddPVListener(func(veap.PV) { otherCnt++ })
+	n.AddPVListener(func(veap.PV) {
+		cnt++
+		// must not deadlock
+		n.RemovePVListener(other)
+		other = n.AddPVListener(func(veap.PV) { otherCnt++ })
+	})
+	n.NotifyPV(veap.PV{})
+	n.NotifyPV(veap.PV{})
+	if cnt != 2 || otherCnt > 2 {
+		t.Error(cnt, otherCnt)
+	}
+}
+
+func TestNotifierRemoveConcurrently(t *testing.T) {
+	var n BasicPVNotifier
+	var mutex sync.Mutex
+	removed := false
+	id := n.AddPVListener(func(veap.PV) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if removed {
+			t.Error("listener called after removal")
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			n.NotifyPV(veap.PV{})
+		}
+	}()
+	n.RemovePVListener(id)
+	mutex.Lock()
+	removed = true
+	mutex.Unlock()
+	<-done
+}
+
+func TestWriteLinks(t *testing.T) {
+	r := NewRoot(&RootCfg{})
+	s := &Service{Root: r}
+	rooms := NewDomain(&DomainCfg{Identifier: "rooms", Collection: r})
+	NewDomain(&DomainCfg{Identifier: "kitchen", Title: "Kitchen", Collection: rooms})
+	NewDomain(&DomainCfg{Identifier: "bath", Title: "Bath", Collection: rooms})
+	d1 := NewLinkedDomain(&DomainCfg{Identifier: "d1", Collection: r})
+	d1.PutLink(r, "function")
+	NewDomain(&DomainCfg{Identifier: "d2", Collection: r})
+
+	readLinks := func() []veap.Link {
+		_, links, err := s.ReadProperties("/d1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r []veap.Link
+		for _, l := range links {
+			if l.Role != "collection" {
+				r = append(r, l)
+			}
+		}
+		sort.Slice(r, func(i, j int) bool {
+			return r[i].Role+r[i].Target < r[j].Role+r[j].Target
+		})
+		return r
+	}
+
+	// replace and add, relative target
+	_, err := s.WriteProperties("/d1", veap.AttrValues{veap.LinksMarker: veap.LinkUpdate{
+		Replace: map[string][]string{"room": {"/rooms/kitchen", "../rooms/bath"}},
+		Add:     []veap.Link{{Role: "function", Target: "/rooms"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links := readLinks(); !reflect.DeepEqual(links, []veap.Link{
+		{Role: "function", Target: "/"},
+		{Role: "function", Target: "/rooms"},
+		{Role: "room", Target: "/rooms/bath", Title: "Bath"},
+		{Role: "room", Target: "/rooms/kitchen", Title: "Kitchen"},
+	}) {
+		t.Errorf("%+v", links)
+	}
+
+	// replace, remove and clear role
+	_, err = s.WriteProperties("/d1", veap.AttrValues{veap.LinksMarker: &veap.LinkUpdate{
+		Replace: map[string][]string{"room": {"/rooms/bath"}, "unknown": {}},
+		Remove:  []veap.Link{{Role: "function", Target: "/"}, {Role: "function", Target: "/d2"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links := readLinks(); !reflect.DeepEqual(links, []veap.Link{
+		{Role: "function", Target: "/rooms"},
+		{Role: "room", Target: "/rooms/bath", Title: "Bath"},
+	}) {
+		t.Errorf("%+v", links)
+	}
+
+	// errors do not modify links
+	_, err = s.WriteProperties("/d1", veap.AttrValues{veap.LinksMarker: veap.LinkUpdate{
+		Replace: map[string][]string{"room": {}},
+		Add:     []veap.Link{{Role: "room", Target: "/unknown"}},
+	}})
+	if err == nil || err.Code() != veap.StatusNotFound {
+		t.Error(err)
+	}
+	_, err = s.WriteProperties("/d1", veap.AttrValues{veap.LinksMarker: veap.LinkUpdate{
+		Add: []veap.Link{{Role: "", Target: "/rooms"}},
+	}})
+	if err == nil || err.Code() != veap.StatusBadRequest {
+		t.Error(err)
+	}
+	_, err = s.WriteProperties("/d1", veap.AttrValues{veap.LinksMarker: veap.LinkUpdate{
+		Replace: map[string][]string{"collection": {"/rooms"}},
+	}})
+	if err == nil || err.Code() != veap.StatusBadRequest {
+		t.Error(err)
+	}
+	_, err = s.WriteProperties("/d1", veap.AttrValues{veap.LinksMarker: veap.LinkUpdate{
+		Add: []veap.Link{{Role: veap.ServiceMarker, Target: "/rooms"}},
+	}})
+	if err == nil || err.Code() != veap.StatusBadRequest {
+		t.Error(err)
+	}
+	_, err = s.WriteProperties("/d1", veap.AttrValues{veap.LinksMarker: []interface{}{}})
+	if err == nil || err.Code() != veap.StatusBadRequest {
+		t.Error(err)
+	}
+	if links := readLinks(); len(links) != 2 {
+		t.Errorf("%+v", links)
+	}
+
+	// links not supported
+	_, err = s.WriteProperties("/d2", veap.AttrValues{veap.LinksMarker: veap.LinkUpdate{
+		Add: []veap.Link{{Role: "room", Target: "/rooms"}},
+	}})
+	if err == nil || err.Code() != veap.StatusMethodNotAllowed {
+		t.Error(err)
+	}
+}
@@ -134,7 +134,8 @@ func (l BasicLink) GetRole() string {
 	return l.Role
 }
 
-// BasicLinks implements LinkReader. It can be manipulated by multiple goroutines.
+// BasicLinks implements LinkReader and LinkWriter. It can be manipulated by
+// multiple goroutines.
 type BasicLinks struct {
 	lobj  map[BasicLink]struct{}
 	mutex sync.RWMutex
@@ -202,6 +203,71 @@ func (n *FuncPVWriter) WritePV(pv veap.PV) veap.Error {
 	return n.WritePVFunc(pv)
 }
 
+// BasicPVNotifier implements PVNotifier. PV changes are signaled with
+// NotifyPV. It can be used by multiple goroutines.
+type BasicPVNotifier struct {
+	listeners map[uint64]*pvListener
+	nextID    uint64
+	mutex     sync.RWMutex
+}
+
+type pvListener struct {
+	listener func(veap.PV)
+
+	// mutex is locked during calls, so that the listener is not called after
+	// RemovePVListener returns
+	mutex   sync.Mutex
+	removed bool
+}
+
+// AddPVListener implements PVNotifier.
+func (n *BasicPVNotifier) AddPVListener(listener func(veap.PV)) uint64 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.listeners == nil {
+		n.listeners = make(map[uint64]*pvListener)
+	}
+	n.nextID++
+	n.listeners[n.nextID] = &pvListener{listener: listener}
+	return n.nextID
+}
+
+// RemovePVListener implements PVNotifier. It waits for a running call of the
+// listener.
+func (n *BasicPVNotifier) RemovePVListener(id uint64) {
+	n.mutex.Lock()
+	l, ok := n.listeners[id]
+	delete(n.listeners, id)
+	n.mutex.Unlock()
+
+	if ok {
+		l.mutex.Lock()
+		l.removed = true
+		l.mutex.Unlock()
+	}
+}
+
+// NotifyPV signals a PV change to all registered listeners. The listeners are
+// called without holding the lock of the notifier, so they may add listeners
+// or remove other listeners.
+func (n *BasicPVNotifier) NotifyPV(pv veap.PV) {
+	n.mutex.RLock()
+	listeners := make([]*pvListener, 0, len(n.listeners))
+	for _, l := range n.listeners {
+		listeners = append(listeners, l)
+	}
+	n.mutex.RUnlock()
+
+	for _, l := range listeners {
+		l.mutex.Lock()
+		if !l.removed {
+			l.listener(pv)
+		}
+		l.mutex.Unlock()
+	}
+}
+
 // FuncHistoryReader implements HistoryReader.
 type FuncHistoryReader struct {
 	ReadHistoryFunc func(begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error)
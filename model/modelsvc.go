@@ -1,29 +1,73 @@
 package model
 
 import (
+	"context"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mdzio/go-veap"
 )
 
-// Service implements veap.Service for an object model. The root object is the entry point
-// for the path evaluation.
+// Service implements veap.Service and veap.ContextService for an object model.
+// The root object is the entry point for the path evaluation. Additionally
+// veap.Subscriber is implemented for objects, which implement PVNotifier, and
+// veap.WritePreparer for atomic writes.
 type Service struct {
 	Root Object
+
+	// EnableContext enables the ...Context methods for veap.AsContextService
+	// (e.g. used by server.Handler). If not set, the methods without context
+	// are called, so that the overridden methods of a type, which embeds
+	// *Service, are not bypassed. Such a type must also override the
+	// ...Context methods, if this is set.
+	EnableContext bool
+
+	subs      map[veap.SubscriptionID][]subscribedNotifier
+	nextSubID veap.SubscriptionID
+	subsMutex sync.Mutex
+}
+
+type subscribedNotifier struct {
+	notifier   PVNotifier
+	listenerID uint64
+}
+
+// Make sure that Service implements veap.Service, veap.ContextService and
+// veap.Subscriber.
+var _ veap.Service = (*Service)(nil)
+var _ veap.ContextService = (*Service)(nil)
+var _ veap.Subscriber = (*Service)(nil)
+var _ veap.WritePreparer = (*Service)(nil)
+var _ veap.ContextSwitch = (*Service)(nil)
+
+// ContextEnabled implements veap.ContextSwitch.
+func (s *Service) ContextEnabled() bool {
+	return s.EnableContext
 }
 
 // ReadPV implements Service.
 func (s *Service) ReadPV(path string) (veap.PV, veap.Error) {
+	return s.ReadPVContext(context.Background(), path)
+}
+
+// ReadPVContext implements veap.ContextService.
+func (s *Service) ReadPVContext(ctx context.Context, path string) (veap.PV, veap.Error) {
 	// find object
 	obj, err := s.EvalPath(path)
 	if err != nil {
 		return veap.PV{}, err
 	}
 	// read PV
+	if pvReader, ok := obj.(ContextPVReader); ok {
+		return pvReader.ReadPVContext(ctx)
+	}
 	if pvReader, ok := obj.(PVReader); ok {
+		if err := veap.ContextError(ctx); err != nil {
+			return veap.PV{}, err
+		}
 		return pvReader.ReadPV()
 	}
 	return veap.PV{}, veap.NewErrorf(veap.StatusMethodNotAllowed, "Reading PV not supported: %s", path)
@@ -31,13 +75,70 @@ func (s *Service) ReadPV(path string) (veap.PV, veap.Error) {
 
 // WritePV implements Service.
 func (s *Service) WritePV(path string, pv veap.PV) veap.Error {
+	return s.WritePVContext(context.Background(), path, pv)
+}
+
+// WritePVContext implements veap.ContextService.
+func (s *Service) WritePVContext(ctx context.Context, path string, pv veap.PV) veap.Error {
 	// find object
 	obj, err := s.EvalPath(path)
 	if err != nil {
 		return err
 	}
+	// validate PV
+	if err := validatePV(obj, path, pv); err != nil {
+		return err
+	}
 	// write PV
+	return writePV(ctx, obj, path, pv)
+}
+
+// PrepareWritePV implements veap.WritePreparer.
+func (s *Service) PrepareWritePV(ctx context.Context, path string, pv veap.PV) (veap.PreparedWrite, veap.Error) {
+	// find object
+	obj, err := s.EvalPath(path)
+	if err != nil {
+		return nil, err
+	}
+	// validate PV
+	if err := validatePV(obj, path, pv); err != nil {
+		return nil, err
+	}
+	// prepare PV
+	if pvPreparer, ok := obj.(PVPreparer); ok {
+		return pvPreparer.PreparePV(ctx, pv)
+	}
+	_, isCtxWriter := obj.(ContextPVWriter)
+	_, isWriter := obj.(PVWriter)
+	if !isCtxWriter && !isWriter {
+		return nil, veap.NewErrorf(veap.StatusMethodNotAllowed, "Writing PV not supported: %s", path)
+	}
+	return &veap.FuncPreparedWrite{
+		CommitFunc: func(ctx context.Context) veap.Error {
+			return writePV(ctx, obj, path, pv)
+		},
+	}, nil
+}
+
+func validatePV(obj Object, path string, pv veap.PV) veap.Error {
+	if specReader, ok := obj.(ValueSpecReader); ok {
+		if spec := specReader.ReadValueSpec(); spec != nil {
+			if err := spec.ValidatePV(pv); err != nil {
+				return veap.NewErrorf(err.Code(), "Invalid PV for %s: %v", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+func writePV(ctx context.Context, obj Object, path string, pv veap.PV) veap.Error {
+	if pvWriter, ok := obj.(ContextPVWriter); ok {
+		return pvWriter.WritePVContext(ctx, pv)
+	}
 	if pvWriter, ok := obj.(PVWriter); ok {
+		if err := veap.ContextError(ctx); err != nil {
+			return err
+		}
 		return pvWriter.WritePV(pv)
 	}
 	return veap.NewErrorf(veap.StatusMethodNotAllowed, "Writing PV not supported: %s", path)
@@ -45,13 +146,24 @@ func (s *Service) WritePV(path string, pv veap.PV) veap.Error {
 
 // ReadHistory implements Service.
 func (s *Service) ReadHistory(path string, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	return s.ReadHistoryContext(context.Background(), path, begin, end, limit)
+}
+
+// ReadHistoryContext implements veap.ContextService.
+func (s *Service) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
 	// find object
 	obj, err := s.EvalPath(path)
 	if err != nil {
 		return nil, err
 	}
 	// read history
+	if historyReader, ok := obj.(ContextHistoryReader); ok {
+		return historyReader.ReadHistoryContext(ctx, begin, end, limit)
+	}
 	if historyReader, ok := obj.(HistoryReader); ok {
+		if err := veap.ContextError(ctx); err != nil {
+			return nil, err
+		}
 		return historyReader.ReadHistory(begin, end, limit)
 	}
 	return nil, veap.NewErrorf(veap.StatusMethodNotAllowed, "Reading History not supported: %s", path)
@@ -59,13 +171,24 @@ func (s *Service) ReadHistory(path string, begin time.Time, end time.Time, limit
 
 // WriteHistory implements Service.
 func (s *Service) WriteHistory(path string, timeSeries []veap.PV) veap.Error {
+	return s.WriteHistoryContext(context.Background(), path, timeSeries)
+}
+
+// WriteHistoryContext implements veap.ContextService.
+func (s *Service) WriteHistoryContext(ctx context.Context, path string, timeSeries []veap.PV) veap.Error {
 	// find object
 	obj, err := s.EvalPath(path)
 	if err != nil {
 		return err
 	}
 	// write history
+	if historyWriter, ok := obj.(ContextHistoryWriter); ok {
+		return historyWriter.WriteHistoryContext(ctx, timeSeries)
+	}
 	if historyWriter, ok := obj.(HistoryWriter); ok {
+		if err := veap.ContextError(ctx); err != nil {
+			return err
+		}
 		return historyWriter.WriteHistory(timeSeries)
 	}
 	return veap.NewErrorf(veap.StatusMethodNotAllowed, "Writing History not supported: %s", path)
@@ -73,6 +196,14 @@ func (s *Service) WriteHistory(path string, timeSeries []veap.PV) veap.Error {
 
 // ReadProperties implements Service.
 func (s *Service) ReadProperties(path string) (veap.AttrValues, []veap.Link, veap.Error) {
+	return s.ReadPropertiesContext(context.Background(), path)
+}
+
+// ReadPropertiesContext implements veap.ContextService.
+func (s *Service) ReadPropertiesContext(ctx context.Context, path string) (veap.AttrValues, []veap.Link, veap.Error) {
+	if err := veap.ContextError(ctx); err != nil {
+		return nil, nil, err
+	}
 	// find object
 	obj, err := s.EvalPath(path)
 	if err != nil {
@@ -85,6 +216,13 @@ func (s *Service) ReadProperties(path string) (veap.AttrValues, []veap.Link, vea
 			attr[k] = v
 		}
 	}
+	if specReader, ok := obj.(ValueSpecReader); ok {
+		if spec := specReader.ReadValueSpec(); spec != nil {
+			for k, v := range spec.Attributes() {
+				attr[k] = v
+			}
+		}
+	}
 	if s := obj.GetIdentifier(); s != "" {
 		attr[IdentifierProperty] = s
 	}
@@ -128,7 +266,9 @@ func (s *Service) ReadProperties(path string) (veap.AttrValues, []veap.Link, vea
 	// PV service
 	_, pvReader := obj.(PVReader)
 	_, pvWriter := obj.(PVWriter)
-	if pvReader || pvWriter {
+	_, ctxPVReader := obj.(ContextPVReader)
+	_, ctxPVWriter := obj.(ContextPVWriter)
+	if pvReader || pvWriter || ctxPVReader || ctxPVWriter {
 		links = append(links, veap.Link{
 			Role:   veap.ServiceMarker,
 			Target: veap.PVMarker,
@@ -138,7 +278,9 @@ func (s *Service) ReadProperties(path string) (veap.AttrValues, []veap.Link, vea
 	// history service
 	_, historyReader := obj.(HistoryReader)
 	_, historyWriter := obj.(HistoryWriter)
-	if historyReader || historyWriter {
+	_, ctxHistoryReader := obj.(ContextHistoryReader)
+	_, ctxHistoryWriter := obj.(ContextHistoryWriter)
+	if historyReader || historyWriter || ctxHistoryReader || ctxHistoryWriter {
 		links = append(links, veap.Link{
 			Role:   veap.ServiceMarker,
 			Target: veap.HistMarker,
@@ -150,9 +292,29 @@ func (s *Service) ReadProperties(path string) (veap.AttrValues, []veap.Link, vea
 
 // WriteProperties implements Service.
 func (s *Service) WriteProperties(objPath string, attributes veap.AttrValues) (created bool, err veap.Error) {
+	return s.WritePropertiesContext(context.Background(), objPath, attributes)
+}
+
+// WritePropertiesContext implements veap.ContextService.
+func (s *Service) WritePropertiesContext(ctx context.Context, objPath string, attributes veap.AttrValues) (created bool, err veap.Error) {
+	if err := veap.ContextError(ctx); err != nil {
+		return false, err
+	}
+	// separate link changes
+	attr, update, err := veap.ExtractLinkUpdate(attributes)
+	if err != nil {
+		return false, err
+	}
+	var links *resolvedLinks
+	if update != nil {
+		links, err = s.resolveLinks(objPath, update)
+		if err != nil {
+			return false, err
+		}
+	}
 	// special case root
 	if objPath == "/" {
-		return false, setAttr(objPath, s.Root, attributes)
+		return false, writeProperties(objPath, s.Root, attr, links)
 	}
 	// find container
 	containerPath := path.Dir(objPath)
@@ -165,22 +327,96 @@ func (s *Service) WriteProperties(objPath string, attributes veap.AttrValues) (c
 	childObj, err := GetItem(containerObj, childIdent)
 	if err == nil {
 		// child found
-		return false, setAttr(objPath, childObj, attributes)
+		return false, writeProperties(objPath, childObj, attr, links)
 	}
 	// supports the container creation of items?
 	modifier, ok := containerObj.(CollectionModifier)
 	if !ok {
 		return false, veap.NewErrorf(veap.StatusMethodNotAllowed, "Create not supported: %s", objPath)
 	}
-	err = modifier.CreateItem(childIdent, attributes)
+	err = modifier.CreateItem(childIdent, attr)
 	if err != nil {
 		return false, err
 	}
+	// set links of the new item, if this fails, the item is deleted again
+	if links != nil {
+		childObj, err = GetItem(containerObj, childIdent)
+		if err != nil {
+			return true, err
+		}
+		if err := writeLinks(objPath, childObj, links); err != nil {
+			if delErr := modifier.DeleteItem(childIdent); delErr != nil {
+				return true, err
+			}
+			return false, err
+		}
+	}
 	return true, nil
 }
 
+// resolvedLinks is a veap.LinkUpdate with resolved targets.
+type resolvedLinks struct {
+	replace map[string][]Object
+	remove  []BasicLink
+	add     []BasicLink
+}
+
+// resolveLinks evaluates the targets of a veap.LinkUpdate. Relative targets
+// are resolved against the object path.
+func (s *Service) resolveLinks(objPath string, update *veap.LinkUpdate) (*resolvedLinks, veap.Error) {
+	resolve := func(target string) (Object, veap.Error) {
+		if !path.IsAbs(target) {
+			target = path.Join(objPath, target)
+		}
+		obj, err := s.EvalPath(target)
+		if err != nil {
+			return nil, veap.NewErrorf(err.Code(), "Invalid link target %s: %v", target, err)
+		}
+		return obj, nil
+	}
+	resolveAll := func(links []veap.Link) ([]BasicLink, veap.Error) {
+		var r []BasicLink
+		for _, l := range links {
+			obj, err := resolve(l.Target)
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, BasicLink{Target: obj, Role: l.Role})
+		}
+		return r, nil
+	}
+	r := &resolvedLinks{replace: make(map[string][]Object)}
+	for role, targets := range update.Replace {
+		objs := make([]Object, 0, len(targets))
+		for _, t := range targets {
+			obj, err := resolve(t)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, obj)
+		}
+		r.replace[role] = objs
+	}
+	var err veap.Error
+	if r.remove, err = resolveAll(update.Remove); err != nil {
+		return nil, err
+	}
+	if r.add, err = resolveAll(update.Add); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
 // Delete implements Service.
 func (s *Service) Delete(itemPath string) veap.Error {
+	return s.DeleteContext(context.Background(), itemPath)
+}
+
+// DeleteContext implements veap.ContextService.
+func (s *Service) DeleteContext(ctx context.Context, itemPath string) veap.Error {
+	if err := veap.ContextError(ctx); err != nil {
+		return err
+	}
 	// special case root
 	if itemPath == "/" {
 		return veap.NewErrorf(veap.StatusMethodNotAllowed, "Root can not be deleted")
@@ -199,6 +435,58 @@ func (s *Service) Delete(itemPath string) veap.Error {
 	return modifier.DeleteItem(path.Base(itemPath))
 }
 
+// Subscribe implements veap.Subscriber. All objects must implement
+// PVNotifier. The Service does not signal PV changes by itself, also not on
+// WritePV. The objects must call NotifyPV (q.v. BasicPVNotifier) for every
+// PV change, including changes by VEAP writes.
+func (s *Service) Subscribe(paths []string, callback veap.PVChangeFunc) (veap.SubscriptionID, veap.Error) {
+	// find notifiers
+	notifiers := make([]PVNotifier, len(paths))
+	for i, p := range paths {
+		obj, err := s.EvalPath(p)
+		if err != nil {
+			return 0, err
+		}
+		notifier, ok := obj.(PVNotifier)
+		if !ok {
+			return 0, veap.NewErrorf(veap.StatusMethodNotAllowed, "Subscription not supported: %s", p)
+		}
+		notifiers[i] = notifier
+	}
+	// register listeners
+	sns := make([]subscribedNotifier, len(paths))
+	for i, n := range notifiers {
+		p := paths[i]
+		sns[i] = subscribedNotifier{
+			notifier:   n,
+			listenerID: n.AddPVListener(func(pv veap.PV) { callback(p, pv) }),
+		}
+	}
+	s.subsMutex.Lock()
+	defer s.subsMutex.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[veap.SubscriptionID][]subscribedNotifier)
+	}
+	s.nextSubID++
+	s.subs[s.nextSubID] = sns
+	return s.nextSubID, nil
+}
+
+// Unsubscribe implements veap.Subscriber.
+func (s *Service) Unsubscribe(id veap.SubscriptionID) veap.Error {
+	s.subsMutex.Lock()
+	sns, ok := s.subs[id]
+	delete(s.subs, id)
+	s.subsMutex.Unlock()
+	if !ok {
+		return veap.NewErrorf(veap.StatusNotFound, "Subscription not found: %d", id)
+	}
+	for _, sn := range sns {
+		sn.notifier.RemovePVListener(sn.listenerID)
+	}
+	return nil
+}
+
 // EvalPath follows the specified path to a object and returns it.
 func (s *Service) EvalPath(path string) (Object, veap.Error) {
 	// check path
@@ -239,6 +527,54 @@ func AbsPath(obj Object) string {
 	return p
 }
 
+// writeProperties updates the attributes and links of an object. The
+// attributes are only written, if no links are changed or attributes are
+// specified.
+func writeProperties(path string, obj Object, attr veap.AttrValues, links *resolvedLinks) veap.Error {
+	if links == nil {
+		return setAttr(path, obj, attr)
+	}
+	// check support before modifying anything
+	if _, ok := obj.(LinkWriter); !ok {
+		return veap.NewErrorf(veap.StatusMethodNotAllowed, "Writing of links not supported: %s", path)
+	}
+	if len(attr) > 0 {
+		if err := setAttr(path, obj, attr); err != nil {
+			return err
+		}
+	}
+	return writeLinks(path, obj, links)
+}
+
+func writeLinks(path string, obj Object, links *resolvedLinks) veap.Error {
+	writer, ok := obj.(LinkWriter)
+	if !ok {
+		return veap.NewErrorf(veap.StatusMethodNotAllowed, "Writing of links not supported: %s", path)
+	}
+	// replace links of roles
+	for role, targets := range links.replace {
+		keep := make(map[Object]bool)
+		for _, t := range targets {
+			keep[t] = true
+		}
+		for _, l := range writer.ReadLinks() {
+			if l.GetRole() == role && !keep[l.GetTarget()] {
+				writer.RemoveLink(l.GetTarget(), role)
+			}
+		}
+		for _, t := range targets {
+			writer.PutLink(t, role)
+		}
+	}
+	for _, l := range links.remove {
+		writer.RemoveLink(l.Target, l.Role)
+	}
+	for _, l := range links.add {
+		writer.PutLink(l.Target, l.Role)
+	}
+	return nil
+}
+
 func setAttr(path string, obj Object, attr veap.AttrValues) veap.Error {
 	if attrWriter, ok := obj.(AttributeWriter); ok {
 		return attrWriter.WriteAttributes(attr)
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"context"
 	"reflect"
 	"sort"
 	"strconv"
@@ -88,6 +89,29 @@ func TestQuery(t *testing.T) {
 				"/a97/c99/a97", "/a97/c99/b98", "/a97/c99/c99"},
 			errText: "",
 		},
+		{
+			pathPatterns: []string{"/a97/a97/**"},
+			resultPaths: []string{"/a97/a97", "/a97/a97/a97", "/a97/a97/a97/a97", "/a97/a97/a97/b98",
+				"/a97/a97/a97/c99", "/a97/a97/b98", "/a97/a97/b98/a97", "/a97/a97/b98/b98",
+				"/a97/a97/b98/c99", "/a97/a97/c99", "/a97/a97/c99/a97", "/a97/a97/c99/b98",
+				"/a97/a97/c99/c99"},
+			errText: "",
+		},
+		{
+			pathPatterns: []string{"/**/c99/c99/c99/c99"},
+			resultPaths:  []string{"/c99/c99/c99/c99"},
+			errText:      "",
+		},
+		{
+			pathPatterns: []string{"/**/**/a97/**/b98/c99/c99"},
+			resultPaths:  []string{"/a97/b98/c99/c99"},
+			errText:      "",
+		},
+		{
+			pathPatterns: []string{"/**/%C3%A4"},
+			resultPaths:  []string{"/%C3%A4"},
+			errText:      "",
+		},
 	}
 
 	// execute tests
@@ -113,3 +137,32 @@ func TestQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryMaxDepth(t *testing.T) {
+	root := NewRoot(&RootCfg{})
+	msvc := veap.BasicMetaService{Service: &Service{Root: root}}
+	buildTree(root, 4)
+
+	rs, err := msvc.ExtendedQuery(context.Background(), veap.QueryParams{
+		PathPatterns: []string{"/**"},
+		MaxDepth:     2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// root, 3 domains on level 1, 9 domains on level 2
+	if len(rs) != 13 {
+		t.Error(len(rs))
+	}
+
+	rs, err = msvc.ExtendedQuery(context.Background(), veap.QueryParams{
+		PathPatterns: []string{"/**/b98"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 + 3 + 9 + 27
+	if len(rs) != 40 {
+		t.Error(len(rs))
+	}
+}
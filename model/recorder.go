@@ -0,0 +1,330 @@
+package model
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-veap"
+)
+
+var recorderLog = logging.Get("veap-recorder")
+
+// RecorderCfg configures a Recorder.
+type RecorderCfg struct {
+	// Writer receives the recorded entries. If it also implements
+	// HistoryReader, the history can be read through the Recorder.
+	Writer HistoryWriter
+
+	// Deadband suppresses small changes of numeric values. A PV is recorded,
+	// if its value differs from the last recorded value by more than Deadband.
+	// Non-numeric values are recorded on every change. Changes of the state
+	// are always recorded.
+	Deadband float64
+
+	// MinInterval is the minimum time between two recorded entries. Changes
+	// within this interval are delayed. If several changes occur, only the
+	// last one is recorded.
+	MinInterval time.Duration
+
+	// MaxInterval is the maximum time between two recorded entries. If no
+	// change is recorded within this interval, the current PV is recorded
+	// again with the current time. 0 disables the repetition.
+	MaxInterval time.Duration
+}
+
+// Recorder turns PV changes into history entries. The PVs are passed to
+// Record, e.g. by a PVNotifier (q.v. NewRecordedVariable), or are received
+// from a veap.Service (q.v. RecordService). Recorder implements HistoryReader,
+// if the writer of the history also implements HistoryReader.
+type Recorder struct {
+	cfg RecorderCfg
+
+	mutex sync.Mutex
+	// last recorded PV
+	last     veap.PV
+	lastTime time.Time
+	recorded bool
+	// last received PV
+	current    veap.PV
+	hasCurrent bool
+	// delayed PV because of MinInterval
+	pending *veap.PV
+	timer   *time.Timer
+	closed  bool
+	stops   []func()
+}
+
+// Make sure that Recorder implements HistoryReader and ContextHistoryReader.
+var _ HistoryReader = (*Recorder)(nil)
+var _ ContextHistoryReader = (*Recorder)(nil)
+
+// NewRecorder constructs a new Recorder.
+func NewRecorder(c *RecorderCfg) *Recorder {
+	return &Recorder{cfg: *c}
+}
+
+// Record passes a PV to the recorder.
+func (r *Recorder) Record(pv veap.PV) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return
+	}
+	r.current, r.hasCurrent = pv, true
+	if r.recorded && !r.significant(pv) {
+		// a delayed change is obsolete
+		r.pending = nil
+		r.schedule()
+		return
+	}
+	if r.recorded && r.cfg.MinInterval > 0 && time.Since(r.lastTime) < r.cfg.MinInterval {
+		r.pending = &pv
+		r.schedule()
+		return
+	}
+	r.write(pv)
+}
+
+// RecordService records the PV of a data point of a veap.Service. If the
+// service does not implement veap.Subscriber, the PV is polled with the
+// specified interval. The subscription ends with Close.
+func (r *Recorder) RecordService(service veap.Service, path string, pollInterval time.Duration) veap.Error {
+	subscriber := veap.AsSubscriber(service, pollInterval)
+	id, err := subscriber.Subscribe([]string{path}, func(_ string, pv veap.PV) {
+		r.Record(pv)
+	})
+	if err != nil {
+		return err
+	}
+	r.addStop(func() {
+		if err := subscriber.Unsubscribe(id); err != nil {
+			recorderLog.Warningf("Unsubscribing %s failed: %v", path, err)
+		}
+	})
+	return nil
+}
+
+// Close stops the recording. A delayed change is recorded immediately.
+func (r *Recorder) Close() {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+	stops := r.stops
+	r.stops = nil
+	r.mutex.Unlock()
+	// stop sources outside of the lock, they may call Record
+	for _, stop := range stops {
+		stop()
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closed = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.pending != nil {
+		r.write(*r.pending)
+	}
+}
+
+// ReadHistory implements HistoryReader.
+func (r *Recorder) ReadHistory(begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	return r.ReadHistoryContext(context.Background(), begin, end, limit)
+}
+
+// ReadHistoryContext implements ContextHistoryReader.
+func (r *Recorder) ReadHistoryContext(ctx context.Context, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	if reader, ok := r.cfg.Writer.(ContextHistoryReader); ok {
+		return reader.ReadHistoryContext(ctx, begin, end, limit)
+	}
+	if reader, ok := r.cfg.Writer.(HistoryReader); ok {
+		if err := veap.ContextError(ctx); err != nil {
+			return nil, err
+		}
+		return reader.ReadHistory(begin, end, limit)
+	}
+	return nil, veap.NewErrorf(veap.StatusMethodNotAllowed, "Reading History not supported by recorder")
+}
+
+func (r *Recorder) addStop(stop func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stops = append(r.stops, stop)
+}
+
+// significant checks whether the PV differs sufficiently from the last
+// recorded PV. mutex must be locked.
+func (r *Recorder) significant(pv veap.PV) bool {
+	if pv.State != r.last.State {
+		return true
+	}
+	v, ok1 := veap.NumericValue(pv.Value)
+	l, ok2 := veap.NumericValue(r.last.Value)
+	if ok1 && ok2 {
+		return math.Abs(v-l) > r.cfg.Deadband
+	}
+	return !reflect.DeepEqual(pv.Value, r.last.Value)
+}
+
+// write records a PV. mutex must be locked.
+func (r *Recorder) write(pv veap.PV) {
+	r.last, r.lastTime, r.recorded = pv, time.Now(), true
+	r.pending = nil
+	if err := r.cfg.Writer.WriteHistory([]veap.PV{pv}); err != nil {
+		recorderLog.Errorf("Recording of history entry failed: %v", err)
+	}
+	r.schedule()
+}
+
+// schedule starts the timer for a delayed change or the repetition. mutex
+// must be locked.
+func (r *Recorder) schedule() {
+	if r.closed {
+		return
+	}
+	var next time.Time
+	switch {
+	case r.pending != nil:
+		next = r.lastTime.Add(r.cfg.MinInterval)
+	case r.cfg.MaxInterval > 0 && r.recorded:
+		next = r.lastTime.Add(r.cfg.MaxInterval)
+	default:
+		return
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(time.Until(next), r.onTimer)
+}
+
+func (r *Recorder) onTimer() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return
+	}
+	elapsed := time.Since(r.lastTime)
+	switch {
+	case r.pending != nil && elapsed >= r.cfg.MinInterval:
+		r.write(*r.pending)
+	case r.pending == nil && r.cfg.MaxInterval > 0 && r.hasCurrent && elapsed >= r.cfg.MaxInterval:
+		// repeat current PV
+		pv := r.current
+		pv.Time = time.Now()
+		r.write(pv)
+	default:
+		// timer was replaced
+		r.schedule()
+	}
+}
+
+// RecordedROVariable is a ROVariable with a recorded history. The PV changes
+// signaled by the variable are recorded. Optionally the PV is polled.
+type RecordedROVariable struct {
+	*ROVariable
+	*Recorder
+}
+
+// RecordedROVariableCfg configures a RecordedROVariable.
+type RecordedROVariableCfg struct {
+	RecorderCfg
+	Variable *ROVariable
+	// PollInterval enables periodic reading of the PV, if greater than 0.
+	PollInterval time.Duration
+}
+
+// NewRecordedROVariable constructs a new RecordedROVariable. It replaces the
+// variable in its collection, so that the history is provided as ~hist
+// service of the variable.
+func NewRecordedROVariable(c *RecordedROVariableCfg) *RecordedROVariable {
+	v := &RecordedROVariable{
+		ROVariable: c.Variable,
+		Recorder:   NewRecorder(&c.RecorderCfg),
+	}
+	v.Recorder.observe(c.Variable, c.Variable, c.PollInterval)
+	if coll, ok := c.Variable.Collection.(ChangeableCollection); ok {
+		coll.PutItem(v)
+	}
+	return v
+}
+
+// RecordedVariable is a Variable with a recorded history. The PV changes
+// signaled by the variable and the successfully written PVs are recorded.
+// Optionally the PV is polled.
+type RecordedVariable struct {
+	*Variable
+	*Recorder
+}
+
+// RecordedVariableCfg configures a RecordedVariable.
+type RecordedVariableCfg struct {
+	RecorderCfg
+	Variable *Variable
+	// PollInterval enables periodic reading of the PV, if greater than 0.
+	PollInterval time.Duration
+}
+
+// NewRecordedVariable constructs a new RecordedVariable. It replaces the
+// variable in its collection, so that the history is provided as ~hist
+// service of the variable.
+func NewRecordedVariable(c *RecordedVariableCfg) *RecordedVariable {
+	v := &RecordedVariable{
+		Variable: c.Variable,
+		Recorder: NewRecorder(&c.RecorderCfg),
+	}
+	v.Recorder.observe(c.Variable, c.Variable, c.PollInterval)
+	if coll, ok := c.Variable.Collection.(ChangeableCollection); ok {
+		coll.PutItem(v)
+	}
+	return v
+}
+
+// WritePV implements PVWriter. The PV is recorded after it was written
+// successfully.
+func (v *RecordedVariable) WritePV(pv veap.PV) veap.Error {
+	if err := v.Variable.WritePV(pv); err != nil {
+		return err
+	}
+	v.Record(pv)
+	return nil
+}
+
+// observe registers a PV listener and starts polling, if requested.
+func (r *Recorder) observe(notifier PVNotifier, reader PVReader, pollInterval time.Duration) {
+	id := notifier.AddPVListener(r.Record)
+	r.addStop(func() { notifier.RemovePVListener(id) })
+	if pollInterval <= 0 {
+		return
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pv, err := reader.ReadPV()
+				if err != nil {
+					recorderLog.Debugf("Polling of PV failed: %v", err)
+					continue
+				}
+				r.Record(pv)
+			case <-done:
+				return
+			}
+		}
+	}()
+	r.addStop(func() {
+		close(done)
+		wg.Wait()
+	})
+}
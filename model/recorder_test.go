@@ -0,0 +1,171 @@
+package model
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-veap"
+)
+
+// testHistory is a simple HistoryReader and HistoryWriter.
+type testHistory struct {
+	mutex   sync.Mutex
+	entries []veap.PV
+}
+
+func (h *testHistory) WriteHistory(timeSeries []veap.PV) veap.Error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.entries = append(h.entries, timeSeries...)
+	return nil
+}
+
+func (h *testHistory) ReadHistory(begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]veap.PV{}, h.entries...), nil
+}
+
+func (h *testHistory) values() []interface{} {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var vs []interface{}
+	for _, e := range h.entries {
+		vs = append(vs, e.Value)
+	}
+	return vs
+}
+
+func checkValues(t *testing.T, h *testHistory, expected ...interface{}) {
+	t.Helper()
+	vs := h.values()
+	if len(vs) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, vs)
+	}
+	for i := range vs {
+		if vs[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, vs)
+		}
+	}
+}
+
+func TestRecorderDeadband(t *testing.T) {
+	h := &testHistory{}
+	r := NewRecorder(&RecorderCfg{Writer: h, Deadband: 0.5})
+	defer r.Close()
+	for _, v := range []interface{}{1.0, 1.2, 1.6, 1.6, "a", "a", "b", 2.0} {
+		r.Record(veap.PV{Time: time.Now(), Value: v})
+	}
+	// state change
+	r.Record(veap.PV{Time: time.Now(), Value: 2.0, State: veap.StateBad})
+	checkValues(t, h, 1.0, 1.6, "a", "b", 2.0, 2.0)
+
+	// unsigned integers and JSON numbers
+	h = &testHistory{}
+	r2 := NewRecorder(&RecorderCfg{Writer: h, Deadband: 0.5})
+	defer r2.Close()
+	for _, v := range []interface{}{uint8(3), json.Number("3.2"), uint64(4)} {
+		r2.Record(veap.PV{Time: time.Now(), Value: v})
+	}
+	checkValues(t, h, uint8(3), uint64(4))
+}
+
+func TestRecorderIntervals(t *testing.T) {
+	h := &testHistory{}
+	r := NewRecorder(&RecorderCfg{Writer: h, MinInterval: 100 * time.Millisecond})
+	r.Record(veap.PV{Value: 1.0})
+	r.Record(veap.PV{Value: 2.0})
+	r.Record(veap.PV{Value: 3.0})
+	checkValues(t, h, 1.0)
+	time.Sleep(200 * time.Millisecond)
+	checkValues(t, h, 1.0, 3.0)
+	// delayed change is recorded on close
+	r.Record(veap.PV{Value: 4.0})
+	r.Close()
+	checkValues(t, h, 1.0, 3.0, 4.0)
+	r.Record(veap.PV{Value: 5.0})
+	checkValues(t, h, 1.0, 3.0, 4.0)
+
+	// repetition
+	h = &testHistory{}
+	r = NewRecorder(&RecorderCfg{Writer: h, MaxInterval: 50 * time.Millisecond})
+	r.Record(veap.PV{Time: time.Unix(1, 0), Value: 1.0})
+	time.Sleep(180 * time.Millisecond)
+	r.Close()
+	if vs := h.values(); len(vs) < 3 || vs[len(vs)-1] != 1.0 {
+		t.Error(vs)
+	}
+	if h.entries[1].Time.Before(time.Unix(2, 0)) {
+		t.Error("repeated entry has not the current time")
+	}
+}
+
+func TestRecordedVariable(t *testing.T) {
+	root := NewRoot(&RootCfg{})
+	value := veap.PV{Time: time.Unix(1, 0), Value: 1.0}
+	vari := NewVariable(&VariableCfg{
+		Identifier: "v",
+		Collection: root,
+		ReadPVFunc: func() (veap.PV, veap.Error) {
+			return value, nil
+		},
+		WritePVFunc: func(pv veap.PV) veap.Error {
+			value = pv
+			return nil
+		},
+	})
+	h := &testHistory{}
+	rv := NewRecordedVariable(&RecordedVariableCfg{
+		RecorderCfg: RecorderCfg{Writer: h},
+		Variable:    vari,
+	})
+	defer rv.Close()
+	svc := &Service{Root: root}
+
+	// history service is provided
+	_, links, err := svc.ReadProperties("/v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, l := range links {
+		if l.Target == veap.HistMarker {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("~hist link missing")
+	}
+
+	// written and signaled PVs are recorded
+	if err := svc.WritePV("/v", veap.PV{Time: time.Unix(2, 0), Value: 2.0}); err != nil {
+		t.Fatal(err)
+	}
+	vari.NotifyPV(veap.PV{Time: time.Unix(3, 0), Value: 3.0})
+	hist, err := svc.ReadHistory("/v", time.Unix(0, 0), time.Unix(10, 0), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != 2 || hist[0].Value != 2.0 || hist[1].Value != 3.0 {
+		t.Error(hist)
+	}
+}
+
+func TestRecordService(t *testing.T) {
+	var svc veap.MemoryService
+	if _, err := svc.WriteProperties("/a", veap.AttrValues{}); err != nil {
+		t.Fatal(err)
+	}
+	h := &testHistory{}
+	r := NewRecorder(&RecorderCfg{Writer: h})
+	if err := r.RecordService(&svc, "/a", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	svc.WritePV("/a", veap.PV{Value: 1.0})
+	svc.WritePV("/a", veap.PV{Value: 2.0})
+	r.Close()
+	svc.WritePV("/a", veap.PV{Value: 3.0})
+	checkValues(t, h, 1.0, 2.0)
+}
@@ -0,0 +1,157 @@
+package model
+
+import (
+	"math"
+
+	"github.com/mdzio/go-veap"
+)
+
+// Property names of a value specification.
+const (
+	ValueTypeProperty = "valueType"
+	UnitProperty      = "unit"
+	MinimumProperty   = "minimum"
+	MaximumProperty   = "maximum"
+	StepProperty      = "step"
+	EnumProperty      = "enum"
+	WritableProperty  = "writable"
+)
+
+// Value types of a value specification.
+const (
+	BoolType    = "BOOL"
+	IntegerType = "INTEGER"
+	FloatType   = "FLOAT"
+	StringType  = "STRING"
+	EnumType    = "ENUM"
+)
+
+// tolerance for step checks
+const stepEpsilon = 1e-9
+
+// ValueSpec describes the value of a PV. PVs written by VEAP clients are
+// validated against the specification.
+type ValueSpec struct {
+	// Type is one of the value types (e.g. FloatType). If empty, the type is
+	// not checked.
+	Type string
+
+	// Unit of the value (e.g. °C).
+	Unit string
+
+	// Minimum and Maximum limit numeric values, if set.
+	Minimum *float64
+	Maximum *float64
+
+	// Step restricts numeric values to multiples of Step, starting at Minimum
+	// (or 0, if Minimum is not set). A zero Step is not checked.
+	Step float64
+
+	// EnumLabels are the labels of the enum values 0, 1, 2, ... (only for
+	// EnumType).
+	EnumLabels []string
+
+	// ReadOnly prevents the writing of the PV by VEAP clients.
+	ReadOnly bool
+}
+
+// Attributes returns the value specification as VEAP attributes.
+func (s *ValueSpec) Attributes() veap.AttrValues {
+	attr := veap.AttrValues{WritableProperty: !s.ReadOnly}
+	if s.Type != "" {
+		attr[ValueTypeProperty] = s.Type
+	}
+	if s.Unit != "" {
+		attr[UnitProperty] = s.Unit
+	}
+	if s.Minimum != nil {
+		attr[MinimumProperty] = *s.Minimum
+	}
+	if s.Maximum != nil {
+		attr[MaximumProperty] = *s.Maximum
+	}
+	if s.Step != 0 {
+		attr[StepProperty] = s.Step
+	}
+	if len(s.EnumLabels) > 0 {
+		attr[EnumProperty] = s.EnumLabels
+	}
+	return attr
+}
+
+// ValidatePV checks whether a PV may be written.
+func (s *ValueSpec) ValidatePV(pv veap.PV) veap.Error {
+	if s.ReadOnly {
+		return veap.NewErrorf(veap.StatusMethodNotAllowed, "PV is not writable")
+	}
+	return s.Validate(pv.Value)
+}
+
+// Validate checks a value against the specification. On violation an error
+// with code veap.StatusBadRequest is returned.
+func (s *ValueSpec) Validate(value interface{}) veap.Error {
+	// check type
+	num, isNum := veap.ToFloat64(value)
+	switch s.Type {
+	case "":
+	case BoolType:
+		if _, ok := value.(bool); !ok {
+			return veap.NewErrorf(veap.StatusBadRequest, "Value is not a boolean: %v", value)
+		}
+	case IntegerType, EnumType:
+		if !isNum || num != math.Trunc(num) {
+			return veap.NewErrorf(veap.StatusBadRequest, "Value is not an integer: %v", value)
+		}
+	case FloatType:
+		if !isNum {
+			return veap.NewErrorf(veap.StatusBadRequest, "Value is not a number: %v", value)
+		}
+	case StringType:
+		if _, ok := value.(string); !ok {
+			return veap.NewErrorf(veap.StatusBadRequest, "Value is not a string: %v", value)
+		}
+	default:
+		return veap.NewErrorf(veap.StatusInternalServerError, "Invalid value type in specification: %s", s.Type)
+	}
+	if !isNum {
+		return nil
+	}
+
+	// check range
+	if s.Minimum != nil && num < *s.Minimum {
+		return veap.NewErrorf(veap.StatusBadRequest, "Value %v is less than minimum %v", value, *s.Minimum)
+	}
+	if s.Maximum != nil && num > *s.Maximum {
+		return veap.NewErrorf(veap.StatusBadRequest, "Value %v is greater than maximum %v", value, *s.Maximum)
+	}
+
+	// check step
+	if s.Step != 0 {
+		var base float64
+		if s.Minimum != nil {
+			base = *s.Minimum
+		}
+		q := (num - base) / s.Step
+		if math.Abs(q-math.Round(q)) > stepEpsilon {
+			return veap.NewErrorf(veap.StatusBadRequest, "Value %v does not match step %v", value, s.Step)
+		}
+	}
+
+	// check enum
+	if s.Type == EnumType && len(s.EnumLabels) > 0 {
+		if num < 0 || num >= float64(len(s.EnumLabels)) {
+			return veap.NewErrorf(veap.StatusBadRequest, "Invalid enum value: %v", value)
+		}
+	}
+	return nil
+}
+
+// BasicValueSpec implements ValueSpecReader.
+type BasicValueSpec struct {
+	ValueSpec *ValueSpec
+}
+
+// ReadValueSpec implements ValueSpecReader.
+func (v *BasicValueSpec) ReadValueSpec() *ValueSpec {
+	return v.ValueSpec
+}
@@ -0,0 +1,163 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/mdzio/go-veap"
+)
+
+func TestValueSpecValidate(t *testing.T) {
+	min, max := -10.0, 10.0
+	cases := []struct {
+		spec  ValueSpec
+		value interface{}
+		ok    bool
+	}{
+		{ValueSpec{}, "abc", true},
+		{ValueSpec{Type: BoolType}, true, true},
+		{ValueSpec{Type: BoolType}, 1.0, false},
+		{ValueSpec{Type: StringType}, "abc", true},
+		{ValueSpec{Type: StringType}, false, false},
+		{ValueSpec{Type: FloatType}, 1.5, true},
+		{ValueSpec{Type: FloatType}, "1.5", false},
+		{ValueSpec{Type: IntegerType}, 2.0, true},
+		{ValueSpec{Type: IntegerType}, 7, true},
+		{ValueSpec{Type: IntegerType}, 2.5, false},
+		{ValueSpec{Type: FloatType, Minimum: &min, Maximum: &max}, -10.0, true},
+		{ValueSpec{Type: FloatType, Minimum: &min, Maximum: &max}, 10.0, true},
+		{ValueSpec{Type: FloatType, Minimum: &min, Maximum: &max}, -10.1, false},
+		{ValueSpec{Type: FloatType, Minimum: &min, Maximum: &max}, 10.1, false},
+		{ValueSpec{Type: FloatType, Minimum: &min, Step: 0.5}, 0.5, true},
+		{ValueSpec{Type: FloatType, Minimum: &min, Step: 0.5}, 0.7, false},
+		{ValueSpec{Type: FloatType, Step: 0.1}, 0.3, true},
+		{ValueSpec{Type: EnumType, EnumLabels: []string{"a", "b"}}, 1.0, true},
+		{ValueSpec{Type: EnumType, EnumLabels: []string{"a", "b"}}, 2.0, false},
+		{ValueSpec{Type: EnumType, EnumLabels: []string{"a", "b"}}, -1.0, false},
+	}
+	for idx, c := range cases {
+		err := c.spec.Validate(c.value)
+		if (err == nil) != c.ok {
+			t.Errorf("Wrong result in test case %d: %v", idx, err)
+		}
+		if err != nil && err.Code() != veap.StatusBadRequest {
+			t.Errorf("Wrong error code in test case %d: %d", idx, err.Code())
+		}
+	}
+}
+
+func TestValueSpecService(t *testing.T) {
+	r := NewRoot(&RootCfg{})
+	s := &Service{Root: r}
+	min, max := 0.0, 100.0
+	var written []veap.PV
+	NewVariable(&VariableCfg{
+		Identifier: "var",
+		Collection: r,
+		ValueSpec: &ValueSpec{
+			Type:    FloatType,
+			Unit:    "%",
+			Minimum: &min,
+			Maximum: &max,
+		},
+		ReadPVFunc: func() (veap.PV, veap.Error) { return veap.PV{}, nil },
+		WritePVFunc: func(pv veap.PV) veap.Error {
+			written = append(written, pv)
+			return nil
+		},
+	})
+	NewVariable(&VariableCfg{
+		Identifier: "ro",
+		Collection: r,
+		ValueSpec:  &ValueSpec{Type: BoolType, ReadOnly: true},
+		WritePVFunc: func(pv veap.PV) veap.Error {
+			t.Error("unexpected write")
+			return nil
+		},
+	})
+
+	// properties
+	attr, _, err := s.ReadProperties("/var")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(attr, veap.AttrValues{
+		"identifier": "var",
+		"valueType":  "FLOAT",
+		"unit":       "%",
+		"minimum":    0.0,
+		"maximum":    100.0,
+		"writable":   true,
+	}) {
+		t.Error(attr)
+	}
+
+	// valid write
+	if err := s.WritePV("/var", veap.PV{Value: 50.0}); err != nil {
+		t.Error(err)
+	}
+	// invalid write
+	if err := s.WritePV("/var", veap.PV{Value: 150.0}); err == nil || err.Code() != veap.StatusBadRequest {
+		t.Error(err)
+	}
+	if len(written) != 1 {
+		t.Error(written)
+	}
+	// not writable
+	if err := s.WritePV("/ro", veap.PV{Value: true}); err == nil || err.Code() != veap.StatusMethodNotAllowed {
+		t.Error(err)
+	}
+}
+
+func TestAtomicWrite(t *testing.T) {
+	r := NewRoot(&RootCfg{})
+	m := &veap.BasicMetaService{Service: &Service{Root: r}}
+	max := 10.0
+	written := make(map[string]interface{})
+	for _, id := range []string{"a", "b"} {
+		id := id
+		NewVariable(&VariableCfg{
+			Identifier: id,
+			Collection: r,
+			ValueSpec:  &ValueSpec{Type: FloatType, Maximum: &max},
+			WritePVFunc: func(pv veap.PV) veap.Error {
+				written[id] = pv.Value
+				return nil
+			},
+		})
+	}
+
+	// one invalid write
+	_, err := m.ExtendedExgData(context.Background(), veap.ExgDataParams{
+		Atomic: true,
+		WritePVs: []veap.WritePVParam{
+			{Path: "/a", PV: veap.PV{Value: 1.0}},
+			{Path: "/b", PV: veap.PV{Value: 20.0}},
+		},
+	})
+	if err == nil || err.Code() != veap.StatusBadRequest || len(written) != 0 {
+		t.Error(err, written)
+	}
+
+	// valid writes
+	_, err = m.ExtendedExgData(context.Background(), veap.ExgDataParams{
+		Atomic: true,
+		WritePVs: []veap.WritePVParam{
+			{Path: "/a", PV: veap.PV{Value: 1.0}},
+			{Path: "/b", PV: veap.PV{Value: 2.0}},
+		},
+	})
+	if err != nil || written["a"] != 1.0 || written["b"] != 2.0 {
+		t.Error(err, written)
+	}
+
+	// unknown object
+	_, err = m.ExtendedExgData(context.Background(), veap.ExgDataParams{
+		Atomic:   true,
+		WritePVs: []veap.WritePVParam{{Path: "/x", PV: veap.PV{Value: 1.0}}},
+	})
+	if err == nil || err.Code() != veap.StatusNotFound {
+		t.Error(err)
+	}
+}
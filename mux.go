@@ -0,0 +1,709 @@
+package veap
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mux composes several services into one VEAP object tree. Each service is
+// mounted at a path prefix (e.g. /devices). The paths are rewritten for the
+// mounted services, e.g. /devices/a is passed as /a to the service mounted at
+// /devices. The ancestors of the mount points (e.g. the root) are provided by
+// the Mux itself and link to the mount points.
+//
+// Mux implements Service, MetaService and their optional extensions. Queries
+// and ExgData requests are split and routed to the mounted services. If a
+// mounted service does not implement MetaService, a BasicMetaService is used.
+type Mux struct {
+	// Title of the root object, optional.
+	Title string
+
+	mutex  sync.RWMutex
+	mounts []*mount
+}
+
+type mount struct {
+	prefix   string
+	segments []string
+	title    string
+	service  ContextService
+	meta     ContextMetaService
+}
+
+// Make sure that Mux implements all service interfaces.
+var _ Service = (*Mux)(nil)
+var _ ContextService = (*Mux)(nil)
+var _ MetaService = (*Mux)(nil)
+var _ ContextMetaService = (*Mux)(nil)
+var _ ExtendedExgDataService = (*Mux)(nil)
+var _ ExtendedQueryService = (*Mux)(nil)
+var _ StreamingQueryService = (*Mux)(nil)
+
+// Mount adds a service at the path prefix. The prefix must start with a slash
+// and must not end with a slash. Mount points must not be nested. The title is
+// used for the link to the mount point.
+func (m *Mux) Mount(prefix string, service Service, title string) Error {
+	if !strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") || path.Clean(prefix) != prefix {
+		return NewErrorf(StatusBadRequest, "Invalid mount point: %s", prefix)
+	}
+	mt := &mount{
+		prefix:   prefix,
+		segments: strings.Split(prefix[1:], "/"),
+		title:    title,
+		service:  AsContextService(service),
+	}
+	if ms, ok := service.(MetaService); ok {
+		mt.meta = AsContextMetaService(ms)
+	} else {
+		mt.meta = &BasicMetaService{Service: service}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, other := range m.mounts {
+		if isWithin(prefix, other.prefix) || isWithin(other.prefix, prefix) {
+			return NewErrorf(StatusBadRequest, "Mount point %s conflicts with %s", prefix, other.prefix)
+		}
+	}
+	m.mounts = append(m.mounts, mt)
+	sort.Slice(m.mounts, func(i, j int) bool { return m.mounts[i].prefix < m.mounts[j].prefix })
+	return nil
+}
+
+// Unmount removes the service at the path prefix.
+func (m *Mux) Unmount(prefix string) Error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, mt := range m.mounts {
+		if mt.prefix == prefix {
+			m.mounts = append(m.mounts[:i], m.mounts[i+1:]...)
+			return nil
+		}
+	}
+	return NewErrorf(StatusNotFound, "Mount point not found: %s", prefix)
+}
+
+// isWithin returns true, if the path equals the prefix or is below it.
+func isWithin(objPath, prefix string) bool {
+	return objPath == prefix || strings.HasPrefix(objPath, prefix+"/")
+}
+
+// route finds the mount for the path and returns the path for the mounted
+// service.
+func (m *Mux) route(objPath string) (*mount, string) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, mt := range m.mounts {
+		if isWithin(objPath, mt.prefix) {
+			innerPath := strings.TrimPrefix(objPath, mt.prefix)
+			if innerPath == "" {
+				innerPath = "/"
+			}
+			return mt, innerPath
+		}
+	}
+	return nil, ""
+}
+
+// children returns the child segments of a virtual object. If the path is
+// not an ancestor of a mount point, false is returned.
+func (m *Mux) children(objPath string) ([]Link, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	prefix := strings.TrimSuffix(objPath, "/") + "/"
+	var links []Link
+	found := false
+	for _, mt := range m.mounts {
+		if !strings.HasPrefix(mt.prefix, prefix) {
+			continue
+		}
+		found = true
+		child := strings.SplitN(mt.prefix[len(prefix):], "/", 2)
+		link := Link{Role: "item", Target: child[0]}
+		if len(child) == 1 {
+			link.Title = mt.title
+		}
+		// avoid duplicates
+		if len(links) > 0 && links[len(links)-1].Target == link.Target {
+			continue
+		}
+		links = append(links, link)
+	}
+	return links, found
+}
+
+func (m *Mux) mountList() []*mount {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return append([]*mount(nil), m.mounts...)
+}
+
+func notMountedError(objPath string) Error {
+	return NewErrorf(StatusNotFound, "VEAP object not found: %s", objPath)
+}
+
+// ReadPV implements Service.
+func (m *Mux) ReadPV(path string) (PV, Error) {
+	return m.ReadPVContext(context.Background(), path)
+}
+
+// ReadPVContext implements ContextService.
+func (m *Mux) ReadPVContext(ctx context.Context, path string) (PV, Error) {
+	mt, innerPath := m.route(path)
+	if mt == nil {
+		return PV{}, notMountedError(path)
+	}
+	return mt.service.ReadPVContext(ctx, innerPath)
+}
+
+// WritePV implements Service.
+func (m *Mux) WritePV(path string, pv PV) Error {
+	return m.WritePVContext(context.Background(), path, pv)
+}
+
+// WritePVContext implements ContextService.
+func (m *Mux) WritePVContext(ctx context.Context, path string, pv PV) Error {
+	mt, innerPath := m.route(path)
+	if mt == nil {
+		return notMountedError(path)
+	}
+	return mt.service.WritePVContext(ctx, innerPath, pv)
+}
+
+// ReadHistory implements Service.
+func (m *Mux) ReadHistory(path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	return m.ReadHistoryContext(context.Background(), path, begin, end, limit)
+}
+
+// ReadHistoryContext implements ContextService.
+func (m *Mux) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]PV, Error) {
+	mt, innerPath := m.route(path)
+	if mt == nil {
+		return nil, notMountedError(path)
+	}
+	return mt.service.ReadHistoryContext(ctx, innerPath, begin, end, limit)
+}
+
+// WriteHistory implements Service.
+func (m *Mux) WriteHistory(path string, timeSeries []PV) Error {
+	return m.WriteHistoryContext(context.Background(), path, timeSeries)
+}
+
+// WriteHistoryContext implements ContextService.
+func (m *Mux) WriteHistoryContext(ctx context.Context, path string, timeSeries []PV) Error {
+	mt, innerPath := m.route(path)
+	if mt == nil {
+		return notMountedError(path)
+	}
+	return mt.service.WriteHistoryContext(ctx, innerPath, timeSeries)
+}
+
+// ReadProperties implements Service.
+func (m *Mux) ReadProperties(path string) (AttrValues, []Link, Error) {
+	return m.ReadPropertiesContext(context.Background(), path)
+}
+
+// ReadPropertiesContext implements ContextService. Absolute links of the
+// mounted services are rewritten.
+func (m *Mux) ReadPropertiesContext(ctx context.Context, objPath string) (AttrValues, []Link, Error) {
+	mt, innerPath := m.route(objPath)
+	if mt != nil {
+		attr, innerLinks, err := mt.service.ReadPropertiesContext(ctx, innerPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return attr, mt.outerLinks(innerPath, innerLinks), nil
+	}
+
+	// virtual object
+	links, ok := m.children(objPath)
+	if !ok {
+		return nil, nil, notMountedError(objPath)
+	}
+	attr := AttrValues{}
+	if objPath == "/" {
+		if m.Title != "" {
+			attr["title"] = m.Title
+		}
+		links = append(links,
+			Link{Role: ServiceMarker, Target: ExgDataMarker, Title: "ExgData Service"},
+			Link{Role: ServiceMarker, Target: QueryMarker, Title: "Query Service"},
+		)
+	} else {
+		attr["identifier"] = path.Base(objPath)
+		links = append(links, Link{Role: "collection", Target: ".."})
+	}
+	return attr, links, nil
+}
+
+// outerLinks rewrites the links of a mounted service.
+func (mt *mount) outerLinks(innerPath string, innerLinks []Link) []Link {
+	links := make([]Link, 0, len(innerLinks)+1)
+	for _, l := range innerLinks {
+		if innerPath == "/" && l.Role == ServiceMarker {
+			// services of the mounted service are not reachable
+			continue
+		}
+		if path.IsAbs(l.Target) {
+			l.Target = mt.outerPath(l.Target)
+		}
+		links = append(links, l)
+	}
+	if innerPath == "/" {
+		links = append(links, Link{Role: "collection", Target: ".."})
+	}
+	return links
+}
+
+func (mt *mount) outerPath(innerPath string) string {
+	if innerPath == "/" {
+		return mt.prefix
+	}
+	return mt.prefix + innerPath
+}
+
+// WriteProperties implements Service.
+func (m *Mux) WriteProperties(path string, attributes AttrValues) (bool, Error) {
+	return m.WritePropertiesContext(context.Background(), path, attributes)
+}
+
+// WritePropertiesContext implements ContextService.
+func (m *Mux) WritePropertiesContext(ctx context.Context, path string, attributes AttrValues) (bool, Error) {
+	mt, innerPath := m.route(path)
+	if mt == nil {
+		return false, NewErrorf(StatusMethodNotAllowed, "Writing properties not supported: %s", path)
+	}
+	return mt.service.WritePropertiesContext(ctx, innerPath, attributes)
+}
+
+// Delete implements Service.
+func (m *Mux) Delete(path string) Error {
+	return m.DeleteContext(context.Background(), path)
+}
+
+// DeleteContext implements ContextService.
+func (m *Mux) DeleteContext(ctx context.Context, path string) Error {
+	mt, innerPath := m.route(path)
+	if mt == nil {
+		return NewErrorf(StatusMethodNotAllowed, "Deleting not supported: %s", path)
+	}
+	return mt.service.DeleteContext(ctx, innerPath)
+}
+
+// ExgData implements MetaService.
+func (m *Mux) ExgData(writePVs []WritePVParam, readPaths []string) ([]Error, []ReadPVResult, Error) {
+	return m.ExgDataContext(context.Background(), writePVs, readPaths)
+}
+
+// ExgDataContext implements ContextMetaService.
+func (m *Mux) ExgDataContext(ctx context.Context, writePVs []WritePVParam, readPaths []string) ([]Error, []ReadPVResult, Error) {
+	results, err := m.ExtendedExgData(ctx, ExgDataParams{WritePVs: writePVs, ReadPaths: readPaths})
+	return results.WriteErrors, results.ReadResults, err
+}
+
+// ExtendedExgData implements ExtendedExgDataService. The request is split by
+// the mount points and each part is passed to the corresponding mounted
+// service. The writes of all parts are executed before the reads. Atomic
+// writes must not span several mount points.
+func (m *Mux) ExtendedExgData(ctx context.Context, params ExgDataParams) (ExgDataResults, Error) {
+	type part struct {
+		params ExgDataParams
+		// indices of the entries in the original request
+		writePVs, writeProps, readPaths, readProps, readHist []int
+	}
+	parts := make(map[*mount]*part)
+	getPart := func(mt *mount) *part {
+		p, ok := parts[mt]
+		if !ok {
+			p = &part{params: ExgDataParams{Atomic: params.Atomic}}
+			parts[mt] = p
+		}
+		return p
+	}
+
+	// prepare results, paths outside of the mount points are not found
+	results := ExgDataResults{
+		WriteErrors: make([]Error, len(params.WritePVs)),
+		ReadResults: make([]ReadPVResult, len(params.ReadPaths)),
+	}
+	if len(params.WriteProperties) > 0 {
+		results.WritePropertiesResults = make([]WritePropertiesResult, len(params.WriteProperties))
+	}
+	if len(params.ReadProperties) > 0 {
+		results.ReadPropertiesResults = make([]ReadPropertiesResult, len(params.ReadProperties))
+	}
+	if len(params.ReadHistory) > 0 {
+		results.ReadHistoryResults = make([]ReadHistoryResult, len(params.ReadHistory))
+	}
+
+	// split request
+	for i, w := range params.WritePVs {
+		mt, innerPath := m.route(w.Path)
+		if mt == nil {
+			results.WriteErrors[i] = notMountedError(w.Path)
+			continue
+		}
+		p := getPart(mt)
+		p.params.WritePVs = append(p.params.WritePVs, WritePVParam{Path: innerPath, PV: w.PV})
+		p.writePVs = append(p.writePVs, i)
+	}
+	if params.Atomic {
+		if len(parts) > 1 {
+			return ExgDataResults{}, NewErrorf(StatusBadRequest, "Atomic writes must not span several mount points")
+		}
+		for i, err := range results.WriteErrors {
+			if err != nil {
+				return ExgDataResults{}, NewErrorf(err.Code(), "Atomic write rejected, %s: %v", params.WritePVs[i].Path, err)
+			}
+		}
+	}
+	for i, w := range params.WriteProperties {
+		mt, innerPath := m.route(w.Path)
+		if mt == nil {
+			results.WritePropertiesResults[i].Error = NewErrorf(StatusMethodNotAllowed, "Writing properties not supported: %s", w.Path)
+			continue
+		}
+		p := getPart(mt)
+		p.params.WriteProperties = append(p.params.WriteProperties, WritePropertiesParam{Path: innerPath, Attributes: w.Attributes})
+		p.writeProps = append(p.writeProps, i)
+	}
+	for i, readPath := range params.ReadPaths {
+		mt, innerPath := m.route(readPath)
+		if mt == nil {
+			results.ReadResults[i].Error = notMountedError(readPath)
+			continue
+		}
+		p := getPart(mt)
+		p.params.ReadPaths = append(p.params.ReadPaths, innerPath)
+		p.readPaths = append(p.readPaths, i)
+	}
+	for i, readPath := range params.ReadProperties {
+		mt, innerPath := m.route(readPath)
+		if mt == nil {
+			// virtual objects are handled by the mux
+			attr, links, err := m.ReadPropertiesContext(ctx, readPath)
+			results.ReadPropertiesResults[i] = ReadPropertiesResult{attr, links, err}
+			continue
+		}
+		p := getPart(mt)
+		p.params.ReadProperties = append(p.params.ReadProperties, innerPath)
+		p.readProps = append(p.readProps, i)
+	}
+	for i, rh := range params.ReadHistory {
+		mt, innerPath := m.route(rh.Path)
+		if mt == nil {
+			results.ReadHistoryResults[i].Error = notMountedError(rh.Path)
+			continue
+		}
+		p := getPart(mt)
+		rh.Path = innerPath
+		p.params.ReadHistory = append(p.params.ReadHistory, rh)
+		p.readHist = append(p.readHist, i)
+	}
+
+	// execute the writes of all parts before the reads, so that the order of
+	// the operations is kept across the mount points
+	mounts := m.mountList()
+	for _, writing := range []bool{true, false} {
+		for _, mt := range mounts {
+			p, ok := parts[mt]
+			if !ok {
+				continue
+			}
+			var sub ExgDataParams
+			if writing {
+				sub = ExgDataParams{Atomic: params.Atomic, WritePVs: p.params.WritePVs, WriteProperties: p.params.WriteProperties}
+			} else {
+				sub = ExgDataParams{ReadPaths: p.params.ReadPaths, ReadProperties: p.params.ReadProperties, ReadHistory: p.params.ReadHistory}
+			}
+			if len(sub.WritePVs) == 0 && len(sub.WriteProperties) == 0 && len(sub.ReadPaths) == 0 &&
+				len(sub.ReadProperties) == 0 && len(sub.ReadHistory) == 0 {
+				continue
+			}
+			r, err := AsExtendedExgDataService(mt.meta, mt.service).ExtendedExgData(ctx, sub)
+			if err != nil {
+				if params.Atomic {
+					return ExgDataResults{}, err
+				}
+				// report service error for all entries of this part
+				r = ExgDataResults{
+					WriteErrors:            make([]Error, len(sub.WritePVs)),
+					WritePropertiesResults: make([]WritePropertiesResult, len(sub.WriteProperties)),
+					ReadResults:            make([]ReadPVResult, len(sub.ReadPaths)),
+					ReadPropertiesResults:  make([]ReadPropertiesResult, len(sub.ReadProperties)),
+					ReadHistoryResults:     make([]ReadHistoryResult, len(sub.ReadHistory)),
+				}
+				for i := range r.WriteErrors {
+					r.WriteErrors[i] = err
+				}
+				for i := range r.WritePropertiesResults {
+					r.WritePropertiesResults[i].Error = err
+				}
+				for i := range r.ReadResults {
+					r.ReadResults[i].Error = err
+				}
+				for i := range r.ReadPropertiesResults {
+					r.ReadPropertiesResults[i].Error = err
+				}
+				for i := range r.ReadHistoryResults {
+					r.ReadHistoryResults[i].Error = err
+				}
+			}
+			if len(r.WriteErrors) != len(sub.WritePVs) || len(r.WritePropertiesResults) != len(sub.WriteProperties) ||
+				len(r.ReadResults) != len(sub.ReadPaths) || len(r.ReadPropertiesResults) != len(sub.ReadProperties) ||
+				len(r.ReadHistoryResults) != len(sub.ReadHistory) {
+				return ExgDataResults{}, NewErrorf(StatusInternalServerError, "ExgData results of %s do not match request", mt.prefix)
+			}
+			if writing {
+				for i, idx := range p.writePVs {
+					results.WriteErrors[idx] = r.WriteErrors[i]
+				}
+				for i, idx := range p.writeProps {
+					results.WritePropertiesResults[idx] = r.WritePropertiesResults[i]
+				}
+				continue
+			}
+			for i, idx := range p.readPaths {
+				results.ReadResults[idx] = r.ReadResults[i]
+			}
+			for i, idx := range p.readProps {
+				rp := r.ReadPropertiesResults[i]
+				if rp.Error == nil {
+					rp.Links = mt.outerLinks(sub.ReadProperties[i], rp.Links)
+				}
+				results.ReadPropertiesResults[idx] = rp
+			}
+			for i, idx := range p.readHist {
+				results.ReadHistoryResults[idx] = r.ReadHistoryResults[i]
+			}
+		}
+	}
+	return results, nil
+}
+
+// signals that the query limit is reached, must differ from the signal of a
+// mounted BasicMetaService (errors are compared by value)
+var errMuxLimitReached = NewErrorf(StatusOK, "Mux query limit reached")
+
+// Query implements MetaService.
+func (m *Mux) Query(pathPatterns []string) ([]QueryResult, Error) {
+	return m.QueryContext(context.Background(), pathPatterns)
+}
+
+// QueryContext implements ContextMetaService.
+func (m *Mux) QueryContext(ctx context.Context, pathPatterns []string) ([]QueryResult, Error) {
+	return m.ExtendedQuery(ctx, QueryParams{PathPatterns: pathPatterns})
+}
+
+// ExtendedQuery implements ExtendedQueryService.
+func (m *Mux) ExtendedQuery(ctx context.Context, params QueryParams) ([]QueryResult, Error) {
+	results := make([]QueryResult, 0)
+	if err := m.QueryFunc(ctx, params, func(item QueryResult) Error {
+		results = append(results, item)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// QueryFunc implements StreamingQueryService. The virtual objects are
+// searched by the Mux. For each mount point the path patterns are rewritten
+// and passed to the mounted service.
+func (m *Mux) QueryFunc(ctx context.Context, params QueryParams, handle func(item QueryResult) Error) Error {
+	var matches, results int
+	emit := func(item QueryResult) Error {
+		if !MatchFilters(params.Filters, item.Attributes, item.Links) {
+			return nil
+		}
+		// paginate
+		matches++
+		if matches <= params.Offset {
+			return nil
+		}
+		if err := handle(item); err != nil {
+			return err
+		}
+		results++
+		if params.Limit > 0 && results >= params.Limit {
+			return errMuxLimitReached
+		}
+		return nil
+	}
+	err := m.queryFunc(ctx, params, emit)
+	if err == errMuxLimitReached {
+		return nil
+	}
+	return err
+}
+
+func (m *Mux) queryFunc(ctx context.Context, params QueryParams, emit func(item QueryResult) Error) Error {
+	nodes := muxNodes(m.mountList())
+	for _, pathPattern := range params.PathPatterns {
+		var patternSegs []string
+		if p := strings.Trim(pathPattern, "/"); p != "" {
+			patternSegs = strings.Split(p, "/")
+		}
+		for _, n := range nodes {
+			var err Error
+			if n.mount == nil {
+				err = m.queryVirtual(ctx, n.path, patternSegs, params.MaxDepth, emit)
+			} else {
+				err = m.queryMount(ctx, n.mount, patternSegs, params, emit)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Mux) queryVirtual(ctx context.Context, virtPath string, patternSegs []string, maxDepth int, emit func(item QueryResult) Error) Error {
+	if maxDepth > 0 && pathDepth(virtPath) > maxDepth {
+		return nil
+	}
+	if !matchSegments(patternSegs, splitPath(virtPath)) {
+		return nil
+	}
+	attr, links, err := m.ReadPropertiesContext(ctx, virtPath)
+	if err != nil {
+		return err
+	}
+	return emit(QueryResult{Path: virtPath, Attributes: attr, Links: links})
+}
+
+func (m *Mux) queryMount(ctx context.Context, mt *mount, patternSegs []string, params QueryParams, emit func(item QueryResult) Error) Error {
+	innerPatterns := routePattern(patternSegs, mt.segments)
+	if len(innerPatterns) == 0 {
+		return nil
+	}
+	innerParams := QueryParams{PathPatterns: innerPatterns, Filters: params.Filters}
+	if params.MaxDepth > 0 {
+		innerParams.MaxDepth = params.MaxDepth - len(mt.segments)
+		if innerParams.MaxDepth < 0 {
+			return nil
+		}
+		if innerParams.MaxDepth == 0 {
+			// only the mount point itself
+			return m.queryMountPoint(ctx, mt, innerPatterns, emit)
+		}
+	}
+	// several inner patterns may match the same object
+	var seen map[string]bool
+	if len(innerPatterns) > 1 {
+		seen = make(map[string]bool)
+	}
+	return AsStreamingQueryService(mt.meta).QueryFunc(ctx, innerParams, func(item QueryResult) Error {
+		if seen != nil {
+			if seen[item.Path] {
+				return nil
+			}
+			seen[item.Path] = true
+		}
+		innerPath := item.Path
+		item.Path = mt.outerPath(innerPath)
+		item.Links = mt.outerLinks(innerPath, item.Links)
+		return emit(item)
+	})
+}
+
+func (m *Mux) queryMountPoint(ctx context.Context, mt *mount, innerPatterns []string, emit func(item QueryResult) Error) Error {
+	for _, p := range innerPatterns {
+		if matchSegments(splitPath(p), nil) {
+			attr, links, err := m.ReadPropertiesContext(ctx, mt.prefix)
+			if err != nil {
+				return err
+			}
+			return emit(QueryResult{Path: mt.prefix, Attributes: attr, Links: links})
+		}
+	}
+	return nil
+}
+
+// muxNode is a virtual object or a mount point.
+type muxNode struct {
+	path  string
+	mount *mount
+}
+
+// muxNodes returns the mount points and their ancestors ordered by path.
+func muxNodes(mounts []*mount) []muxNode {
+	set := map[string]*mount{"/": nil}
+	for _, mt := range mounts {
+		for i := 1; i < len(mt.segments); i++ {
+			set["/"+strings.Join(mt.segments[:i], "/")] = nil
+		}
+		set[mt.prefix] = mt
+	}
+	nodes := make([]muxNode, 0, len(set))
+	for p, mt := range set {
+		nodes = append(nodes, muxNode{p, mt})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].path < nodes[j].path })
+	return nodes
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// matchSegments checks whether a path matches a path pattern. The pattern
+// segment ** matches zero or more path segments.
+func matchSegments(patternSegs, pathSegs []string) bool {
+	if len(patternSegs) == 0 {
+		return len(pathSegs) == 0
+	}
+	if patternSegs[0] == RecursiveWildcard {
+		if matchSegments(patternSegs[1:], pathSegs) {
+			return true
+		}
+		return len(pathSegs) > 0 && matchSegments(patternSegs, pathSegs[1:])
+	}
+	if len(pathSegs) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(patternSegs[0], pathSegs[0]); !ok {
+		return false
+	}
+	return matchSegments(patternSegs[1:], pathSegs[1:])
+}
+
+// routePattern returns the path patterns for a service mounted at the
+// specified prefix segments. If the path pattern can not match objects of the
+// mounted service, nil is returned.
+func routePattern(patternSegs, prefixSegs []string) []string {
+	if len(prefixSegs) == 0 {
+		return []string{"/" + strings.Join(patternSegs, "/")}
+	}
+	if len(patternSegs) == 0 {
+		return nil
+	}
+	var results []string
+	if patternSegs[0] == RecursiveWildcard {
+		// zero levels
+		results = append(results, routePattern(patternSegs[1:], prefixSegs)...)
+		// one or more levels
+		results = append(results, routePattern(patternSegs, prefixSegs[1:])...)
+	} else if ok, _ := path.Match(patternSegs[0], prefixSegs[0]); ok {
+		results = routePattern(patternSegs[1:], prefixSegs[1:])
+	}
+	// remove duplicates
+	var unique []string
+	seen := make(map[string]bool)
+	for _, r := range results {
+		if !seen[r] {
+			seen[r] = true
+			unique = append(unique, r)
+		}
+	}
+	return unique
+}
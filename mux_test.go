@@ -0,0 +1,177 @@
+package veap
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// newTreeService creates a service for a tree. The PV of an object is its
+// path.
+func newTreeService(children map[string][]string) *FuncService {
+	return &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			if _, ok := children[path]; !ok {
+				return PV{}, NewErrorf(StatusNotFound, "Not found: %s", path)
+			}
+			return PV{Value: path}, nil
+		},
+		ReadPropertiesFunc: func(path string) (AttrValues, []Link, Error) {
+			cs, ok := children[path]
+			if !ok {
+				return nil, nil, NewErrorf(StatusNotFound, "Not found: %s", path)
+			}
+			var links []Link
+			for _, c := range cs {
+				links = append(links, Link{Role: "item", Target: c})
+			}
+			if path != "/" {
+				links = append(links, Link{Role: "collection", Target: ".."})
+			}
+			return AttrValues{"path": path}, links, nil
+		},
+	}
+}
+
+func TestMux(t *testing.T) {
+	mux := &Mux{Title: "Root"}
+	err := mux.Mount("/dev", newTreeService(map[string][]string{
+		"/": {"a"}, "/a": {"x"}, "/a/x": nil,
+	}), "Devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mux.Mount("/sys/db", &BasicMetaService{Service: newTreeService(map[string][]string{
+		"/": {"t"}, "/t": nil,
+	})}, "Database")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// conflicts
+	for _, p := range []string{"/dev", "/dev/a", "/sys", "sys", "/x/"} {
+		if err := mux.Mount(p, &FuncService{}, ""); err == nil {
+			t.Errorf("Mount of %s must fail", p)
+		}
+	}
+
+	// properties of virtual objects
+	attr, links, err := mux.ReadProperties("/")
+	if err != nil || attr["title"] != "Root" || len(links) != 4 ||
+		links[0] != (Link{Role: "item", Target: "dev", Title: "Devices"}) ||
+		links[1] != (Link{Role: "item", Target: "sys"}) {
+		t.Error(attr, links, err)
+	}
+	_, links, err = mux.ReadProperties("/sys")
+	if err != nil || !reflect.DeepEqual(links, []Link{
+		{Role: "item", Target: "db", Title: "Database"},
+		{Role: "collection", Target: ".."},
+	}) {
+		t.Error(links, err)
+	}
+	if _, _, err := mux.ReadProperties("/x"); err == nil || err.Code() != StatusNotFound {
+		t.Error(err)
+	}
+
+	// properties of a mount point, service links are removed
+	_, links, err = mux.ReadProperties("/sys/db")
+	if err != nil || !reflect.DeepEqual(links, []Link{
+		{Role: "item", Target: "t"},
+		{Role: "collection", Target: ".."},
+	}) {
+		t.Error(links, err)
+	}
+
+	// paths are rewritten
+	pv, err := mux.ReadPV("/dev/a/x")
+	if err != nil || pv.Value != "/a/x" {
+		t.Error(pv, err)
+	}
+	if _, err := mux.ReadPV("/sys"); err == nil || err.Code() != StatusNotFound {
+		t.Error(err)
+	}
+
+	// queries
+	cases := []struct {
+		params QueryParams
+		paths  []string
+	}{
+		{QueryParams{PathPatterns: []string{"/**"}}, []string{
+			"/", "/dev", "/dev/a", "/dev/a/x", "/sys", "/sys/db", "/sys/db/t"}},
+		{QueryParams{PathPatterns: []string{"/*/a"}}, []string{"/dev/a"}},
+		{QueryParams{PathPatterns: []string{"/**/t"}}, []string{"/sys/db/t"}},
+		{QueryParams{PathPatterns: []string{"/sys/*"}}, []string{"/sys/db"}},
+		{QueryParams{PathPatterns: []string{"/**"}, MaxDepth: 2}, []string{
+			"/", "/dev", "/dev/a", "/sys", "/sys/db"}},
+		{QueryParams{PathPatterns: []string{"/**"}, Filters: []Filter{{Name: "path", Op: FilterEqual, Value: "/"}}}, []string{
+			"/dev", "/sys/db"}},
+		{QueryParams{PathPatterns: []string{"/**"}, Offset: 1, Limit: 2}, []string{"/dev", "/dev/a"}},
+	}
+	for _, c := range cases {
+		res, err := mux.ExtendedQuery(context.Background(), c.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, r := range res {
+			paths = append(paths, r.Path)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, c.paths) {
+			t.Errorf("Wrong result for %v: %v", c.params, paths)
+		}
+	}
+
+	// exgdata
+	_, results, err := mux.ExgData(nil, []string{"/sys/db/t", "/nope", "/dev/a"})
+	if err != nil || len(results) != 3 {
+		t.Fatal(results, err)
+	}
+	if results[0].PV.Value != "/t" || results[1].Error == nil || results[1].Error.Code() != StatusNotFound ||
+		results[2].PV.Value != "/a" {
+		t.Error(results)
+	}
+
+	// atomic writes across mount points
+	_, err = mux.ExtendedExgData(context.Background(), ExgDataParams{
+		Atomic:   true,
+		WritePVs: []WritePVParam{{Path: "/dev/a"}, {Path: "/sys/db/t"}},
+	})
+	if err == nil || err.Code() != StatusBadRequest {
+		t.Error(err)
+	}
+
+	// unmount
+	if err := mux.Unmount("/dev"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mux.ReadPV("/dev/a"); err == nil || err.Code() != StatusNotFound {
+		t.Error(err)
+	}
+}
+
+func TestMuxExgDataOrder(t *testing.T) {
+	// both mount points share the same service
+	var svc MemoryService
+	if _, err := svc.WriteProperties("/x", AttrValues{}); err != nil {
+		t.Fatal(err)
+	}
+	mux := &Mux{}
+	if err := mux.Mount("/a", &svc, "A"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.Mount("/b", &svc, "B"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the write at the second mount point is executed before the read at the
+	// first one
+	writeErrs, results, err := mux.ExgData([]WritePVParam{{Path: "/b/x", PV: PV{Value: 2.0}}}, []string{"/a/x"})
+	if err != nil || len(writeErrs) != 1 || writeErrs[0] != nil || len(results) != 1 {
+		t.Fatal(writeErrs, results, err)
+	}
+	if results[0].Error != nil || results[0].PV.Value != 2.0 {
+		t.Error(results)
+	}
+}
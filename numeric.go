@@ -0,0 +1,50 @@
+package veap
+
+import "encoding/json"
+
+// ToFloat64 converts numbers of all Go number types and json.Number to
+// float64. For other types false is returned.
+func ToFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// NumericValue converts numbers (q.v. ToFloat64) and booleans to float64. true
+// is converted to 1, false to 0. For other types false is returned.
+func NumericValue(value interface{}) (float64, bool) {
+	if b, ok := value.(bool); ok {
+		if b {
+			return 1, true
+		}
+		return 0, true
+	}
+	return ToFloat64(value)
+}
@@ -0,0 +1,52 @@
+package veap
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestToFloat64(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want float64
+		ok   bool
+	}{
+		{1.5, 1.5, true},
+		{float32(2.5), 2.5, true},
+		{int8(-3), -3, true},
+		{uint(4), 4, true},
+		{uint64(5), 5, true},
+		{json.Number("6.5"), 6.5, true},
+		{json.Number("x"), 0, false},
+		{true, 0, false},
+		{"7", 0, false},
+		{nil, 0, false},
+	}
+	for _, c := range cases {
+		v, ok := ToFloat64(c.in)
+		if v != c.want || ok != c.ok {
+			t.Error(c.in, v, ok)
+		}
+	}
+}
+
+func TestNumericValue(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want float64
+		ok   bool
+	}{
+		{1.5, 1.5, true},
+		{uint16(2), 2, true},
+		{json.Number("3"), 3, true},
+		{true, 1, true},
+		{false, 0, true},
+		{"4", 0, false},
+	}
+	for _, c := range cases {
+		v, ok := NumericValue(c.in)
+		if v != c.want || ok != c.ok {
+			t.Error(c.in, v, ok)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package veap
 
 import (
+	"context"
 	"net/url"
 	"path"
+	"sort"
 	"strings"
 )
 
+// childPaths returns the paths of the direct children in ascending order. The
+// order is stable, so that query results can be paginated.
 func childPaths(objPath string, links []Link) []string {
 	results := make([]string, 0)
 	for _, link := range links {
@@ -23,32 +27,109 @@ func childPaths(objPath string, links []Link) []string {
 			results = append(results, linkPath)
 		}
 	}
+	sort.Strings(results)
 	return results
 }
 
-func traverseTree(service Service, pathPattern, startPath string, handle func(item QueryResult) Error) Error {
+// RecursiveWildcard is a path pattern segment, which matches zero or more
+// levels of the VEAP object tree.
+const RecursiveWildcard = "**"
+
+// treeWalker searches the VEAP object tree for objects matching a path
+// pattern.
+type treeWalker struct {
+	ctx      context.Context
+	service  ContextService
+	maxDepth int
+	exec     executor
+	handle   func(item QueryResult) Error
+
+	// for patterns with recursive wildcards: visited states
+	visited map[walkState]bool
+
+	// cached properties, for patterns with recursive wildcards they are kept
+	// until the end of the search
+	cache     map[string]cachedProperties
+	keepCache bool
+}
+
+type walkState struct {
+	objPath     string
+	pathPattern string
+}
+
+type cachedProperties struct {
+	item QueryResult
+	err  Error
+}
+
+// traverseTree calls handle for all objects matching the path pattern. The
+// path pattern must not start with a slash. If maxDepth is greater than 0,
+// objects deeper than maxDepth levels below the root are not searched. With
+// a parallel executor the properties of sibling objects are read
+// concurrently, the order of the results does not change.
+func traverseTree(ctx context.Context, service ContextService, pathPattern, startPath string, maxDepth int, exec executor, handle func(item QueryResult) Error) Error {
+	w := &treeWalker{
+		ctx:      ctx,
+		service:  service,
+		maxDepth: maxDepth,
+		exec:     exec,
+		handle:   handle,
+		cache:    make(map[string]cachedProperties),
+	}
+	if strings.Contains(pathPattern, RecursiveWildcard) {
+		w.visited = make(map[walkState]bool)
+		w.keepCache = true
+	}
+	return w.walk(pathPattern, startPath, pathDepth(startPath))
+}
+
+func (w *treeWalker) walk(pathPattern, objPath string, depth int) Error {
+	// cycle protection
+	if w.visited != nil {
+		s := walkState{objPath, pathPattern}
+		if w.visited[s] {
+			return nil
+		}
+		w.visited[s] = true
+	}
 	// read all properties
-	attrs, links, err := service.ReadProperties(startPath)
+	item, err := w.readProperties(objPath)
 	if err != nil {
 		return err
 	}
 	// no more path levels?
 	if pathPattern == "" {
-		handle(QueryResult{
-			Path:       startPath,
-			Attributes: attrs,
-			Links:      links,
-		})
-		return nil
+		return w.handle(item)
 	}
 	// pattern for next level
-	rawPattern, pathPattern, _ := strings.Cut(pathPattern, "/")
+	rawPattern, remPattern := pathPattern, ""
+	if pos := strings.Index(pathPattern, "/"); pos != -1 {
+		rawPattern, remPattern = pathPattern[:pos], pathPattern[pos+1:]
+	}
 	pattern, pathErr := url.PathUnescape(rawPattern)
 	if pathErr != nil {
 		return NewErrorf(StatusBadRequest, "Invalid content '%s' in URL parameter ~path for query service: %v", rawPattern, pathErr)
 	}
+	recursive := pattern == RecursiveWildcard
+	if recursive {
+		// zero levels
+		if err := w.walk(remPattern, objPath, depth); err != nil {
+			return err
+		}
+	}
+	// max. depth reached?
+	if w.maxDepth > 0 && depth >= w.maxDepth {
+		return nil
+	}
 	// find matching children
-	for _, childPath := range childPaths(startPath, links) {
+	var nextPaths []string
+	for _, childPath := range childPaths(objPath, item.Links) {
+		if recursive {
+			// one or more levels
+			nextPaths = append(nextPaths, childPath)
+			continue
+		}
 		childIdent, pathErr := url.PathUnescape(path.Base(childPath))
 		if pathErr != nil {
 			return NewErrorf(StatusInternalServerError, "Invalid identifier '%s' for object: %v", path.Base(childPath), pathErr)
@@ -58,10 +139,77 @@ func traverseTree(service Service, pathPattern, startPath string, handle func(it
 			return NewErrorf(StatusBadRequest, "Invalid content '%s' in URL parameter ~path for query service: %v", rawPattern, matchErr)
 		}
 		if matches {
-			if err = traverseTree(service, pathPattern, childPath, handle); err != nil {
-				return err
-			}
+			nextPaths = append(nextPaths, childPath)
+		}
+	}
+	nextPattern := remPattern
+	if recursive {
+		nextPattern = pathPattern
+	}
+	w.prefetch(nextPaths)
+	for _, nextPath := range nextPaths {
+		if err := w.walk(nextPattern, nextPath, depth+1); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+func (w *treeWalker) readProperties(objPath string) (QueryResult, Error) {
+	if c, ok := w.cache[objPath]; ok {
+		if !w.keepCache {
+			delete(w.cache, objPath)
+		}
+		return c.item, c.err
+	}
+	c := w.fetch(objPath)
+	if w.keepCache && c.err == nil {
+		w.cache[objPath] = c
+	}
+	return c.item, c.err
+}
+
+// prefetch reads the properties of the objects concurrently, if the executor
+// supports parallelism.
+func (w *treeWalker) prefetch(objPaths []string) {
+	if w.exec.workers < 2 {
+		return
+	}
+	var missing []string
+	for _, p := range objPaths {
+		if _, ok := w.cache[p]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	fetched := make([]cachedProperties, len(missing))
+	w.exec.forEach(len(missing), func(i int) {
+		fetched[i] = w.fetch(missing[i])
+	})
+	for i, p := range missing {
+		w.cache[p] = fetched[i]
+	}
+}
+
+func (w *treeWalker) fetch(objPath string) cachedProperties {
+	v, err := w.exec.call(w.ctx, func(ctx context.Context) (interface{}, Error) {
+		attrs, links, err := w.service.ReadPropertiesContext(ctx, objPath)
+		return QueryResult{
+			Path:       objPath,
+			Attributes: attrs,
+			Links:      links,
+		}, err
+	})
+	if err != nil {
+		return cachedProperties{err: err}
+	}
+	return cachedProperties{item: v.(QueryResult)}
+}
+
+// pathDepth returns the number of levels below the root.
+func pathDepth(objPath string) int {
+	objPath = strings.Trim(objPath, "/")
+	if objPath == "" {
+		return 0
+	}
+	return strings.Count(objPath, "/") + 1
+}
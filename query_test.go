@@ -1,7 +1,9 @@
 package veap
 
 import (
+	"context"
 	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -26,3 +28,54 @@ func TestChildPaths(t *testing.T) {
 func TestGlob(t *testing.T) {
 
 }
+
+func TestRecursiveWildcard(t *testing.T) {
+	// tree: / -> a -> b -> c
+	children := map[string][]Link{
+		"/":      {{Role: "item", Target: "a"}},
+		"/a":     {{Role: "item", Target: "b"}, {Role: "collection", Target: ".."}},
+		"/a/b":   {{Role: "item", Target: "c"}, {Role: "collection", Target: ".."}},
+		"/a/b/c": {{Role: "collection", Target: ".."}},
+	}
+	reads := 0
+	svc := &FuncService{
+		ReadPropertiesFunc: func(path string) (AttrValues, []Link, Error) {
+			reads++
+			links, ok := children[path]
+			if !ok {
+				return nil, nil, NewErrorf(StatusNotFound, "Not found: %s", path)
+			}
+			return AttrValues{}, links, nil
+		},
+	}
+	cases := []struct {
+		pattern  string
+		maxDepth int
+		paths    []string
+	}{
+		{"**", 0, []string{"/", "/a", "/a/b", "/a/b/c"}},
+		{"**/**", 0, []string{"/", "/a", "/a/b", "/a/b/c"}},
+		{"**/c", 0, []string{"/a/b/c"}},
+		{"a/**/c", 0, []string{"/a/b/c"}},
+		{"**", 1, []string{"/", "/a"}},
+	}
+	for _, c := range cases {
+		reads = 0
+		var paths []string
+		err := traverseTree(context.Background(), AsContextService(svc), c.pattern, "/", c.maxDepth, executor{}, func(item QueryResult) Error {
+			paths = append(paths, item.Path)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, c.paths) {
+			t.Errorf("Wrong paths for %s: %v", c.pattern, paths)
+		}
+		// properties are read only once
+		if reads > len(children) {
+			t.Errorf("Too many reads for %s: %d", c.pattern, reads)
+		}
+	}
+}
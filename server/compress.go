@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mdzio/go-veap"
+)
+
+const (
+	// default min. size of a response body to be compressed: 1 KB
+	defaultCompressionThreshold = 1024
+
+	// supported content codings
+	codingGzip    = "gzip"
+	codingDeflate = "deflate"
+)
+
+// receiveRequest reads the request body. Bodies with Content-Encoding gzip or
+// deflate are decompressed. The size limit is applied to the compressed and
+// to the decompressed body.
+func (h *Handler) receiveRequest(respWriter http.ResponseWriter, request *http.Request) ([]byte, error) {
+	limit := h.requestSizeLimit()
+	body := http.MaxBytesReader(respWriter, request.Body, limit)
+	coding := strings.ToLower(strings.TrimSpace(request.Header.Get("Content-Encoding")))
+	if coding == "" || coding == "identity" {
+		return ioutil.ReadAll(body)
+	}
+
+	// decompress body
+	cr := &countingReader{r: body}
+	var dr io.ReadCloser
+	var err error
+	switch coding {
+	case codingGzip:
+		dr, err = gzip.NewReader(cr)
+	case codingDeflate:
+		dr, err = zlib.NewReader(cr)
+	default:
+		return nil, veap.NewErrorf(veap.StatusUnsupportedMediaType, "Unsupported content encoding: %s", coding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Decompression failed: %v", err)
+	}
+	defer dr.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(dr, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("Decompression failed: %v", err)
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("Request size limit of %d bytes exceeded", limit)
+	}
+
+	// update statistics
+	atomic.AddUint64(&h.Stats.CompressedRequestBytes, cr.n)
+	atomic.AddUint64(&h.Stats.UncompressedRequestBytes, uint64(len(b)))
+	return b, nil
+}
+
+// responseCoding returns the content coding for a response body of the
+// specified size. An empty string is returned, if the body should not be
+// compressed. Small bodies are only compressed, if the client refuses the
+// identity coding.
+func (h *Handler) responseCoding(request *http.Request, size int) string {
+	if !h.compressionEnabled() {
+		return ""
+	}
+	coding, identity := acceptedCoding(request)
+	if identity && size < h.compressionThreshold() {
+		return ""
+	}
+	return coding
+}
+
+// sendCompressed compresses and sends a response body.
+func (h *Handler) sendCompressed(respWriter http.ResponseWriter, code int, coding string, b []byte) error {
+	var buf bytes.Buffer
+	cw := newCompressor(coding, &buf)
+	if _, err := cw.Write(b); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	respWriter.Header().Set("Content-Encoding", coding)
+	respWriter.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	respWriter.WriteHeader(code)
+
+	// update statistics
+	atomic.AddUint64(&h.Stats.CompressedResponseBytes, uint64(buf.Len()))
+	atomic.AddUint64(&h.Stats.UncompressedResponseBytes, uint64(len(b)))
+
+	_, err := respWriter.Write(buf.Bytes())
+	return err
+}
+
+func (h *Handler) compressionEnabled() bool {
+	return h.CompressionThreshold >= 0
+}
+
+func (h *Handler) compressionThreshold() int {
+	if h.CompressionThreshold == 0 {
+		return defaultCompressionThreshold
+	}
+	return h.CompressionThreshold
+}
+
+// acceptedCoding selects a supported content coding based on the
+// Accept-Encoding header of the request (q.v. RFC 7231 section 5.3.4). gzip is
+// preferred over deflate with the same quality value. Codings with a quality
+// value of 0 are not acceptable, * applies to all codings not listed
+// explicitly. Additionally it is returned, whether the identity coding is
+// acceptable.
+func acceptedCoding(request *http.Request) (string, bool) {
+	qvalues := make(map[string]float64)
+	for _, header := range request.Header.Values("Accept-Encoding") {
+		for _, item := range strings.Split(header, ",") {
+			parts := strings.Split(item, ";")
+			coding := strings.ToLower(strings.TrimSpace(parts[0]))
+			if coding == "" {
+				continue
+			}
+			q := 1.0
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					v, err := strconv.ParseFloat(param[2:], 64)
+					if err != nil {
+						v = 0
+					}
+					q = v
+				}
+			}
+			qvalues[coding] = q
+		}
+	}
+	qvalue := func(coding string) (float64, bool) {
+		if q, ok := qvalues[coding]; ok {
+			return q, true
+		}
+		q, ok := qvalues["*"]
+		return q, ok
+	}
+
+	var best string
+	var bestQ float64
+	for _, coding := range []string{codingGzip, codingDeflate} {
+		if q, ok := qvalue(coding); ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	// identity is acceptable, unless refused explicitly or by *
+	identity := true
+	if q, ok := qvalue("identity"); ok && q <= 0 {
+		identity = false
+	}
+	return best, identity
+}
+
+func newCompressor(coding string, w io.Writer) io.WriteCloser {
+	if coding == codingDeflate {
+		return zlib.NewWriter(w)
+	}
+	return gzip.NewWriter(w)
+}
+
+// codingETag returns the entity tag of a compressed representation. A strong
+// entity tag must differ for different content codings.
+func codingETag(etag string, coding string) string {
+	if etag == "" || coding == "" {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + coding + `"`
+}
+
+// stripCodingETag removes the content coding from an entity tag (q.v.
+// codingETag).
+func stripCodingETag(etag string) string {
+	for _, coding := range []string{codingGzip, codingDeflate} {
+		suffix := "-" + coding + `"`
+		if strings.HasSuffix(etag, suffix) {
+			return strings.TrimSuffix(etag, suffix) + `"`
+		}
+	}
+	return etag
+}
+
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += uint64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += uint64(n)
+	return n, err
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+)
+
+// validators of a response for conditional requests (RFC 7232). Properties
+// get an entity tag, PVs additionally get their timestamp as modification
+// time.
+type validators struct {
+	etag         string
+	lastModified time.Time
+}
+
+// entityTag returns a strong entity tag for the representation b.
+func entityTag(b []byte) string {
+	h := fnv.New64a()
+	h.Write(b)
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// pvValidators returns the validators of a PV. The entity tag identifies the
+// state of the PV independent of the requested format.
+func pvValidators(pv veap.PV) (validators, error) {
+	b, err := encoding.MarshalPV(pv, encoding.NumericStates)
+	if err != nil {
+		return validators{}, fmt.Errorf("Conversion of PV to JSON failed: %v", err)
+	}
+	return validators{etag: entityTag(b), lastModified: pv.Time}, nil
+}
+
+func (h *Handler) currentPVValidators(ctx context.Context, path string) (validators, error) {
+	pv, svcErr := veap.AsContextService(h.Service).ReadPVContext(ctx, path)
+	if svcErr != nil {
+		return validators{}, svcErr
+	}
+	return pvValidators(pv)
+}
+
+func (h *Handler) currentPropertiesValidators(ctx context.Context, path string) (validators, error) {
+	b, err := h.serveProperties(ctx, path)
+	if err != nil {
+		return validators{}, err
+	}
+	return validators{etag: entityTag(b)}, nil
+}
+
+// checkIfMatch evaluates the If-Match header of a request. current returns the
+// validators of the current state of the target resource. If the header does
+// not match, an error with code StatusPreconditionFailed is returned.
+func checkIfMatch(request *http.Request, current func() (validators, error)) error {
+	ifMatch := strings.Join(request.Header.Values("If-Match"), ",")
+	if ifMatch == "" {
+		return nil
+	}
+	v, err := current()
+	if err != nil {
+		if svcErr, ok := err.(veap.Error); ok && svcErr.Code() == veap.StatusNotFound {
+			return veap.NewErrorf(veap.StatusPreconditionFailed, "Precondition failed, object does not exist: %s", request.URL.Path)
+		}
+		return err
+	}
+	if !matchETag(ifMatch, v.etag, false /* strong comparison */) {
+		return veap.NewErrorf(veap.StatusPreconditionFailed, "Precondition failed, entity tag does not match: %s", ifMatch)
+	}
+	return nil
+}
+
+// notModified evaluates the If-None-Match and If-Modified-Since headers of a
+// request. If-Modified-Since is ignored, if If-None-Match is present.
+func notModified(request *http.Request, v validators) bool {
+	if ifNoneMatch := strings.Join(request.Header.Values("If-None-Match"), ","); ifNoneMatch != "" {
+		return matchETag(ifNoneMatch, v.etag, true /* weak comparison */)
+	}
+	if ims := request.Header.Get("If-Modified-Since"); ims != "" && !v.lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		// HTTP dates have a resolution of one second
+		return !v.lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// matchETag checks whether a list of entity tags (or *) contains the entity
+// tag. With weak comparison the W/ prefixes are ignored, otherwise weak entity
+// tags never match. Entity tags of compressed representations match the
+// entity tag of the uncompressed one.
+func matchETag(list string, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return true
+		}
+		if strings.HasPrefix(t, "W/") {
+			if !weak {
+				continue
+			}
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if stripCodingETag(t) == etag {
+			return true
+		}
+	}
+	return false
+}
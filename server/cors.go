@@ -0,0 +1,205 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdzio/go-veap"
+)
+
+// CORSConfig configures Cross-Origin Resource Sharing for a Handler.
+type CORSConfig struct {
+	// AllowedOrigins lists the origins (e.g. https://example.com), which may
+	// access the VEAP server. The origin * allows all origins, but it is
+	// ignored if AllowCredentials is set, because every web site could
+	// otherwise access the VEAP server with the credentials of the user. If
+	// empty, no cross-origin requests are allowed.
+	AllowedOrigins []string
+
+	// AllowedMethods lists the allowed HTTP methods. If not set, GET, PUT and
+	// DELETE are allowed. Additionally, the methods are limited by the
+	// requested VEAP resource (e.g. only PUT for ~exgdata).
+	AllowedMethods []string
+
+	// AllowedHeaders lists the allowed request headers. The header * allows
+	// all headers. If not set, the headers for authentication, content type,
+	// compression and conditional requests are allowed.
+	AllowedHeaders []string
+
+	// ExposedHeaders lists the response headers, which are accessible by the
+	// client. If not set, ETag and Last-Modified are exposed.
+	ExposedHeaders []string
+
+	// AllowCredentials allows requests with credentials (e.g. HTTP basic
+	// authentication, cookies).
+	AllowCredentials bool
+
+	// MaxAge is the duration, for which the result of a preflight request
+	// may be cached. If not set, the browser default is used.
+	MaxAge time.Duration
+}
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPut, http.MethodDelete}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Content-Encoding",
+		"If-Match", "If-None-Match", "If-Modified-Since"}
+	defaultCORSExposedHeaders = []string{"ETag", "Last-Modified"}
+)
+
+// serveCORS adds the CORS headers to the response. For a preflight request the
+// complete response is sent and true is returned.
+func (h *Handler) serveCORS(respWriter http.ResponseWriter, request *http.Request, fullPath string) bool {
+	origin := request.Header.Get("Origin")
+	if h.CORS == nil || origin == "" {
+		return false
+	}
+	cfg := h.CORS
+	header := respWriter.Header()
+	header.Add("Vary", "Origin")
+	preflight := request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != ""
+	if preflight {
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+	}
+
+	// check origin
+	if !h.corsOriginAllowed(origin) {
+		if preflight {
+			h.errorResponse(respWriter, request, veap.StatusForbidden, "Origin not allowed: %s", origin)
+			return true
+		}
+		return false
+	}
+	if h.corsAnyOrigin() {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if cfg.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		exposed := cfg.ExposedHeaders
+		if exposed == nil {
+			exposed = defaultCORSExposedHeaders
+		}
+		if len(exposed) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+		}
+		return false
+	}
+
+	// check method
+	methods := h.corsMethods(fullPath)
+	reqMethod := request.Header.Get("Access-Control-Request-Method")
+	if !contains(methods, reqMethod) {
+		h.errorResponse(respWriter, request, veap.StatusMethodNotAllowed,
+			"Method %s not allowed for %s", reqMethod, fullPath)
+		return true
+	}
+
+	// check headers
+	allowedHeaders := cfg.AllowedHeaders
+	if allowedHeaders == nil {
+		allowedHeaders = defaultCORSHeaders
+	}
+	var reqHeaders []string
+	for _, v := range request.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !contains(allowedHeaders, "*") && !containsFold(allowedHeaders, name) {
+				h.errorResponse(respWriter, request, veap.StatusForbidden, "Header not allowed: %s", name)
+				return true
+			}
+			reqHeaders = append(reqHeaders, name)
+		}
+	}
+
+	// send preflight response
+	header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(reqHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(reqHeaders, ", "))
+	}
+	if cfg.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge/time.Second)))
+	}
+	handlerLog.Tracef("Response code: %d", http.StatusNoContent)
+	respWriter.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// corsOriginAllowed checks whether the origin is allowed by the CORS
+// configuration.
+func (h *Handler) corsOriginAllowed(origin string) bool {
+	if h.CORS == nil {
+		return false
+	}
+	return containsFold(h.CORS.AllowedOrigins, origin) || h.corsAnyOrigin()
+}
+
+// corsAnyOrigin checks whether all origins are allowed. The origin * is not
+// accepted together with credentials.
+func (h *Handler) corsAnyOrigin() bool {
+	return contains(h.CORS.AllowedOrigins, "*") && !h.CORS.AllowCredentials
+}
+
+// sameOrigin checks whether the origin matches the host of the request.
+func sameOrigin(request *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, request.Host)
+}
+
+// corsMethods returns the configured methods, which are supported by the VEAP
+// resource.
+func (h *Handler) corsMethods(fullPath string) []string {
+	var supported []string
+	switch path.Base(fullPath) {
+	case veap.PVMarker, veap.HistMarker:
+		supported = []string{http.MethodGet, http.MethodPut}
+	case veap.ExgDataMarker:
+		supported = []string{http.MethodPut}
+	case veap.QueryMarker, veap.WebSocketMarker:
+		supported = []string{http.MethodGet}
+	default:
+		supported = []string{http.MethodGet, http.MethodPut, http.MethodDelete}
+	}
+	allowed := h.CORS.AllowedMethods
+	if allowed == nil {
+		allowed = defaultCORSMethods
+	}
+	var methods []string
+	for _, m := range supported {
+		if containsFold(allowed, m) {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
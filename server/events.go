@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+)
+
+const (
+	// default interval between two heartbeat comments of an event stream
+	defaultHeartbeatInterval = 30 * time.Second
+
+	// max. number of queued PV changes of an event stream, older changes are
+	// discarded
+	eventQueueSize = 100
+
+	// query parameter for requesting an event stream
+	watchQueryParam = "watch"
+
+	// query parameters for waiting on a PV change
+	sinceQueryParam   = "since"
+	timeoutQueryParam = "timeout"
+
+	// default and max. timeout for waiting on a PV change
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
+
+	contentTypeEventStream = "text/event-stream"
+)
+
+// wantsEvents checks whether a Server-Sent Events stream is requested (header
+// Accept: text/event-stream or query parameter watch=1).
+func wantsEvents(request *http.Request) bool {
+	if w := request.URL.Query().Get(watchQueryParam); w == "1" || w == "true" {
+		return true
+	}
+	for _, a := range request.Header["Accept"] {
+		for _, t := range strings.Split(a, ",") {
+			if mt := strings.TrimSpace(strings.SplitN(t, ";", 2)[0]); mt == contentTypeEventStream {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// subscriber returns the native veap.Subscriber of the service, if
+// implemented. Otherwise the PVs are polled with the context of the request,
+// so that the principal is taken into account.
+func (h *Handler) subscriber(ctx context.Context) veap.Subscriber {
+	if s, ok := h.Service.(veap.Subscriber); ok {
+		return s
+	}
+	return &veap.PollingSubscriber{
+		Service:  &requestService{ServiceAdapter: veap.ServiceAdapter{ContextService: veap.AsContextService(h.Service)}, ctx: ctx},
+		Interval: h.PollingInterval,
+	}
+}
+
+// requestService reads PVs with the context of a request.
+type requestService struct {
+	veap.ServiceAdapter
+	ctx context.Context
+}
+
+func (s *requestService) ReadPV(path string) (veap.PV, veap.Error) {
+	return s.ContextService.ReadPVContext(s.ctx, path)
+}
+
+// servePVEvents streams the PV of a data point as Server-Sent Events. The
+// current PV is sent first, then every change. Each event contains a PV in
+// JSON (q.v. encoding.WirePV). Heartbeat comments keep the connection alive.
+// The stream ends, when the client disconnects. An error is only returned, if
+// no response is sent yet.
+func (h *Handler) servePVEvents(ctx context.Context, respWriter http.ResponseWriter, request *http.Request, path string, mode encoding.StateMode) error {
+	flusher, ok := respWriter.(http.Flusher)
+	if !ok {
+		return veap.NewErrorf(veap.StatusInternalServerError, "Streaming of events not supported")
+	}
+
+	// subscribe before reading the current PV, so that no change is missed
+	queue := &pvQueue{signal: make(chan struct{}, 1)}
+	subscriber := h.subscriber(ctx)
+	id, svcErr := subscriber.Subscribe([]string{path}, func(_ string, pv veap.PV) {
+		queue.put(pv)
+	})
+	if svcErr != nil {
+		return svcErr
+	}
+	defer func() {
+		if err := subscriber.Unsubscribe(id); err != nil {
+			handlerLog.Warningf("Unsubscribing event stream of %s failed: %v", request.RemoteAddr, err)
+		}
+	}()
+	last, svcErr := veap.AsContextService(h.Service).ReadPVContext(ctx, path)
+	if svcErr != nil {
+		return svcErr
+	}
+
+	// start response
+	respWriter.Header().Set("Content-Type", contentTypeEventStream)
+	respWriter.Header().Set("Cache-Control", "no-cache")
+	respWriter.Header().Set("X-Content-Type-Options", "nosniff")
+	respWriter.WriteHeader(http.StatusOK)
+	write := func(b []byte) bool {
+		n, err := respWriter.Write(b)
+		atomic.AddUint64(&h.Stats.ResponseBytes, uint64(n))
+		if err != nil {
+			handlerLog.Debugf("Event stream to %s stopped: %v", request.RemoteAddr, err)
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	writePV := func(pv veap.PV) bool {
+		b, err := encoding.MarshalPV(pv, mode)
+		if err != nil {
+			handlerLog.Warningf("Conversion of PV to JSON failed: %v", err)
+			return true
+		}
+		return write([]byte(fmt.Sprintf("data: %s\n\n", b)))
+	}
+	if !writePV(last) {
+		return nil
+	}
+
+	// stream changes
+	heartbeat := time.NewTicker(h.heartbeatInterval())
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			handlerLog.Debugf("Event stream to %s closed", request.RemoteAddr)
+			return nil
+		case <-heartbeat.C:
+			if !write([]byte(": heartbeat\n\n")) {
+				return nil
+			}
+		case <-queue.signal:
+			for _, pv := range queue.take() {
+				// the current PV may also be notified
+				if pv.Equal(last) {
+					continue
+				}
+				last = pv
+				if !writePV(pv) {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// servePVWait waits until the timestamp of the PV is newer than the query
+// parameter since or the timeout (query parameter timeout) expires. Both
+// parameters are in milliseconds. Then the current PV is returned. If the
+// timeout expired, its timestamp is not newer than since.
+func (h *Handler) servePVWait(ctx context.Context, path string, params url.Values, mode encoding.StateMode) ([]byte, error) {
+	// parse params
+	since, err := parseIntParam(params, sinceQueryParam)
+	if err != nil {
+		return nil, err
+	}
+	timeout := defaultWaitTimeout
+	t, err := parseIntParam(params, timeoutQueryParam)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil {
+		timeout = time.Duration(*t) * time.Millisecond
+		if timeout < 0 || timeout > maxWaitTimeout {
+			return nil, veap.NewErrorf(veap.StatusBadRequest, "Invalid request parameter %s: %d", timeoutQueryParam, *t)
+		}
+	}
+	// timestamps are compared with the precision of the wire format
+	newer := func(pv veap.PV) bool {
+		return pv.Time.UnixNano()/1000000 > *since
+	}
+
+	// subscribe before reading the current PV, so that no change is missed
+	changed := make(chan veap.PV, 1)
+	subscriber := h.subscriber(ctx)
+	id, svcErr := subscriber.Subscribe([]string{path}, func(_ string, pv veap.PV) {
+		if newer(pv) {
+			select {
+			case changed <- pv:
+			default:
+			}
+		}
+	})
+	if svcErr != nil {
+		return nil, svcErr
+	}
+	defer func() {
+		if err := subscriber.Unsubscribe(id); err != nil {
+			handlerLog.Warningf("Unsubscribing of %s failed: %v", path, err)
+		}
+	}()
+	pv, svcErr := veap.AsContextService(h.Service).ReadPVContext(ctx, path)
+	if svcErr != nil {
+		return nil, svcErr
+	}
+
+	// wait for change
+	if !newer(pv) {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case pv = <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, veap.ContextError(ctx)
+		}
+	}
+
+	// convert PV to JSON
+	b, err := encoding.MarshalPV(pv, mode)
+	if err != nil {
+		return nil, fmt.Errorf("Conversion of PV to JSON failed: %v", err)
+	}
+	return b, nil
+}
+
+func (h *Handler) heartbeatInterval() time.Duration {
+	if h.HeartbeatInterval <= 0 {
+		return defaultHeartbeatInterval
+	}
+	return h.HeartbeatInterval
+}
+
+// pvQueue buffers PV changes for a slow receiver. If the queue is full, the
+// oldest PV is discarded.
+type pvQueue struct {
+	mutex  sync.Mutex
+	pvs    []veap.PV
+	signal chan struct{}
+}
+
+func (q *pvQueue) put(pv veap.PV) {
+	q.mutex.Lock()
+	if len(q.pvs) == eventQueueSize {
+		q.pvs = q.pvs[1:]
+	}
+	q.pvs = append(q.pvs, pv)
+	q.mutex.Unlock()
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (q *pvQueue) take() []veap.PV {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	pvs := q.pvs
+	q.pvs = nil
+	return pvs
+}
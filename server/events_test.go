@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-veap"
+)
+
+// readEvent returns the next event or comment of a Server-Sent Events stream.
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return strings.Join(lines, "\n")
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestHandlerPVEvents(t *testing.T) {
+	var svc veap.MemoryService
+	if _, err := svc.WriteProperties("/a", veap.AttrValues{}); err != nil {
+		t.Fatal(err)
+	}
+	svc.WritePV("/a", veap.PV{Time: time.Unix(1, 0), Value: 1.0})
+	srv := httptest.NewServer(&Handler{Service: &svc})
+	defer srv.Close()
+
+	// unknown data point
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/b/~pv", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != veap.StatusNotFound {
+		t.Error(resp.StatusCode)
+	}
+
+	// stream of changes
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/a/~pv", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != veap.StatusOK || resp.Header.Get("Content-Type") != contentTypeEventStream {
+		t.Fatal(resp.StatusCode, resp.Header)
+	}
+	r := bufio.NewReader(resp.Body)
+	if e := readEvent(t, r); e != `data: {"ts":1000,"v":1,"s":0}` {
+		t.Error(e)
+	}
+	svc.WritePV("/a", veap.PV{Time: time.Unix(2, 0), Value: 2.0})
+	if e := readEvent(t, r); e != `data: {"ts":2000,"v":2,"s":0}` {
+		t.Error(e)
+	}
+	cancel()
+}
+
+func TestHandlerPVEventsPolling(t *testing.T) {
+	var mutex sync.Mutex
+	value := 1.0
+	svc := veap.FuncService{
+		ReadPVFunc: func(path string) (veap.PV, veap.Error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return veap.PV{Time: time.Unix(int64(value), 0), Value: value}, nil
+		},
+	}
+	srv := httptest.NewServer(&Handler{
+		Service:           &svc,
+		PollingInterval:   10 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+	})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/a/~pv?watch=1&states=text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	if e := readEvent(t, r); e != `data: {"ts":1000,"v":1,"s":"GOOD"}` {
+		t.Error(e)
+	}
+	mutex.Lock()
+	value = 2.0
+	mutex.Unlock()
+	if e := readEvent(t, r); e != `data: {"ts":2000,"v":2,"s":"GOOD"}` {
+		t.Error(e)
+	}
+	if e := readEvent(t, r); e != ": heartbeat" {
+		t.Error(e)
+	}
+}
+
+func TestHandlerPVWait(t *testing.T) {
+	var svc veap.MemoryService
+	if _, err := svc.WriteProperties("/a", veap.AttrValues{}); err != nil {
+		t.Fatal(err)
+	}
+	svc.WritePV("/a", veap.PV{Time: time.Unix(1, 0), Value: 1.0})
+	srv := httptest.NewServer(&Handler{Service: &svc})
+	defer srv.Close()
+
+	get := func(query string) (int, string) {
+		resp, err := http.Get(srv.URL + "/a/~pv?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	// invalid parameters
+	for _, q := range []string{"since=x", "since=0&timeout=x", "since=0&timeout=-1", "since=0&timeout=300001"} {
+		if code, _ := get(q); code != veap.StatusBadRequest {
+			t.Error(q, code)
+		}
+	}
+
+	// PV is already newer
+	if code, body := get("since=999"); code != veap.StatusOK || body != `{"ts":1000,"v":1,"s":0}` {
+		t.Error(code, body)
+	}
+
+	// timeout
+	if code, body := get("since=1000&timeout=10"); code != veap.StatusOK || body != `{"ts":1000,"v":1,"s":0}` {
+		t.Error(code, body)
+	}
+
+	// change
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		svc.WritePV("/a", veap.PV{Time: time.Unix(2, 0), Value: 2.0})
+	}()
+	if code, body := get("since=1000&timeout=5000"); code != veap.StatusOK || body != `{"ts":2000,"v":2,"s":0}` {
+		t.Error(code, body)
+	}
+}
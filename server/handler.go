@@ -1,9 +1,11 @@
 package server
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
@@ -28,6 +30,10 @@ const (
 	writePVQueryParam = "writepv"
 	formatQueryParam  = "format"
 	formatSimple      = "simple"
+	statesQueryParam  = "states"
+	statesText        = "text"
+	aggrParam         = "aggr"
+	intervalParam     = "interval"
 
 	// content types
 	contentTypeJSON = "application/json"
@@ -37,15 +43,45 @@ const (
 var handlerLog = logging.Get("veap-handler")
 
 // HandlerStats collects statistics about the requests and responses. To access
-// the counters atomic.LoadInt64 must be used.
+// the counters atomic.LoadInt64 must be used. RequestBytes and ResponseBytes
+// count the uncompressed sizes of the bodies. The Compressed... counters
+// count the transmitted sizes of compressed bodies, the Uncompressed...
+// counters the original sizes of these bodies.
 type HandlerStats struct {
 	Requests       uint64
 	RequestBytes   uint64
 	ResponseBytes  uint64
 	ErrorResponses uint64
+
+	CompressedRequestBytes    uint64
+	UncompressedRequestBytes  uint64
+	CompressedResponseBytes   uint64
+	UncompressedResponseBytes uint64
 }
 
 // Handler transforms HTTP requests to VEAP service requests.
+//
+// The context of the HTTP request is passed to the service, if it implements
+// veap.ContextService or veap.ContextMetaService and the context is not
+// disabled (q.v. veap.ContextSwitch). In this case the methods without context
+// are not called. If Authenticate is set, the user name of HTTP basic
+// authentication is stored in the context as principal (q.v.
+// veap.WithPrincipal).
+//
+// PV changes can be received over a WebSocket at /~ws (q.v. serveWebSocket),
+// as Server-Sent Events (Accept: text/event-stream or ?watch=1, q.v.
+// servePVEvents) or by long polling (?since=<ms>&timeout=<ms>, q.v.
+// servePVWait).
+//
+// Responses for properties and PVs carry an ETag, PVs additionally their
+// timestamp as Last-Modified. Conditional GET requests (If-None-Match,
+// If-Modified-Since) are answered with 304 Not Modified, if nothing changed.
+// PUT requests with If-Match are rejected with 412 Precondition Failed, if the
+// current state does not match. The check is not atomic with the write, so a
+// concurrent write between both is not detected.
+//
+// Responses are compressed with gzip or deflate based on the Accept-Encoding
+// header, request bodies may be compressed as well (Content-Encoding).
 type Handler struct {
 	// Service is VEAP service provider for processing the requests.
 	veap.Service
@@ -61,6 +97,33 @@ type Handler struct {
 	// set, the limit is 10000 entries.
 	HistorySizeLimit int64
 
+	// PollingInterval is the interval for reading subscribed PVs, if the
+	// service does not implement veap.Subscriber. If not set, the PVs are
+	// read every second.
+	PollingInterval time.Duration
+
+	// HeartbeatInterval is the interval between two heartbeat comments of an
+	// event stream. If not set, the interval is 30 seconds.
+	HeartbeatInterval time.Duration
+
+	// CompressionThreshold is the minimum size of a response body to be
+	// compressed. Query results are always compressed, if the client accepts
+	// it. If not set, the threshold is 1 KB. A negative value disables the
+	// compression of responses.
+	CompressionThreshold int
+
+	// Authenticate verifies the credentials of HTTP basic authentication. If
+	// it returns false, the request is answered with 401 Unauthorized.
+	// Otherwise the user name is used as principal for access control (q.v.
+	// veap.AccessControlService). If not set, the credentials are ignored and
+	// no principal is set.
+	Authenticate func(user, password string) bool
+
+	// CORS enables Cross-Origin Resource Sharing. Preflight requests (OPTIONS)
+	// are answered for all VEAP resources. If not set, cross-origin requests
+	// are not supported.
+	CORS *CORSConfig
+
 	// Statistics collects statistics about the requests and responses.
 	Stats HandlerStats
 }
@@ -78,11 +141,31 @@ func (h *Handler) ServeHTTP(respWriter http.ResponseWriter, request *http.Reques
 	}
 	fullPath = strings.TrimPrefix(fullPath, h.URLPrefix)
 
+	// Cross-Origin Resource Sharing, on preflight the response is already sent
+	if h.serveCORS(respWriter, request, fullPath) {
+		return
+	}
+
+	// authenticate caller
+	ctx := request.Context()
+	if user, password, ok := request.BasicAuth(); ok && h.Authenticate != nil {
+		if !h.Authenticate(user, password) {
+			respWriter.Header().Set("WWW-Authenticate", `Basic realm="VEAP"`)
+			h.errorResponse(respWriter, request, veap.StatusUnauthorized, "Authentication failed for user %s", user)
+			return
+		}
+		// principal for access control (q.v. veap.AccessControlService)
+		ctx = veap.WithPrincipal(ctx, user)
+	}
+
 	// receive request
-	reqLimitReader := http.MaxBytesReader(respWriter, request.Body, h.requestSizeLimit())
-	reqBytes, err := ioutil.ReadAll(reqLimitReader)
+	reqBytes, err := h.receiveRequest(respWriter, request)
 	if err != nil {
-		h.errorResponse(respWriter, request, veap.StatusBadRequest, "Receiving of request failed: %v", err)
+		code := veap.StatusBadRequest
+		if svcErr, ok := err.(veap.Error); ok {
+			code = svcErr.Code()
+		}
+		h.errorResponse(respWriter, request, code, "Receiving of request failed: %v", err)
 		return
 	}
 
@@ -98,6 +181,7 @@ func (h *Handler) ServeHTTP(respWriter http.ResponseWriter, request *http.Reques
 	respCode := http.StatusOK
 	var respBytes []byte
 	var contentType = contentTypeJSON
+	var valid validators
 	base := path.Base(fullPath)
 	switch base {
 
@@ -109,14 +193,30 @@ func (h *Handler) ServeHTTP(respWriter http.ResponseWriter, request *http.Reques
 			if wpv != "" {
 				// VEAP protocol extension: HTTP-GET request for writing PV with
 				// query parameter 'writepv'
-				err = h.serveSetPV(path.Dir(fullPath), []byte(wpv), true /* fuzzy parsing */)
+				err = h.serveSetPV(ctx, path.Dir(fullPath), []byte(wpv), true /* fuzzy parsing */)
+			} else if qvs.Get(sinceQueryParam) != "" {
+				// VEAP protocol extension: long polling, waiting for a PV
+				// change with query parameters 'since' and 'timeout'
+				respBytes, err = h.servePVWait(ctx, path.Dir(fullPath), qvs, stateMode(qvs))
+			} else if wantsEvents(request) {
+				// VEAP protocol extension: streaming of PV changes as
+				// Server-Sent Events, on success the response is already sent
+				err = h.servePVEvents(ctx, respWriter, request, path.Dir(fullPath), stateMode(qvs))
+				if err == nil {
+					return
+				}
 			} else {
 				// VEAP protocol extension: returning PV in specific format with
 				// query parameter 'format', contentType may be changed
-				respBytes, contentType, err = h.servePV(path.Dir(fullPath), qvs.Get(formatQueryParam))
+				respBytes, contentType, valid, err = h.servePV(ctx, path.Dir(fullPath), qvs.Get(formatQueryParam), stateMode(qvs))
 			}
 		case http.MethodPut:
-			err = h.serveSetPV(path.Dir(fullPath), reqBytes, false /* no fuzzy parsing */)
+			err = checkIfMatch(request, func() (validators, error) {
+				return h.currentPVValidators(ctx, path.Dir(fullPath))
+			})
+			if err == nil {
+				err = h.serveSetPV(ctx, path.Dir(fullPath), reqBytes, false /* no fuzzy parsing */)
+			}
 		default:
 			h.errorResponse(respWriter, request, veap.StatusMethodNotAllowed,
 				"Method %s not allowed for PV %s", request.Method, fullPath)
@@ -126,9 +226,9 @@ func (h *Handler) ServeHTTP(respWriter http.ResponseWriter, request *http.Reques
 	case veap.HistMarker:
 		switch request.Method {
 		case http.MethodGet:
-			respBytes, err = h.serveHistory(path.Dir(fullPath), request.URL.Query())
+			respBytes, err = h.serveHistory(ctx, path.Dir(fullPath), request.URL.Query())
 		case http.MethodPut:
-			err = h.serveSetHistory(path.Dir(fullPath), reqBytes)
+			err = h.serveSetHistory(ctx, path.Dir(fullPath), reqBytes)
 		default:
 			h.errorResponse(respWriter, request, veap.StatusMethodNotAllowed,
 				"Method %s not allowed for history %s", request.Method, fullPath)
@@ -146,7 +246,7 @@ func (h *Handler) ServeHTTP(respWriter http.ResponseWriter, request *http.Reques
 				"Invalid path for ExgData service: %s", fullPath)
 			return
 		}
-		respBytes, err = h.serveExgData(reqBytes)
+		respBytes, err = h.serveExgData(ctx, reqBytes)
 
 	case veap.QueryMarker:
 		if request.Method != http.MethodGet {
@@ -159,20 +259,47 @@ func (h *Handler) ServeHTTP(respWriter http.ResponseWriter, request *http.Reques
 				"Invalid path for Query service: %s", fullPath)
 			return
 		}
-		respBytes, err = h.serveQuery(request.URL.Query())
+		// on success the response is already sent
+		err = h.serveQuery(ctx, respWriter, request)
+		if err == nil {
+			return
+		}
+
+	case veap.WebSocketMarker:
+		if request.Method != http.MethodGet {
+			h.errorResponse(respWriter, request, veap.StatusMethodNotAllowed,
+				"Invalid method for WebSocket service: %s", request.Method)
+			return
+		}
+		if fullPath != "/"+veap.WebSocketMarker {
+			h.errorResponse(respWriter, request, veap.StatusNotFound,
+				"Invalid path for WebSocket service: %s", fullPath)
+			return
+		}
+		// on success the connection is taken over until it is closed
+		err = h.serveWebSocket(ctx, respWriter, request)
+		if err == nil {
+			return
+		}
 
 	default:
 		switch request.Method {
 		case http.MethodGet:
-			respBytes, err = h.serveProperties(fullPath)
+			respBytes, err = h.serveProperties(ctx, fullPath)
+			valid.etag = entityTag(respBytes)
 		case http.MethodPut:
-			var created bool
-			created, err = h.serveSetProperties(fullPath, reqBytes)
-			if created {
-				respCode = http.StatusCreated
+			err = checkIfMatch(request, func() (validators, error) {
+				return h.currentPropertiesValidators(ctx, fullPath)
+			})
+			if err == nil {
+				var created bool
+				created, err = h.serveSetProperties(ctx, fullPath, reqBytes)
+				if created {
+					respCode = http.StatusCreated
+				}
 			}
 		case http.MethodDelete:
-			err = h.serveDelete(fullPath)
+			err = h.serveDelete(ctx, fullPath)
 		default:
 			h.errorResponse(respWriter, request, veap.StatusMethodNotAllowed,
 				"Method %s not allowed for %s", request.Method, fullPath)
@@ -191,6 +318,25 @@ func (h *Handler) ServeHTTP(respWriter http.ResponseWriter, request *http.Reques
 		return
 	}
 
+	// select content coding
+	coding := h.responseCoding(request, len(respBytes))
+	if h.compressionEnabled() {
+		respWriter.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	// conditional GET request
+	if valid.etag != "" {
+		respWriter.Header().Set("ETag", codingETag(valid.etag, coding))
+	}
+	if !valid.lastModified.IsZero() {
+		respWriter.Header().Set("Last-Modified", valid.lastModified.UTC().Format(http.TimeFormat))
+	}
+	if request.Method == http.MethodGet && notModified(request, valid) {
+		handlerLog.Tracef("Response code: %d", http.StatusNotModified)
+		respWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	// update statistics
 	atomic.AddUint64(&h.Stats.ResponseBytes, uint64(len(respBytes)))
 
@@ -203,6 +349,12 @@ func (h *Handler) ServeHTTP(respWriter http.ResponseWriter, request *http.Reques
 	}
 	respWriter.Header().Set("Content-Type", contentType)
 	respWriter.Header().Set("X-Content-Type-Options", "nosniff")
+	if coding != "" {
+		if err = h.sendCompressed(respWriter, respCode, coding, respBytes); err != nil {
+			handlerLog.Warningf("Sending response to %s failed: %v", request.RemoteAddr, err)
+		}
+		return
+	}
 	respWriter.Header().Set("Content-Length", strconv.Itoa(len(respBytes)))
 	respWriter.WriteHeader(respCode)
 	if _, err = respWriter.Write(respBytes); err != nil {
@@ -244,27 +396,31 @@ func (h *Handler) errorResponse(respWriter http.ResponseWriter, request *http.Re
 	atomic.AddUint64(&h.Stats.ResponseBytes, uint64(len(b)))
 }
 
-func (h *Handler) servePV(path string, format string) ([]byte, string, error) {
+func (h *Handler) servePV(ctx context.Context, path string, format string, mode encoding.StateMode) ([]byte, string, validators, error) {
 	// invoke service
-	pv, svcErr := h.Service.ReadPV(path)
+	pv, svcErr := veap.AsContextService(h.Service).ReadPVContext(ctx, path)
 	if svcErr != nil {
-		return nil, "", svcErr
+		return nil, "", validators{}, svcErr
+	}
+	valid, err := pvValidators(pv)
+	if err != nil {
+		return nil, "", validators{}, err
 	}
 
 	// format PV
 	if format == formatSimple {
-		return []byte(fmt.Sprint(pv.Value)), contentTypeText, nil
+		return []byte(fmt.Sprint(pv.Value)), contentTypeText, valid, nil
 	}
 
 	// default format: convert PV to JSON
-	b, err := json.Marshal(encoding.PVToWire(pv))
+	b, err := encoding.MarshalPV(pv, mode)
 	if err != nil {
-		return nil, "", fmt.Errorf("Conversion of PV to JSON failed: %v", err)
+		return nil, "", validators{}, fmt.Errorf("Conversion of PV to JSON failed: %v", err)
 	}
-	return b, contentTypeJSON, nil
+	return b, contentTypeJSON, valid, nil
 }
 
-func (h *Handler) serveSetPV(path string, b []byte, fuzzy bool) error {
+func (h *Handler) serveSetPV(ctx context.Context, path string, b []byte, fuzzy bool) error {
 	// convert JSON to PV
 	pv, err := encoding.BytesToPV(b, fuzzy)
 	if err != nil {
@@ -272,10 +428,10 @@ func (h *Handler) serveSetPV(path string, b []byte, fuzzy bool) error {
 	}
 
 	// invoke service
-	return h.Service.WritePV(path, pv)
+	return veap.AsContextService(h.Service).WritePVContext(ctx, path, pv)
 }
 
-func (h *Handler) serveHistory(path string, params url.Values) ([]byte, error) {
+func (h *Handler) serveHistory(ctx context.Context, path string, params url.Values) ([]byte, error) {
 	// parse params
 	begin, err := parseTimeParam(params, "begin")
 	if err != nil {
@@ -318,21 +474,36 @@ func (h *Handler) serveHistory(path string, params url.Values) ([]byte, error) {
 		limit = &maxLimit
 	}
 
+	aggr, err := parseAggregation(params)
+	if err != nil {
+		return nil, err
+	}
+
 	// invoke service
-	hist, err := h.Service.ReadHistory(path, *begin, *end, *limit)
+	var hist []veap.PV
+	if aggr != nil {
+		hist, err = veap.AsAggregatingHistoryReader(h.Service).ReadAggregatedHistory(ctx, path, *begin, *end, *aggr, *limit)
+	} else {
+		hist, err = veap.AsContextService(h.Service).ReadHistoryContext(ctx, path, *begin, *end, *limit)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// convert history to JSON
-	b, err := json.Marshal(encoding.HistToWire(hist))
+	var b []byte
+	if aggr != nil {
+		b, err = encoding.MarshalAggregatedHist(hist, *aggr, stateMode(params))
+	} else {
+		b, err = encoding.MarshalHist(hist, stateMode(params))
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Conversion of history to JSON failed: %v", err)
 	}
 	return b, nil
 }
 
-func (h *Handler) serveSetHistory(path string, reqBytes []byte) error {
+func (h *Handler) serveSetHistory(ctx context.Context, path string, reqBytes []byte) error {
 	// convert JSON to history
 	var w encoding.WireHist
 	err := json.Unmarshal(reqBytes, &w)
@@ -345,12 +516,12 @@ func (h *Handler) serveSetHistory(path string, reqBytes []byte) error {
 	if err != nil {
 		return err
 	}
-	return h.Service.WriteHistory(path, hist)
+	return veap.AsContextService(h.Service).WriteHistoryContext(ctx, path, hist)
 }
 
-func (h *Handler) serveProperties(objPath string) ([]byte, error) {
+func (h *Handler) serveProperties(ctx context.Context, objPath string) ([]byte, error) {
 	// invoke service
-	attr, links, svrErr := h.Service.ReadProperties(objPath)
+	attr, links, svrErr := veap.AsContextService(h.Service).ReadPropertiesContext(ctx, objPath)
 	if svrErr != nil {
 		return nil, svrErr
 	}
@@ -387,26 +558,90 @@ func (h *Handler) serveProperties(objPath string) ([]byte, error) {
 	return b, nil
 }
 
-func (h *Handler) serveSetProperties(path string, reqBytes []byte) (bool, error) {
+// The optional ~links property of the request body changes the
+// non-hierarchical links of the object (e.g. {"~links": {"replace": {"room":
+// ["/rooms/kitchen"]}, "remove": [{"rel": "function", "href": "/functions/light"}],
+// "add": [...]}}), q.v. veap.LinkUpdate. Absolute link targets must include
+// the URL prefix.
+func (h *Handler) serveSetProperties(ctx context.Context, path string, reqBytes []byte) (bool, error) {
 	// convert JSON to attributes
-	var attr map[string]interface{}
-	err := json.Unmarshal(reqBytes, &attr)
+	var wireAttr map[string]interface{}
+	err := json.Unmarshal(reqBytes, &wireAttr)
 	if err != nil {
 		return false, veap.NewErrorf(veap.StatusBadRequest, "Conversion of JSON to attributes failed: %v", err)
 	}
+	attr := encoding.WireToAttributes(wireAttr)
+
+	// remove URL prefix from absolute link targets
+	if update, ok := attr[veap.LinksMarker].(veap.LinkUpdate); ok {
+		update, err = h.trimLinkUpdate(update)
+		if err != nil {
+			return false, err
+		}
+		attr[veap.LinksMarker] = update
+	}
 
 	// invoke service
-	return h.Service.WriteProperties(path, attr)
+	return veap.AsContextService(h.Service).WritePropertiesContext(ctx, path, attr)
 }
 
-func (h *Handler) serveDelete(path string) error {
+// trimLinkUpdate removes the URL prefix from the absolute link targets (q.v.
+// serveProperties).
+func (h *Handler) trimLinkUpdate(update veap.LinkUpdate) (veap.LinkUpdate, error) {
+	trim := func(target string) (string, error) {
+		if !path.IsAbs(target) {
+			return target, nil
+		}
+		if !strings.HasPrefix(target, h.URLPrefix) {
+			return "", veap.NewErrorf(veap.StatusNotFound, "Path prefix of link target does not match: %s", target)
+		}
+		return strings.TrimPrefix(target, h.URLPrefix), nil
+	}
+	trimLinks := func(links []veap.Link) ([]veap.Link, error) {
+		if links == nil {
+			return nil, nil
+		}
+		r := make([]veap.Link, len(links))
+		for i, l := range links {
+			t, err := trim(l.Target)
+			if err != nil {
+				return nil, err
+			}
+			r[i] = veap.Link{Role: l.Role, Target: t, Title: l.Title}
+		}
+		return r, nil
+	}
+	var r veap.LinkUpdate
+	var err error
+	if update.Replace != nil {
+		r.Replace = make(map[string][]string, len(update.Replace))
+		for role, targets := range update.Replace {
+			ts := make([]string, len(targets))
+			for i, t := range targets {
+				if ts[i], err = trim(t); err != nil {
+					return veap.LinkUpdate{}, err
+				}
+			}
+			r.Replace[role] = ts
+		}
+	}
+	if r.Remove, err = trimLinks(update.Remove); err != nil {
+		return veap.LinkUpdate{}, err
+	}
+	if r.Add, err = trimLinks(update.Add); err != nil {
+		return veap.LinkUpdate{}, err
+	}
+	return r, nil
+}
+
+func (h *Handler) serveDelete(ctx context.Context, path string) error {
 	// invoke service
-	return h.Service.Delete(path)
+	return veap.AsContextService(h.Service).DeleteContext(ctx, path)
 }
 
-func (h *Handler) serveExgData(reqBytes []byte) (respBytes []byte, serviceErr error) {
+func (h *Handler) serveExgData(ctx context.Context, reqBytes []byte) (respBytes []byte, serviceErr error) {
 	// service provided?
-	ms, ok := h.Service.(veap.MetaService)
+	ms, ok := h.contextMetaService()
 	if !ok {
 		serviceErr = veap.NewErrorf(veap.StatusBadRequest, "ExgData service not implemented")
 		return
@@ -419,16 +654,41 @@ func (h *Handler) serveExgData(reqBytes []byte) (respBytes []byte, serviceErr er
 		serviceErr = veap.NewErrorf(veap.StatusBadRequest, "Invalid JSON for ExgData parameters: %v", err)
 		return
 	}
-	writePVs, readPaths := encoding.WireToExgDataParams(&wireParams)
+	params := encoding.WireToExtendedExgDataParams(&wireParams)
+
+	// check history limits
+	maxLimit := h.historySizeLimit()
+	for i := range params.ReadHistory {
+		p := &params.ReadHistory[i]
+		if p.Limit > maxLimit {
+			serviceErr = veap.NewErrorf(veap.StatusBadRequest, "History size limit exceeded: %d", p.Limit)
+			return
+		}
+		if p.Limit <= 0 {
+			p.Limit = maxLimit
+		}
+	}
+
+	// remove URL prefix from absolute link targets
+	for i := range params.WriteProperties {
+		attr := params.WriteProperties[i].Attributes
+		if update, ok := attr[veap.LinksMarker].(veap.LinkUpdate); ok {
+			update, serviceErr = h.trimLinkUpdate(update)
+			if serviceErr != nil {
+				return
+			}
+			attr[veap.LinksMarker] = update
+		}
+	}
 
 	// call service
-	writeErrors, readResults, serviceErr := ms.ExgData(writePVs, readPaths)
+	results, serviceErr := veap.AsExtendedExgDataService(ms, veap.AsContextService(h.Service)).ExtendedExgData(ctx, params)
 	if serviceErr != nil {
 		return
 	}
 
 	// encode results
-	wireResult := encoding.ExgDataResultsToWire(writeErrors, readResults)
+	wireResult := encoding.ExtendedExgDataResultsToWire(results)
 	respBytes, err = json.Marshal(wireResult)
 	if err != nil {
 		serviceErr = veap.NewErrorf(veap.StatusInternalServerError, "Conversion of ExgData results to JSON failed: %v", err)
@@ -438,75 +698,220 @@ func (h *Handler) serveExgData(reqBytes []byte) (respBytes []byte, serviceErr er
 }
 
 // The ~path URL parameter specifies a path mask (e.g. ~path=/device/*/*). This
-// parameter must be specified at least once.
-func (h *Handler) serveQuery(parameters url.Values) (respBytes []byte, serviceErr error) {
+// parameter must be specified at least once. A path mask segment ** matches
+// zero or more levels. The optional ~filter URL parameters specify filter
+// expressions (e.g. ~filter=title*=Kitchen), q.v. veap.ParseFilter. The
+// optional ~maxdepth URL parameter limits the depth of the search. The
+// optional ~offset and ~limit URL parameters paginate the results. The results
+// are streamed to the HTTP client. An error is only returned, if no response
+// is sent yet.
+func (h *Handler) serveQuery(ctx context.Context, respWriter http.ResponseWriter, request *http.Request) error {
 	// service provided?
-	ms, ok := h.Service.(veap.MetaService)
+	ms, ok := h.contextMetaService()
 	if !ok {
-		serviceErr = veap.NewErrorf(veap.StatusBadRequest, "Query service not implemented")
-		return
+		return veap.NewErrorf(veap.StatusBadRequest, "Query service not implemented")
+	}
+
+	// parse parameters
+	params, err := h.parseQueryParams(request.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	// call service and stream results
+	var coding string
+	if h.compressionEnabled() {
+		coding, _ = acceptedCoding(request)
 	}
+	sw := &queryStreamWriter{respWriter: respWriter, coding: coding}
+	svcErr := veap.AsStreamingQueryService(ms).QueryFunc(ctx, params, func(item veap.QueryResult) veap.Error {
+		b, err := json.Marshal(h.queryResultToWire(item))
+		if err != nil {
+			return veap.NewErrorf(veap.StatusInternalServerError, "Conversion of Query result to JSON failed: %v", err)
+		}
+		if handlerLog.TraceEnabled() {
+			handlerLog.Tracef("Response item: %s", string(b))
+		}
+		if err := sw.writeItem(b); err != nil {
+			return veap.NewErrorf(veap.StatusInternalServerError, "Sending of Query result failed: %v", err)
+		}
+		return nil
+	})
+	if svcErr != nil && !sw.started {
+		return svcErr
+	}
+	var streamErr error = svcErr
+	if svcErr == nil {
+		streamErr = sw.finish()
+	}
+	atomic.AddUint64(&h.Stats.ResponseBytes, sw.written)
+	if sw.compressed != nil {
+		atomic.AddUint64(&h.Stats.CompressedResponseBytes, sw.compressed.n)
+		atomic.AddUint64(&h.Stats.UncompressedResponseBytes, sw.written)
+	}
+	if streamErr != nil {
+		// response is already started, abort it
+		handlerLog.Warningf("Streaming of Query results to %s failed: %v", request.RemoteAddr, streamErr)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
 
+func (h *Handler) parseQueryParams(parameters url.Values) (veap.QueryParams, error) {
 	// extract paths and remove URL prefix
 	paths := make([]string, 0)
 	for _, fullPath := range parameters[veap.PathMarker] {
 		if !strings.HasPrefix(fullPath, h.URLPrefix) {
-			return nil, veap.NewErrorf(veap.StatusNotFound, "Path prefix does not match: %s", fullPath)
+			return veap.QueryParams{}, veap.NewErrorf(veap.StatusNotFound, "Path prefix does not match: %s", fullPath)
 		}
 		paths = append(paths, strings.TrimPrefix(fullPath, h.URLPrefix))
 	}
+	params := veap.QueryParams{PathPatterns: paths}
 
-	// call service
-	queryResults, serviceErr := ms.Query(paths)
-	if serviceErr != nil {
-		return
+	// parse filters
+	for _, expr := range parameters[veap.FilterMarker] {
+		filter, err := veap.ParseFilter(expr)
+		if err != nil {
+			return veap.QueryParams{}, err
+		}
+		params.Filters = append(params.Filters, filter)
+	}
+
+	// parse max. depth and pagination
+	ints := []struct {
+		marker string
+		value  *int
+	}{
+		{veap.MaxDepthMarker, &params.MaxDepth},
+		{veap.OffsetMarker, &params.Offset},
+		{veap.LimitMarker, &params.Limit},
+	}
+	for _, i := range ints {
+		v, err := parseIntParam(parameters, i.marker)
+		if err != nil {
+			return veap.QueryParams{}, err
+		}
+		if v != nil {
+			if *v < 0 {
+				return veap.QueryParams{}, veap.NewErrorf(veap.StatusBadRequest, "Invalid request parameter %s: %d", i.marker, *v)
+			}
+			*i.value = int(*v)
+		}
 	}
+	return params, nil
+}
 
-	// encode results
-	wireResult := make([]map[string]interface{}, len(queryResults))
-	for idx := range queryResults {
-
-		// copy attributes
-		wireAttr := make(map[string]interface{})
-		for k, v := range queryResults[idx].Attributes {
-			wireAttr[k] = v
-		}
-
-		// add ~links property
-		if len(queryResults[idx].Links) > 0 {
-			wireLinks := make([]encoding.WireLink, len(queryResults[idx].Links))
-			for i, l := range queryResults[idx].Links {
-				// modify absolute paths
-				p := l.Target
-				if path.IsAbs(p) {
-					p = h.URLPrefix + p
-				}
-				wireLinks[i] = encoding.WireLink{
-					Role:   l.Role,
-					Target: p,
-					Title:  l.Title,
-				}
+func (h *Handler) queryResultToWire(result veap.QueryResult) map[string]interface{} {
+	// copy attributes
+	wireAttr := make(map[string]interface{})
+	for k, v := range result.Attributes {
+		wireAttr[k] = v
+	}
+
+	// add ~links property
+	if len(result.Links) > 0 {
+		wireLinks := make([]encoding.WireLink, len(result.Links))
+		for i, l := range result.Links {
+			// modify absolute paths
+			p := l.Target
+			if path.IsAbs(p) {
+				p = h.URLPrefix + p
+			}
+			wireLinks[i] = encoding.WireLink{
+				Role:   l.Role,
+				Target: p,
+				Title:  l.Title,
 			}
-			wireAttr[veap.LinksMarker] = wireLinks
 		}
+		wireAttr[veap.LinksMarker] = wireLinks
+	}
+
+	// add ~path property
+	p := result.Path
+	// modify absolute paths
+	if path.IsAbs(p) {
+		p = h.URLPrefix + p
+	}
+	wireAttr[veap.PathMarker] = p
+	return wireAttr
+}
+
+// size of the write buffer for streamed responses
+const streamBufferSize = 32 * 1024
+
+// queryStreamWriter writes query results as JSON array. The HTTP response is
+// started with the first item. If a content coding is set, the response is
+// compressed.
+type queryStreamWriter struct {
+	respWriter http.ResponseWriter
+	coding     string
+	buf        *bufio.Writer
+	comp       io.WriteCloser
+	compressed *countingWriter
+	started    bool
+	written    uint64
+}
+
+func (w *queryStreamWriter) start() error {
+	w.respWriter.Header().Set("Content-Type", contentTypeJSON)
+	w.respWriter.Header().Set("X-Content-Type-Options", "nosniff")
+	if w.coding != "" {
+		w.respWriter.Header().Add("Vary", "Accept-Encoding")
+		w.respWriter.Header().Set("Content-Encoding", w.coding)
+		w.respWriter.WriteHeader(http.StatusOK)
+		w.compressed = &countingWriter{w: w.respWriter}
+		w.comp = newCompressor(w.coding, w.compressed)
+		w.buf = bufio.NewWriterSize(w.comp, streamBufferSize)
+	} else {
+		w.respWriter.WriteHeader(http.StatusOK)
+		w.buf = bufio.NewWriterSize(w.respWriter, streamBufferSize)
+	}
+	w.started = true
+	return w.write([]byte("["))
+}
 
-		// add ~path property
-		p := queryResults[idx].Path
-		// modify absolute paths
-		if path.IsAbs(p) {
-			p = h.URLPrefix + p
+func (w *queryStreamWriter) writeItem(b []byte) error {
+	if !w.started {
+		if err := w.start(); err != nil {
+			return err
 		}
-		wireAttr[veap.PathMarker] = p
+	} else {
+		if err := w.write([]byte(",")); err != nil {
+			return err
+		}
+	}
+	return w.write(b)
+}
 
-		// add to result
-		wireResult[idx] = wireAttr
+func (w *queryStreamWriter) finish() error {
+	if !w.started {
+		if err := w.start(); err != nil {
+			return err
+		}
 	}
-	respBytes, err := json.Marshal(wireResult)
-	if err != nil {
-		serviceErr = veap.NewErrorf(veap.StatusInternalServerError, "Conversion of Query results to JSON failed: %v", err)
-		return
+	if err := w.write([]byte("]")); err != nil {
+		return err
 	}
-	return
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.comp != nil {
+		return w.comp.Close()
+	}
+	return nil
+}
+
+func (w *queryStreamWriter) write(b []byte) error {
+	n, err := w.buf.Write(b)
+	w.written += uint64(n)
+	return err
+}
+
+func (h *Handler) contextMetaService() (veap.ContextMetaService, bool) {
+	if ms, ok := h.Service.(veap.MetaService); ok {
+		return veap.AsContextMetaService(ms), true
+	}
+	return nil, false
 }
 
 func (h *Handler) requestSizeLimit() int64 {
@@ -523,6 +928,15 @@ func (h *Handler) historySizeLimit() int64 {
 	return h.HistorySizeLimit
 }
 
+// VEAP protocol extension: states are encoded as text with query parameter
+// 'states=text'.
+func stateMode(params url.Values) encoding.StateMode {
+	if params.Get(statesQueryParam) == statesText {
+		return encoding.TextStates
+	}
+	return encoding.NumericStates
+}
+
 func parseIntParam(params url.Values, name string) (*int64, error) {
 	values, ok := params[name]
 	if !ok {
@@ -539,6 +953,33 @@ func parseIntParam(params url.Values, name string) (*int64, error) {
 	return &i, nil
 }
 
+// parseAggregation parses the parameters aggr and interval (in milliseconds).
+// If no aggregation is requested, nil is returned.
+func parseAggregation(params url.Values) (*veap.Aggregation, error) {
+	values, ok := params[aggrParam]
+	if !ok {
+		return nil, nil
+	}
+	if len(values) != 1 {
+		return nil, veap.NewErrorf(veap.StatusBadRequest, "Invalid request parameter: %s", aggrParam)
+	}
+	interval, err := parseIntParam(params, intervalParam)
+	if err != nil {
+		return nil, err
+	}
+	if interval == nil {
+		return nil, veap.NewErrorf(veap.StatusBadRequest, "Missing request parameter: %s", intervalParam)
+	}
+	aggr := &veap.Aggregation{
+		Func:     veap.AggregateFunc(values[0]),
+		Interval: time.Duration(*interval) * time.Millisecond,
+	}
+	if err := aggr.Validate(); err != nil {
+		return nil, err
+	}
+	return aggr, nil
+}
+
 func parseTimeParam(params url.Values, name string) (*time.Time, error) {
 	i, err := parseIntParam(params, name)
 	if err != nil {
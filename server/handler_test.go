@@ -2,11 +2,15 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -406,6 +410,15 @@ func TestHandlerSetProperties(t *testing.T) {
 			veap.AttrValues{"active": false},
 			veap.StatusOK,
 		},
+		{
+			`{"~links":{"replace":{"room":["/r1"]},"add":[{"rel":"function","href":"f1"}]}}`,
+			false,
+			veap.AttrValues{veap.LinksMarker: veap.LinkUpdate{
+				Replace: map[string][]string{"room": {"/r1"}},
+				Add:     []veap.Link{{Role: "function", Target: "f1"}},
+			}},
+			veap.StatusOK,
+		},
 	}
 
 	var attrOut veap.AttrValues
@@ -682,3 +695,608 @@ func TestExgData(t *testing.T) {
 		t.Fatalf("Unexpected response: %s", resp)
 	}
 }
+
+type contextTestService struct {
+	veap.FuncService
+	ctx context.Context
+}
+
+func (s *contextTestService) ReadPVContext(ctx context.Context, path string) (veap.PV, veap.Error) {
+	s.ctx = ctx
+	return veap.PV{}, nil
+}
+
+func (s *contextTestService) WritePVContext(ctx context.Context, path string, pv veap.PV) veap.Error {
+	return nil
+}
+
+func (s *contextTestService) ReadHistoryContext(ctx context.Context, path string, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	return nil, nil
+}
+
+func (s *contextTestService) WriteHistoryContext(ctx context.Context, path string, timeSeries []veap.PV) veap.Error {
+	return nil
+}
+
+func (s *contextTestService) ReadPropertiesContext(ctx context.Context, path string) (veap.AttrValues, []veap.Link, veap.Error) {
+	return nil, nil, nil
+}
+
+func (s *contextTestService) WritePropertiesContext(ctx context.Context, path string, attributes veap.AttrValues) (bool, veap.Error) {
+	return false, nil
+}
+
+func (s *contextTestService) DeleteContext(ctx context.Context, path string) veap.Error {
+	return nil
+}
+
+func TestHandlerContext(t *testing.T) {
+	svc := &contextTestService{}
+	h := &Handler{Service: svc}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/~pv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != veap.StatusOK {
+		t.Fatal(resp.StatusCode)
+	}
+	if svc.ctx == nil {
+		t.Fatal("context not passed")
+	}
+	// request context is canceled after the request is finished
+	select {
+	case <-svc.ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("context not canceled")
+	}
+}
+
+func TestHandlerTextStates(t *testing.T) {
+	pv := veap.PV{Time: time.Unix(1, 0), Value: 1.0, State: veap.StateNotConnected}
+	var pvOut veap.PV
+	svc := veap.FuncService{
+		ReadPVFunc: func(path string) (veap.PV, veap.Error) {
+			return pv, nil
+		},
+		WritePVFunc: func(path string, pv veap.PV) veap.Error {
+			pvOut = pv
+			return nil
+		},
+		ReadHistoryFunc: func(path string, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+			return []veap.PV{pv}, nil
+		},
+	}
+	h := &Handler{Service: &svc}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	cases := []struct {
+		url  string
+		text string
+	}{
+		{"/~pv", `{"ts":1000,"v":1,"s":201}`},
+		{"/~pv?states=text", `{"ts":1000,"v":1,"s":"NOT_CONNECTED"}`},
+		{"/~hist?begin=0&end=2000&states=text", `{"ts":[1000],"v":[1],"s":["NOT_CONNECTED"]}`},
+	}
+	for _, c := range cases {
+		resp, err := http.Get(srv.URL + c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != c.text {
+			t.Error(string(b))
+		}
+	}
+
+	// textual state in request
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/~pv", bytes.NewBufferString(`{"ts":1,"v":2,"s":"SUBSTITUTED"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != veap.StatusOK || pvOut.State != veap.StateSubstituted {
+		t.Error(resp.StatusCode, pvOut)
+	}
+}
+
+func TestHandlerAccessControl(t *testing.T) {
+	svc := &veap.AccessControlService{
+		Service: &veap.FuncService{
+			ReadPVFunc: func(path string) (veap.PV, veap.Error) {
+				return veap.PV{Time: time.Unix(1, 0), Value: 1.0}, nil
+			},
+			WritePVFunc: func(path string, pv veap.PV) veap.Error {
+				return nil
+			},
+		},
+		Rules: []veap.AccessRule{
+			{Principal: veap.AnyPrincipal, PathPattern: "/**", Operations: veap.OpReadPV},
+			{Principal: "admin", PathPattern: "/**", Operations: veap.OpAll},
+		},
+	}
+	h := &Handler{
+		Service: svc,
+		Authenticate: func(user, password string) bool {
+			return password == "secret"
+		},
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	cases := []struct {
+		method, user, password string
+		code                   int
+	}{
+		{http.MethodGet, "", "", veap.StatusOK},
+		{http.MethodPut, "", "", veap.StatusForbidden},
+		{http.MethodPut, "guest", "secret", veap.StatusForbidden},
+		{http.MethodPut, "admin", "secret", veap.StatusOK},
+		{http.MethodPut, "admin", "wrong", veap.StatusUnauthorized},
+		{http.MethodGet, "admin", "wrong", veap.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, srv.URL+"/a/~pv", bytes.NewBufferString(`{"v":2}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Errorf("%s as '%s': expected %d, got %d", c.method, c.user, c.code, resp.StatusCode)
+		}
+	}
+}
+
+func TestHandlerAggregatedHistory(t *testing.T) {
+	svc := veap.FuncService{
+		ReadHistoryFunc: func(path string, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+			return []veap.PV{
+				{Time: time.Unix(1, 0), Value: 1.0},
+				{Time: time.Unix(2, 0), Value: 2.0},
+				{Time: time.Unix(12, 0), Value: 3.0},
+			}, nil
+		},
+	}
+	h := &Handler{Service: &svc}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	cases := []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"aggr=count&interval=10000", veap.StatusOK, `{"ts":[0,10000],"v":[2,1],"s":[0,0],"aggr":"count","interval":10000}`},
+		{"aggr=count&interval=10000&limit=1", veap.StatusOK, `{"ts":[0],"v":[2],"s":[0],"aggr":"count","interval":10000}`},
+		{"aggr=count", veap.StatusBadRequest, ""},
+		{"aggr=median&interval=10000", veap.StatusBadRequest, ""},
+		{"aggr=avg&interval=0", veap.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		resp, err := http.Get(srv.URL + "/a/~hist?begin=0&end=20000&" + c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.code {
+			t.Errorf("%s: expected %d, got %d", c.query, c.code, resp.StatusCode)
+		}
+		if c.body != "" && string(b) != c.body {
+			t.Errorf("%s: unexpected response: %s", c.query, string(b))
+		}
+	}
+}
+
+func TestHandlerSetLinks(t *testing.T) {
+	var attrOut veap.AttrValues
+	svc := veap.FuncService{
+		WritePropertiesFunc: func(path string, attributes veap.AttrValues) (created bool, err veap.Error) {
+			_, _, err = veap.ExtractLinkUpdate(attributes)
+			attrOut = attributes
+			return false, err
+		},
+	}
+	h := &Handler{Service: &svc, URLPrefix: "/veap"}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	put := func(body string) int {
+		attrOut = nil
+		req, err := http.NewRequest(http.MethodPut, srv.URL+"/veap/d", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// URL prefix is removed from absolute targets
+	if code := put(`{"~links":{"replace":{"room":["/veap/r1"]},"remove":[{"rel":"room","href":"r2"}]}}`); code != veap.StatusOK {
+		t.Fatal(code)
+	}
+	if !reflect.DeepEqual(attrOut, veap.AttrValues{veap.LinksMarker: veap.LinkUpdate{
+		Replace: map[string][]string{"room": {"/r1"}},
+		Remove:  []veap.Link{{Role: "room", Target: "r2"}},
+	}}) {
+		t.Error(attrOut)
+	}
+
+	// invalid requests
+	if code := put(`{"~links":{"add":[{"rel":"room","href":"/r1"}]}}`); code != veap.StatusNotFound || attrOut != nil {
+		t.Error(code)
+	}
+	if code := put(`{"~links":[{"rel":"room","href":"/veap/r1"}]}`); code != veap.StatusBadRequest {
+		t.Error(code)
+	}
+	if code := put(`{"~links":{"add":[{"href":"/veap/r1"}]}}`); code != veap.StatusBadRequest {
+		t.Error(code)
+	}
+	// link updates within ~exgdata
+	h.Service = &veap.BasicMetaService{Service: &svc}
+	exgData := func(href string) int {
+		attrOut = nil
+		body := `{"writeProperties":[{"path":"/d","attributes":{"~links":{"add":[{"rel":"room","href":"` + href + `"}]}}}]}`
+		req, err := http.NewRequest(http.MethodPut, srv.URL+"/veap/~exgdata", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := exgData("/veap/r1"); code != veap.StatusOK {
+		t.Fatal(code)
+	}
+	if !reflect.DeepEqual(attrOut, veap.AttrValues{veap.LinksMarker: veap.LinkUpdate{
+		Add: []veap.Link{{Role: "room", Target: "/r1"}},
+	}}) {
+		t.Error(attrOut)
+	}
+	if code := exgData("/r1"); code != veap.StatusNotFound || attrOut != nil {
+		t.Error(code)
+	}
+}
+
+func TestHandlerConditional(t *testing.T) {
+	var svc veap.MemoryService
+	if _, err := svc.WriteProperties("/a", veap.AttrValues{"title": "A"}); err != nil {
+		t.Fatal(err)
+	}
+	svc.WritePV("/a", veap.PV{Time: time.Unix(10, 0), Value: 1.0})
+	srv := httptest.NewServer(&Handler{Service: &svc})
+	defer srv.Close()
+
+	do := func(method, url, body string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+url, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// PV
+	resp := do(http.MethodGet, "/a/~pv", "", nil)
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != veap.StatusOK || etag == "" ||
+		resp.Header.Get("Last-Modified") != "Thu, 01 Jan 1970 00:00:10 GMT" {
+		t.Fatal(resp.StatusCode, resp.Header)
+	}
+	if resp := do(http.MethodGet, "/a/~pv", "", map[string]string{"If-None-Match": etag}); resp.StatusCode != veap.StatusNotModified {
+		t.Error(resp.StatusCode)
+	}
+	if resp := do(http.MethodGet, "/a/~pv", "", map[string]string{"If-Modified-Since": "Thu, 01 Jan 1970 00:00:10 GMT"}); resp.StatusCode != veap.StatusNotModified {
+		t.Error(resp.StatusCode)
+	}
+	if resp := do(http.MethodGet, "/a/~pv", "", map[string]string{"If-Modified-Since": "Thu, 01 Jan 1970 00:00:09 GMT"}); resp.StatusCode != veap.StatusOK {
+		t.Error(resp.StatusCode)
+	}
+	if resp := do(http.MethodPut, "/a/~pv", `{"ts":20000,"v":2}`, map[string]string{"If-Match": etag}); resp.StatusCode != veap.StatusOK {
+		t.Error(resp.StatusCode)
+	}
+	if resp := do(http.MethodPut, "/a/~pv", `{"ts":30000,"v":3}`, map[string]string{"If-Match": etag}); resp.StatusCode != veap.StatusPreconditionFailed {
+		t.Error(resp.StatusCode)
+	}
+	if resp := do(http.MethodGet, "/a/~pv", "", map[string]string{"If-None-Match": etag}); resp.StatusCode != veap.StatusOK {
+		t.Error(resp.StatusCode)
+	}
+
+	// properties
+	resp = do(http.MethodGet, "/a", "", nil)
+	etag = resp.Header.Get("ETag")
+	if resp.StatusCode != veap.StatusOK || etag == "" {
+		t.Fatal(resp.StatusCode, resp.Header)
+	}
+	if resp := do(http.MethodGet, "/a", "", map[string]string{"If-None-Match": `"x", W/` + etag}); resp.StatusCode != veap.StatusNotModified {
+		t.Error(resp.StatusCode)
+	}
+	if resp := do(http.MethodPut, "/a", `{"title":"B"}`, map[string]string{"If-Match": `W/` + etag}); resp.StatusCode != veap.StatusPreconditionFailed {
+		t.Error(resp.StatusCode)
+	}
+	if resp := do(http.MethodPut, "/a", `{"title":"B"}`, map[string]string{"If-Match": etag}); resp.StatusCode != veap.StatusOK {
+		t.Error(resp.StatusCode)
+	}
+	if resp := do(http.MethodGet, "/a", "", map[string]string{"If-None-Match": etag}); resp.StatusCode != veap.StatusOK {
+		t.Error(resp.StatusCode)
+	}
+	if resp := do(http.MethodPut, "/b", `{}`, map[string]string{"If-Match": "*"}); resp.StatusCode != veap.StatusPreconditionFailed {
+		t.Error(resp.StatusCode)
+	}
+}
+
+func TestHandlerCompression(t *testing.T) {
+	var histIn, histOut []veap.PV
+	for i := 0; i < 200; i++ {
+		histIn = append(histIn, veap.PV{Time: time.Unix(int64(i), 0), Value: float64(i)})
+	}
+	svc := veap.FuncService{
+		ReadHistoryFunc: func(path string, begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+			return histIn, nil
+		},
+		WriteHistoryFunc: func(path string, timeSeries []veap.PV) veap.Error {
+			histOut = timeSeries
+			return nil
+		},
+		ReadPVFunc: func(path string) (veap.PV, veap.Error) {
+			return veap.PV{Time: time.Unix(1, 0), Value: 1.0}, nil
+		},
+	}
+	h := &Handler{Service: &svc}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	do := func(method, url string, body []byte, header map[string]string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, srv.URL+url, bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp, b
+	}
+	histURL := "/a/~hist?begin=0&end=1000000"
+
+	// uncompressed
+	resp, plain := do(http.MethodGet, histURL, nil, map[string]string{"Accept-Encoding": "identity"})
+	if resp.StatusCode != veap.StatusOK || resp.Header.Get("Content-Encoding") != "" || len(plain) < 1024 {
+		t.Fatal(resp.StatusCode, resp.Header, len(plain))
+	}
+
+	// gzip
+	resp, b := do(http.MethodGet, histURL, nil, map[string]string{"Accept-Encoding": "deflate;q=0.5, gzip"})
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Vary") != "Accept-Encoding" || len(b) >= len(plain) {
+		t.Fatal(resp.Header, len(b))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(zr); !bytes.Equal(b, plain) {
+		t.Error(string(b))
+	}
+	if atomic.LoadUint64(&h.Stats.CompressedResponseBytes) != uint64(len(b)) ||
+		atomic.LoadUint64(&h.Stats.UncompressedResponseBytes) != uint64(len(plain)) {
+		t.Error(h.Stats)
+	}
+
+	// deflate
+	resp, b = do(http.MethodGet, histURL, nil, map[string]string{"Accept-Encoding": "gzip;q=0, deflate"})
+	if resp.Header.Get("Content-Encoding") != "deflate" {
+		t.Fatal(resp.Header)
+	}
+	dr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(dr); !bytes.Equal(b, plain) {
+		t.Error(string(b))
+	}
+
+	// refused codings
+	for _, accept := range []string{"gzip;q=0", "*;q=0, identity", "deflate;q=0, *;q=0"} {
+		resp, _ = do(http.MethodGet, histURL, nil, map[string]string{"Accept-Encoding": accept})
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Error(accept, resp.Header)
+		}
+	}
+	resp, _ = do(http.MethodGet, histURL, nil, map[string]string{"Accept-Encoding": "*"})
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Error(resp.Header)
+	}
+
+	// below threshold
+	resp, b = do(http.MethodGet, "/a/~pv", nil, map[string]string{"Accept-Encoding": "gzip"})
+	if resp.Header.Get("Content-Encoding") != "" || string(b) != `{"ts":1000,"v":1,"s":0}` {
+		t.Error(resp.Header, string(b))
+	}
+	resp, _ = do(http.MethodGet, "/a/~pv", nil, map[string]string{"Accept-Encoding": "gzip, identity;q=0"})
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Error(resp.Header)
+	}
+
+	// compressed request
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(plain)
+	zw.Close()
+	resp, _ = do(http.MethodPut, "/a/~hist", buf.Bytes(), map[string]string{"Content-Encoding": "gzip"})
+	if resp.StatusCode != veap.StatusOK || !reflect.DeepEqual(histOut, histIn) {
+		t.Error(resp.StatusCode, histOut)
+	}
+	if atomic.LoadUint64(&h.Stats.CompressedRequestBytes) != uint64(buf.Len()) ||
+		atomic.LoadUint64(&h.Stats.UncompressedRequestBytes) != uint64(len(plain)) {
+		t.Error(h.Stats)
+	}
+	resp, _ = do(http.MethodPut, "/a/~hist", plain, map[string]string{"Content-Encoding": "br"})
+	if resp.StatusCode != veap.StatusUnsupportedMediaType {
+		t.Error(resp.StatusCode)
+	}
+
+	// request size limit applies to the decompressed body
+	h.RequestSizeLimit = int64(len(plain) - 1)
+	resp, _ = do(http.MethodPut, "/a/~hist", buf.Bytes(), map[string]string{"Content-Encoding": "gzip"})
+	if resp.StatusCode != veap.StatusBadRequest {
+		t.Error(resp.StatusCode)
+	}
+	h.RequestSizeLimit = 0
+
+	// compression disabled
+	h.CompressionThreshold = -1
+	resp, b = do(http.MethodGet, histURL, nil, map[string]string{"Accept-Encoding": "gzip"})
+	if resp.Header.Get("Content-Encoding") != "" || !bytes.Equal(b, plain) {
+		t.Error(resp.Header)
+	}
+}
+
+func TestHandlerCORS(t *testing.T) {
+	svc := veap.FuncService{
+		ReadPVFunc: func(path string) (veap.PV, veap.Error) {
+			return veap.PV{Time: time.Unix(1, 0), Value: 1.0}, nil
+		},
+	}
+	h := &Handler{Service: &svc, URLPrefix: "/veap", CORS: &CORSConfig{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	do := func(method, url string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	preflight := func(url, origin, method, headers string) *http.Response {
+		return do(http.MethodOptions, url, map[string]string{
+			"Origin":                         origin,
+			"Access-Control-Request-Method":  method,
+			"Access-Control-Request-Headers": headers,
+		})
+	}
+
+	// preflight requests for all VEAP resources
+	cases := []struct {
+		url     string
+		method  string
+		methods string
+	}{
+		{"/veap/a/~pv", http.MethodPut, "GET, PUT"},
+		{"/veap/a/~hist", http.MethodGet, "GET, PUT"},
+		{"/veap/~exgdata", http.MethodPut, "PUT"},
+		{"/veap/~query", http.MethodGet, "GET"},
+		{"/veap/a", http.MethodDelete, "GET, PUT, DELETE"},
+	}
+	for _, c := range cases {
+		resp := preflight(c.url, "https://app.example.com", c.method, "content-type, if-match")
+		if resp.StatusCode != http.StatusNoContent ||
+			resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+			resp.Header.Get("Access-Control-Allow-Credentials") != "true" ||
+			resp.Header.Get("Access-Control-Allow-Methods") != c.methods ||
+			resp.Header.Get("Access-Control-Allow-Headers") != "content-type, if-match" ||
+			resp.Header.Get("Access-Control-Max-Age") != "600" {
+			t.Error(c.url, resp.StatusCode, resp.Header)
+		}
+	}
+
+	// rejected preflight requests
+	if resp := preflight("/veap/a/~pv", "https://evil.example.com", http.MethodGet, ""); resp.StatusCode != veap.StatusForbidden ||
+		resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Error(resp.StatusCode, resp.Header)
+	}
+	if resp := preflight("/veap/~query", "https://app.example.com", http.MethodPut, ""); resp.StatusCode != veap.StatusMethodNotAllowed {
+		t.Error(resp.StatusCode)
+	}
+	if resp := preflight("/veap/a", "https://app.example.com", http.MethodGet, "X-Custom"); resp.StatusCode != veap.StatusForbidden {
+		t.Error(resp.StatusCode)
+	}
+
+	// actual request
+	resp := do(http.MethodGet, "/veap/a/~pv", map[string]string{"Origin": "https://app.example.com"})
+	if resp.StatusCode != veap.StatusOK ||
+		resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		resp.Header.Get("Access-Control-Expose-Headers") != "ETag, Last-Modified" {
+		t.Error(resp.StatusCode, resp.Header)
+	}
+	resp = do(http.MethodGet, "/veap/a/~pv", map[string]string{"Origin": "https://evil.example.com"})
+	if resp.StatusCode != veap.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Error(resp.StatusCode, resp.Header)
+	}
+
+	// all origins without credentials
+	h.CORS = &CORSConfig{AllowedOrigins: []string{"*"}}
+	resp = preflight("/veap/a/~pv", "https://other.example.com", http.MethodGet, "")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "*" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Error(resp.StatusCode, resp.Header)
+	}
+
+	// all origins are not allowed with credentials
+	h.CORS = &CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+	resp = preflight("/veap/a/~pv", "https://other.example.com", http.MethodGet, "")
+	if resp.StatusCode != veap.StatusForbidden || resp.Header.Get("Access-Control-Allow-Origin") != "" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Error(resp.StatusCode, resp.Header)
+	}
+	resp = do(http.MethodGet, "/veap/a/~pv", map[string]string{"Origin": "https://other.example.com"})
+	if resp.StatusCode != veap.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Error(resp.StatusCode, resp.Header)
+	}
+
+	// CORS disabled
+	h.CORS = nil
+	if resp := preflight("/veap/a/~pv", "https://app.example.com", http.MethodGet, ""); resp.StatusCode != veap.StatusMethodNotAllowed {
+		t.Error(resp.StatusCode)
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+	"github.com/mdzio/go-veap/internal/websocket"
+)
+
+const (
+	// max. number of queued outgoing messages of a WebSocket connection
+	wsSendQueueSize = 1000
+
+	// additional size of a WebSocket message for the envelope of a request
+	wsMessageOverhead = 64 * 1024
+)
+
+// serveWebSocket takes over the connection and processes WebSocket requests
+// until the connection is closed (q.v. encoding.WireWSRequest). An error is
+// only returned, if the handshake failed. Browsers do not apply the same-origin
+// policy to WebSockets, therefore handshakes with an Origin header are only
+// accepted from the same origin or from an origin allowed by the CORS
+// configuration.
+func (h *Handler) serveWebSocket(ctx context.Context, respWriter http.ResponseWriter, request *http.Request) error {
+	if origin := request.Header.Get("Origin"); origin != "" && !sameOrigin(request, origin) && !h.corsOriginAllowed(origin) {
+		return veap.NewErrorf(veap.StatusForbidden, "Origin not allowed for WebSocket: %s", origin)
+	}
+	conn, err := websocket.Upgrade(respWriter, request)
+	if err != nil {
+		return veap.NewErrorf(veap.StatusBadRequest, "WebSocket handshake failed: %v", err)
+	}
+	conn.ReadLimit = h.requestSizeLimit() + wsMessageOverhead
+	handlerLog.Debugf("WebSocket connection from %s opened", request.RemoteAddr)
+
+	s := &wsSession{
+		handler:    h,
+		ctx:        ctx,
+		request:    request,
+		conn:       conn,
+		subscriber: h.subscriber(ctx),
+		send:       make(chan []byte, wsSendQueueSize),
+		subs:       make(map[uint64]*wsSub),
+	}
+	s.run()
+	handlerLog.Debugf("WebSocket connection from %s closed", request.RemoteAddr)
+	return nil
+}
+
+// wsSession handles a single WebSocket connection. The requests are processed
+// sequentially, the responses and notifications are sent by a separate
+// goroutine.
+type wsSession struct {
+	handler    *Handler
+	ctx        context.Context
+	request    *http.Request
+	conn       *websocket.Conn
+	subscriber veap.Subscriber
+	send       chan []byte
+
+	mutex   sync.Mutex
+	subs    map[uint64]*wsSub
+	nextSub uint64
+	closed  bool
+}
+
+type wsSub struct {
+	id veap.SubscriptionID
+	// notifications are delayed until the response to SUBSCRIBE is queued
+	ready   bool
+	pending [][]byte
+}
+
+func (s *wsSession) run() {
+	writerDone := make(chan struct{})
+	go s.writeLoop(writerDone)
+	for {
+		msg, err := s.conn.ReadMessage()
+		if err != nil {
+			handlerLog.Debugf("Receiving from WebSocket %s stopped: %v", s.request.RemoteAddr, err)
+			break
+		}
+		s.handle(msg)
+	}
+
+	// stop subscriptions and writer
+	s.mutex.Lock()
+	s.closed = true
+	subs := s.subs
+	s.subs = nil
+	s.mutex.Unlock()
+	for _, sub := range subs {
+		if err := s.subscriber.Unsubscribe(sub.id); err != nil {
+			handlerLog.Warningf("Unsubscribing for WebSocket %s failed: %v", s.request.RemoteAddr, err)
+		}
+	}
+	close(s.send)
+	<-writerDone
+	s.conn.Close()
+}
+
+func (s *wsSession) writeLoop(done chan struct{}) {
+	defer close(done)
+	failed := false
+	for b := range s.send {
+		if failed {
+			continue
+		}
+		if handlerLog.TraceEnabled() {
+			handlerLog.Tracef("WebSocket message to %s: %s", s.request.RemoteAddr, string(b))
+		}
+		if err := s.conn.WriteMessage(b); err != nil {
+			handlerLog.Debugf("Sending to WebSocket %s failed: %v", s.request.RemoteAddr, err)
+			// reader is stopped by closing the connection
+			s.conn.Close()
+			failed = true
+		}
+	}
+}
+
+func (s *wsSession) handle(msg []byte) {
+	if handlerLog.TraceEnabled() {
+		handlerLog.Tracef("WebSocket message from %s: %s", s.request.RemoteAddr, string(msg))
+	}
+	var req encoding.WireWSRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		atomic.AddUint64(&s.handler.Stats.Requests, 1)
+		s.respondError(0, veap.NewErrorf(veap.StatusBadRequest, "Invalid WebSocket request: %v", err))
+		return
+	}
+	switch req.Method {
+	case encoding.WSMethodSubscribe:
+		atomic.AddUint64(&s.handler.Stats.Requests, 1)
+		s.subscribe(req)
+	case encoding.WSMethodUnsubscribe:
+		atomic.AddUint64(&s.handler.Stats.Requests, 1)
+		s.unsubscribe(req)
+	default:
+		s.forward(req)
+	}
+}
+
+// forward processes a request with an HTTP method like an HTTP request.
+func (s *wsSession) forward(req encoding.WireWSRequest) {
+	if !strings.HasPrefix(req.Path, "/") {
+		atomic.AddUint64(&s.handler.Stats.Requests, 1)
+		s.respondError(req.ID, veap.NewErrorf(veap.StatusBadRequest, "Invalid path of WebSocket request: %s", req.Path))
+		return
+	}
+	r, err := http.NewRequestWithContext(s.ctx, req.Method, s.handler.URLPrefix+req.Path, bytes.NewReader(req.Body))
+	if err != nil {
+		atomic.AddUint64(&s.handler.Stats.Requests, 1)
+		s.respondError(req.ID, veap.NewErrorf(veap.StatusBadRequest, "Invalid WebSocket request: %v", err))
+		return
+	}
+	r.RemoteAddr = s.request.RemoteAddr
+	if auth := s.request.Header.Get("Authorization"); auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	rw := &bufferedResponseWriter{header: make(http.Header), status: http.StatusOK}
+	s.handler.ServeHTTP(rw, r)
+
+	// statistics are already updated by ServeHTTP
+	resp := encoding.WireWSMessage{ID: req.ID, Status: rw.status}
+	if rw.body.Len() > 0 {
+		if ct := rw.header.Get("Content-Type"); strings.HasPrefix(ct, contentTypeJSON) {
+			resp.Body = rw.body.Bytes()
+		} else {
+			resp.ContentType = ct
+			resp.Body, _ = json.Marshal(rw.body.String())
+		}
+	}
+	s.queue(resp, false)
+}
+
+func (s *wsSession) subscribe(req encoding.WireWSRequest) {
+	if len(req.Paths) == 0 {
+		s.respondError(req.ID, veap.NewErrorf(veap.StatusBadRequest, "Missing paths for subscription"))
+		return
+	}
+	sub := &wsSub{}
+	s.mutex.Lock()
+	s.nextSub++
+	local := s.nextSub
+	s.mutex.Unlock()
+
+	// the subscriber may invoke the callback while subscribing, therefore the
+	// mutex must not be locked
+	id, err := s.subscriber.Subscribe(req.Paths, func(path string, pv veap.PV) {
+		wpv := encoding.PVToWire(pv)
+		b, err := json.Marshal(encoding.WireWSMessage{Sub: local, Path: path, PV: &wpv})
+		if err != nil {
+			handlerLog.Warningf("Conversion of PV to JSON failed: %v", err)
+			return
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if !sub.ready {
+			sub.pending = append(sub.pending, b)
+			return
+		}
+		s.queueLocked(b, true)
+	})
+	if err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+
+	// send response before the notifications
+	b, merr := json.Marshal(encoding.WireWSMessage{ID: req.ID, Status: http.StatusOK, Sub: local})
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		s.subscriber.Unsubscribe(id)
+		return
+	}
+	sub.id = id
+	sub.ready = true
+	s.subs[local] = sub
+	if merr == nil {
+		s.queueLocked(b, true)
+	}
+	for _, p := range sub.pending {
+		s.queueLocked(p, true)
+	}
+	sub.pending = nil
+	s.mutex.Unlock()
+}
+
+func (s *wsSession) unsubscribe(req encoding.WireWSRequest) {
+	s.mutex.Lock()
+	sub, ok := s.subs[req.Sub]
+	delete(s.subs, req.Sub)
+	s.mutex.Unlock()
+	if !ok {
+		s.respondError(req.ID, veap.NewErrorf(veap.StatusNotFound, "Subscription not found: %d", req.Sub))
+		return
+	}
+	if err := s.subscriber.Unsubscribe(sub.id); err != nil {
+		s.respondError(req.ID, err)
+		return
+	}
+	s.queue(encoding.WireWSMessage{ID: req.ID, Status: http.StatusOK}, true)
+}
+
+func (s *wsSession) respondError(id uint64, err veap.Error) {
+	handlerLog.Debugf("WebSocket request from %s: %v; code %d", s.request.RemoteAddr, err, err.Code())
+	atomic.AddUint64(&s.handler.Stats.ErrorResponses, 1)
+	body, _ := json.Marshal(wireServiceError{Message: err.Error()})
+	s.queue(encoding.WireWSMessage{ID: id, Status: err.Code(), Body: body}, true)
+}
+
+func (s *wsSession) queue(m encoding.WireWSMessage, count bool) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		handlerLog.Warningf("Conversion of WebSocket message to JSON failed: %v", err)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queueLocked(b, count)
+}
+
+// queueLocked queues a message for sending. If the queue is full, the
+// connection is closed. mutex must be locked.
+func (s *wsSession) queueLocked(b []byte, count bool) {
+	if s.closed {
+		return
+	}
+	select {
+	case s.send <- b:
+		if count {
+			atomic.AddUint64(&s.handler.Stats.ResponseBytes, uint64(len(b)))
+		}
+	default:
+		handlerLog.Warningf("Send queue of WebSocket %s is full, closing connection", s.request.RemoteAddr)
+		s.closed = true
+		s.conn.Close()
+	}
+}
+
+// bufferedResponseWriter collects an HTTP response in memory.
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
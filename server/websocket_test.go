@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+	"github.com/mdzio/go-veap/internal/websocket"
+)
+
+func TestHandlerWebSocket(t *testing.T) {
+	var svc veap.MemoryService
+	if _, err := svc.WriteProperties("/a", veap.AttrValues{"title": "A"}); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{Service: &svc, URLPrefix: "/veap"}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// only GET with handshake
+	resp, err := http.Get(srv.URL + "/veap/~ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != veap.StatusBadRequest {
+		t.Error(resp.StatusCode)
+	}
+
+	conn, err := websocket.Dial(context.Background(), srv.URL+"/veap/~ws", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send := func(req string) {
+		if err := conn.WriteMessage([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func() encoding.WireWSMessage {
+		b, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m encoding.WireWSMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	// requests with HTTP semantics
+	send(`{"id":1,"method":"PUT","path":"/a/~pv","body":{"ts":1000,"v":42,"s":0}}`)
+	if m := receive(); m.ID != 1 || m.Status != veap.StatusOK {
+		t.Errorf("%+v", m)
+	}
+	send(`{"id":2,"method":"GET","path":"/a/~pv"}`)
+	if m := receive(); m.ID != 2 || m.Status != veap.StatusOK || string(m.Body) != `{"ts":1000,"v":42,"s":0}` {
+		t.Errorf("%+v %s", m, m.Body)
+	}
+	send(`{"id":3,"method":"GET","path":"/a/~pv?format=simple"}`)
+	if m := receive(); m.ContentType != contentTypeText || string(m.Body) != `"42"` {
+		t.Errorf("%+v %s", m, m.Body)
+	}
+	send(`{"id":4,"method":"GET","path":"/b"}`)
+	if m := receive(); m.ID != 4 || m.Status != veap.StatusNotFound {
+		t.Errorf("%+v", m)
+	}
+	send(`{"id":5,"method":"GET","path":"a"}`)
+	if m := receive(); m.ID != 5 || m.Status != veap.StatusBadRequest {
+		t.Errorf("%+v", m)
+	}
+	send(`{"id":`)
+	if m := receive(); m.ID != 0 || m.Status != veap.StatusBadRequest {
+		t.Errorf("%+v", m)
+	}
+
+	// subscription
+	send(`{"id":6,"method":"SUBSCRIBE","paths":["/a"]}`)
+	m := receive()
+	if m.ID != 6 || m.Status != veap.StatusOK || m.Sub == 0 {
+		t.Fatalf("%+v", m)
+	}
+	sub := m.Sub
+	svc.WritePV("/a", veap.PV{Time: time.Unix(2, 0), Value: 43.0})
+	if m := receive(); m.ID != 0 || m.Sub != sub || m.Path != "/a" || m.PV == nil || m.PV.Value != 43.0 {
+		t.Errorf("%+v", m)
+	}
+	send(`{"id":7,"method":"UNSUBSCRIBE","sub":` + jsonString(sub) + `}`)
+	if m := receive(); m.ID != 7 || m.Status != veap.StatusOK {
+		t.Errorf("%+v", m)
+	}
+	send(`{"id":8,"method":"UNSUBSCRIBE","sub":` + jsonString(sub) + `}`)
+	if m := receive(); m.ID != 8 || m.Status != veap.StatusNotFound {
+		t.Errorf("%+v", m)
+	}
+	send(`{"id":9,"method":"SUBSCRIBE"}`)
+	if m := receive(); m.ID != 9 || m.Status != veap.StatusBadRequest {
+		t.Errorf("%+v", m)
+	}
+}
+
+func TestHandlerWebSocketPolling(t *testing.T) {
+	var value float64
+	svc := veap.FuncService{
+		ReadPVFunc: func(path string) (veap.PV, veap.Error) {
+			return veap.PV{Time: time.Unix(int64(value), 0), Value: value}, nil
+		},
+	}
+	acl := &veap.AccessControlService{
+		Service: &svc,
+		Rules:   []veap.AccessRule{{Principal: "user", PathPattern: "/a", Operations: veap.OpReadPV}},
+	}
+	srv := httptest.NewServer(&Handler{
+		Service: acl,
+		Authenticate: func(user, password string) bool {
+			return password == ""
+		},
+	})
+	defer srv.Close()
+
+	subscribe := func(header http.Header) encoding.WireWSMessage {
+		conn, err := websocket.Dial(context.Background(), srv.URL+"/~ws", header, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.WriteMessage([]byte(`{"id":1,"method":"SUBSCRIBE","paths":["/a"]}`))
+		b, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m encoding.WireWSMessage
+		json.Unmarshal(b, &m)
+		return m
+	}
+
+	// principal of the connection is used for polling
+	if m := subscribe(nil); m.Status != veap.StatusForbidden {
+		t.Errorf("%+v", m)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("user", "")
+	if m := subscribe(req.Header); m.Status != veap.StatusOK {
+		t.Errorf("%+v", m)
+	}
+	// handshake with invalid credentials
+	req.SetBasicAuth("user", "wrong")
+	if _, err := websocket.Dial(context.Background(), srv.URL+"/~ws", req.Header, nil); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func jsonString(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestHandlerWebSocketOrigin(t *testing.T) {
+	h := &Handler{Service: &veap.MemoryService{}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	dial := func(origin string) error {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, err := websocket.Dial(context.Background(), srv.URL+"/~ws", header, nil)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// no origin (e.g. no browser) and same origin
+	if err := dial(""); err != nil {
+		t.Error(err)
+	}
+	if err := dial(srv.URL); err != nil {
+		t.Error(err)
+	}
+
+	// foreign origin
+	if err := dial("https://evil.example.com"); err == nil {
+		t.Error("expected error")
+	}
+	h.CORS = &CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}
+	if err := dial("https://evil.example.com"); err == nil {
+		t.Error("expected error")
+	}
+	if err := dial("https://app.example.com"); err != nil {
+		t.Error(err)
+	}
+}
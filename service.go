@@ -65,14 +65,19 @@ func (pv PV) Equal(o PV) bool {
 
 // VEAP service error codes. They are based on the HTTP status codes.
 const (
-	StatusOK                  int = 200
-	StatusCreated             int = 201
-	StatusBadRequest          int = 400
-	StatusUnauthorized        int = 401
-	StatusForbidden           int = 403
-	StatusNotFound            int = 404
-	StatusMethodNotAllowed    int = 405
-	StatusInternalServerError int = 500
+	StatusOK                   int = 200
+	StatusCreated              int = 201
+	StatusNotModified          int = 304
+	StatusBadRequest           int = 400
+	StatusUnauthorized         int = 401
+	StatusForbidden            int = 403
+	StatusNotFound             int = 404
+	StatusMethodNotAllowed     int = 405
+	StatusPreconditionFailed   int = 412
+	StatusUnsupportedMediaType int = 415
+	StatusInternalServerError  int = 500
+	StatusServiceUnavailable   int = 503
+	StatusGatewayTimeout       int = 504
 
 	// Signals an error in VEAP client code (e.g. no connection to VEAP server,
 	// deserialization failed).
@@ -134,6 +139,94 @@ type Link struct {
 	Title string
 }
 
+// LinkUpdate describes changes of the non-hierarchical links of a VEAP object
+// (e.g. links to rooms or functions). It is passed to WriteProperties as value
+// of the attribute LinksMarker. The changes are applied in the order Replace,
+// Remove, Add. The titles of the links are ignored. The targets are absolute
+// paths or paths relative to the object.
+type LinkUpdate struct {
+	// Replace sets the targets of the links with the specified roles. Links
+	// of other roles are not changed. An empty list removes all links of the
+	// role.
+	Replace map[string][]string
+
+	// Remove removes links. Missing links are ignored.
+	Remove []Link
+
+	// Add adds links. Existing links are ignored.
+	Add []Link
+}
+
+// Validate checks that roles and targets are not empty and that no roles of
+// the hierarchical links (ServiceMarker, collection, item) are changed.
+func (u LinkUpdate) Validate() Error {
+	for role, targets := range u.Replace {
+		if role == "" {
+			return NewErrorf(StatusBadRequest, "Empty link role")
+		}
+		if hierarchicalRole(role) {
+			return NewErrorf(StatusBadRequest, "Link role can not be changed: %s", role)
+		}
+		for _, t := range targets {
+			if t == "" {
+				return NewErrorf(StatusBadRequest, "Empty link target for role: %s", role)
+			}
+		}
+	}
+	for _, links := range [][]Link{u.Remove, u.Add} {
+		for _, l := range links {
+			if l.Role == "" {
+				return NewErrorf(StatusBadRequest, "Empty link role for target: %s", l.Target)
+			}
+			if l.Target == "" {
+				return NewErrorf(StatusBadRequest, "Empty link target for role: %s", l.Role)
+			}
+			if hierarchicalRole(l.Role) {
+				return NewErrorf(StatusBadRequest, "Link role can not be changed: %s", l.Role)
+			}
+		}
+	}
+	return nil
+}
+
+// hierarchicalRole checks whether the links of the role are generated by the
+// service.
+func hierarchicalRole(role string) bool {
+	return role == ServiceMarker || role == "collection" || role == "item"
+}
+
+// ExtractLinkUpdate removes the attribute LinksMarker from the attributes of
+// a WriteProperties. The returned LinkUpdate is nil, if the attribute is not
+// present. The passed attributes are not modified.
+func ExtractLinkUpdate(attributes AttrValues) (AttrValues, *LinkUpdate, Error) {
+	v, ok := attributes[LinksMarker]
+	if !ok {
+		return attributes, nil, nil
+	}
+	var update LinkUpdate
+	switch u := v.(type) {
+	case LinkUpdate:
+		update = u
+	case *LinkUpdate:
+		if u == nil {
+			return nil, nil, NewErrorf(StatusBadRequest, "Invalid %s property: nil", LinksMarker)
+		}
+		update = *u
+	default:
+		return nil, nil, NewErrorf(StatusBadRequest, "Invalid %s property: expected an object with add, remove or replace", LinksMarker)
+	}
+	if err := update.Validate(); err != nil {
+		return nil, nil, err
+	}
+	attr := make(AttrValues, len(attributes)-1)
+	for k, v := range attributes {
+		if k != LinksMarker {
+			attr[k] = v
+		}
+	}
+	return attr, &update, nil
+}
+
 // Service provides the VEAP base services. The path parameter is always
 // escaped, use url.PathUnescape to unescape path segments.
 type Service interface {
@@ -161,9 +254,11 @@ type Service interface {
 	ReadProperties(path string) (attributes AttrValues, links []Link, err Error)
 
 	// WriteProperties updates properties of an existing VEAP object. If no
-	// object exists at the specified path, a new object is created. Links are
-	// intentionally not handled. (A concept is still pending.) Attributes were
-	// unmarshalled with package json. VEAP-Protocol: HTTP-PUT on object
+	// object exists at the specified path, a new object is created. Attributes
+	// were unmarshalled with package json. Changes of the non-hierarchical
+	// links are passed as LinkUpdate in the attribute LinksMarker (q.v.
+	// ExtractLinkUpdate). Services not supporting links should reject it.
+	// VEAP-Protocol: HTTP-PUT on object
 	WriteProperties(path string, attributes AttrValues) (created bool, err Error)
 
 	// Delete destroys a VEAP object. VEAP-Protocol: HTTP-DELETE on object
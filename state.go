@@ -0,0 +1,163 @@
+package veap
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Standard sub-states within the base state ranges. Integrations should use
+// these states, before defining their own ones.
+const (
+	// The value was overridden locally (e.g. manual operation at the device).
+	StateLocalOverride State = StateGood + 1
+
+	// The value is the last known value. Communication has failed.
+	StateLastKnownValue State = StateUncertain + 1
+	// The value was substituted (e.g. by a default or simulated value).
+	StateSubstituted State = StateUncertain + 2
+	// The value is outside of the specified range.
+	StateOutOfRange State = StateUncertain + 3
+	// The value is inaccurate (e.g. sensor not calibrated).
+	StateInaccurate State = StateUncertain + 4
+
+	// The data point is not connected to a data source.
+	StateNotConnected State = StateBad + 1
+	// The sensor has failed.
+	StateSensorFailure State = StateBad + 2
+	// The communication with the device has failed. No last known value is
+	// available.
+	StateCommFailure State = StateBad + 3
+	// The device has failed.
+	StateDeviceFailure State = StateBad + 4
+	// The data point is misconfigured.
+	StateConfigError State = StateBad + 5
+	// The data point is out of service.
+	StateOutOfService State = StateBad + 6
+)
+
+var stateNames = map[State]string{
+	StateGood:           "GOOD",
+	StateLocalOverride:  "LOCAL_OVERRIDE",
+	StateUncertain:      "UNCERTAIN",
+	StateLastKnownValue: "LAST_KNOWN_VALUE",
+	StateSubstituted:    "SUBSTITUTED",
+	StateOutOfRange:     "OUT_OF_RANGE",
+	StateInaccurate:     "INACCURATE",
+	StateBad:            "BAD",
+	StateNotConnected:   "NOT_CONNECTED",
+	StateSensorFailure:  "SENSOR_FAILURE",
+	StateCommFailure:    "COMM_FAILURE",
+	StateDeviceFailure:  "DEVICE_FAILURE",
+	StateConfigError:    "CONFIG_ERROR",
+	StateOutOfService:   "OUT_OF_SERVICE",
+}
+
+var stateValues = func() map[string]State {
+	m := make(map[string]State, len(stateNames))
+	for s, n := range stateNames {
+		m[n] = s
+	}
+	return m
+}()
+
+// String returns the name of a standard state (e.g. NOT_CONNECTED). For
+// other states the name of the base state and the code is returned (e.g.
+// BAD(250)).
+func (s State) String() string {
+	if n, ok := stateNames[s]; ok {
+		return n
+	}
+	var base State
+	switch {
+	case s.Good():
+		base = StateGood
+	case s.Uncertain():
+		base = StateUncertain
+	default:
+		base = StateBad
+	}
+	return stateNames[base] + "(" + strconv.Itoa(int(s)) + ")"
+}
+
+// ParseState converts the result of State.String or a decimal number to a
+// State.
+func ParseState(txt string) (State, error) {
+	txt = strings.TrimSpace(txt)
+	if s, ok := stateValues[txt]; ok {
+		return s, nil
+	}
+	// base state with code (e.g. BAD(250))?
+	if pos := strings.IndexRune(txt, '('); pos != -1 && strings.HasSuffix(txt, ")") {
+		if _, ok := stateValues[txt[:pos]]; ok {
+			txt = txt[pos+1 : len(txt)-1]
+		}
+	}
+	i, err := strconv.Atoi(txt)
+	if err != nil {
+		return StateBad, fmt.Errorf("Invalid state: %s", txt)
+	}
+	return State(i), nil
+}
+
+// UnmarshalJSON accepts the numeric and the textual (q.v. String)
+// representation of a state. Like for other numbers, null is a no-op.
+func (s *State) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var txt string
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &txt); err != nil {
+			return err
+		}
+	} else {
+		txt = string(b)
+	}
+	st, err := ParseState(txt)
+	if err != nil {
+		return err
+	}
+	*s = st
+	return nil
+}
+
+// severity returns a comparable severity. Invalid states are worse than all
+// other states.
+func (s State) severity() int {
+	switch {
+	case s.Good():
+		return 0
+	case s.Uncertain():
+		return 1
+	case s >= StateBad:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// WorstState returns the worst of the specified states. Bad states are worse
+// than uncertain states, uncertain states are worse than good states. Within
+// the same range the higher code is worse. Without states, StateGood is
+// returned.
+func WorstState(states ...State) State {
+	worst := StateGood
+	for _, s := range states {
+		ws, ss := worst.severity(), s.severity()
+		if ss > ws || (ss == ws && s > worst) {
+			worst = s
+		}
+	}
+	return worst
+}
+
+// WorstPVState returns the worst state of the specified PVs (q.v. WorstState).
+func WorstPVState(pvs ...PV) State {
+	worst := StateGood
+	for _, pv := range pvs {
+		worst = WorstState(worst, pv.State)
+	}
+	return worst
+}
@@ -0,0 +1,84 @@
+package veap
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStateString(t *testing.T) {
+	cases := []struct {
+		state State
+		text  string
+	}{
+		{StateGood, "GOOD"},
+		{StateNotConnected, "NOT_CONNECTED"},
+		{StateLastKnownValue, "LAST_KNOWN_VALUE"},
+		{5, "GOOD(5)"},
+		{150, "UNCERTAIN(150)"},
+		{250, "BAD(250)"},
+		{-1, "BAD(-1)"},
+	}
+	for _, c := range cases {
+		if c.state.String() != c.text {
+			t.Errorf("Wrong text for state %d: %s", int(c.state), c.state.String())
+		}
+		s, err := ParseState(c.text)
+		if err != nil || s != c.state {
+			t.Errorf("Parsing of %s failed: %v, %v", c.text, s, err)
+		}
+	}
+	if _, err := ParseState("GOOD(x)"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestStateUnmarshalJSON(t *testing.T) {
+	var v struct {
+		States []State `json:"s"`
+	}
+	err := json.Unmarshal([]byte(`{"s":[0,"SENSOR_FAILURE","UNCERTAIN(150)",42]}`), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.States) != 4 || v.States[0] != StateGood || v.States[1] != StateSensorFailure ||
+		v.States[2] != 150 || v.States[3] != 42 {
+		t.Error(v.States)
+	}
+	if err := json.Unmarshal([]byte(`{"s":["INVALID"]}`), &v); err == nil {
+		t.Error("expected error")
+	}
+
+	// null is accepted and leaves the state unchanged
+	pv := struct {
+		Time  int64       `json:"ts"`
+		Value interface{} `json:"v"`
+		State State       `json:"s"`
+	}{State: StateUncertain}
+	if err := json.Unmarshal([]byte(`{"ts":1,"v":2,"s":null}`), &pv); err != nil {
+		t.Fatal(err)
+	}
+	if pv.State != StateUncertain {
+		t.Error(pv.State)
+	}
+}
+
+func TestWorstState(t *testing.T) {
+	cases := []struct {
+		states []State
+		worst  State
+	}{
+		{nil, StateGood},
+		{[]State{StateGood, StateLocalOverride}, StateLocalOverride},
+		{[]State{StateOutOfRange, StateLocalOverride}, StateOutOfRange},
+		{[]State{StateNotConnected, StateOutOfRange, StateSensorFailure}, StateSensorFailure},
+		{[]State{StateOutOfService, -1}, -1},
+	}
+	for idx, c := range cases {
+		if w := WorstState(c.states...); w != c.worst {
+			t.Errorf("Wrong state in test case %d: %v", idx, w)
+		}
+	}
+	if w := WorstPVState(PV{State: StateGood}, PV{State: StateCommFailure}); w != StateCommFailure {
+		t.Error(w)
+	}
+}
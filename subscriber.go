@@ -0,0 +1,154 @@
+package veap
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-logging"
+)
+
+const (
+	// default polling interval of PollingSubscriber
+	defaultPollingInterval = 1 * time.Second
+)
+
+var subscriberLog = logging.Get("veap-subscriber")
+
+// SubscriptionID identifies a subscription (q.v. Subscriber).
+type SubscriptionID uint64
+
+// PVChangeFunc is called with the path and the new PV of a changed data point.
+type PVChangeFunc func(path string, pv PV)
+
+// Subscriber provides push based notifications about PV changes. A Service
+// can optionally implement this interface. For services without native
+// support, PollingSubscriber can be used.
+type Subscriber interface {
+	// Subscribe registers a callback for the data points with the specified
+	// paths. The callback is invoked for every PV change after subscribing. It
+	// may be called from any goroutine and must not block.
+	Subscribe(paths []string, callback PVChangeFunc) (SubscriptionID, Error)
+
+	// Unsubscribe removes a subscription. After returning, the callback of the
+	// subscription is no longer invoked. Unsubscribe must not be called from
+	// within the callback.
+	Unsubscribe(id SubscriptionID) Error
+}
+
+// AsSubscriber returns the native Subscriber of the service, if implemented.
+// Otherwise a PollingSubscriber with the specified interval is returned.
+func AsSubscriber(service Service, interval time.Duration) Subscriber {
+	if s, ok := service.(Subscriber); ok {
+		return s
+	}
+	return &PollingSubscriber{Service: service, Interval: interval}
+}
+
+// PollingSubscriber implements Subscriber for services, that do not support
+// change notifications natively. The PVs are read periodically with ReadPV.
+type PollingSubscriber struct {
+	Service
+
+	// Interval between two ReadPV calls. If not set, the PVs are read every
+	// second.
+	Interval time.Duration
+
+	subs   map[SubscriptionID]*pollingSub
+	nextID SubscriptionID
+	mutex  sync.Mutex
+}
+
+// Make sure that PollingSubscriber implements Subscriber.
+var _ Subscriber = (*PollingSubscriber)(nil)
+
+type pollingSub struct {
+	paths    []string
+	lastPVs  []PV
+	callback PVChangeFunc
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Subscribe implements Subscriber. The current PVs are read once to check the
+// paths and to initialize the change detection.
+func (s *PollingSubscriber) Subscribe(paths []string, callback PVChangeFunc) (SubscriptionID, Error) {
+	// read initial PVs
+	sub := &pollingSub{
+		paths:    append([]string(nil), paths...),
+		lastPVs:  make([]PV, len(paths)),
+		callback: callback,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for i, p := range sub.paths {
+		pv, err := s.Service.ReadPV(p)
+		if err != nil {
+			return 0, err
+		}
+		sub.lastPVs[i] = pv
+	}
+
+	// register subscription
+	s.mutex.Lock()
+	if s.subs == nil {
+		s.subs = make(map[SubscriptionID]*pollingSub)
+	}
+	s.nextID++
+	id := s.nextID
+	s.subs[id] = sub
+	s.mutex.Unlock()
+
+	// start polling
+	go s.poll(sub)
+	return id, nil
+}
+
+// Unsubscribe implements Subscriber.
+func (s *PollingSubscriber) Unsubscribe(id SubscriptionID) Error {
+	s.mutex.Lock()
+	sub, ok := s.subs[id]
+	delete(s.subs, id)
+	s.mutex.Unlock()
+	if !ok {
+		return NewErrorf(StatusNotFound, "Subscription not found: %d", id)
+	}
+	// wait for polling goroutine
+	close(sub.stop)
+	<-sub.done
+	return nil
+}
+
+func (s *PollingSubscriber) poll(sub *pollingSub) {
+	defer close(sub.done)
+	interval := s.Interval
+	if interval <= 0 {
+		interval = defaultPollingInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sub.stop:
+			return
+		case <-ticker.C:
+		}
+		for i, p := range sub.paths {
+			pv, err := s.Service.ReadPV(p)
+			if err != nil {
+				subscriberLog.Debugf("Polling of PV %s failed: %v", p, err)
+				continue
+			}
+			if pv.Equal(sub.lastPVs[i]) {
+				continue
+			}
+			sub.lastPVs[i] = pv
+			// unsubscribed in the meantime?
+			select {
+			case <-sub.stop:
+				return
+			default:
+			}
+			sub.callback(p, pv)
+		}
+	}
+}
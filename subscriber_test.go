@@ -0,0 +1,88 @@
+package veap
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPollingSubscriber(t *testing.T) {
+	var mutex sync.Mutex
+	value := 1
+	svc := &FuncService{
+		ReadPVFunc: func(path string) (PV, Error) {
+			if path != "/a" {
+				return PV{}, NewErrorf(StatusNotFound, "Not found: %s", path)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			return PV{Time: time.Unix(int64(value), 0), Value: value}, nil
+		},
+	}
+	s := &PollingSubscriber{Service: svc, Interval: 10 * time.Millisecond}
+
+	// invalid path
+	_, err := s.Subscribe([]string{"/a", "/b"}, func(string, PV) {})
+	if err == nil || err.Code() != StatusNotFound {
+		t.Fatal(err)
+	}
+
+	// subscribe
+	changes := make(chan PV, 10)
+	id, err := s.Subscribe([]string{"/a"}, func(path string, pv PV) {
+		if path != "/a" {
+			t.Error(path)
+		}
+		changes <- pv
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no change
+	select {
+	case pv := <-changes:
+		t.Fatal(pv)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// change
+	mutex.Lock()
+	value = 2
+	mutex.Unlock()
+	select {
+	case pv := <-changes:
+		if pv.Value != 2 {
+			t.Error(pv)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no change notification")
+	}
+
+	// unsubscribe
+	if err := s.Unsubscribe(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unsubscribe(id); err == nil || err.Code() != StatusNotFound {
+		t.Error(err)
+	}
+	mutex.Lock()
+	value = 3
+	mutex.Unlock()
+	select {
+	case pv := <-changes:
+		t.Fatal(pv)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAsSubscriber(t *testing.T) {
+	svc := &FuncService{}
+	if _, ok := AsSubscriber(svc, 0).(*PollingSubscriber); !ok {
+		t.Error("expected PollingSubscriber")
+	}
+	ps := &PollingSubscriber{Service: svc}
+	if AsSubscriber(ps, 0) != ps {
+		t.Error("expected native subscriber")
+	}
+}
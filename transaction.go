@@ -0,0 +1,88 @@
+package veap
+
+import (
+	"context"
+)
+
+// PreparedWrite is a validated, but not yet executed write operation (q.v.
+// WritePreparer).
+type PreparedWrite interface {
+	// Commit executes the write operation.
+	Commit(ctx context.Context) Error
+
+	// Rollback discards the write operation. Rollback is not called after
+	// Commit.
+	Rollback()
+}
+
+// WritePreparer can optionally be implemented by a Service to support atomic
+// ExgData writes (q.v. ExgDataParams.Atomic). All writes are prepared first.
+// Only if all preparations succeed, the writes are committed.
+type WritePreparer interface {
+	// PrepareWritePV validates the writing of a PV. Resources needed for the
+	// write operation can be reserved. The PV is not written before Commit is
+	// called on the returned PreparedWrite.
+	PrepareWritePV(ctx context.Context, path string, pv PV) (PreparedWrite, Error)
+}
+
+// FuncPreparedWrite implements PreparedWrite with functions. Both functions
+// are optional.
+type FuncPreparedWrite struct {
+	CommitFunc   func(ctx context.Context) Error
+	RollbackFunc func()
+}
+
+// Make sure that FuncPreparedWrite implements PreparedWrite.
+var _ PreparedWrite = (*FuncPreparedWrite)(nil)
+
+// Commit implements PreparedWrite.
+func (w *FuncPreparedWrite) Commit(ctx context.Context) Error {
+	if w.CommitFunc == nil {
+		return nil
+	}
+	return w.CommitFunc(ctx)
+}
+
+// Rollback implements PreparedWrite.
+func (w *FuncPreparedWrite) Rollback() {
+	if w.RollbackFunc != nil {
+		w.RollbackFunc()
+	}
+}
+
+// WritePVsAtomic writes all PVs or none of them. If a preparation fails, all
+// prepared writes are rolled back. If a commit fails, the remaining writes are
+// rolled back. Writes already committed can not be undone in this case.
+func WritePVsAtomic(ctx context.Context, preparer WritePreparer, writePVs []WritePVParam) Error {
+	// prepare all writes
+	prepared := make([]PreparedWrite, 0, len(writePVs))
+	rollback := func(pws []PreparedWrite) {
+		for i := len(pws) - 1; i >= 0; i-- {
+			pws[i].Rollback()
+		}
+	}
+	for i := range writePVs {
+		pw, err := preparer.PrepareWritePV(ctx, writePVs[i].Path, writePVs[i].PV)
+		if err == nil {
+			err = ContextError(ctx)
+		}
+		if err != nil {
+			if pw != nil {
+				prepared = append(prepared, pw)
+			}
+			rollback(prepared)
+			return NewErrorf(err.Code(), "Atomic write rejected, %s: %v", writePVs[i].Path, err)
+		}
+		prepared = append(prepared, pw)
+	}
+
+	// commit all writes
+	for i, pw := range prepared {
+		if err := pw.Commit(ctx); err != nil {
+			rollback(prepared[i+1:])
+			return NewErrorf(err.Code(), "Atomic write failed after %d of %d writes, %s: %v",
+				i, len(prepared), writePVs[i].Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package veap
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+type testPreparer struct {
+	FuncService
+	log []string
+}
+
+func (p *testPreparer) PrepareWritePV(ctx context.Context, path string, pv PV) (PreparedWrite, Error) {
+	if pv.Value == "invalid" {
+		return nil, NewErrorf(StatusBadRequest, "Invalid value")
+	}
+	return &FuncPreparedWrite{
+		CommitFunc: func(ctx context.Context) Error {
+			if pv.Value == "fail" {
+				return NewErrorf(StatusInternalServerError, "Commit failed")
+			}
+			p.log = append(p.log, "commit "+path)
+			return nil
+		},
+		RollbackFunc: func() {
+			p.log = append(p.log, "rollback "+path)
+		},
+	}, nil
+}
+
+func TestWritePVsAtomic(t *testing.T) {
+	cases := []struct {
+		values []string
+		code   int
+		log    string
+	}{
+		{[]string{"ok", "ok"}, 0, "[commit /0 commit /1]"},
+		{[]string{"ok", "invalid", "ok"}, StatusBadRequest, "[rollback /0]"},
+		{[]string{"ok", "fail", "ok"}, StatusInternalServerError, "[commit /0 rollback /2]"},
+		{nil, 0, "[]"},
+	}
+	for idx, c := range cases {
+		p := &testPreparer{}
+		var writePVs []WritePVParam
+		for i, v := range c.values {
+			writePVs = append(writePVs, WritePVParam{Path: "/" + string(rune('0'+i)), PV: PV{Value: v}})
+		}
+		err := WritePVsAtomic(context.Background(), p, writePVs)
+		if (err == nil) != (c.code == 0) || err != nil && err.Code() != c.code {
+			t.Errorf("Wrong error in test case %d: %v", idx, err)
+		}
+		if log := fmt.Sprint(p.log); log != c.log {
+			t.Errorf("Wrong log in test case %d: %s", idx, log)
+		}
+	}
+}
+
+func TestBasicMetaServiceAtomic(t *testing.T) {
+	p := &testPreparer{}
+	m := &BasicMetaService{Service: p}
+	_, err := m.ExtendedExgData(context.Background(), ExgDataParams{
+		Atomic:   true,
+		WritePVs: []WritePVParam{{Path: "/a", PV: PV{Value: "ok"}}, {Path: "/b", PV: PV{Value: "invalid"}}},
+	})
+	if err == nil || err.Code() != StatusBadRequest || len(p.log) != 1 || p.log[0] != "rollback /a" {
+		t.Error(err, p.log)
+	}
+	res, err := m.ExtendedExgData(context.Background(), ExgDataParams{
+		Atomic:   true,
+		WritePVs: []WritePVParam{{Path: "/c", PV: PV{Value: "ok"}}},
+	})
+	if err != nil || len(res.WriteErrors) != 1 || res.WriteErrors[0] != nil || p.log[1] != "commit /c" {
+		t.Error(err, res, p.log)
+	}
+
+	// not supported
+	m = &BasicMetaService{Service: &FuncService{}}
+	_, err = m.ExtendedExgData(context.Background(), ExgDataParams{Atomic: true, WritePVs: []WritePVParam{{Path: "/a"}}})
+	if err == nil || err.Code() != StatusBadRequest {
+		t.Error(err)
+	}
+}